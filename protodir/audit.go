@@ -0,0 +1,311 @@
+package protodir
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	GLOBAL_AUDIT_MAX_SIZE int64 = 10 * 1024 * 1024
+	GLOBAL_AUDIT_BACKUPS  int   = 5
+	GLOBAL_AUDIT_HEAD     int   = 512
+)
+
+var globalAuditLog *auditLogger
+
+type peerCredentials struct {
+	Pid int32  `json:"pid"`
+	Uid uint32 `json:"uid"`
+	Gid uint32 `json:"gid"`
+}
+
+// auditRecord is one line of the audit log. Requests to the HTTP gateway
+// have the remote address and the HTTP status instead of the peer.
+type auditRecord struct {
+	Time     time.Time        `json:"time"`
+	Peer     *peerCredentials `json:"peer"`
+	Remote   string           `json:"remote,omitempty"`
+	State    string           `json:"state,omitempty"`
+	Command  string           `json:"command"`
+	Path     string           `json:"path,omitempty"`
+	Code     int              `json:"code"`
+	Response string           `json:"response"`
+	Status   int              `json:"status,omitempty"`
+	BytesIn  int              `json:"bytes_in"`
+	BytesOut int64            `json:"bytes_out"`
+}
+
+type auditTarget struct {
+	command string
+	state   string
+	path    string
+}
+
+// auditedConn keeps what an audit record needs to know about a connection:
+// who is on the other end, what they asked for and what they got back.
+type auditedConn struct {
+	net.Conn
+	sync.Mutex
+	peer    *peerCredentials
+	request []byte
+	target  auditTarget
+	head    []byte
+	written int64
+}
+
+// auditedResponseWriter is auditedConn for the HTTP gateway.
+type auditedResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+type auditLogger struct {
+	sync.Mutex
+	path string
+	file *os.File
+	size int64
+}
+
+func openAuditLog(path string) {
+	if path == "" {
+		return
+	}
+
+	logger, err := newAuditLogger(path)
+	if err != nil {
+		handleError(err)
+		os.Exit(1)
+	}
+
+	globalAuditLog = logger
+}
+
+func newAuditLogger(path string) (*auditLogger, error) {
+	logger := auditLogger{path: path}
+	if err := logger.open(); err != nil {
+		return nil, err
+	}
+
+	return &logger, nil
+}
+
+func newAuditedConn(conn net.Conn) *auditedConn {
+	audited := auditedConn{Conn: conn, head: make([]byte, 0)}
+	if globalAuditLog != nil {
+		audited.peer = peerCredentialsOf(conn)
+	}
+
+	return &audited
+}
+
+func newAuditedResponseWriter(w http.ResponseWriter) *auditedResponseWriter {
+	return &auditedResponseWriter{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (aw *auditedResponseWriter) WriteHeader(status int) {
+	aw.status = status
+	aw.ResponseWriter.WriteHeader(status)
+}
+
+func (aw *auditedResponseWriter) Write(b []byte) (int, error) {
+	n, err := aw.ResponseWriter.Write(b)
+	aw.written += int64(n)
+
+	return n, err
+}
+
+func (ac *auditedConn) Write(b []byte) (int, error) {
+	n, err := ac.Conn.Write(b)
+
+	ac.Lock()
+	ac.written += int64(n)
+	if room := GLOBAL_AUDIT_HEAD - len(ac.head); room > 0 {
+		if room > n {
+			room = n
+		}
+		ac.head = append(ac.head, b[:room]...)
+	}
+	ac.Unlock()
+
+	return n, err
+}
+
+// responseCode reads the code back from the first response written, which
+// also covers streamed responses the handlers write on their own.
+func (ac *auditedConn) responseCode() responseCode {
+	ac.Lock()
+	defer ac.Unlock()
+
+	codeStr, _, found := strings.Cut(string(ac.head), " - ")
+	if !found {
+		return 0
+	}
+
+	code, err := strconv.Atoi(codeStr)
+	if err != nil {
+		return 0
+	}
+
+	return responseCode(code)
+}
+
+func (ac *auditedConn) initHash() string {
+	ac.Lock()
+	defer ac.Unlock()
+
+	_, body, found := strings.Cut(string(ac.head), "\n\n")
+	if !found {
+		return ""
+	}
+
+	hash, _, _ := strings.Cut(body, "\n")
+	return hash
+}
+
+// resolveAuditTarget has to run before the request is handled, as a CD
+// changes the dir the hashes in the request are relative to.
+func (pdr *protoDirState) resolveAuditTarget(conn *auditedConn) {
+	if globalAuditLog == nil {
+		return
+	}
+
+	conn.target = pdr.auditTargetOf(conn.request)
+}
+
+func (pdr *protoDirState) auditTargetOf(buffer []byte) auditTarget {
+	target := auditTarget{command: auditCommand(buffer)}
+
+	req, pathOrHash, success := parseRequest(buffer)
+	if !success || req == ACT_LIST_STATE || req == ACT_CACHE_STATS {
+		return target
+	} else if req == ACT_INIT_STATE || req == ACT_INIT_UNION {
+		target.path = pathOrHash
+		return target
+	}
+
+	fields := strings.Split(pathOrHash, GLOBAL_TUPLE_SEP)
+	target.state = fields[0]
+
+	state := pdr.filterStatesAndReturn(fields[0])
+	if state == nil {
+		return target
+	}
+
+	target.path = state.path.currDir
+	if len(fields) < 2 {
+		return target
+	}
+
+	if state.matchHash(fields[1]) {
+		target.path = state.path.rootDir
+	} else if entity := state.path.getFileByHash(fields[1]); entity != nil {
+		target.path = filepath.Join(state.path.dirOf(entity), entity.path)
+	} else if entity := state.path.getSubDirByHash(fields[1]); entity != nil {
+		target.path = filepath.Join(state.path.dirOf(entity), entity.path)
+	}
+
+	return target
+}
+
+func (pdr *protoDirState) auditRequest(conn *auditedConn) {
+	if globalAuditLog == nil {
+		return
+	}
+
+	code := conn.responseCode()
+	record := auditRecord{
+		Time:     time.Now(),
+		Peer:     conn.peer,
+		State:    conn.target.state,
+		Command:  conn.target.command,
+		Path:     conn.target.path,
+		Code:     int(code),
+		Response: code.text(),
+		BytesIn:  len(conn.request),
+		BytesOut: conn.written,
+	}
+
+	if code == RESPONSE_INIT_STATE_OK {
+		record.State = conn.initHash()
+	}
+
+	globalAuditLog.write(record)
+}
+
+func (al *auditLogger) write(record auditRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		handleError(err)
+		return
+	}
+	line = append(line, 10)
+
+	al.Lock()
+	defer al.Unlock()
+
+	if al.size+int64(len(line)) > GLOBAL_AUDIT_MAX_SIZE && al.size > 0 {
+		handleError(al.rotate())
+	}
+
+	n, err := al.file.Write(line)
+	al.size += int64(n)
+	handleError(err)
+}
+
+func (al *auditLogger) open() error {
+	file, err := os.OpenFile(al.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	al.file, al.size = file, info.Size()
+	return nil
+}
+
+// rotate moves log to log.1, log.1 to log.2 and so on, dropping the oldest.
+// The old file is only closed once a new one is open, so if rotating fails
+// the records keep going to the old one.
+func (al *auditLogger) rotate() error {
+	for i := GLOBAL_AUDIT_BACKUPS - 1; i > 0; i-- {
+		os.Rename(backupAuditPath(al.path, i), backupAuditPath(al.path, i+1))
+	}
+
+	if err := os.Rename(al.path, backupAuditPath(al.path, 1)); err != nil {
+		return err
+	}
+
+	old := al.file
+	if err := al.open(); err != nil {
+		return err
+	}
+
+	return old.Close()
+}
+
+func backupAuditPath(path string, index int) string {
+	return fmt.Sprintf("%s.%d", path, index)
+}
+
+func auditCommand(buffer []byte) string {
+	fields := strings.Fields(string(buffer))
+	if len(fields) < 3 {
+		return ""
+	}
+
+	return fields[2]
+}
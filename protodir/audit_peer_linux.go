@@ -0,0 +1,31 @@
+//go:build linux
+
+package protodir
+
+import (
+	"net"
+	"syscall"
+)
+
+func peerCredentialsOf(conn net.Conn) *peerCredentials {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || credErr != nil {
+		return nil
+	}
+
+	return &peerCredentials{Pid: cred.Pid, Uid: cred.Uid, Gid: cred.Gid}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package protodir
+
+import "net"
+
+// Peer credentials of unix sockets are only read on Linux, elsewhere the
+// peer of audit records is left empty.
+func peerCredentialsOf(conn net.Conn) *peerCredentials {
+	return nil
+}
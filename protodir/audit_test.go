@@ -0,0 +1,71 @@
+package protodir
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestAuditLogger(t *testing.T) *auditLogger {
+	t.Helper()
+
+	logger, err := newAuditLogger(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatalf("newAuditLogger: %v", err)
+	}
+	t.Cleanup(func() { logger.file.Close() })
+
+	return logger
+}
+
+func readAuditFile(t *testing.T, path string) string {
+	t.Helper()
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile(%s): %v", path, err)
+	}
+
+	return string(contents)
+}
+
+func TestAuditLogRotates(t *testing.T) {
+	logger := newTestAuditLogger(t)
+
+	logger.write(auditRecord{Command: "BEFORE"})
+	logger.size = GLOBAL_AUDIT_MAX_SIZE
+	logger.write(auditRecord{Command: "AFTER"})
+
+	if rotated := readAuditFile(t, backupAuditPath(logger.path, 1)); !strings.Contains(rotated, "BEFORE") {
+		t.Errorf("rotated log = %q, want the record from before", rotated)
+	}
+	if current := readAuditFile(t, logger.path); !strings.Contains(current, "AFTER") || strings.Contains(current, "BEFORE") {
+		t.Errorf("current log = %q, want only the record from after", current)
+	}
+}
+
+// Backups that are dirs with something in them cannot be renamed over, so
+// rotating fails and the records have to keep going to the current log.
+func TestAuditLogKeepsWritingWhenRotateFails(t *testing.T) {
+	logger := newTestAuditLogger(t)
+
+	for i := 1; i <= GLOBAL_AUDIT_BACKUPS; i++ {
+		dir := backupAuditPath(logger.path, i)
+		if err := os.MkdirAll(filepath.Join(dir, "keep"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	logger.write(auditRecord{Command: "BEFORE"})
+	logger.size = GLOBAL_AUDIT_MAX_SIZE
+	logger.write(auditRecord{Command: "FIRST"})
+	logger.write(auditRecord{Command: "SECOND"})
+
+	current := readAuditFile(t, logger.path)
+	for _, command := range []string{"BEFORE", "FIRST", "SECOND"} {
+		if !strings.Contains(current, command) {
+			t.Errorf("current log = %q, want a record of %s", current, command)
+		}
+	}
+}
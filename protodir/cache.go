@@ -0,0 +1,252 @@
+package protodir
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	CACHE_NAME_OVERHEAD    int64 = 16
+	CACHE_LISTING_OVERHEAD int64 = 128
+)
+
+type dirListing struct {
+	subdirs []string
+	files   []string
+	layerOf map[string]string
+}
+
+type cachedListing struct {
+	path    string
+	modTime time.Time
+	listing dirListing
+	size    int64
+}
+
+type cacheStats struct {
+	hits      uint64
+	misses    uint64
+	stale     uint64
+	evictions uint64
+}
+
+// dirCache keeps the listings of dirs, shared by every state. A listing is
+// read again once the modification time of its dir changes, which it does
+// whenever an entry is added to, removed from or renamed in it. The least
+// recently used listings are evicted to stay within the cache limits.
+type dirCache struct {
+	sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+	bytes   int64
+	stats   cacheStats
+}
+
+var globalDirCache = newDirCache()
+
+func newDirCache() *dirCache {
+	return &dirCache{
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// CACHE_STATS
+func (pdr *protoDirState) handleRequestCacheStats() ([]byte, responseCode) {
+	return []byte(globalDirCache.toString()), RESPONSE_CACHE_STATS
+}
+
+func (dc *dirCache) listDir(path string) (dirListing, successStatus) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return dirListing{}, STATUS_DID_FAIL
+	}
+
+	// The dir is stated before it is read, so a change made while reading
+	// shows up as a new modification time on the next lookup.
+	info, err := os.Stat(absPath)
+	if err != nil {
+		dc.forget(absPath)
+		return dirListing{}, STATUS_NOT_EXISTS
+	} else if !info.IsDir() {
+		dc.forget(absPath)
+		return dirListing{}, STATUS_ISNOTDIR
+	}
+
+	if listing, ok := dc.lookup(absPath, info.ModTime()); ok {
+		return listing, STATUS_EXISTS
+	}
+
+	entries, err := os.ReadDir(absPath)
+	if err != nil {
+		return dirListing{}, STATUS_DID_FAIL
+	}
+
+	listing := dirListing{subdirs: make([]string, 0), files: make([]string, 0)}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			listing.subdirs = append(listing.subdirs, entry.Name())
+		} else {
+			listing.files = append(listing.files, entry.Name())
+		}
+	}
+
+	dc.store(absPath, info.ModTime(), listing)
+
+	return listing, STATUS_EXISTS
+}
+
+func (dc *dirCache) lookup(path string, modTime time.Time) (dirListing, bool) {
+	dc.Lock()
+	defer dc.Unlock()
+
+	elem, ok := dc.entries[path]
+	if !ok {
+		dc.stats.misses++
+		return dirListing{}, false
+	}
+
+	cached := elem.Value.(*cachedListing)
+	if !cached.modTime.Equal(modTime) {
+		dc.stats.stale++
+		dc.remove(elem)
+		return dirListing{}, false
+	}
+
+	dc.stats.hits++
+	dc.order.MoveToFront(elem)
+
+	return cached.listing, true
+}
+
+func (dc *dirCache) store(path string, modTime time.Time, listing dirListing) {
+	cached := cachedListing{path: path, modTime: modTime, listing: listing, size: listingSize(path, listing)}
+	if globalLimits.CacheBytes > 0 && cached.size > globalLimits.CacheBytes {
+		return
+	}
+
+	dc.Lock()
+	defer dc.Unlock()
+
+	if elem, ok := dc.entries[path]; ok {
+		dc.remove(elem)
+	}
+
+	dc.entries[path] = dc.order.PushFront(&cached)
+	dc.bytes += cached.size
+
+	for dc.isOverLimits() {
+		dc.remove(dc.order.Back())
+		dc.stats.evictions++
+	}
+}
+
+func (dc *dirCache) forget(path string) {
+	dc.Lock()
+	defer dc.Unlock()
+
+	if elem, ok := dc.entries[path]; ok {
+		dc.remove(elem)
+	}
+}
+
+func (dc *dirCache) remove(elem *list.Element) {
+	cached := dc.order.Remove(elem).(*cachedListing)
+	delete(dc.entries, cached.path)
+	dc.bytes -= cached.size
+}
+
+func (dc *dirCache) isOverLimits() bool {
+	if dc.order.Len() == 0 {
+		return false
+	}
+
+	overEntries := globalLimits.CacheEntries > 0 && dc.order.Len() > globalLimits.CacheEntries
+	overBytes := globalLimits.CacheBytes > 0 && dc.bytes > globalLimits.CacheBytes
+
+	return overEntries || overBytes
+}
+
+func (dc *dirCache) toString() string {
+	dc.Lock()
+	defer dc.Unlock()
+
+	hitRate := 0.0
+	if lookups := dc.stats.hits + dc.stats.misses + dc.stats.stale; lookups > 0 {
+		hitRate = float64(dc.stats.hits) / float64(lookups)
+	}
+
+	return fmt.Sprintf(`%sCACHE_STATS;
+Entries: %d;
+Bytes: %d;
+MaxEntries: %d;
+MaxBytes: %d;
+Hits: %d;
+Misses: %d;
+Stale: %d;
+Evictions: %d;
+HitRate: %.4f;`,
+		GLOBAL_HEADER_PREFIX, dc.order.Len(), dc.bytes, globalLimits.CacheEntries, globalLimits.CacheBytes,
+		dc.stats.hits, dc.stats.misses, dc.stats.stale, dc.stats.evictions, hitRate)
+}
+
+// refreshFilesAndSubDirs brings the listing of the current dir up to date
+// from the cache. Entities that are still there keep their hashes, so hashes
+// a client already has stay valid. It tells if anything changed.
+func (p *pathCollective) refreshFilesAndSubDirs() bool {
+	var listing dirListing
+	var stat successStatus
+	if p.isUnion() {
+		listing, stat = p.unionListing()
+	} else {
+		listing, stat = globalDirCache.listDir(p.currDir)
+	}
+	if stat != STATUS_EXISTS {
+		return false
+	}
+
+	subdirs, dirsChanged := mergeEntities(p.subdirs, listing, listing.subdirs, newEntityPath)
+	files, filesChanged := mergeEntities(p.files, listing, listing.files, newFilePath)
+	p.subdirs, p.files = subdirs, files
+
+	return dirsChanged || filesChanged
+}
+
+// In a union state an entity also moves to the root it is now taken from.
+func mergeEntities(old []entityPath, listing dirListing, names []string, newEntity func(string) entityPath) ([]entityPath, bool) {
+	byName := make(map[string]entityPath, len(old))
+	for _, entity := range old {
+		byName[entity.path] = entity
+	}
+
+	merged := make([]entityPath, 0, len(names))
+	changed := len(old) != len(names)
+	for _, name := range names {
+		entity, ok := byName[name]
+		if !ok {
+			entity, changed = newEntity(name), true
+		}
+		if layer := listing.layerOf[name]; layer != entity.layer {
+			entity.layer, changed = layer, true
+		}
+		merged = append(merged, entity)
+	}
+
+	return merged, changed
+}
+
+func listingSize(path string, listing dirListing) int64 {
+	size := CACHE_LISTING_OVERHEAD + int64(len(path))
+	for _, name := range listing.subdirs {
+		size += CACHE_NAME_OVERHEAD + int64(len(name))
+	}
+	for _, name := range listing.files {
+		size += CACHE_NAME_OVERHEAD + int64(len(name))
+	}
+
+	return size
+}
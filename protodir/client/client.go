@@ -0,0 +1,421 @@
+// Package client talks PTDP to a ProtoDir server and hands back the responses
+// as Go values instead of the raw text of the protocol.
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"protogen/protodir"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProtoDir answers one request per connection, so the client dials a new one
+// for every request.
+type Dialer func() (net.Conn, error)
+
+type Client struct {
+	dial Dialer
+}
+
+type EntryType int
+
+const (
+	EntryFile EntryType = iota
+	EntryDir
+)
+
+const (
+	statModTimeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+	responseSep       = "\n\n"
+)
+
+type Entry struct {
+	Type EntryType
+	Path string
+	Hash string
+}
+
+type Listing struct {
+	Dir   string
+	Files []Entry
+	Dirs  []Entry
+}
+
+type File struct {
+	Path    string
+	Version string
+	Data    []byte
+}
+
+type EntityStat struct {
+	Path    string
+	Name    string
+	IsDir   bool
+	ModTime time.Time
+	Mode    string
+	Size    int64
+	Version string
+	// Root is the root the entity was taken from, only set in union states.
+	Root string
+}
+
+type WalkEntry struct {
+	Type EntryType
+	Name string
+	Size int64
+}
+
+type StateInfo struct {
+	Hash string
+	Dir  string
+}
+
+type response struct {
+	code   int
+	status string
+	body   []byte
+}
+
+func New(dial Dialer) *Client {
+	return &Client{dial: dial}
+}
+
+func NewUnix(sockPath string) *Client {
+	return New(func() (net.Conn, error) {
+		return net.Dial("unix", sockPath)
+	})
+}
+
+// InitState makes a new state rooted at root and changes into the root, so
+// it can be listed right away. It returns the hash of the state.
+func (c *Client) InitState(root string) (string, error) {
+	return c.initAndCd(protodir.COMM_INIT_STATE, root)
+}
+
+// InitUnion makes a union state overlaying roots, the first root given
+// taking precedence, and changes into its root like InitState.
+func (c *Client) InitUnion(roots ...string) (string, error) {
+	return c.initAndCd(protodir.COMM_INIT_UNION, joinArgs(roots...))
+}
+
+func (c *Client) initAndCd(command, args string) (string, error) {
+	resp, err := c.do(command, args, int(protodir.RESPONSE_INIT_STATE_OK))
+	if err != nil {
+		return "", err
+	}
+
+	hash := strings.TrimSpace(string(resp.body))
+	if err := c.Cd(hash, hash); err != nil {
+		return "", err
+	}
+
+	return hash, nil
+}
+
+// Cd changes into the subdir with the given hash, or back to the root of the
+// state if the state hash itself is given.
+func (c *Client) Cd(state, dir string) error {
+	_, err := c.do(protodir.COMM_CD_SD, joinArgs(state, dir), int(protodir.RESPONSE_CD_SUBDIR_OK))
+	return err
+}
+
+func (c *Client) ListDir(state string) (*Listing, error) {
+	resp, err := c.do(protodir.COMM_LIST_DIR, state, int(protodir.RESPONSE_DIR_LISTED))
+	if err != nil {
+		return nil, err
+	}
+
+	dir, rest := splitHeader(resp.body)
+	listing := Listing{Dir: dir, Files: make([]Entry, 0), Dirs: make([]Entry, 0)}
+	for _, line := range strings.Split(string(rest), "\n") {
+		entry, ok := parseEntry(line)
+		if !ok {
+			continue
+		} else if entry.Type == EntryDir {
+			listing.Dirs = append(listing.Dirs, entry)
+		} else {
+			listing.Files = append(listing.Files, entry)
+		}
+	}
+
+	return &listing, nil
+}
+
+func (c *Client) ReadBytes(state, file string) (*File, error) {
+	resp, err := c.do(protodir.COMM_READ_BYTES, joinArgs(state, file), int(protodir.RESPONSE_READ_FILE_OK))
+	if err != nil {
+		return nil, err
+	}
+
+	path, rest := splitHeader(resp.body)
+	version, data := splitHeader(rest)
+
+	return &File{Path: path, Version: version, Data: data}, nil
+}
+
+// ReadBytesIfNoneMatch reads the file only if its version is not version
+// anymore, and gives ErrNotModified otherwise.
+func (c *Client) ReadBytesIfNoneMatch(state, file, version string) (*File, error) {
+	option := protodir.OPT_IF_NONE_MATCH + protodir.GLOBAL_OPTION_SEP + version
+	resp, err := c.do(protodir.COMM_READ_BYTES, joinArgs(state, file, option), int(protodir.RESPONSE_READ_FILE_OK))
+	if err != nil {
+		return nil, err
+	}
+
+	path, rest := splitHeader(resp.body)
+	version, data := splitHeader(rest)
+
+	return &File{Path: path, Version: version, Data: data}, nil
+}
+
+// ReadBytesEncoded asks for the file in the first of the given encodings the
+// server knows, like "gzip+base64,base64", and hands back the decoded data.
+func (c *Client) ReadBytesEncoded(state, file, encodings string) (*File, error) {
+	option := protodir.OPT_ENCODING + protodir.GLOBAL_OPTION_SEP + encodings
+	resp, err := c.do(protodir.COMM_READ_BYTES, joinArgs(state, file, option), int(protodir.RESPONSE_READ_FILE_OK))
+	if err != nil {
+		return nil, err
+	}
+
+	path, rest := splitHeader(resp.body)
+	version, rest := splitHeader(rest)
+	data, err := decodeBody(rest)
+	if err != nil {
+		return nil, err
+	}
+
+	return &File{Path: path, Version: version, Data: data}, nil
+}
+
+func (c *Client) Stat(state, entity string) (*EntityStat, error) {
+	resp, err := c.do(protodir.COMM_STAT, joinArgs(state, entity), int(protodir.RESPONSE_STAT_ENTITY_OK))
+	if err != nil {
+		return nil, err
+	}
+
+	path, rest := splitHeader(resp.body)
+	stat := EntityStat{Path: path}
+	for _, line := range strings.Split(string(rest), "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), ": ")
+		if !found {
+			continue
+		}
+		value = strings.TrimSuffix(value, protodir.GLOBAL_TUPLE_SEP)
+
+		switch key {
+		case "IsDir":
+			stat.IsDir = value == "true"
+		case "ModTime":
+			stat.ModTime, _ = time.Parse(statModTimeLayout, value)
+		case "Mode":
+			stat.Mode = value
+		case "Name":
+			stat.Name = value
+		case "Size":
+			stat.Size, _ = strconv.ParseInt(value, 10, 64)
+		case "Version":
+			stat.Version = value
+		case "Root":
+			stat.Root = value
+		}
+	}
+
+	return &stat, nil
+}
+
+func (c *Client) Walk(state string) ([]WalkEntry, error) {
+	resp, err := c.do(protodir.COMM_WAL_TREE, state, int(protodir.RESPONSE_DIR_WALKED))
+	if err != nil {
+		return nil, err
+	}
+
+	_, rest := splitHeader(resp.body)
+	walked := make([]WalkEntry, 0)
+	for _, line := range strings.Split(string(rest), "\n") {
+		if entry, ok := parseWalkEntry(line); ok {
+			walked = append(walked, entry)
+		}
+	}
+
+	return walked, nil
+}
+
+func (c *Client) ListStates() ([]StateInfo, error) {
+	resp, err := c.do(protodir.COMM_LIST_STATES, "", int(protodir.RESPONSE_LISTED_STATES))
+	if err != nil {
+		return nil, err
+	}
+
+	states := make([]StateInfo, 0)
+	for _, line := range strings.Split(string(resp.body), "\n") {
+		fields, ok := parseMarkedLine(line, "^s^", "cd", "hash")
+		if ok {
+			states = append(states, StateInfo{Dir: fields[0], Hash: fields[1]})
+		}
+	}
+
+	return states, nil
+}
+
+// History gives the dirs the state has been to, oldest first, the last one
+// being the current dir.
+func (c *Client) History(state string) ([]string, error) {
+	resp, err := c.do(protodir.COMM_HISTORY, state, int(protodir.RESPONSE_HISTORY_LISTED))
+	if err != nil {
+		return nil, err
+	}
+
+	_, rest := splitHeader(resp.body)
+	history := make([]string, 0)
+	for _, line := range strings.Split(string(rest), "\n") {
+		if line != "" && line != "NO_HISTORY" {
+			history = append(history, line)
+		}
+	}
+
+	return history, nil
+}
+
+func (c *Client) do(command, args string, want int) (response, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return response{}, err
+	}
+	defer conn.Close()
+
+	request := fmt.Sprintf("%s %s %s %s", protodir.GLOBAL_PROTOCOL_NAME, protodir.GLOBAL_VERSION_CONTROL, command, args)
+	if _, err := conn.Write([]byte(request)); err != nil {
+		return response{}, err
+	}
+
+	raw, err := io.ReadAll(conn)
+	if err != nil && len(raw) == 0 {
+		return response{}, err
+	}
+
+	resp, err := parseResponse(raw)
+	if err != nil {
+		return response{}, err
+	} else if resp.code != want {
+		return response{}, resp.toError()
+	}
+
+	return resp, nil
+}
+
+func parseResponse(raw []byte) (response, error) {
+	statusLine, body, found := bytes.Cut(raw, []byte(responseSep))
+	if !found {
+		return response{}, fmt.Errorf("protodir: malformed response %q", raw)
+	}
+
+	codeStr, status, _ := strings.Cut(string(statusLine), " - ")
+	code, err := strconv.Atoi(codeStr)
+	if err != nil {
+		return response{}, fmt.Errorf("protodir: malformed status line %q", statusLine)
+	}
+
+	body = bytes.TrimSuffix(body, []byte(responseSep))
+
+	return response{code: code, status: status, body: body}, nil
+}
+
+func (r response) toError() error {
+	respErr := ResponseError{
+		Code:    r.code,
+		Status:  r.status,
+		Message: strings.TrimSpace(string(r.body)),
+	}
+
+	return &respErr
+}
+
+// splitHeader takes the first `$HEADER: value;` line off body and returns
+// its value along with the rest of the body.
+func splitHeader(body []byte) (string, []byte) {
+	if !bytes.HasPrefix(body, []byte(protodir.GLOBAL_HEADER_PREFIX)) {
+		return "", body
+	}
+
+	line, rest, _ := bytes.Cut(body, []byte("\n"))
+	_, value, _ := strings.Cut(string(line), ": ")
+
+	return strings.TrimSuffix(value, protodir.GLOBAL_TUPLE_SEP), rest
+}
+
+func decodeBody(body []byte) ([]byte, error) {
+	if !bytes.HasPrefix(body, []byte(protodir.GLOBAL_HEADER_PREFIX+protodir.GLOBAL_ENCODING_HEADER+": ")) {
+		return nil, fmt.Errorf("protodir: response has no %s header", protodir.GLOBAL_ENCODING_HEADER)
+	}
+
+	encoding, rest := splitHeader(body)
+
+	return protodir.DecodePayload(encoding, rest)
+}
+
+func parseEntry(line string) (Entry, bool) {
+	if fields, ok := parseMarkedLine(line, "*f*", "path", "hash"); ok {
+		return Entry{Type: EntryFile, Path: fields[0], Hash: fields[1]}, true
+	} else if fields, ok := parseMarkedLine(line, "+d+", "path", "hash"); ok {
+		return Entry{Type: EntryDir, Path: fields[0], Hash: fields[1]}, true
+	}
+
+	return Entry{}, false
+}
+
+func parseWalkEntry(line string) (WalkEntry, bool) {
+	entryType := EntryFile
+	fields, ok := parseMarkedLine(line, "*f*", "path", "size")
+	if !ok {
+		entryType = EntryDir
+		fields, ok = parseMarkedLine(line, "+d+", "path", "size")
+	}
+	if !ok {
+		return WalkEntry{}, false
+	}
+
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return WalkEntry{}, false
+	}
+
+	return WalkEntry{Type: entryType, Name: fields[0], Size: size}, true
+}
+
+// parseMarkedLine reads lines like `*f*path=a*hash=b`, where the first char
+// of the marker comes before every key. Values are taken up to the last
+// separator of the next key, so a path may hold the separator itself.
+func parseMarkedLine(line, marker string, keys ...string) ([]string, bool) {
+	if !strings.HasPrefix(line, marker) {
+		return nil, false
+	}
+
+	sep := marker[:1]
+	rest := strings.TrimPrefix(line, marker)
+	values := make([]string, len(keys))
+
+	for i := len(keys) - 1; i >= 0; i-- {
+		prefix := keys[i] + "="
+		if i > 0 {
+			prefix = sep + prefix
+		}
+
+		at := strings.LastIndex(rest, prefix)
+		if at == -1 || (i == 0 && at != 0) {
+			return nil, false
+		}
+
+		values[i] = rest[at+len(prefix):]
+		rest = rest[:at]
+	}
+
+	return values, true
+}
+
+func joinArgs(args ...string) string {
+	return strings.Join(args, protodir.GLOBAL_TUPLE_SEP)
+}
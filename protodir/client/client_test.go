@@ -0,0 +1,238 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"protogen/protodir"
+	"strings"
+	"testing"
+)
+
+// newTestClient runs a ProtoDir server in process, every request going over
+// its own net.Pipe.
+func newTestClient(t *testing.T) *Client {
+	t.Helper()
+
+	server := protodir.NewServer()
+	return New(func() (net.Conn, error) {
+		clientEnd, serverEnd := net.Pipe()
+		go server.ServeConn(serverEnd)
+		return clientEnd, nil
+	})
+}
+
+// newTestRoot makes a dir with a.txt, sub/ and sub/b.txt in it.
+func newTestRoot(t *testing.T) string {
+	t.Helper()
+
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "a.txt"), []byte("hello\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "sub", "b.txt"), []byte("bye\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return root
+}
+
+func findEntry(entries []Entry, path string) (Entry, bool) {
+	for _, entry := range entries {
+		if entry.Path == path {
+			return entry, true
+		}
+	}
+
+	return Entry{}, false
+}
+
+func TestClientBrowsesState(t *testing.T) {
+	c := newTestClient(t)
+	root := newTestRoot(t)
+
+	state, err := c.InitState(root)
+	if err != nil {
+		t.Fatalf("InitState: %v", err)
+	}
+
+	listing, err := c.ListDir(state)
+	if err != nil {
+		t.Fatalf("ListDir: %v", err)
+	}
+	if listing.Dir != root {
+		t.Errorf("ListDir dir = %q, want %q", listing.Dir, root)
+	}
+	file, ok := findEntry(listing.Files, "a.txt")
+	if !ok || file.Type != EntryFile {
+		t.Fatalf("ListDir files = %+v, want a.txt", listing.Files)
+	}
+	sub, ok := findEntry(listing.Dirs, "sub")
+	if !ok || sub.Type != EntryDir {
+		t.Fatalf("ListDir dirs = %+v, want sub", listing.Dirs)
+	}
+
+	read, err := c.ReadBytes(state, file.Hash)
+	if err != nil {
+		t.Fatalf("ReadBytes: %v", err)
+	}
+	if !bytes.Equal(read.Data, []byte("hello\n")) || read.Version == "" {
+		t.Errorf("ReadBytes = %q version %q, want %q with a version", read.Data, read.Version, "hello\n")
+	}
+
+	stat, err := c.Stat(state, file.Hash)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if stat.Name != "a.txt" || stat.IsDir || stat.Size != 6 || stat.Version != read.Version {
+		t.Errorf("Stat = %+v, want a 6 byte file a.txt with version %q", stat, read.Version)
+	}
+
+	walked, err := c.Walk(state)
+	if err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+	if len(walked) != 4 {
+		t.Errorf("Walk = %+v, want the root, a.txt, sub and b.txt", walked)
+	}
+
+	if err := c.Cd(state, sub.Hash); err != nil {
+		t.Fatalf("Cd: %v", err)
+	}
+	history, err := c.History(state)
+	if err != nil {
+		t.Fatalf("History: %v", err)
+	}
+	if len(history) != 2 || history[0] != root || history[1] != filepath.Join(root, "sub") {
+		t.Errorf("History = %q, want the root and then sub", history)
+	}
+
+	states, err := c.ListStates()
+	if err != nil {
+		t.Fatalf("ListStates: %v", err)
+	}
+	found := false
+	for _, info := range states {
+		found = found || (info.Hash == state && info.Dir == filepath.Join(root, "sub"))
+	}
+	if !found {
+		t.Errorf("ListStates = %+v, want %s in sub", states, state)
+	}
+}
+
+func TestClientConditionalRead(t *testing.T) {
+	c := newTestClient(t)
+	root := newTestRoot(t)
+
+	state, err := c.InitState(root)
+	if err != nil {
+		t.Fatalf("InitState: %v", err)
+	}
+	listing, err := c.ListDir(state)
+	if err != nil {
+		t.Fatalf("ListDir: %v", err)
+	}
+	file, _ := findEntry(listing.Files, "a.txt")
+
+	read, err := c.ReadBytes(state, file.Hash)
+	if err != nil {
+		t.Fatalf("ReadBytes: %v", err)
+	}
+
+	if _, err := c.ReadBytesIfNoneMatch(state, file.Hash, read.Version); !errors.Is(err, ErrNotModified) {
+		t.Errorf("ReadBytesIfNoneMatch with the current version: err = %v, want ErrNotModified", err)
+	}
+
+	changed, err := c.ReadBytesIfNoneMatch(state, file.Hash, "m-0")
+	if err != nil {
+		t.Fatalf("ReadBytesIfNoneMatch with an old version: %v", err)
+	}
+	if !bytes.Equal(changed.Data, read.Data) {
+		t.Errorf("ReadBytesIfNoneMatch = %q, want %q", changed.Data, read.Data)
+	}
+}
+
+// A file starting with a line like a header is still all data, as the
+// version line is always there to take.
+func TestClientReadsHeaderLikeFile(t *testing.T) {
+	c := newTestClient(t)
+	root := t.TempDir()
+	contents := []byte("$HOME: /root;\nrest\n")
+	if err := os.WriteFile(filepath.Join(root, "env.txt"), contents, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := c.InitState(root)
+	if err != nil {
+		t.Fatalf("InitState: %v", err)
+	}
+	listing, err := c.ListDir(state)
+	if err != nil {
+		t.Fatalf("ListDir: %v", err)
+	}
+	file, _ := findEntry(listing.Files, "env.txt")
+
+	read, err := c.ReadBytes(state, file.Hash)
+	if err != nil {
+		t.Fatalf("ReadBytes: %v", err)
+	}
+	if !bytes.Equal(read.Data, contents) || !strings.HasPrefix(read.Version, "m-") {
+		t.Errorf("ReadBytes = %q version %q, want %q with a version", read.Data, read.Version, contents)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	c := newTestClient(t)
+	root := newTestRoot(t)
+
+	state, err := c.InitState(root)
+	if err != nil {
+		t.Fatalf("InitState: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		call func() error
+		want error
+	}{
+		{"unknown state", func() error { _, err := c.ListDir("nostate"); return err }, ErrNoState},
+		{"unknown subdir", func() error { return c.Cd(state, "nohash") }, ErrNoHash},
+		{"unknown file", func() error { _, err := c.ReadBytes(state, "nohash"); return err }, ErrNoHash},
+		{"unknown encoding", func() error { _, err := c.ReadBytesEncoded(state, "nohash", "zstd"); return err }, ErrBadArguments},
+		{"missing root", func() error { _, err := c.InitState(filepath.Join(root, "missing")); return err }, ErrNoExist},
+	}
+
+	for _, test := range tests {
+		err := test.call()
+		if !errors.Is(err, test.want) {
+			t.Errorf("%s: err = %v, want %v", test.name, err, test.want)
+		}
+	}
+}
+
+func TestResponseErrorsMatchCodes(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want error
+	}{
+		{"26 - NOT_MODIFIED\n\n$READ_BYTES: /a;\n\n", ErrNotModified},
+		{"290 - OUT_OF_JAIL\n\n\n\n", ErrOutOfJail},
+		{"280 - NO_SNAPSHOT\n\nbefore\n\n", ErrNoSnapshot},
+		{"220 - REQUEST_TOO_LARGE\n\nERROR_REQUEST_TOO_LARGE\nLimit: 4096;\n\n", ErrRequestTooLarge},
+	}
+
+	for _, test := range tests {
+		resp, err := parseResponse([]byte(test.raw))
+		if err != nil {
+			t.Fatalf("parseResponse(%q): %v", test.raw, err)
+		}
+		if err := resp.toError(); !errors.Is(err, test.want) {
+			t.Errorf("parseResponse(%q).toError() = %v, want %v", test.raw, err, test.want)
+		}
+	}
+}
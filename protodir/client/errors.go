@@ -0,0 +1,55 @@
+package client
+
+import (
+	"fmt"
+	"protogen/protodir"
+)
+
+// ResponseError is a response ProtoDir answered with a failure code. The
+// errors below can be matched with errors.Is, whatever the message was.
+type ResponseError struct {
+	Code    int
+	Status  string
+	Message string
+}
+
+var (
+	ErrParseFailed     = newResponseError(int(protodir.RESPONSE_PARSE_FAILED), "PARSE_FAILED")
+	ErrNoDir           = newResponseError(int(protodir.RESPONSE_NO_DIR), "NO_DIR")
+	ErrNoHash          = newResponseError(int(protodir.RESPONSE_NO_HASH), "NO_HASH")
+	ErrNoState         = newResponseError(int(protodir.RESPONSE_NO_STATE), "NO_STATE")
+	ErrNoExist         = newResponseError(int(protodir.RESPONSE_NO_EXIST), "NO_EXISTS")
+	ErrWalkFailed      = newResponseError(int(protodir.RESPONSE_WALK_FAILED), "WALK_FAILED")
+	ErrReadFailed      = newResponseError(int(protodir.RESPONSE_READ_FAILED), "READ_FAILED")
+	ErrStatFailed      = newResponseError(int(protodir.RESPONSE_STAT_FAILED), "STAT_FAILED")
+	ErrWrongCommand    = newResponseError(int(protodir.RESPONSE_WRONG_COMM), "WRONG_COMMAND")
+	ErrIsNotFile       = newResponseError(int(protodir.RESPONSE_IS_NOT_FILE), "IS_NOT_FILE")
+	ErrIsNotDir        = newResponseError(int(protodir.RESPONSE_IS_NOT_DIR), "IS_NOT_DIR")
+	ErrBadArguments    = newResponseError(int(protodir.RESPONSE_BAD_ARGUMENTS), "BAD_ARGUMENTS")
+	ErrRequestTooLarge = newResponseError(int(protodir.RESPONSE_REQUEST_TOO_LARGE), "REQUEST_TOO_LARGE")
+	ErrReadTooLarge    = newResponseError(int(protodir.RESPONSE_READ_TOO_LARGE), "READ_TOO_LARGE")
+	ErrWalkTooLarge    = newResponseError(int(protodir.RESPONSE_WALK_TOO_LARGE), "WALK_TOO_MANY_ENTRIES")
+	ErrWalkTooDeep     = newResponseError(int(protodir.RESPONSE_WALK_TOO_DEEP), "WALK_TOO_DEEP")
+	ErrTooManyConns    = newResponseError(int(protodir.RESPONSE_TOO_MANY_CONNS), "TOO_MANY_CONNECTIONS")
+	ErrTimedOut        = newResponseError(int(protodir.RESPONSE_TIMED_OUT), "TIME_BUDGET_EXCEEDED")
+	ErrNoSnapshot      = newResponseError(int(protodir.RESPONSE_NO_SNAPSHOT), "NO_SNAPSHOT")
+	ErrOutOfJail       = newResponseError(int(protodir.RESPONSE_OUT_OF_JAIL), "OUT_OF_JAIL")
+	ErrNotModified     = newResponseError(int(protodir.RESPONSE_NOT_MODIFIED), "NOT_MODIFIED")
+)
+
+func newResponseError(code int, status string) *ResponseError {
+	return &ResponseError{Code: code, Status: status}
+}
+
+func (re *ResponseError) Error() string {
+	if re.Message == "" {
+		return fmt.Sprintf("protodir: %d - %s", re.Code, re.Status)
+	}
+
+	return fmt.Sprintf("protodir: %d - %s: %s", re.Code, re.Status, re.Message)
+}
+
+func (re *ResponseError) Is(target error) bool {
+	targetErr, ok := target.(*ResponseError)
+	return ok && targetErr.Code == re.Code
+}
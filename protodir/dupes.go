@@ -0,0 +1,422 @@
+package protodir
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DUPES_STAGE_SCAN    string = "SCAN"
+	DUPES_STAGE_PARTIAL string = "PARTIAL_HASH"
+	DUPES_STAGE_FULL    string = "FULL_HASH"
+)
+
+type dupeProgress func(stage string, done, total int)
+
+// dupeCandidate has the path it is shown with in rel when that is not its
+// path relative to the root, as for files of a union state.
+type dupeCandidate struct {
+	path string
+	rel  string
+	size int64
+	hash string
+}
+
+type dupeGroup struct {
+	hash  string
+	size  int64
+	paths []string
+}
+
+type progressReporter struct {
+	sync.Mutex
+	stage    string
+	total    int
+	done     int
+	lastSent time.Time
+	report   dupeProgress
+}
+
+func newProgressReporter(stage string, total int, report dupeProgress) *progressReporter {
+	return &progressReporter{stage: stage, total: total, report: report}
+}
+
+// FIND_DUPES <state>[;PROGRESS=yes]
+//
+// Files under the current dir of the state are grouped by size, then by a hash
+// of their first bytes and only then by a hash of their whole content, so most
+// files are never read in full.
+func (pdr *protoDirState) handleRequestFindDupes(pathOrHash string, progress dupeProgress) ([]byte, responseCode) {
+	fields, success := parsePathOrHashFields(pathOrHash, 1, GLOBAL_MAX_FIELDS)
+	if success != STATUS_DID_SPLIT {
+		return []byte(ERR_PARSE_HASH), RESPONSE_PARSE_FAILED
+	}
+
+	if _, success := parseRequestOptions(fields[1:]); success != STATUS_DID_SPLIT {
+		return []byte(ERR_PARSE_OPTION), RESPONSE_BAD_ARGUMENTS
+	}
+
+	state := pdr.filterStatesAndReturn(fields[0])
+	if state == nil {
+		return nil, RESPONSE_NO_STATE
+	}
+
+	groups, stat := findDupes(state.path.currentDirs(), progress)
+	if stat != STATUS_WALK_SUCCESS {
+		return walkFailureResponse(stat)
+	}
+
+	return addHeader(state.path.currDir, GLOBAL_DUPES_HEADER, []byte(dupeGroupsToString(groups))), RESPONSE_DUPES_FOUND
+}
+
+// With PROGRESS=yes the connection first gets a FINDING_DUPES response
+// followed by progress lines, and the result is sent as a second response
+// once the search is done.
+func (pdr *protoDirState) handleRequestFindDupesWithProgress(conn net.Conn, pathOrHash string) {
+	if _, err := conn.Write([]byte(RESPONSE_FINDING_DUPES.toString())); err != nil {
+		return
+	}
+
+	var writeLock sync.Mutex
+	progress := func(stage string, done, total int) {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+
+		line := fmt.Sprintf("%s%s: stage=%s;done=%d;total=%d;\n", GLOBAL_HEADER_PREFIX, GLOBAL_PROGRESS_HEADER, stage, done, total)
+		conn.Write([]byte(line))
+	}
+
+	bResp, code := pdr.handleRequestFindDupes(pathOrHash, progress)
+
+	conn.Write([]byte{10})
+	writeResponse(conn, bResp, code)
+}
+
+// findDupes looks through the merged tree of dirs when there is more than
+// one, so files hidden by a root of higher precedence are left out.
+func findDupes(dirs []string, progress dupeProgress) ([]dupeGroup, successStatus) {
+	if len(dirs) == 0 {
+		return nil, STATUS_NOT_EXISTS
+	}
+
+	root := dirs[0]
+	statIsDir := checkStatIsDirAndExists(root)
+	if statIsDir != STATUS_EXISTS {
+		return nil, statIsDir
+	}
+
+	budget := newWalkBudget(root)
+	var files []dupeCandidate
+	var stat successStatus
+	if len(dirs) > 1 {
+		files, stat = scanUnionForDupes(dirs, progress)
+	} else {
+		files, stat = scanForDupes(root, budget, progress)
+	}
+	if stat != STATUS_WALK_SUCCESS {
+		return nil, stat
+	}
+
+	candidates := flattenGroups(groupCandidates(files, func(c dupeCandidate) string {
+		return fmt.Sprint(c.size)
+	}))
+
+	hashCandidates(candidates, GLOBAL_DUPES_PARTIAL, DUPES_STAGE_PARTIAL, budget, progress)
+	candidates = flattenGroups(groupCandidates(candidates, sizeAndHashKey))
+
+	// Files no bigger than the partial hash were already hashed in full.
+	needsFull := make([]dupeCandidate, 0)
+	complete := make([]dupeCandidate, 0)
+	for _, candidate := range candidates {
+		if candidate.size > GLOBAL_DUPES_PARTIAL {
+			needsFull = append(needsFull, candidate)
+		} else {
+			complete = append(complete, candidate)
+		}
+	}
+
+	hashCandidates(needsFull, 0, DUPES_STAGE_FULL, budget, progress)
+	complete = append(complete, needsFull...)
+
+	if budget.isPastDeadline() {
+		return nil, STATUS_TIMED_OUT
+	}
+
+	groups := make([]dupeGroup, 0)
+	for _, group := range groupCandidates(complete, sizeAndHashKey) {
+		groups = append(groups, newDupeGroup(root, group))
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].wasted() != groups[j].wasted() {
+			return groups[i].wasted() > groups[j].wasted()
+		}
+		return groups[i].paths[0] < groups[j].paths[0]
+	})
+
+	return groups, STATUS_WALK_SUCCESS
+}
+
+func scanUnionForDupes(dirs []string, progress dupeProgress) ([]dupeCandidate, successStatus) {
+	entries, stat := walkUnionEntries(dirs)
+	if stat != STATUS_WALK_SUCCESS {
+		return nil, stat
+	}
+
+	files := make([]dupeCandidate, 0)
+	reporter := newProgressReporter(DUPES_STAGE_SCAN, 0, progress)
+	for _, entry := range entries {
+		if entry.info.Mode().IsRegular() && entry.info.Size() > 0 {
+			files = append(files, dupeCandidate{path: entry.path, rel: entry.rel, size: entry.info.Size()})
+			reporter.advance()
+		}
+	}
+	reporter.finish()
+
+	return files, STATUS_WALK_SUCCESS
+}
+
+func scanForDupes(root string, budget *walkBudget, progress dupeProgress) ([]dupeCandidate, successStatus) {
+	files := make([]dupeCandidate, 0)
+	reporter := newProgressReporter(DUPES_STAGE_SCAN, 0, progress)
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			return nil
+		}
+
+		if err := budget.visit(path); err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil || info.Size() == 0 {
+			return nil
+		}
+
+		files = append(files, dupeCandidate{path: path, size: info.Size()})
+		reporter.advance()
+
+		return nil
+	})
+
+	if budget.stat != STATUS_WALK_SUCCESS {
+		return nil, budget.stat
+	} else if err != nil {
+		return nil, STATUS_WALK_FAIL
+	}
+
+	reporter.finish()
+
+	return files, STATUS_WALK_SUCCESS
+}
+
+// hashCandidates hashes the first limit bytes of every candidate, or all of
+// it if limit is 0, with a bounded pool of workers. Candidates that could not
+// be read, or were not hashed before the time budget ran out, are left with an
+// empty hash.
+func hashCandidates(candidates []dupeCandidate, limit int64, stage string, budget *walkBudget, progress dupeProgress) {
+	jobs := make(chan int)
+	results := make(chan int)
+
+	for w := 0; w < GLOBAL_DUPES_WORKERS; w++ {
+		go func() {
+			for i := range jobs {
+				if budget.isPastDeadline() {
+					candidates[i].hash = ""
+					results <- i
+					continue
+				}
+				candidates[i].hash = hashFileContents(candidates[i].path, limit)
+				results <- i
+			}
+		}()
+	}
+
+	go func() {
+		for i := range candidates {
+			jobs <- i
+		}
+		close(jobs)
+	}()
+
+	reporter := newProgressReporter(stage, len(candidates), progress)
+	for range candidates {
+		<-results
+		reporter.advance()
+	}
+	reporter.finish()
+}
+
+func hashFileContents(path string, limit int64) string {
+	file, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if limit > 0 {
+		reader = io.LimitReader(file, limit)
+	}
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, reader); err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+func groupCandidates(candidates []dupeCandidate, key func(dupeCandidate) string) [][]dupeCandidate {
+	byKey := make(map[string][]dupeCandidate)
+	keys := make([]string, 0)
+
+	for _, candidate := range candidates {
+		k := key(candidate)
+		if _, ok := byKey[k]; !ok {
+			keys = append(keys, k)
+		}
+		byKey[k] = append(byKey[k], candidate)
+	}
+
+	groups := make([][]dupeCandidate, 0)
+	for _, k := range keys {
+		if len(byKey[k]) > 1 {
+			groups = append(groups, byKey[k])
+		}
+	}
+
+	return groups
+}
+
+func flattenGroups(groups [][]dupeCandidate) []dupeCandidate {
+	flat := make([]dupeCandidate, 0)
+	for _, group := range groups {
+		flat = append(flat, group...)
+	}
+
+	return flat
+}
+
+func sizeAndHashKey(c dupeCandidate) string {
+	if c.hash == "" {
+		// Unreadable files never match anything.
+		return "!" + c.path
+	}
+
+	return fmt.Sprintf("%d-%s", c.size, c.hash)
+}
+
+func newDupeGroup(root string, candidates []dupeCandidate) dupeGroup {
+	paths := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		if candidate.rel != "" {
+			paths = append(paths, candidate.rel)
+			continue
+		}
+
+		rel, err := filepath.Rel(root, candidate.path)
+		if err != nil {
+			rel = candidate.path
+		}
+		paths = append(paths, rel)
+	}
+	sort.Strings(paths)
+
+	return dupeGroup{hash: candidates[0].hash, size: candidates[0].size, paths: paths}
+}
+
+func (dg dupeGroup) wasted() int64 {
+	return dg.size * int64(len(dg.paths)-1)
+}
+
+func (dg dupeGroup) toString() string {
+	finStr := fmt.Sprintf("#g#hash=%s#size=%d#count=%d#wasted=%d", dg.hash[:16], dg.size, len(dg.paths), dg.wasted())
+	for _, path := range dg.paths {
+		finStr += fmt.Sprintf("\n*f*path=%s", path)
+	}
+
+	return finStr
+}
+
+func dupeGroupsToString(groups []dupeGroup) string {
+	if len(groups) == 0 {
+		return "NO_DUPES"
+	}
+
+	var wasted int64
+	finStr := ""
+	for _, group := range groups {
+		finStr += "\n" + group.toString() + "\n"
+		wasted += group.wasted()
+	}
+
+	return fmt.Sprintf("%s===\nGroups: %d;\nWasted: %d;", finStr, len(groups), wasted)
+}
+
+func (pr *progressReporter) advance() {
+	if pr.report == nil {
+		return
+	}
+
+	pr.Lock()
+	defer pr.Unlock()
+
+	pr.done++
+	if time.Since(pr.lastSent) >= GLOBAL_PROGRESS_EVERY {
+		pr.lastSent = time.Now()
+		pr.report(pr.stage, pr.done, pr.total)
+	}
+}
+
+func (pr *progressReporter) finish() {
+	if pr.report == nil {
+		return
+	}
+
+	pr.Lock()
+	defer pr.Unlock()
+
+	pr.report(pr.stage, pr.done, pr.total)
+}
+
+func wantsProgress(pathOrHash string) bool {
+	fields, success := parsePathOrHashFields(pathOrHash, 1, GLOBAL_MAX_FIELDS)
+	if success != STATUS_DID_SPLIT {
+		return false
+	}
+
+	options, success := parseRequestOptions(fields[1:])
+	if success != STATUS_DID_SPLIT {
+		return false
+	}
+
+	return isTruthy(options[OPT_PROGRESS])
+}
+
+func isTruthy(value string) bool {
+	switch strings.ToLower(value) {
+	case "yes", "true", "1", "on":
+		return true
+	}
+
+	return false
+}
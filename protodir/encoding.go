@@ -0,0 +1,144 @@
+package protodir
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	ENCODING_IDENTITY   string = "identity"
+	ENCODING_BASE64     string = "base64"
+	ENCODING_GZIP       string = "gzip"
+	ENCODING_FLATE      string = "flate"
+	ENCODING_CHAIN_SEP  string = "+"
+	ENCODING_CHOICE_SEP string = ","
+)
+
+var errUnknownEncoding = errors.New("unknown encoding")
+
+// negotiateEncoding picks the first encoding of a comma separated list that
+// is known, like `ENCODING=gzip+base64,base64`. Encodings can be chained with
+// `+` and are applied from left to right, so `gzip+base64` is gzipped first.
+// Without an ENCODING option it returns an empty encoding, the contents are
+// then sent as they are and not announced.
+func (o requestOptions) negotiateEncoding() (string, bool) {
+	value, ok := o[OPT_ENCODING]
+	if !ok {
+		return "", true
+	}
+
+	for _, choice := range strings.Split(value, ENCODING_CHOICE_SEP) {
+		choice = strings.ToLower(strings.TrimSpace(choice))
+		if isKnownEncoding(choice) {
+			return choice, true
+		}
+	}
+
+	return "", false
+}
+
+func isKnownEncoding(encoding string) bool {
+	if encoding == "" {
+		return false
+	}
+
+	for _, step := range strings.Split(encoding, ENCODING_CHAIN_SEP) {
+		switch step {
+		case ENCODING_IDENTITY, ENCODING_BASE64, ENCODING_GZIP, ENCODING_FLATE:
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+func encodePayload(encoding string, data []byte) ([]byte, error) {
+	for _, step := range strings.Split(encoding, ENCODING_CHAIN_SEP) {
+		var buffer bytes.Buffer
+		var writer io.WriteCloser
+
+		switch step {
+		case ENCODING_IDENTITY:
+			continue
+		case ENCODING_BASE64:
+			writer = base64.NewEncoder(base64.StdEncoding, &buffer)
+		case ENCODING_GZIP:
+			writer = gzip.NewWriter(&buffer)
+		case ENCODING_FLATE:
+			writer, _ = flate.NewWriter(&buffer, flate.DefaultCompression)
+		default:
+			return nil, errUnknownEncoding
+		}
+
+		if _, err := writer.Write(data); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+
+		data = buffer.Bytes()
+	}
+
+	return data, nil
+}
+
+// DecodePayload undoes encodePayload, for clients reading a response with
+// an `$ENCODING` header.
+func DecodePayload(encoding string, data []byte) ([]byte, error) {
+	steps := strings.Split(strings.ToLower(encoding), ENCODING_CHAIN_SEP)
+	for i := len(steps) - 1; i >= 0; i-- {
+		var reader io.Reader
+
+		switch steps[i] {
+		case ENCODING_IDENTITY:
+			continue
+		case ENCODING_BASE64:
+			reader = base64.NewDecoder(base64.StdEncoding, bytes.NewReader(data))
+		case ENCODING_GZIP:
+			gzReader, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			reader = gzReader
+		case ENCODING_FLATE:
+			reader = flate.NewReader(bytes.NewReader(data))
+		default:
+			return nil, fmt.Errorf("%w: %s", errUnknownEncoding, steps[i])
+		}
+
+		decoded, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, err
+		}
+
+		data = decoded
+	}
+
+	return data, nil
+}
+
+// addEncodingHeader encodes contents and puts the encoding before them.
+// An encoding that was asked for is always announced, identity included, so
+// clients never mistake the start of a file for the header.
+func addEncodingHeader(encoding string, contents []byte) ([]byte, bool) {
+	if encoding == "" {
+		return contents, true
+	}
+
+	encoded, err := encodePayload(encoding, contents)
+	if err != nil {
+		return nil, false
+	}
+
+	header := []byte(fmt.Sprintf("%s%s: %s;\n", GLOBAL_HEADER_PREFIX, GLOBAL_ENCODING_HEADER, encoding))
+
+	return append(header, encoded...), true
+}
@@ -0,0 +1,589 @@
+package protodir
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	HTTP_BROWSE_PREFIX string = "/browse/"
+	HTTP_LIST_PREFIX   string = "/api/list/"
+	HTTP_STAT_PREFIX   string = "/api/stat/"
+	HTTP_URL_SEP       string = "/"
+)
+
+type httpGateway struct {
+	root     string
+	realRoot string
+	state    *protoDirState
+	slots    connSlots
+	sessions uint64
+}
+
+// httpSession is the PTDP state a single HTTP request is answered through.
+// It is made when the request comes in and dropped once it is answered, and
+// keeps what the audit record of the request needs.
+type httpSession struct {
+	gateway *httpGateway
+	hash    string
+	path    string
+	code    responseCode
+}
+
+// resolvedEntity is an entity a URL was resolved to. The collective is left
+// in the dir of the entity, or in the entity itself if it is a dir.
+type resolvedEntity struct {
+	ty         pathType
+	path       string
+	hash       string
+	urlPath    string
+	collective pathCollective
+}
+
+type httpEntry struct {
+	Name    string    `json:"name"`
+	IsDir   bool      `json:"is_dir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	URL     string    `json:"url"`
+}
+
+type httpListing struct {
+	Path    string      `json:"path"`
+	Parent  string      `json:"parent,omitempty"`
+	Entries []httpEntry `json:"entries"`
+}
+
+type httpStat struct {
+	Name    string    `json:"name"`
+	Path    string    `json:"path"`
+	IsDir   bool      `json:"is_dir"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"mod_time"`
+	Version string    `json:"version"`
+}
+
+type httpError struct {
+	Code  responseCode `json:"code"`
+	Error string       `json:"error"`
+}
+
+var listingTemplate = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>ProtoDir {{.Path}}</title></head>
+<body>
+<h1>{{.Path}}</h1>
+<table>
+<tr><th>Name</th><th>Size</th><th>Modified</th></tr>
+{{if .Parent}}<tr><td><a href="{{.Parent}}">../</a></td><td></td><td></td></tr>
+{{end}}{{range .Entries}}<tr><td><a href="{{.URL}}">{{.Name}}{{if .IsDir}}/{{end}}</a></td><td>{{if not .IsDir}}{{.Size}}{{end}}</td><td>{{.ModTime.Format "2006-01-02 15:04:05"}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// ProtoDirHttpMain serves the tree under root over HTTP and WebDAV. Every
+// request is answered through a PTDP state of its own, so the limits and the
+// audit log of ProtoDir apply to it just as to a request on the socket.
+func ProtoDirHttpMain(addr, root string, writable bool, limitsSet ProtoDirLimits, auditLogSet string) {
+	globalLimits = limitsSet
+	openAuditLog(auditLogSet)
+	handler, err := NewHttpHandler(root, writable)
+	if err != nil {
+		handleError(err)
+		os.Exit(1)
+	}
+
+	handleError(http.ListenAndServe(addr, handler))
+}
+
+func CleanUpProtoDirHttp() {
+	fmt.Println("\nProtoGen's ProtoDir HTTP server has been terminated")
+	os.Exit(0)
+}
+
+// NewHttpHandler gives the handler ProtoDirHttpMain serves. The WebDAV
+// methods that change the tree are only allowed if it is writable.
+func NewHttpHandler(root string, writable bool) (http.Handler, error) {
+	gateway, err := newHttpGateway(root)
+	if err != nil {
+		return nil, err
+	}
+
+	dav := davHandler{gateway: gateway, writable: writable}
+	mux := gateway.routes()
+	mux.Handle(HTTP_DAV_PREFIX, gateway.serve(dav.serve))
+
+	return mux, nil
+}
+
+func newHttpGateway(root string) (*httpGateway, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	realRoot, err := filepath.EvalSymlinks(absRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	if stat := checkStatIsDirAndExists(realRoot); stat != STATUS_EXISTS {
+		return nil, fmt.Errorf("%s is not a dir", root)
+	}
+
+	return &httpGateway{root: absRoot, realRoot: realRoot, state: initProtoDirState(), slots: newConnSlots()}, nil
+}
+
+func (hg *httpGateway) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle(HTTP_BROWSE_PREFIX, hg.serve(hg.handleBrowse))
+	mux.Handle(HTTP_LIST_PREFIX, hg.serve(hg.handleList))
+	mux.Handle(HTTP_STAT_PREFIX, hg.serve(hg.handleStat))
+	mux.HandleFunc(HTTP_URL_SEP, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != HTTP_URL_SEP {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, HTTP_BROWSE_PREFIX, http.StatusFound)
+	})
+
+	return mux
+}
+
+// serve takes a connection slot and a session for the request, and writes
+// its audit record once it is answered.
+func (hg *httpGateway) serve(handle func(http.ResponseWriter, *http.Request, *httpSession)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		audited := newAuditedResponseWriter(w)
+		session := &httpSession{gateway: hg}
+		defer session.audit(audited, r)
+
+		if !hg.slots.acquire() {
+			session.code = RESPONSE_TOO_MANY_CONNS
+			http.Error(audited, string(limitExceeded(ERR_TOO_MANY_CONNS, int64(globalLimits.MaxConnections))), http.StatusServiceUnavailable)
+			return
+		}
+		defer hg.slots.release()
+
+		session.open()
+		defer session.close()
+
+		handle(audited, r, session)
+	})
+}
+
+// GET /browse/<path> lists dirs as HTML and downloads files, with Range and
+// conditional requests handled by http.ServeContent.
+func (hg *httpGateway) handleBrowse(w http.ResponseWriter, r *http.Request, session *httpSession) {
+	if !allowReadMethod(w, r) {
+		return
+	}
+
+	entity, stat := session.resolve(strings.TrimPrefix(r.URL.Path, HTTP_BROWSE_PREFIX))
+	if stat != STATUS_EXISTS {
+		writeHttpStatus(w, stat)
+		return
+	}
+
+	if entity.ty == GLOBAL_DIRPATH {
+		if !strings.HasSuffix(r.URL.Path, HTTP_URL_SEP) {
+			http.Redirect(w, r, r.URL.Path+HTTP_URL_SEP, http.StatusMovedPermanently)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		handleError(listingTemplate.Execute(w, entity.toListing(HTTP_BROWSE_PREFIX, hg.realRoot)))
+		return
+	}
+
+	session.serveFile(w, r, entity)
+}
+
+// GET /api/list/<path>
+func (hg *httpGateway) handleList(w http.ResponseWriter, r *http.Request, session *httpSession) {
+	if !allowReadMethod(w, r) {
+		return
+	}
+
+	entity, stat := session.resolve(strings.TrimPrefix(r.URL.Path, HTTP_LIST_PREFIX))
+	if stat == STATUS_EXISTS && entity.ty != GLOBAL_DIRPATH {
+		stat = STATUS_ISNOTDIR
+	}
+	if stat != STATUS_EXISTS {
+		writeHttpJsonStatus(w, stat)
+		return
+	}
+
+	writeHttpJson(w, http.StatusOK, entity.toListing(HTTP_LIST_PREFIX, hg.realRoot))
+}
+
+// GET /api/stat/<path>
+func (hg *httpGateway) handleStat(w http.ResponseWriter, r *http.Request, session *httpSession) {
+	if !allowReadMethod(w, r) {
+		return
+	}
+
+	entity, stat := session.resolve(strings.TrimPrefix(r.URL.Path, HTTP_STAT_PREFIX))
+	if stat != STATUS_EXISTS {
+		writeHttpJsonStatus(w, stat)
+		return
+	}
+
+	info, err := os.Stat(entity.path)
+	if err != nil {
+		writeHttpJsonStatus(w, STATUS_NOT_EXISTS)
+		return
+	}
+
+	byContent := isTruthy(r.URL.Query().Get("content"))
+	writeHttpJson(w, http.StatusOK, httpStat{
+		Name:    info.Name(),
+		Path:    entity.urlPath,
+		IsDir:   info.IsDir(),
+		Size:    info.Size(),
+		Mode:    info.Mode().String(),
+		ModTime: info.ModTime(),
+		Version: versionOfEntity(entity.path, info, byContent).token,
+	})
+}
+
+// serveFile reads the file with READ_BYTES, so it is bound by the read limit
+// and the time budget like any other read.
+func (hs *httpSession) serveFile(w http.ResponseWriter, r *http.Request, entity resolvedEntity) {
+	identity := OPT_ENCODING + GLOBAL_OPTION_SEP + ENCODING_IDENTITY
+	body, code := hs.ptdp(COMM_READ_BYTES, hs.hash, entity.hash, identity)
+	if code != RESPONSE_READ_FILE_OK {
+		writeHttpStatus(w, statusOfResponse(code))
+		return
+	}
+
+	info, err := os.Stat(entity.path)
+	if err != nil {
+		writeHttpStatus(w, STATUS_NOT_EXISTS)
+		return
+	}
+
+	version, contents := readPayloadOf(body)
+	w.Header().Set("ETag", fmt.Sprintf(`"%s"`, version))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), bytes.NewReader(contents))
+}
+
+// open gives the session a state of its own. All states of the gateway share
+// its root, so they are told apart by the number of the session instead.
+func (hs *httpSession) open() {
+	id := atomic.AddUint64(&hs.gateway.sessions, 1)
+	key := fmt.Sprintf("%s%s%d", hs.gateway.root, GLOBAL_TUPLE_SEP, id)
+
+	newState, _ := newPathState(hs.gateway.root)
+	newState.hash = hashString(key)
+
+	pdr := hs.gateway.state
+	pdr.Lock()
+	pdr.states = append(pdr.states, &newState)
+	pdr.Unlock()
+
+	hs.hash = newState.getHashTrimmed()
+}
+
+func (hs *httpSession) close() {
+	hs.gateway.state.dropState(hs.hash)
+}
+
+// ptdp answers a PTDP request on the state of the session.
+func (hs *httpSession) ptdp(command string, args ...string) ([]byte, responseCode) {
+	request := fmt.Sprintf("%s %s %s %s", GLOBAL_PROTOCOL_NAME, GLOBAL_VERSION_CONTROL, command, strings.Join(args, GLOBAL_TUPLE_SEP))
+	body, code := hs.gateway.state.handleRequestWithBudget([]byte(request))
+	hs.code = code
+
+	return body, code
+}
+
+func (hs *httpSession) fail(code responseCode, stat successStatus) (resolvedEntity, successStatus) {
+	hs.code = code
+	return resolvedEntity{}, stat
+}
+
+// resolve walks a slash separated path from the root, changing into one
+// subdir at a time by name. Paths that lead out of the root, whether through
+// `..` or a symlink, are refused.
+func (hs *httpSession) resolve(urlPath string) (resolvedEntity, successStatus) {
+	hg := hs.gateway
+	hs.path = hg.root
+
+	segments, ok := splitUrlPath(urlPath)
+	if !ok {
+		return hs.fail(RESPONSE_OUT_OF_JAIL, STATUS_OUT_OF_JAIL)
+	}
+
+	if _, code := hs.ptdp(COMM_CD_SD, hs.hash, hs.hash); code != RESPONSE_CD_SUBDIR_OK {
+		return resolvedEntity{}, statusOfResponse(code)
+	}
+
+	state := hg.state.filterStatesAndReturn(hs.hash)
+	if state == nil {
+		return hs.fail(RESPONSE_NO_STATE, STATUS_DID_FAIL)
+	}
+
+	entity := resolvedEntity{ty: GLOBAL_DIRPATH, path: hg.root, urlPath: HTTP_URL_SEP}
+
+	for i, name := range segments {
+		entity.urlPath = HTTP_URL_SEP + strings.Join(segments[:i+1], HTTP_URL_SEP)
+
+		if dir := state.path.getSubDirByName(name); dir != nil {
+			if _, code := hs.ptdp(COMM_CD_SD, hs.hash, dir.getHashTrimmed()); code != RESPONSE_CD_SUBDIR_OK {
+				return resolvedEntity{}, statusOfResponse(code)
+			}
+			entity.path = state.path.currDir
+			hs.path = entity.path
+			continue
+		}
+
+		file := state.path.getFileByName(name)
+		if file == nil || i != len(segments)-1 {
+			return hs.fail(RESPONSE_NO_EXIST, STATUS_NOT_EXISTS)
+		}
+
+		entity.ty, entity.hash = GLOBAL_FILEPATH, file.getHashTrimmed()
+		entity.path = filepath.Join(state.path.currDir, file.path)
+		hs.path = entity.path
+	}
+
+	if !isInJail(hg.realRoot, entity.path) {
+		return hs.fail(RESPONSE_OUT_OF_JAIL, STATUS_OUT_OF_JAIL)
+	}
+
+	entity.collective = state.path
+	return entity, STATUS_EXISTS
+}
+
+func (hs *httpSession) audit(w *auditedResponseWriter, r *http.Request) {
+	if globalAuditLog == nil {
+		return
+	}
+
+	bytesIn := len(r.RequestURI)
+	if r.ContentLength > 0 {
+		bytesIn += int(r.ContentLength)
+	}
+
+	globalAuditLog.write(auditRecord{
+		Time:     time.Now(),
+		Remote:   r.RemoteAddr,
+		State:    hs.hash,
+		Command:  r.Method,
+		Path:     hs.path,
+		Code:     int(hs.code),
+		Response: hs.code.text(),
+		Status:   w.status,
+		BytesIn:  bytesIn,
+		BytesOut: w.written,
+	})
+}
+
+// readPayloadOf takes the version and the contents out of a READ_BYTES
+// response asked for in identity, the encoding header coming last.
+func readPayloadOf(body []byte) (string, []byte) {
+	body = bytes.TrimSuffix(body, []byte("\n\n"))
+
+	version := ""
+	for bytes.HasPrefix(body, []byte(GLOBAL_HEADER_PREFIX)) {
+		line, rest, _ := bytes.Cut(body, []byte("\n"))
+		header, value, _ := strings.Cut(strings.TrimPrefix(string(line), GLOBAL_HEADER_PREFIX), ": ")
+		body = rest
+
+		if header == GLOBAL_VERSION_HEADER {
+			version = strings.TrimSuffix(value, GLOBAL_TUPLE_SEP)
+		} else if header == GLOBAL_ENCODING_HEADER {
+			break
+		}
+	}
+
+	return version, body
+}
+
+// toListing leaves out symlinks that lead out of the root.
+func (re resolvedEntity) toListing(prefix, realRoot string) httpListing {
+	listing := httpListing{Path: re.urlPath, Entries: make([]httpEntry, 0)}
+	if re.urlPath != HTTP_URL_SEP {
+		listing.Parent = escapeUrlPath(prefix + strings.TrimPrefix(path.Dir(re.urlPath), HTTP_URL_SEP))
+	}
+
+	entities := append(append(make([]entityPath, 0), re.collective.subdirs...), re.collective.files...)
+	for _, entity := range entities {
+		entityPath := filepath.Join(re.collective.currDir, entity.path)
+		info, err := os.Stat(entityPath)
+		if err != nil || !isInJail(realRoot, entityPath) {
+			continue
+		}
+
+		// Files link to their download, dirs to their listing in kind.
+		entry := httpEntry{
+			Name:    entity.path,
+			IsDir:   entity.ty == GLOBAL_DIRPATH,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			URL:     HTTP_BROWSE_PREFIX + strings.TrimPrefix(path.Join(re.urlPath, entity.path), HTTP_URL_SEP),
+		}
+		if entry.IsDir {
+			entry.URL = prefix + strings.TrimPrefix(entry.URL, HTTP_BROWSE_PREFIX) + HTTP_URL_SEP
+		}
+
+		entry.URL = escapeUrlPath(entry.URL)
+		listing.Entries = append(listing.Entries, entry)
+	}
+
+	sort.Slice(listing.Entries, func(i, j int) bool { return listing.Entries[i].Name < listing.Entries[j].Name })
+
+	return listing
+}
+
+func (p *pathCollective) getSubDirByName(name string) *entityPath {
+	for i, sd := range p.subdirs {
+		if sd.path == name {
+			return &p.subdirs[i]
+		}
+	}
+
+	return nil
+}
+
+func (p *pathCollective) getFileByName(name string) *entityPath {
+	for i, f := range p.files {
+		if f.path == name {
+			return &p.files[i]
+		}
+	}
+
+	return nil
+}
+
+// isInJail tells if path, once its symlinks are followed, is still under the
+// root. Paths that do not exist yet are judged by their closest existing
+// parent.
+func isInJail(realRoot, target string) bool {
+	existing := target
+	rest := ""
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return false
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+
+	real, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return false
+	}
+
+	rel, err := filepath.Rel(realRoot, filepath.Join(real, rest))
+	if err != nil {
+		return false
+	}
+
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func splitUrlPath(urlPath string) ([]string, bool) {
+	segments := make([]string, 0)
+	for _, segment := range strings.Split(urlPath, HTTP_URL_SEP) {
+		switch segment {
+		case "":
+		case ".", "..":
+			return nil, false
+		default:
+			segments = append(segments, segment)
+		}
+	}
+
+	return segments, true
+}
+
+func escapeUrlPath(urlPath string) string {
+	return (&url.URL{Path: urlPath}).EscapedPath()
+}
+
+func allowReadMethod(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return true
+	}
+
+	w.Header().Set("Allow", "GET, HEAD")
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	return false
+}
+
+// statusOfResponse maps the code of a failed PTDP request back to the status
+// the gateway reports it with.
+func statusOfResponse(code responseCode) successStatus {
+	switch code {
+	case RESPONSE_NO_DIR, RESPONSE_IS_NOT_DIR:
+		return STATUS_ISNOTDIR
+	case RESPONSE_NO_EXIST:
+		return STATUS_NOT_EXISTS
+	case RESPONSE_NO_HASH:
+		return STATUS_NO_HASH
+	case RESPONSE_IS_NOT_FILE:
+		return STATUS_ISNOTFILE
+	case RESPONSE_READ_TOO_LARGE:
+		return STATUS_TOO_LARGE
+	case RESPONSE_TIMED_OUT:
+		return STATUS_TIMED_OUT
+	}
+
+	return STATUS_DID_FAIL
+}
+
+// httpStatusOf maps the status of a failed lookup to an HTTP status and the
+// PTDP response code a socket client would have gotten.
+func httpStatusOf(stat successStatus) (int, responseCode) {
+	switch stat {
+	case STATUS_NOT_EXISTS, STATUS_NO_HASH:
+		return http.StatusNotFound, RESPONSE_NO_EXIST
+	case STATUS_ISNOTDIR:
+		return http.StatusBadRequest, RESPONSE_IS_NOT_DIR
+	case STATUS_ISNOTFILE:
+		return http.StatusBadRequest, RESPONSE_IS_NOT_FILE
+	case STATUS_OUT_OF_JAIL:
+		return http.StatusForbidden, RESPONSE_OUT_OF_JAIL
+	case STATUS_TOO_LARGE:
+		return http.StatusRequestEntityTooLarge, RESPONSE_READ_TOO_LARGE
+	case STATUS_TIMED_OUT:
+		return http.StatusServiceUnavailable, RESPONSE_TIMED_OUT
+	}
+
+	return http.StatusInternalServerError, RESPONSE_READ_FAILED
+}
+
+func writeHttpStatus(w http.ResponseWriter, stat successStatus) {
+	status, code := httpStatusOf(stat)
+	http.Error(w, code.text(), status)
+}
+
+func writeHttpJsonStatus(w http.ResponseWriter, stat successStatus) {
+	status, code := httpStatusOf(stat)
+	writeHttpJson(w, status, httpError{Code: code, Error: code.text()})
+}
+
+func writeHttpJson(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	handleError(json.NewEncoder(w).Encode(value))
+}
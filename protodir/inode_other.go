@@ -0,0 +1,9 @@
+//go:build !unix
+
+package protodir
+
+import "os"
+
+func inodeOf(info os.FileInfo) uint64 {
+	return 0
+}
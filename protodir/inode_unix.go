@@ -0,0 +1,16 @@
+//go:build unix
+
+package protodir
+
+import (
+	"os"
+	"syscall"
+)
+
+func inodeOf(info os.FileInfo) uint64 {
+	if sys, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(sys.Ino)
+	}
+
+	return 0
+}
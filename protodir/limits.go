@@ -0,0 +1,202 @@
+package protodir
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ProtoDirLimits bounds the work a single request can cause. A zero value
+// for any of the limits turns that limit off.
+type ProtoDirLimits struct {
+	MaxRequestBytes int
+	MaxReadBytes    int64
+	MaxWalkEntries  int
+	MaxWalkDepth    int
+	MaxConnections  int
+	TimeBudget      time.Duration
+	CacheEntries    int
+	CacheBytes      int64
+}
+
+type walkBudget struct {
+	root     string
+	entries  int
+	deadline time.Time
+	stat     successStatus
+}
+
+type connSlots chan struct{}
+
+const GLOBAL_REFUSE_READ_WAIT = time.Millisecond * 100
+
+var (
+	globalLimits      = DefaultProtoDirLimits()
+	errWalkOverBudget = errors.New("walk over budget")
+)
+
+func DefaultProtoDirLimits() ProtoDirLimits {
+	return ProtoDirLimits{
+		MaxRequestBytes: 4096,
+		MaxReadBytes:    64 * 1024 * 1024,
+		MaxWalkEntries:  100000,
+		MaxWalkDepth:    64,
+		MaxConnections:  128,
+		TimeBudget:      time.Second * 30,
+		CacheEntries:    4096,
+		CacheBytes:      64 * 1024 * 1024,
+	}
+}
+
+func newWalkBudget(root string) *walkBudget {
+	budget := walkBudget{root: root, stat: STATUS_WALK_SUCCESS}
+	if globalLimits.TimeBudget > 0 {
+		budget.deadline = time.Now().Add(globalLimits.TimeBudget)
+	}
+
+	return &budget
+}
+
+func newConnSlots() connSlots {
+	if globalLimits.MaxConnections <= 0 {
+		return nil
+	}
+
+	return make(connSlots, globalLimits.MaxConnections)
+}
+
+// visit is called for every entry of a walk, the root included. Once the
+// budget is exceeded it keeps returning errWalkOverBudget, and the reason is
+// kept in stat.
+func (wb *walkBudget) visit(path string) error {
+	return wb.visitAtDepth(walkDepth(wb.root, path))
+}
+
+// visitAtDepth is visit for walks that know how deep they are, like those
+// going through several roots at once.
+func (wb *walkBudget) visitAtDepth(depth int) error {
+	if wb.stat != STATUS_WALK_SUCCESS {
+		return errWalkOverBudget
+	}
+
+	wb.entries++
+	if globalLimits.MaxWalkEntries > 0 && wb.entries > globalLimits.MaxWalkEntries {
+		wb.stat = STATUS_WALK_TOO_LARGE
+	} else if globalLimits.MaxWalkDepth > 0 && depth > globalLimits.MaxWalkDepth {
+		wb.stat = STATUS_WALK_TOO_DEEP
+	} else if wb.isPastDeadline() {
+		wb.stat = STATUS_TIMED_OUT
+	}
+
+	if wb.stat != STATUS_WALK_SUCCESS {
+		return errWalkOverBudget
+	}
+
+	return nil
+}
+
+func (wb *walkBudget) isPastDeadline() bool {
+	return !wb.deadline.IsZero() && time.Now().After(wb.deadline)
+}
+
+func (cs connSlots) acquire() bool {
+	if cs == nil {
+		return true
+	}
+
+	select {
+	case cs <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (cs connSlots) release() {
+	if cs != nil {
+		<-cs
+	}
+}
+
+// handleRequestWithBudget answers with TIME_BUDGET_EXCEEDED if the request
+// takes longer than the budget. Walks check the budget on their own and stop
+// early, so the abandoned request does not keep running for long.
+func (pdr *protoDirState) handleRequestWithBudget(bufferInput []byte) ([]byte, responseCode) {
+	if globalLimits.TimeBudget <= 0 {
+		return pdr.handleRequest(bufferInput)
+	}
+
+	type handledRequest struct {
+		bResp []byte
+		code  responseCode
+	}
+
+	done := make(chan handledRequest, 1)
+	go func() {
+		bResp, code := pdr.handleRequest(bufferInput)
+		done <- handledRequest{bResp: bResp, code: code}
+	}()
+
+	timer := time.NewTimer(globalLimits.TimeBudget)
+	defer timer.Stop()
+
+	select {
+	case handled := <-done:
+		return handled.bResp, handled.code
+	case <-timer.C:
+		budget := limitExceeded(ERR_TIMED_OUT, globalLimits.TimeBudget.Milliseconds())
+		return append(budget, 10, 10), RESPONSE_TIMED_OUT
+	}
+}
+
+// refuseConn still reads the request, closing a unix socket with unread data
+// in it resets the connection before the client gets to read the response.
+func (pdr *protoDirState) refuseConn(rawConn net.Conn) {
+	conn := newAuditedConn(rawConn)
+	defer conn.Close()
+	defer pdr.auditRequest(conn)
+
+	var readBuffer [500]byte
+	conn.SetReadDeadline(time.Now().Add(GLOBAL_REFUSE_READ_WAIT))
+	n, _ := conn.Read(readBuffer[0:])
+	conn.request = readBuffer[:n]
+
+	writeResponse(conn, limitExceeded(ERR_TOO_MANY_CONNS, int64(globalLimits.MaxConnections)), RESPONSE_TOO_MANY_CONNS)
+}
+
+func walkFailureResponse(stat successStatus) ([]byte, responseCode) {
+	switch stat {
+	case STATUS_ISNOTDIR:
+		return nil, RESPONSE_IS_NOT_DIR
+	case STATUS_NOT_EXISTS:
+		return nil, RESPONSE_NO_EXIST
+	case STATUS_WALK_TOO_LARGE:
+		return limitExceeded(ERR_WALK_TOO_LARGE, int64(globalLimits.MaxWalkEntries)), RESPONSE_WALK_TOO_LARGE
+	case STATUS_WALK_TOO_DEEP:
+		return limitExceeded(ERR_WALK_TOO_DEEP, int64(globalLimits.MaxWalkDepth)), RESPONSE_WALK_TOO_DEEP
+	case STATUS_TIMED_OUT:
+		return limitExceeded(ERR_TIMED_OUT, globalLimits.TimeBudget.Milliseconds()), RESPONSE_TIMED_OUT
+	}
+
+	return nil, RESPONSE_WALK_FAILED
+}
+
+func exceedsReadLimit(size int64) bool {
+	return globalLimits.MaxReadBytes > 0 && size > globalLimits.MaxReadBytes
+}
+
+func walkDepth(root, path string) int {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." {
+		return 0
+	}
+
+	return strings.Count(rel, string(filepath.Separator)) + 1
+}
+
+func limitExceeded(errStr string, limit int64) []byte {
+	return []byte(fmt.Sprintf("%s\nLimit: %d;", errStr, limit))
+}
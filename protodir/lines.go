@@ -0,0 +1,414 @@
+package protodir
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+type lineFollower struct {
+	path    string
+	file    *os.File
+	info    os.FileInfo
+	offset  int64
+	partial []byte
+}
+
+func newLineFollower(path string, file *os.File, info os.FileInfo, offset int64) *lineFollower {
+	return &lineFollower{
+		path:    path,
+		file:    file,
+		info:    info,
+		offset:  offset,
+		partial: make([]byte, 0),
+	}
+}
+
+// HEAD_LINES <state>;<file>[;count]
+// TAIL_LINES <state>;<file>[;count]
+// READ_LINES <state>;<file>;<from>[;to]
+func (pdr *protoDirState) handleLinesRequest(req requestCode, pathOrHash string) ([]byte, responseCode) {
+	minFields, maxFields := 2, 3
+	if req == ACT_READ_LINES {
+		minFields, maxFields = 3, 4
+	}
+
+	fields, success := parsePathOrHashFields(pathOrHash, minFields, maxFields)
+	if success != STATUS_DID_SPLIT {
+		return []byte(ERR_LINE_ARGS), RESPONSE_PARSE_FAILED
+	}
+
+	path, code := pdr.resolveFileForLines(fields[0], fields[1])
+	if code != RESPONSE_LINES_READ {
+		return nil, code
+	}
+
+	var read []byte
+	var header string
+	var stat successStatus
+
+	switch req {
+	case ACT_HEAD_LINES:
+		count, ok := parseLineCount(fields, 2)
+		if !ok {
+			return []byte(ERR_LINE_ARGS), RESPONSE_BAD_ARGUMENTS
+		}
+		read, stat = headLinesOfFile(path, count)
+		header = GLOBAL_HEAD_HEADER
+	case ACT_TAIL_LINES:
+		count, ok := parseLineCount(fields, 2)
+		if !ok {
+			return []byte(ERR_LINE_ARGS), RESPONSE_BAD_ARGUMENTS
+		}
+		read, _, stat = tailLinesOfFile(path, count)
+		header = GLOBAL_TAIL_HEADER
+	case ACT_READ_LINES:
+		from, to, ok := parseLineRange(fields)
+		if !ok {
+			return []byte(ERR_LINE_ARGS), RESPONSE_BAD_ARGUMENTS
+		}
+		read, stat = rangeLinesOfFile(path, from, to)
+		header = GLOBAL_LINES_HEADER
+	}
+
+	if stat != STATUS_IS_READ {
+		return readFailureResponse(stat)
+	}
+
+	return addHeader(path, header, read), RESPONSE_LINES_READ
+}
+
+// TAIL_FOLLOW <state>;<file>[;count]
+//
+// Sends the last lines of the file like TAIL_LINES and then keeps the connection
+// open, streaming lines appended to the file until the client hangs up.
+func (pdr *protoDirState) handleRequestTailFollow(conn net.Conn, pathOrHash string) {
+	fields, success := parsePathOrHashFields(pathOrHash, 2, 3)
+	if success != STATUS_DID_SPLIT {
+		writeResponse(conn, []byte(ERR_LINE_ARGS), RESPONSE_PARSE_FAILED)
+		return
+	}
+
+	count, ok := parseLineCount(fields, 2)
+	if !ok {
+		writeResponse(conn, []byte(ERR_LINE_ARGS), RESPONSE_BAD_ARGUMENTS)
+		return
+	}
+
+	path, code := pdr.resolveFileForLines(fields[0], fields[1])
+	if code != RESPONSE_LINES_READ {
+		writeResponse(conn, nil, code)
+		return
+	}
+
+	read, offset, stat := tailLinesOfFile(path, count)
+	if stat != STATUS_IS_READ {
+		bResp, code := readFailureResponse(stat)
+		writeResponse(conn, bResp, code)
+		return
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		writeResponse(conn, nil, RESPONSE_READ_FAILED)
+		return
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		writeResponse(conn, nil, RESPONSE_READ_FAILED)
+		return
+	}
+
+	follower := newLineFollower(path, file, info, offset)
+	defer follower.close()
+
+	responseBytes := []byte(RESPONSE_FOLLOWING_LINES.toString())
+	responseBytes = append(responseBytes, addHeader(path, GLOBAL_FOLLOW_HEADER, read)...)
+	if _, err := conn.Write(responseBytes); err != nil {
+		return
+	}
+
+	hungUp := make(chan struct{})
+	go waitForHangUp(conn, hungUp)
+
+	ticker := time.NewTicker(GLOBAL_FOLLOW_POLL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hungUp:
+			return
+		case <-ticker.C:
+			appended := follower.poll()
+			if len(appended) == 0 {
+				continue
+			}
+			if _, err := conn.Write(appended); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (pdr *protoDirState) resolveFileForLines(hashState, hashFile string) (string, responseCode) {
+	state := pdr.filterStatesAndReturn(hashState)
+	if state == nil {
+		return "", RESPONSE_NO_STATE
+	}
+
+	file := state.path.getFileByHash(hashFile)
+	if file == nil {
+		if state.path.getSubDirByHash(hashFile) != nil {
+			return "", RESPONSE_IS_NOT_FILE
+		}
+		return "", RESPONSE_NO_HASH
+	}
+
+	return filepath.Join(state.path.dirOf(file), file.path), RESPONSE_LINES_READ
+}
+
+func (lf *lineFollower) poll() []byte {
+	stat, err := os.Stat(lf.path)
+	if err != nil {
+		// The file may briefly be missing while it is being rotated.
+		return nil
+	}
+
+	appended := make([]byte, 0)
+
+	if !os.SameFile(stat, lf.info) {
+		appended = append(appended, lf.readAppended()...)
+		appended = append(appended, lf.flushPartial()...)
+
+		newFile, err := os.Open(lf.path)
+		if err != nil {
+			return appended
+		}
+
+		lf.file.Close()
+		lf.file, lf.info, lf.offset = newFile, stat, 0
+		appended = append(appended, followMarker(lf.path, GLOBAL_ROTATED_HEADER)...)
+	} else if stat.Size() < lf.offset {
+		lf.offset = 0
+		lf.partial = lf.partial[:0]
+		appended = append(appended, followMarker(lf.path, GLOBAL_TRUNCATED_HEADER)...)
+	}
+
+	return append(appended, lf.readAppended()...)
+}
+
+func (lf *lineFollower) readAppended() []byte {
+	var chunk [4096]byte
+
+	for {
+		n, err := lf.file.ReadAt(chunk[0:], lf.offset)
+		lf.partial = append(lf.partial, chunk[:n]...)
+		lf.offset += int64(n)
+		if err != nil || n == 0 {
+			break
+		}
+	}
+
+	lastNewline := bytes.LastIndexByte(lf.partial, '\n')
+	if lastNewline == -1 {
+		return nil
+	}
+
+	complete := append([]byte{}, lf.partial[:lastNewline+1]...)
+	lf.partial = append(lf.partial[:0], lf.partial[lastNewline+1:]...)
+
+	return complete
+}
+
+func (lf *lineFollower) flushPartial() []byte {
+	if len(lf.partial) == 0 {
+		return nil
+	}
+
+	rest := append([]byte{}, lf.partial...)
+	rest = append(rest, '\n')
+	lf.partial = lf.partial[:0]
+
+	return rest
+}
+
+func (lf *lineFollower) close() {
+	lf.file.Close()
+}
+
+func headLinesOfFile(path string, count int) ([]byte, successStatus) {
+	if count == 0 {
+		return []byte{}, STATUS_IS_READ
+	}
+
+	return rangeLinesOfFile(path, 1, count)
+}
+
+func rangeLinesOfFile(path string, from, to int) ([]byte, successStatus) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, STATUS_NOT_EXISTS
+	} else if err != nil {
+		return nil, STATUS_DID_FAIL
+	}
+	defer file.Close()
+
+	read := make([]byte, 0)
+	reader := bufio.NewReader(file)
+
+	for lineNum := 1; to == 0 || lineNum <= to; lineNum++ {
+		line, err := reader.ReadBytes('\n')
+		if lineNum >= from {
+			read = append(read, line...)
+			if exceedsReadLimit(int64(len(read))) {
+				return nil, STATUS_TOO_LARGE
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, STATUS_DID_FAIL
+		}
+	}
+
+	return read, STATUS_IS_READ
+}
+
+// tailLinesOfFile seeks backwards from the end of the file in chunks until it
+// has seen enough newlines, so only the tail of large files is ever read. It
+// also returns the offset of the end of the file for followers.
+func tailLinesOfFile(path string, count int) ([]byte, int64, successStatus) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, 0, STATUS_NOT_EXISTS
+	} else if err != nil {
+		return nil, 0, STATUS_DID_FAIL
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, STATUS_DID_FAIL
+	}
+
+	size := info.Size()
+	start, stat := findTailStart(file, size, count)
+	if stat != STATUS_IS_READ {
+		return nil, 0, stat
+	} else if exceedsReadLimit(size - start) {
+		return nil, 0, STATUS_TOO_LARGE
+	}
+
+	read := make([]byte, size-start)
+	if _, err := file.ReadAt(read, start); err != nil && err != io.EOF {
+		return nil, 0, STATUS_DID_FAIL
+	}
+
+	return read, size, STATUS_IS_READ
+}
+
+func findTailStart(file *os.File, size int64, count int) (int64, successStatus) {
+	if count == 0 {
+		return size, STATUS_IS_READ
+	}
+
+	found := 0
+	pos := size
+
+	for pos > 0 {
+		chunkSize := GLOBAL_TAIL_CHUNK
+		if pos < chunkSize {
+			chunkSize = pos
+		}
+		pos -= chunkSize
+
+		chunk := make([]byte, chunkSize)
+		if _, err := file.ReadAt(chunk, pos); err != nil && err != io.EOF {
+			return 0, STATUS_DID_FAIL
+		}
+
+		for i := len(chunk) - 1; i >= 0; i-- {
+			if chunk[i] != '\n' || pos+int64(i) == size-1 {
+				continue
+			}
+
+			found++
+			if found == count {
+				return pos + int64(i) + 1, STATUS_IS_READ
+			}
+		}
+	}
+
+	return 0, STATUS_IS_READ
+}
+
+func parseLineCount(fields []string, index int) (int, bool) {
+	if len(fields) <= index {
+		return GLOBAL_DEFAULT_LINES, true
+	}
+
+	count, err := strconv.ParseUint(fields[index], 10, 31)
+	if err != nil {
+		return 0, false
+	}
+
+	return int(count), true
+}
+
+func parseLineRange(fields []string) (int, int, bool) {
+	from, err := strconv.ParseUint(fields[2], 10, 31)
+	if err != nil || from == 0 {
+		return 0, 0, false
+	}
+
+	if len(fields) == 3 {
+		return int(from), 0, true
+	}
+
+	to, err := strconv.ParseUint(fields[3], 10, 31)
+	if err != nil || to < from {
+		return 0, 0, false
+	}
+
+	return int(from), int(to), true
+}
+
+func readFailureResponse(stat successStatus) ([]byte, responseCode) {
+	switch stat {
+	case STATUS_NOT_EXISTS:
+		return nil, RESPONSE_NO_EXIST
+	case STATUS_TOO_LARGE:
+		return limitExceeded(ERR_READ_TOO_LARGE, globalLimits.MaxReadBytes), RESPONSE_READ_TOO_LARGE
+	}
+
+	return nil, RESPONSE_READ_FAILED
+}
+
+func followMarker(path, header string) []byte {
+	return []byte(fmt.Sprintf("%s%s: %s;\n", GLOBAL_HEADER_PREFIX, header, path))
+}
+
+func waitForHangUp(conn net.Conn, hungUp chan struct{}) {
+	var discard [64]byte
+
+	for {
+		if _, err := conn.Read(discard[0:]); err != nil {
+			close(hungUp)
+			return
+		}
+	}
+}
+
+func writeResponse(conn net.Conn, body []byte, code responseCode) {
+	responseBytes := []byte(code.toString())
+	responseBytes = append(responseBytes, body...)
+	responseBytes = append(responseBytes, 10, 10)
+	conn.Write(responseBytes)
+}
@@ -0,0 +1,158 @@
+package protodir
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestState inits a state on a temp dir holding files, by name.
+func newTestState(t *testing.T, files map[string]string) (*protoDirState, string, string) {
+	t.Helper()
+
+	root := t.TempDir()
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pdr := &protoDirState{
+		states:    make([]*pathState, 0),
+		snapshots: make(map[string]map[string]dirSnapshot),
+	}
+	state, code := askDir(pdr, "INIT_STATE %s", root)
+	if code != RESPONSE_INIT_STATE_OK {
+		t.Fatalf("INIT_STATE: got %d %q", code, state)
+	}
+	if body, code := askDir(pdr, "CD_SUBDIR %s;%s", state, state); code != RESPONSE_CD_SUBDIR_OK {
+		t.Fatalf("CD_SUBDIR: got %d %q", code, body)
+	}
+
+	return pdr, state, root
+}
+
+// askDir sends a request with the protocol prefix and answers the body
+// without the blank line that ends it.
+func askDir(pdr *protoDirState, format string, args ...any) (string, responseCode) {
+	bResp, code := pdr.handleRequest([]byte("PTDP v1 " + fmt.Sprintf(format, args...)))
+
+	return strings.TrimSuffix(string(bResp), "\n\n"), code
+}
+
+// testFileHash is the hash of a file in the current dir of state.
+func testFileHash(t *testing.T, pdr *protoDirState, state, name string) string {
+	t.Helper()
+
+	for _, file := range pdr.filterStatesAndReturn(state).path.files {
+		if file.path == name {
+			return trimHash(file.hash)
+		}
+	}
+	t.Fatalf("no file %s in the state", name)
+
+	return ""
+}
+
+func TestTailLines(t *testing.T) {
+	var long strings.Builder
+	for i := 1; i <= 1000; i++ {
+		fmt.Fprintf(&long, "line %d\n", i)
+	}
+
+	pdr, state, root := newTestState(t, map[string]string{
+		"short.txt":   "a\nb\nc\n",
+		"long.txt":    long.String(),
+		"no_eol.txt":  "a\nb\nc",
+		"empty.txt":   "",
+		"one_eol.txt": "\n",
+	})
+
+	tests := []struct {
+		file  string
+		count string
+		want  string
+	}{
+		{"short.txt", "2", "b\nc\n"},
+		{"short.txt", "10", "a\nb\nc\n"},
+		{"short.txt", "0", ""},
+		{"long.txt", "3", "line 998\nline 999\nline 1000\n"},
+		{"long.txt", "600", long.String()[strings.Index(long.String(), "line 401\n"):]},
+		{"no_eol.txt", "1", "c"},
+		{"no_eol.txt", "2", "b\nc"},
+		{"empty.txt", "3", ""},
+		{"one_eol.txt", "1", "\n"},
+	}
+
+	for _, test := range tests {
+		body, code := askDir(pdr, "TAIL_LINES %s;%s;%s", state, testFileHash(t, pdr, state, test.file), test.count)
+		header := fmt.Sprintf("$TAIL_LINES: %s;\n", filepath.Join(root, test.file))
+		if code != RESPONSE_LINES_READ || !strings.HasPrefix(body, header) {
+			t.Errorf("%s;%s: got %d %q", test.file, test.count, code, body)
+		} else if got := strings.TrimPrefix(body, header); got != test.want {
+			t.Errorf("%s;%s: got %q, want %q", test.file, test.count, got, test.want)
+		}
+	}
+}
+
+// readFollowed reads from conn until what was read has want in it.
+func readFollowed(t *testing.T, conn net.Conn, read *bytes.Buffer, want string) {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var chunk [4096]byte
+	for !strings.Contains(read.String(), want) {
+		n, err := conn.Read(chunk[0:])
+		read.Write(chunk[:n])
+		if err != nil {
+			t.Fatalf("reading for %q: %v, read %q", want, err, read.String())
+		}
+	}
+}
+
+func TestTailFollowTruncated(t *testing.T) {
+	pdr, state, root := newTestState(t, map[string]string{"app.log": "one\ntwo\nthree\n"})
+	path := filepath.Join(root, "app.log")
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go pdr.handleStreamingRequest(server, []byte(fmt.Sprintf("PTDP v1 TAIL_FOLLOW %s;%s;2", state, testFileHash(t, pdr, state, "app.log"))))
+
+	var read bytes.Buffer
+	readFollowed(t, client, &read, "two\nthree\n")
+	if want := fmt.Sprintf("$TAIL_FOLLOW: %s;\ntwo\nthree\n", path); !strings.HasSuffix(read.String(), want) {
+		t.Fatalf("first response = %q, want it to end in %q", read.String(), want)
+	}
+
+	appendTo := func(contents string) {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.WriteString(contents)
+		file.Close()
+	}
+
+	read.Reset()
+	appendTo("four\nfi")
+	readFollowed(t, client, &read, "four\n")
+	appendTo("ve\n")
+	readFollowed(t, client, &read, "five\n")
+	if read.String() != "four\nfive\n" {
+		t.Errorf("appended = %q, want only the whole lines", read.String())
+	}
+
+	read.Reset()
+	if err := os.WriteFile(path, []byte("new\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	readFollowed(t, client, &read, "new\n")
+	if want := fmt.Sprintf("$TRUNCATED: %s;\nnew\n", path); read.String() != want {
+		t.Errorf("after truncating = %q, want %q", read.String(), want)
+	}
+}
@@ -0,0 +1,173 @@
+package protodir
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	GLOBAL_STATES_FILE      string = "protodir_states.json"
+	GLOBAL_STATES_FILE_TEMP string = ".protodir_states-*.tmp"
+	GLOBAL_STATES_VERSION   int    = 1
+)
+
+var (
+	globalStateDir = ""
+	persistLock    sync.Mutex
+)
+
+type persistedEntity struct {
+	Type  pathType `json:"type"`
+	Path  string   `json:"path"`
+	Hash  string   `json:"hash"`
+	Layer string   `json:"layer,omitempty"`
+}
+
+type persistedState struct {
+	Hash     string            `json:"hash"`
+	RootDir  string            `json:"root_dir"`
+	CurrDir  string            `json:"curr_dir"`
+	History  []string          `json:"history"`
+	Files    []persistedEntity `json:"files"`
+	Subdirs  []persistedEntity `json:"subdirs"`
+	Deadline time.Time         `json:"deadline"`
+	Layers   []string          `json:"layers,omitempty"`
+	LayerDir string            `json:"layer_dir,omitempty"`
+}
+
+type persistedStates struct {
+	Version int              `json:"version"`
+	States  []persistedState `json:"states"`
+}
+
+// persistStates writes all states to the state dir, if one is set. The file
+// is written next to the old one and renamed over it, so a crash never leaves
+// a half written file behind.
+func (pdr *protoDirState) persistStates() {
+	if globalStateDir == "" {
+		return
+	}
+
+	persistLock.Lock()
+	defer persistLock.Unlock()
+
+	pdr.Lock()
+	persisted := persistedStates{Version: GLOBAL_STATES_VERSION, States: make([]persistedState, 0, len(pdr.states))}
+	for _, state := range pdr.states {
+		if !state.isExpired() {
+			persisted.States = append(persisted.States, state.toPersisted())
+		}
+	}
+	pdr.Unlock()
+
+	encoded, err := json.MarshalIndent(persisted, "", "  ")
+	if err != nil {
+		handleError(err)
+		return
+	}
+
+	handleError(writeFileAtomically(filepath.Join(globalStateDir, GLOBAL_STATES_FILE), encoded))
+}
+
+func (pdr *protoDirState) loadPersistedStates() {
+	if globalStateDir == "" {
+		return
+	}
+
+	encoded, err := os.ReadFile(filepath.Join(globalStateDir, GLOBAL_STATES_FILE))
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		handleError(err)
+		return
+	}
+
+	var persisted persistedStates
+	if err := json.Unmarshal(encoded, &persisted); err != nil {
+		handleError(err)
+		return
+	}
+
+	pdr.Lock()
+	defer pdr.Unlock()
+
+	for _, state := range persisted.States {
+		restored := state.toPathState()
+		if !restored.isExpired() {
+			pdr.states = append(pdr.states, &restored)
+		}
+	}
+}
+
+func (ps pathState) toPersisted() persistedState {
+	return persistedState{
+		Hash:     ps.hash,
+		RootDir:  ps.path.rootDir,
+		CurrDir:  ps.path.currDir,
+		History:  ps.path.history,
+		Files:    entitiesToPersisted(ps.path.files),
+		Subdirs:  entitiesToPersisted(ps.path.subdirs),
+		Deadline: ps.deadline,
+		Layers:   ps.path.layers,
+		LayerDir: ps.path.layerDir,
+	}
+}
+
+func (ps persistedState) toPathState() pathState {
+	collective := newPathCollective(ps.RootDir)
+	collective.currDir = ps.CurrDir
+	collective.files = entitiesFromPersisted(ps.Files)
+	collective.subdirs = entitiesFromPersisted(ps.Subdirs)
+	collective.layers = ps.Layers
+	collective.layerDir = ps.LayerDir
+	if ps.History != nil {
+		collective.history = ps.History
+	}
+
+	return pathState{path: collective, hash: ps.Hash, deadline: ps.Deadline}
+}
+
+func entitiesToPersisted(entities []entityPath) []persistedEntity {
+	persisted := make([]persistedEntity, 0, len(entities))
+	for _, entity := range entities {
+		persisted = append(persisted, persistedEntity{Type: entity.ty, Path: entity.path, Hash: entity.hash, Layer: entity.layer})
+	}
+
+	return persisted
+}
+
+func entitiesFromPersisted(persisted []persistedEntity) []entityPath {
+	entities := make([]entityPath, 0, len(persisted))
+	for _, entity := range persisted {
+		entities = append(entities, entityPath{ty: entity.Type, path: entity.Path, hash: entity.Hash, layer: entity.Layer})
+	}
+
+	return entities
+}
+
+func writeFileAtomically(path string, contents []byte) error {
+	temp, err := os.CreateTemp(filepath.Dir(path), GLOBAL_STATES_FILE_TEMP)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(contents); err != nil {
+		temp.Close()
+		return err
+	}
+
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), path)
+}
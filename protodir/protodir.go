@@ -19,6 +19,7 @@ type requestCode int
 type responseCode int
 type successStatus int
 type bArr []byte
+type requestOptions map[string]string
 
 const (
 	GLOBAL_VERSION_CONTROL     string        = "v1"
@@ -31,6 +32,23 @@ const (
 	GLOBAL_STAT_HEADER         string        = "STAT_ENTITY"
 	GLOBAL_WALK_HEADER         string        = "WALK_TREE"
 	GLOBAL_READ_HEADER         string        = "READ_BYTES"
+	GLOBAL_HEAD_HEADER         string        = "HEAD_LINES"
+	GLOBAL_TAIL_HEADER         string        = "TAIL_LINES"
+	GLOBAL_LINES_HEADER        string        = "READ_LINES"
+	GLOBAL_FOLLOW_HEADER       string        = "TAIL_FOLLOW"
+	GLOBAL_TRUNCATED_HEADER    string        = "TRUNCATED"
+	GLOBAL_ROTATED_HEADER      string        = "ROTATED"
+	GLOBAL_VERSION_HEADER      string        = "VERSION"
+	GLOBAL_DUPES_HEADER        string        = "FIND_DUPES"
+	GLOBAL_PROGRESS_HEADER     string        = "PROGRESS"
+	GLOBAL_SNAPSHOT_HEADER     string        = "SNAPSHOT"
+	GLOBAL_DIFF_HEADER         string        = "DIFF"
+	GLOBAL_TREE_HEADER         string        = "TREE"
+	GLOBAL_SUMMARY_HEADER      string        = "SUMMARY"
+	GLOBAL_HISTORY_HEADER      string        = "HISTORY"
+	GLOBAL_ENCODING_HEADER     string        = "ENCODING"
+	GLOBAL_LIVE_SNAPSHOT       string        = "LIVE"
+	GLOBAL_OPTION_SEP          string        = "="
 	GLOBAL_TRIMMER             string        = " \n\r\x00"
 	GLOBAL_TUPLE_SEP           string        = ";"
 	COMM_INIT_STATE            string        = "INIT_STATE"
@@ -42,12 +60,44 @@ const (
 	COMM_LIST_SUBDIRS          string        = "LIST_SUBDIRS"
 	COMM_LIST_STATES           string        = "LIST_STATES"
 	COMM_WAL_TREE              string        = "WALK_TREE"
+	COMM_HEAD_LINES            string        = "HEAD_LINES"
+	COMM_TAIL_LINES            string        = "TAIL_LINES"
+	COMM_READ_LINES            string        = "READ_LINES"
+	COMM_TAIL_FOLLOW           string        = "TAIL_FOLLOW"
+	COMM_FIND_DUPES            string        = "FIND_DUPES"
+	COMM_SNAPSHOT              string        = "SNAPSHOT"
+	COMM_DIFF                  string        = "DIFF"
+	COMM_CACHE_STATS           string        = "CACHE_STATS"
+	COMM_TREE                  string        = "TREE"
+	COMM_SUMMARY               string        = "SUMMARY"
+	COMM_INIT_UNION            string        = "INIT_UNION"
+	COMM_HISTORY               string        = "HISTORY"
 	ERR_PARSE_COMM             string        = "ERROR_PARSE_COMM"
 	ERR_WRONG_COMM             string        = "ERROR_WRONG_COMM"
 	ERR_PARSE_HASH             string        = "ERROR_PARSE_PATH_OR_HASH"
 	ERR_PARSE_PNAME            string        = "ERROR_PARSE_PROTOCOL_NAME"
 	ERR_PARSE_PVER             string        = "ERROR_PARSE_VERSION_CONTROL"
 	ERR_TWO_HASH               string        = "ERROR_NEEDS_TWO_HASH"
+	ERR_LINE_ARGS              string        = "ERROR_PARSE_LINE_ARGUMENTS"
+	ERR_PARSE_OPTION           string        = "ERROR_PARSE_OPTION"
+	ERR_REQUEST_TOO_LARGE      string        = "ERROR_REQUEST_TOO_LARGE"
+	ERR_READ_TOO_LARGE         string        = "ERROR_READ_TOO_LARGE"
+	ERR_WALK_TOO_LARGE         string        = "ERROR_WALK_TOO_MANY_ENTRIES"
+	ERR_WALK_TOO_DEEP          string        = "ERROR_WALK_TOO_DEEP"
+	ERR_TOO_MANY_CONNS         string        = "ERROR_TOO_MANY_CONNECTIONS"
+	ERR_TIMED_OUT              string        = "ERROR_TIME_BUDGET_EXCEEDED"
+	ERR_SNAPSHOT_ARGS          string        = "ERROR_PARSE_SNAPSHOT_ARGUMENTS"
+	ERR_UNION_ARGS             string        = "ERROR_PARSE_UNION_ROOTS"
+	OPT_IF_NONE_MATCH          string        = "IF_NONE_MATCH"
+	OPT_IF_MODIFIED_SINCE      string        = "IF_MODIFIED_SINCE"
+	OPT_VERSION                string        = "VERSION"
+	OPT_PROGRESS               string        = "PROGRESS"
+	OPT_HASH                   string        = "HASH"
+	OPT_FORMAT                 string        = "FORMAT"
+	OPT_DEPTH                  string        = "DEPTH"
+	OPT_RECURSIVE              string        = "RECURSIVE"
+	OPT_ENCODING               string        = "ENCODING"
+	OPT_PRECEDENCE             string        = "PRECEDENCE"
 	GLOBAL_FILEPATH            pathType      = 31
 	GLOBAL_DIRPATH             pathType      = 32
 	ACT_INIT_STATE             requestCode   = 0
@@ -59,6 +109,18 @@ const (
 	ACT_LIST_FILES             requestCode   = 62
 	ACT_WALK_TREE              requestCode   = 72
 	ACT_LIST_STATE             requestCode   = 82
+	ACT_HEAD_LINES             requestCode   = 92
+	ACT_TAIL_LINES             requestCode   = 102
+	ACT_READ_LINES             requestCode   = 112
+	ACT_TAIL_FOLLOW            requestCode   = 122
+	ACT_FIND_DUPES             requestCode   = 132
+	ACT_SNAPSHOT               requestCode   = 142
+	ACT_DIFF                   requestCode   = 152
+	ACT_CACHE_STATS            requestCode   = 162
+	ACT_TREE                   requestCode   = 172
+	ACT_SUMMARY                requestCode   = 182
+	ACT_INIT_UNION             requestCode   = 192
+	ACT_HISTORY                requestCode   = 202
 	PARSE_ERROR_PNAME          requestCode   = 10
 	PARSE_ERROR_PVER           requestCode   = 11
 	PARSE_ERROR_COMM           requestCode   = 13
@@ -68,11 +130,22 @@ const (
 	RESPONSE_CD_SUBDIR_OK      responseCode  = 13
 	RESPONSE_READ_FILE_OK      responseCode  = 22
 	RESPONSE_STAT_ENTITY_OK    responseCode  = 23
+	RESPONSE_LINES_READ        responseCode  = 24
+	RESPONSE_FOLLOWING_LINES   responseCode  = 25
+	RESPONSE_NOT_MODIFIED      responseCode  = 26
 	RESPONSE_DIR_LISTED        responseCode  = 32
 	RESPONSE_FILES_LISTED      responseCode  = 33
 	RESPONSE_SUBDIRS_LISTED    responseCode  = 34
 	RESPONSE_DIR_WALKED        responseCode  = 42
+	RESPONSE_DUPES_FOUND       responseCode  = 43
+	RESPONSE_FINDING_DUPES     responseCode  = 44
+	RESPONSE_TREE_DRAWN        responseCode  = 45
+	RESPONSE_SUMMARIZED        responseCode  = 46
 	RESPONSE_LISTED_STATES     responseCode  = 52
+	RESPONSE_SNAPSHOT_TAKEN    responseCode  = 53
+	RESPONSE_SNAPSHOTS_DIFFED  responseCode  = 54
+	RESPONSE_CACHE_STATS       responseCode  = 55
+	RESPONSE_HISTORY_LISTED    responseCode  = 56
 	RESPONSE_PARSE_FAILED      responseCode  = 100
 	RESPONSE_NO_DIR            responseCode  = 110
 	RESPONSE_NO_HASH           responseCode  = 120
@@ -84,6 +157,15 @@ const (
 	RESPONSE_WRONG_COMM        responseCode  = 180
 	RESPONSE_IS_NOT_FILE       responseCode  = 190
 	RESPONSE_IS_NOT_DIR        responseCode  = 200
+	RESPONSE_BAD_ARGUMENTS     responseCode  = 210
+	RESPONSE_REQUEST_TOO_LARGE responseCode  = 220
+	RESPONSE_READ_TOO_LARGE    responseCode  = 230
+	RESPONSE_WALK_TOO_LARGE    responseCode  = 240
+	RESPONSE_WALK_TOO_DEEP     responseCode  = 250
+	RESPONSE_TOO_MANY_CONNS    responseCode  = 260
+	RESPONSE_TIMED_OUT         responseCode  = 270
+	RESPONSE_NO_SNAPSHOT       responseCode  = 280
+	RESPONSE_OUT_OF_JAIL       responseCode  = 290
 	STATUS_NOT_EXISTS          successStatus = 0
 	STATUS_NO_HASH             successStatus = 1
 	STATUS_EXISTS              successStatus = 3
@@ -97,6 +179,20 @@ const (
 	STATUS_DID_FAIL            successStatus = 11
 	STATUS_DID_SPLIT           successStatus = 12
 	STATUS_SPLIT_FAIL          successStatus = 13
+	STATUS_TOO_LARGE           successStatus = 14
+	STATUS_WALK_TOO_LARGE      successStatus = 15
+	STATUS_WALK_TOO_DEEP       successStatus = 16
+	STATUS_TIMED_OUT           successStatus = 17
+	STATUS_OUT_OF_JAIL         successStatus = 18
+	GLOBAL_MAX_FIELDS          int           = 8
+	GLOBAL_DEFAULT_LINES       int           = 10
+	GLOBAL_TAIL_CHUNK          int64         = 4096
+	GLOBAL_FOLLOW_POLL         time.Duration = time.Millisecond * 500
+	GLOBAL_DUPES_WORKERS       int           = 4
+	GLOBAL_DUPES_PARTIAL       int64         = 4096
+	GLOBAL_PROGRESS_EVERY      time.Duration = time.Millisecond * 250
+	GLOBAL_MAX_SNAPSHOTS       int           = 16
+	GLOBAL_MAX_HISTORY         int           = 100
 )
 
 var (
@@ -106,9 +202,10 @@ var (
 )
 
 type entityPath struct {
-	ty   pathType
-	path string
-	hash string
+	ty    pathType
+	path  string
+	hash  string
+	layer string
 }
 
 type walkedEntityPath struct {
@@ -118,20 +215,25 @@ type walkedEntityPath struct {
 }
 
 type pathCollective struct {
-	rootDir string
-	currDir string
-	files   []entityPath
-	subdirs []entityPath
+	rootDir  string
+	currDir  string
+	history  []string
+	files    []entityPath
+	subdirs  []entityPath
+	layers   []string
+	layerDir string
 }
 
 type pathState struct {
-	path pathCollective
-	hash string
+	path     pathCollective
+	hash     string
+	deadline time.Time
 }
 
 type protoDirState struct {
 	sync.Mutex
-	states []pathState
+	states    []*pathState
+	snapshots map[string]map[string]dirSnapshot
 }
 
 type requestParser struct {
@@ -141,24 +243,26 @@ type requestParser struct {
 	pathOrHash      bArr
 }
 
-func ProtoDirMain(sockPath string, globalTtlSet, globalCleareIntervalSet int) {
+func ProtoDirMain(sockPath string, globalTtlSet, globalCleareIntervalSet int, limitsSet ProtoDirLimits, stateDirSet, auditLogSet string) {
 	globalCleareInterval = globalCleareIntervalSet
 	globalTtl = globalTtlSet
+	globalLimits = limitsSet
+	globalStateDir = stateDirSet
 	socketPath = sockPath
-	state := initProtoDirState()
+	openAuditLog(auditLogSet)
+	server := NewServer()
 	listener, err := net.Listen("unix", sockPath)
 	handleError(err)
 
-	for {
-		conn, _ := listener.Accept()
-		go state.handleUDMConn(conn)
-	}
+	handleError(server.Serve(listener))
 }
 
 func initProtoDirState() *protoDirState {
 	state := protoDirState{
-		states: make([]pathState, 0),
+		states:    make([]*pathState, 0),
+		snapshots: make(map[string]map[string]dirSnapshot),
 	}
+	state.loadPersistedStates()
 	go state.loopAndWaitForClearNUll()
 
 	return &state
@@ -184,6 +288,7 @@ func newPathCollective(root string) pathCollective {
 	return pathCollective{
 		rootDir: root,
 		currDir: "UNSET",
+		history: make([]string, 0),
 		subdirs: make([]entityPath, 0),
 		files:   make([]entityPath, 0),
 	}
@@ -191,10 +296,10 @@ func newPathCollective(root string) pathCollective {
 
 func newPathState(root string) (pathState, string) {
 	pState := pathState{
-		path: newPathCollective(root),
-		hash: hashString(root),
+		path:     newPathCollective(root),
+		hash:     hashString(root),
+		deadline: time.Now().Add(time.Minute * time.Duration(globalTtl)),
 	}
-	go pState.waitForGC()
 
 	return pState, pState.hash
 }
@@ -249,6 +354,8 @@ func (pdr *protoDirState) handleRequest(bufferInput []byte) ([]byte, responseCod
 		bResp, code = pdr.handleRequestFailure(req)
 	} else if req == ACT_CD_SUBDIR || req == ACT_READ_BYTES || req == ACT_STAT_ENTITY {
 		bResp, code = pdr.handleDoubleHashRequest(req, pathOrHash)
+	} else if req == ACT_HEAD_LINES || req == ACT_TAIL_LINES || req == ACT_READ_LINES {
+		bResp, code = pdr.handleLinesRequest(req, pathOrHash)
 	} else {
 		bResp, code = pdr.handleSingleHashRequest(req, pathOrHash)
 	}
@@ -259,6 +366,27 @@ func (pdr *protoDirState) handleRequest(bufferInput []byte) ([]byte, responseCod
 	return bResp, code
 }
 
+func (pdr *protoDirState) handleStreamingRequest(conn net.Conn, bufferInput []byte) bool {
+	req, pathOrHash, success := parseRequest(bufferInput)
+	if !success {
+		return false
+	}
+
+	switch req {
+	case ACT_TAIL_FOLLOW:
+		pdr.handleRequestTailFollow(conn, pathOrHash)
+	case ACT_FIND_DUPES:
+		if !wantsProgress(pathOrHash) {
+			return false
+		}
+		pdr.handleRequestFindDupesWithProgress(conn, pathOrHash)
+	default:
+		return false
+	}
+
+	return true
+}
+
 func (*protoDirState) handleRequestFailure(req requestCode) ([]byte, responseCode) {
 	var bResp []byte
 	var code responseCode
@@ -277,21 +405,33 @@ func (*protoDirState) handleRequestFailure(req requestCode) ([]byte, responseCod
 }
 
 func (pdr *protoDirState) handleDoubleHashRequest(req requestCode, doubleHash string) ([]byte, responseCode) {
-	stateHash, entityHash, success := parsePathOrHashTuple(doubleHash)
+	if req == ACT_CD_SUBDIR {
+		stateHash, entityHash, success := parsePathOrHashTuple(doubleHash)
+		if success != STATUS_DID_SPLIT {
+			return []byte(ERR_TWO_HASH), RESPONSE_PARSE_FAILED
+		}
+
+		return []byte{}, pdr.handleRequestCDSubDir(stateHash, entityHash)
+	}
+
+	fields, success := parsePathOrHashFields(doubleHash, 2, GLOBAL_MAX_FIELDS)
 	if success != STATUS_DID_SPLIT {
 		return []byte(ERR_TWO_HASH), RESPONSE_PARSE_FAILED
 	}
 
+	stateHash, entityHash := fields[0], fields[1]
+	options, success := parseRequestOptions(fields[2:])
+	if success != STATUS_DID_SPLIT {
+		return []byte(ERR_PARSE_OPTION), RESPONSE_BAD_ARGUMENTS
+	}
+
 	var bResp []byte
 	var code responseCode
 
-	if req == ACT_CD_SUBDIR {
-		code = pdr.handleRequestCDSubDir(stateHash, entityHash)
-		bResp = []byte{}
-	} else if req == ACT_READ_BYTES {
-		bResp, code = pdr.handleRequestReadFile(stateHash, entityHash)
+	if req == ACT_READ_BYTES {
+		bResp, code = pdr.handleRequestReadFile(stateHash, entityHash, options)
 	} else if req == ACT_STAT_ENTITY {
-		bResp, code = pdr.handleRequestStat(stateHash, entityHash)
+		bResp, code = pdr.handleRequestStat(stateHash, entityHash, options)
 	}
 
 	return bResp, code
@@ -303,6 +443,8 @@ func (pdr *protoDirState) handleSingleHashRequest(req requestCode, pathOrHash st
 
 	if req == ACT_INIT_STATE {
 		bResp, code = pdr.handleRequestInit(pathOrHash)
+	} else if req == ACT_INIT_UNION {
+		bResp, code = pdr.handleRequestInitUnion(pathOrHash)
 	} else if req == ACT_LIST_DIR {
 		bResp, code = pdr.handleRequestWholeDir(pathOrHash)
 	} else if req == ACT_LIST_SUBDIRS {
@@ -313,6 +455,20 @@ func (pdr *protoDirState) handleSingleHashRequest(req requestCode, pathOrHash st
 		bResp, code = pdr.handleRequestWalkDir(pathOrHash)
 	} else if req == ACT_LIST_STATE {
 		bResp, code = pdr.handleRequestListStates()
+	} else if req == ACT_CACHE_STATS {
+		bResp, code = pdr.handleRequestCacheStats()
+	} else if req == ACT_TREE {
+		bResp, code = pdr.handleRequestTree(pathOrHash)
+	} else if req == ACT_SUMMARY {
+		bResp, code = pdr.handleRequestSummary(pathOrHash)
+	} else if req == ACT_FIND_DUPES {
+		bResp, code = pdr.handleRequestFindDupes(pathOrHash, nil)
+	} else if req == ACT_SNAPSHOT {
+		bResp, code = pdr.handleRequestSnapshot(pathOrHash)
+	} else if req == ACT_DIFF {
+		bResp, code = pdr.handleRequestDiff(pathOrHash)
+	} else if req == ACT_HISTORY {
+		bResp, code = pdr.handleRequestHistory(pathOrHash)
 	} else {
 		bResp, code = []byte(ERR_WRONG_COMM), RESPONSE_WRONG_COMM
 	}
@@ -320,20 +476,34 @@ func (pdr *protoDirState) handleSingleHashRequest(req requestCode, pathOrHash st
 	return bResp, code
 }
 
-func (pdr *protoDirState) handleUDMConn(conn net.Conn) {
+func (pdr *protoDirState) handleUDMConn(rawConn net.Conn) {
+	conn := newAuditedConn(rawConn)
 	defer conn.Close()
+	defer pdr.auditRequest(conn)
 
 	var readBuffer [500]byte
 	var inputBufffer []byte
 	for {
 		n, _ := conn.Read(readBuffer[0:])
 		inputBufffer = append(inputBufffer, readBuffer[0:n]...)
+		if globalLimits.MaxRequestBytes > 0 && len(inputBufffer) > globalLimits.MaxRequestBytes {
+			conn.request = inputBufffer
+			writeResponse(conn, limitExceeded(ERR_REQUEST_TOO_LARGE, int64(globalLimits.MaxRequestBytes)), RESPONSE_REQUEST_TOO_LARGE)
+			return
+		}
 		if n != 500 {
 			break
 		}
 	}
 
-	bytes, stat := pdr.handleRequest(inputBufffer)
+	conn.request = inputBufffer
+	pdr.resolveAuditTarget(conn)
+
+	if pdr.handleStreamingRequest(conn, inputBufffer) {
+		return
+	}
+
+	bytes, stat := pdr.handleRequestWithBudget(inputBufffer)
 
 	responseBytes := []byte(stat.toString())
 	responseBytes = append(responseBytes, bytes...)
@@ -341,37 +511,74 @@ func (pdr *protoDirState) handleUDMConn(conn net.Conn) {
 }
 
 func (pdr *protoDirState) addNewState(rootDir string) string {
-	defer pdr.Unlock()
 	pdr.Lock()
-
 	newState, hashState := newPathState(rootDir)
-	pdr.states = append(pdr.states, newState)
+	pdr.states = append(pdr.states, &newState)
+	pdr.Unlock()
+
+	pdr.persistStates()
 
 	return hashState
 }
 
 func (pdr *protoDirState) cleanNull() {
-	var rest []pathState
+	pdr.Lock()
+	alive := make([]*pathState, 0, len(pdr.states))
+	aliveHashes := make(map[string]bool)
+	for _, reader := range pdr.states {
+		if reader.hash != GLOBAL_DESTROY_READER && !reader.isExpired() {
+			alive = append(alive, reader)
+			aliveHashes[reader.getHashTrimmed()] = true
+		}
+	}
+	removed := len(alive) != len(pdr.states)
+	pdr.states = alive
 
-	for i, reader := range pdr.states {
-		if reader.hash == GLOBAL_DESTROY_READER {
-			rest = pdr.states[i+1:]
-			pdr.states = pdr.states[:i]
-			pdr.states = append(pdr.states, rest...)
+	for hash := range pdr.snapshots {
+		if !aliveHashes[hash] {
+			delete(pdr.snapshots, hash)
 		}
 	}
+	pdr.Unlock()
+
+	if removed {
+		pdr.persistStates()
+	}
 }
 
 func (pdr *protoDirState) filterStatesAndReturn(hash string) *pathState {
-	for i, state := range pdr.states {
+	pdr.Lock()
+	defer pdr.Unlock()
+
+	for _, state := range pdr.states {
 		if state.matchHash(hash) {
-			return &pdr.states[i]
+			return state
 		}
 	}
 
 	return nil
 }
 
+// dropState removes a state right away instead of waiting for it to expire,
+// along with its snapshots.
+func (pdr *protoDirState) dropState(hash string) {
+	pdr.Lock()
+	kept := make([]*pathState, 0, len(pdr.states))
+	for _, state := range pdr.states {
+		if state.getHashTrimmed() != hash {
+			kept = append(kept, state)
+		}
+	}
+	removed := len(kept) != len(pdr.states)
+	pdr.states = kept
+	delete(pdr.snapshots, hash)
+	pdr.Unlock()
+
+	if removed {
+		pdr.persistStates()
+	}
+}
+
 func (pdr *protoDirState) loopAndWaitForClearNUll() {
 	for {
 		time.Sleep(time.Hour * time.Duration(globalCleareInterval))
@@ -401,6 +608,8 @@ func (pdr *protoDirState) handleRequestCDSubDir(hashState, hashDir string) respo
 		return RESPONSE_NO_HASH
 	}
 
+	pdr.persistStates()
+
 	return RESPONSE_CD_SUBDIR_OK
 }
 
@@ -420,12 +629,29 @@ func (pdr *protoDirState) handleRequestListStates() ([]byte, responseCode) {
 	return []byte(listStates), RESPONSE_LISTED_STATES
 }
 
+// HISTORY <state>
+//
+// The dirs the state has been to, oldest first, the last one being the
+// current dir.
+func (pdr *protoDirState) handleRequestHistory(hashState string) ([]byte, responseCode) {
+	state := pdr.filterStatesAndReturn(hashState)
+	if state == nil {
+		return nil, RESPONSE_NO_STATE
+	}
+
+	return addHeader(state.path.currDir, GLOBAL_HISTORY_HEADER, []byte(state.path.historyToString())), RESPONSE_HISTORY_LISTED
+}
+
 func (pdr *protoDirState) handleRequestListSubDirs(hashState string) ([]byte, responseCode) {
 	state := pdr.filterStatesAndReturn(hashState)
 	if state == nil {
 		return nil, RESPONSE_NO_STATE
 	}
 
+	if state.path.refreshFilesAndSubDirs() {
+		pdr.persistStates()
+	}
+
 	res := state.path.dirsToString()
 
 	return addHeader(state.path.currDir, GLOBAL_LIST_SUBDIRS_HEADER, []byte(res)), RESPONSE_SUBDIRS_LISTED
@@ -437,6 +663,10 @@ func (pdr *protoDirState) handleRequestListFiles(hashState string) ([]byte, resp
 		return nil, RESPONSE_NO_STATE
 	}
 
+	if state.path.refreshFilesAndSubDirs() {
+		pdr.persistStates()
+	}
+
 	res := state.path.filesToSting()
 
 	return addHeader(state.path.currDir, GLOBAL_LIST_FILES_HEADER, []byte(res)), RESPONSE_FILES_LISTED
@@ -448,55 +678,114 @@ func (pdr *protoDirState) handleRequestWholeDir(hashState string) ([]byte, respo
 		return nil, RESPONSE_NO_STATE
 	}
 
+	if state.path.refreshFilesAndSubDirs() {
+		pdr.persistStates()
+	}
+
 	res := state.path.dirsAndFilesToString()
 
 	return addHeader(state.path.currDir, GLOBAL_LIST_DIR_HEADER, []byte(res)), RESPONSE_DIR_LISTED
 }
 
-func (pdr *protoDirState) handleRequestWalkDir(hashState string) ([]byte, responseCode) {
-	state := pdr.filterStatesAndReturn(hashState)
+// WALK_TREE <state>[;ENCODING=...]
+func (pdr *protoDirState) handleRequestWalkDir(pathOrHash string) ([]byte, responseCode) {
+	fields, success := parsePathOrHashFields(pathOrHash, 1, GLOBAL_MAX_FIELDS)
+	if success != STATUS_DID_SPLIT {
+		return []byte(ERR_PARSE_HASH), RESPONSE_PARSE_FAILED
+	}
+
+	options, success := parseRequestOptions(fields[1:])
+	if success != STATUS_DID_SPLIT {
+		return []byte(ERR_PARSE_OPTION), RESPONSE_BAD_ARGUMENTS
+	}
+
+	encoding, ok := options.negotiateEncoding()
+	if !ok {
+		return []byte(ERR_PARSE_OPTION), RESPONSE_BAD_ARGUMENTS
+	}
+
+	state := pdr.filterStatesAndReturn(fields[0])
 	if state == nil {
 		return nil, RESPONSE_NO_STATE
 	}
 
 	walked, stat := state.path.walkDirAndToBytes()
-	if stat == STATUS_ISNOTDIR {
-		return nil, RESPONSE_IS_NOT_DIR
-	} else if stat == STATUS_NOT_EXISTS {
-		return nil, RESPONSE_NO_EXIST
-	} else if stat == STATUS_WALK_FAIL {
+	if stat != STATUS_WALK_SUCCESS {
+		return walkFailureResponse(stat)
+	}
+
+	encoded, ok := addEncodingHeader(encoding, walked)
+	if !ok {
 		return nil, RESPONSE_WALK_FAILED
 	}
 
-	return addHeader(state.path.currDir, GLOBAL_WALK_HEADER, walked), RESPONSE_DIR_WALKED
+	return addHeader(state.path.currDir, GLOBAL_WALK_HEADER, encoded), RESPONSE_DIR_WALKED
 }
 
-func (pdr *protoDirState) handleRequestReadFile(hashState, hashFile string) ([]byte, responseCode) {
+func (pdr *protoDirState) handleRequestReadFile(hashState, hashFile string, options requestOptions) ([]byte, responseCode) {
 	state := pdr.filterStatesAndReturn(hashState)
 	if state == nil {
 		return nil, RESPONSE_NO_STATE
 	}
 
+	cond, ok := options.toReadCondition()
+	if !ok {
+		return []byte(ERR_PARSE_OPTION), RESPONSE_BAD_ARGUMENTS
+	}
+
+	encoding, ok := options.negotiateEncoding()
+	if !ok {
+		return []byte(ERR_PARSE_OPTION), RESPONSE_BAD_ARGUMENTS
+	}
+
+	// The content version is taken from the bytes read below, so it cannot
+	// describe different bytes than the ones sent.
+	version, path, versionStat := state.path.filterAndVersionFile(hashFile)
+	if versionStat == STATUS_DID_STAT && !cond.byContent && !cond.isModified(version) {
+		return addHeader(path, GLOBAL_READ_HEADER, addVersionHeader(version, nil)), RESPONSE_NOT_MODIFIED
+	} else if versionStat != STATUS_DID_STAT {
+		version = entityVersion{}
+	}
+
 	read, path, stat := state.path.filterAndReadFile(hashFile)
 
 	if stat == STATUS_ISNOTFILE {
 		return nil, RESPONSE_IS_NOT_FILE
+	} else if stat == STATUS_TOO_LARGE {
+		return limitExceeded(ERR_READ_TOO_LARGE, globalLimits.MaxReadBytes), RESPONSE_READ_TOO_LARGE
 	} else if stat == STATUS_NOT_EXISTS {
 		return nil, RESPONSE_NO_EXIST
 	} else if stat == STATUS_NO_HASH {
 		return nil, RESPONSE_NO_HASH
 	}
 
-	return addHeader(path, GLOBAL_READ_HEADER, read), RESPONSE_READ_FILE_OK
+	if cond.byContent {
+		version.token = contentVersionOf(read)
+		if versionStat == STATUS_DID_STAT && !cond.isModified(version) {
+			return addHeader(path, GLOBAL_READ_HEADER, addVersionHeader(version, nil)), RESPONSE_NOT_MODIFIED
+		}
+	}
+
+	encoded, ok := addEncodingHeader(encoding, read)
+	if !ok {
+		return nil, RESPONSE_READ_FAILED
+	}
+
+	return addHeader(path, GLOBAL_READ_HEADER, addVersionHeader(version, encoded)), RESPONSE_READ_FILE_OK
 }
 
-func (pdr *protoDirState) handleRequestStat(hashState, hashEntity string) ([]byte, responseCode) {
+func (pdr *protoDirState) handleRequestStat(hashState, hashEntity string, options requestOptions) ([]byte, responseCode) {
 	state := pdr.filterStatesAndReturn(hashState)
 	if state == nil {
 		return nil, RESPONSE_NO_STATE
 	}
 
-	entityStat, path, stat := state.path.filterAndStatEntity(hashEntity)
+	byContent, ok := options.versionByContent()
+	if !ok {
+		return []byte(ERR_PARSE_OPTION), RESPONSE_BAD_ARGUMENTS
+	}
+
+	entityStat, path, stat := state.path.filterAndStatEntity(hashEntity, byContent)
 
 	if stat == STATUS_NOT_EXISTS {
 		return nil, RESPONSE_NO_EXIST
@@ -513,6 +802,13 @@ func (ep entityPath) readFile(rootDir string) ([]byte, string, successStatus) {
 	}
 
 	path := filepath.Join(rootDir, ep.path)
+	stat, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, "", STATUS_NOT_EXISTS
+	} else if err == nil && exceedsReadLimit(stat.Size()) {
+		return nil, path, STATUS_TOO_LARGE
+	}
+
 	contents, err := os.ReadFile(path)
 	if os.IsNotExist(err) {
 		return nil, "", STATUS_NOT_EXISTS
@@ -521,19 +817,22 @@ func (ep entityPath) readFile(rootDir string) ([]byte, string, successStatus) {
 	return contents, path, STATUS_IS_READ
 }
 
-func (ep entityPath) statEntity(rootDir string) ([]byte, string, successStatus) {
+func (ep entityPath) statEntity(rootDir string, byContent bool) ([]byte, string, successStatus) {
 	path := filepath.Join(rootDir, ep.path)
 	stat, err := os.Stat(path)
 	if os.IsNotExist(err) {
 		return nil, "", STATUS_NOT_EXISTS
 	}
 
+	version := versionOfEntity(path, stat, byContent).token
+
 	statString := fmt.Sprintf(`IsDir: %t;
 ModTime: %s;
 Mode: %s;
 Name: %s;
 Size: %d;
-	`, stat.IsDir(), stat.ModTime(), stat.Mode().String(), stat.Name(), stat.Size())
+Version: %s;%s
+	`, stat.IsDir(), stat.ModTime(), stat.Mode().String(), stat.Name(), stat.Size(), version, rootLine(&ep))
 
 	return []byte(statString), path, STATUS_DID_STAT
 }
@@ -590,6 +889,20 @@ func (ep pathCollective) dirsToString() string {
 	return finStr
 }
 
+func (ep pathCollective) historyToString() string {
+	finStr := ""
+
+	for _, dir := range ep.history {
+		finStr += "\n" + dir
+	}
+
+	if len(finStr) == 0 {
+		finStr = "NO_HISTORY"
+	}
+
+	return finStr
+}
+
 func (ep pathCollective) dirsAndFilesToString() string {
 	fileStr := ""
 	dirsStr := ""
@@ -638,10 +951,14 @@ func (p *pathCollective) cdToSubDir(subdirHash string) successStatus {
 	if subDir == nil {
 		return STATUS_NO_HASH
 	}
-	joinedPath := filepath.Join(p.rootDir, subDir.path)
+	if p.isUnion() {
+		return p.cdToUnionDir(filepath.Join(p.layerDir, subDir.path))
+	}
+
+	joinedPath := filepath.Join(p.currDir, subDir.path)
 	stat := checkStatIsDirAndExists(joinedPath)
 
-	if stat != STATUS_EXISTS {
+	if stat == STATUS_EXISTS {
 		p.currDir = joinedPath
 		return STATUS_DID_CD
 	}
@@ -650,6 +967,10 @@ func (p *pathCollective) cdToSubDir(subdirHash string) successStatus {
 }
 
 func (p *pathCollective) cdToRoot() successStatus {
+	if p.isUnion() {
+		return p.cdToUnionDir(".")
+	}
+
 	stat := checkStatIsDirAndExists(p.rootDir)
 	if stat == STATUS_EXISTS {
 		p.currDir = p.rootDir
@@ -659,6 +980,10 @@ func (p *pathCollective) cdToRoot() successStatus {
 }
 
 func (p *pathCollective) setFilesAndSubDirs() successStatus {
+	if p.isUnion() {
+		return p.setUnionFilesAndSubDirs()
+	}
+
 	newSubDirs, newFiles, result := getFilesAndSubdirsInAFolder(p.currDir)
 
 	if result != STATUS_IS_READ {
@@ -675,11 +1000,17 @@ func (p *pathCollective) filterAndReadFile(hash string) ([]byte, string, success
 		return nil, "", STATUS_NO_HASH
 	}
 
-	return filePath.readFile(p.currDir)
+	return filePath.readFile(p.dirOf(filePath))
 }
 
 func (p pathCollective) walkDirAndToBytes() ([]byte, successStatus) {
-	walked, stat := walkDir(p.currDir)
+	var walked []walkedEntityPath
+	var stat successStatus
+	if p.isUnion() {
+		walked, stat = walkUnionDir(p.currentDirs())
+	} else {
+		walked, stat = walkDir(p.currDir)
+	}
 	if stat != STATUS_WALK_SUCCESS {
 		return nil, stat
 	}
@@ -689,7 +1020,7 @@ func (p pathCollective) walkDirAndToBytes() ([]byte, successStatus) {
 	return []byte(str), STATUS_WALK_SUCCESS
 }
 
-func (p pathCollective) filterAndStatEntity(hash string) ([]byte, string, successStatus) {
+func (p pathCollective) filterAndStatEntity(hash string, byContent bool) ([]byte, string, successStatus) {
 	entity := p.getFileByHash(hash)
 	if entity == nil {
 		entity = p.getSubDirByHash(hash)
@@ -698,7 +1029,7 @@ func (p pathCollective) filterAndStatEntity(hash string) ([]byte, string, succes
 		return nil, "", STATUS_NO_HASH
 	}
 
-	fileOrDirState, path, stat := entity.statEntity(p.currDir)
+	fileOrDirState, path, stat := entity.statEntity(p.dirOf(entity), byContent)
 
 	if stat != STATUS_DID_STAT {
 		return nil, "", stat
@@ -720,21 +1051,21 @@ func (ps *pathState) cdAndSetFilesAndSubdirs(hash string) successStatus {
 		return stat
 	}
 
+	ps.path.history = append(ps.path.history, ps.path.currDir)
+	if len(ps.path.history) > GLOBAL_MAX_HISTORY {
+		ps.path.history = ps.path.history[len(ps.path.history)-GLOBAL_MAX_HISTORY:]
+	}
 	stat = ps.path.setFilesAndSubDirs()
 
 	return stat
 }
 
-func (ps *pathState) setForGC() {
-	ps.hash = GLOBAL_DESTROY_READER
+func (ps *pathState) isExpired() bool {
+	return time.Now().After(ps.deadline)
 }
 
-func (ps *pathState) waitForGC() {
-	time.Sleep(time.Minute * time.Duration(globalTtl))
-	ps.setForGC()
-}
 func (ps *pathState) matchHash(hash string) bool {
-	return trimHash(ps.hash) == hash
+	return trimHash(ps.hash) == hash && !ps.isExpired()
 }
 
 func (ps *pathState) getHashTrimmed() string {
@@ -749,18 +1080,16 @@ func getFilesAndSubdirsInAFolder(path string) ([]entityPath, []entityPath, succe
 	var subdirs []entityPath
 	var files []entityPath
 
-	statusAndExistance := checkStatIsDirAndExists(path)
+	listing, statusAndExistance := globalDirCache.listDir(path)
 	if statusAndExistance != STATUS_EXISTS {
 		return nil, nil, statusAndExistance
 	}
 
-	entries, _ := os.ReadDir(path)
-	for _, entry := range entries {
-		if entry.IsDir() {
-			subdirs = append(subdirs, newEntityPath(entry.Name()))
-		} else {
-			files = append(files, newFilePath(entry.Name()))
-		}
+	for _, name := range listing.subdirs {
+		subdirs = append(subdirs, newEntityPath(name))
+	}
+	for _, name := range listing.files {
+		files = append(files, newFilePath(name))
 	}
 
 	return subdirs, files, STATUS_IS_READ
@@ -774,7 +1103,16 @@ func walkDir(path string) ([]walkedEntityPath, successStatus) {
 		return nil, statIsDir
 	}
 
+	budget := newWalkBudget(path)
 	err := filepath.Walk(path, func(path string, f os.FileInfo, err error) error {
+		if f == nil {
+			return err
+		}
+
+		if err := budget.visit(path); err != nil {
+			return err
+		}
+
 		if f.IsDir() {
 			results = append(results, newWalkedEntityPath(GLOBAL_DIRPATH, f.Name(), f.Size()))
 		} else {
@@ -784,7 +1122,9 @@ func walkDir(path string) ([]walkedEntityPath, successStatus) {
 		return nil
 	})
 
-	if err != nil {
+	if budget.stat != STATUS_WALK_SUCCESS {
+		return nil, budget.stat
+	} else if err != nil {
 		return nil, STATUS_WALK_FAIL
 	}
 
@@ -866,7 +1206,7 @@ func parseRequest(buffer []byte) (requestCode, string, bool) {
 		return PARSE_ERROR_PVER, "", false
 	}
 
-	if !strings.Contains(command, COMM_LIST_STATES) {
+	if !strings.Contains(command, COMM_LIST_STATES) && !strings.Contains(command, COMM_CACHE_STATS) {
 		if len(pathOrHash) < 2 {
 			return PARSE_ERROR_PATH, "", false
 		}
@@ -874,6 +1214,8 @@ func parseRequest(buffer []byte) (requestCode, string, bool) {
 
 	if strings.Contains(command, COMM_INIT_STATE) {
 		return ACT_INIT_STATE, pathOrHash, true
+	} else if strings.Contains(command, COMM_INIT_UNION) {
+		return ACT_INIT_UNION, pathOrHash, true
 	} else if strings.Contains(command, COMM_CD_SD) {
 		return ACT_CD_SUBDIR, pathOrHash, true
 	} else if strings.Contains(command, COMM_READ_BYTES) {
@@ -888,8 +1230,30 @@ func parseRequest(buffer []byte) (requestCode, string, bool) {
 		return ACT_LIST_SUBDIRS, pathOrHash, true
 	} else if strings.Contains(command, COMM_WAL_TREE) {
 		return ACT_WALK_TREE, pathOrHash, true
+	} else if strings.Contains(command, COMM_TREE) {
+		return ACT_TREE, pathOrHash, true
+	} else if strings.Contains(command, COMM_SUMMARY) {
+		return ACT_SUMMARY, pathOrHash, true
 	} else if strings.Contains(command, COMM_LIST_STATES) {
 		return ACT_LIST_STATE, pathOrHash, true
+	} else if strings.Contains(command, COMM_CACHE_STATS) {
+		return ACT_CACHE_STATS, pathOrHash, true
+	} else if strings.Contains(command, COMM_HEAD_LINES) {
+		return ACT_HEAD_LINES, pathOrHash, true
+	} else if strings.Contains(command, COMM_TAIL_LINES) {
+		return ACT_TAIL_LINES, pathOrHash, true
+	} else if strings.Contains(command, COMM_READ_LINES) {
+		return ACT_READ_LINES, pathOrHash, true
+	} else if strings.Contains(command, COMM_TAIL_FOLLOW) {
+		return ACT_TAIL_FOLLOW, pathOrHash, true
+	} else if strings.Contains(command, COMM_FIND_DUPES) {
+		return ACT_FIND_DUPES, pathOrHash, true
+	} else if strings.Contains(command, COMM_SNAPSHOT) {
+		return ACT_SNAPSHOT, pathOrHash, true
+	} else if strings.Contains(command, COMM_DIFF) {
+		return ACT_DIFF, pathOrHash, true
+	} else if strings.Contains(command, COMM_HISTORY) {
+		return ACT_HISTORY, pathOrHash, true
 	} else {
 		return PARSE_ERROR_COMM, pathOrHash, true
 	}
@@ -915,7 +1279,37 @@ func parsePathOrHashTuple(pOrH string) (string, string, successStatus) {
 	return split[0], split[1], STATUS_DID_SPLIT
 }
 
+func parsePathOrHashFields(pOrH string, minFields, maxFields int) ([]string, successStatus) {
+	trimmed := strings.Trim(pOrH, GLOBAL_TRIMMER)
+	split := strings.Split(trimmed, GLOBAL_TUPLE_SEP)
+
+	if len(split) < minFields || len(split) > maxFields {
+		return nil, STATUS_SPLIT_FAIL
+	}
+
+	return split, STATUS_DID_SPLIT
+}
+
+func parseRequestOptions(fields []string) (requestOptions, successStatus) {
+	options := make(requestOptions)
+
+	for _, field := range fields {
+		key, value, found := strings.Cut(field, GLOBAL_OPTION_SEP)
+		if !found || len(key) == 0 {
+			return nil, STATUS_SPLIT_FAIL
+		}
+
+		options[strings.ToUpper(key)] = value
+	}
+
+	return options, STATUS_DID_SPLIT
+}
+
 func (r responseCode) toString() string {
+	return fmt.Sprintf("%d - %s\n\n", r, r.text())
+}
+
+func (r responseCode) text() string {
 	respText := ""
 
 	switch r {
@@ -957,9 +1351,51 @@ func (r responseCode) toString() string {
 		respText = "BYTES_READ"
 	case RESPONSE_IS_NOT_DIR:
 		respText = "IS_NOT_DIR"
-	}
-
-	return fmt.Sprintf("%d - %s\n\n", r, respText)
+	case RESPONSE_IS_NOT_FILE:
+		respText = "IS_NOT_FILE"
+	case RESPONSE_LINES_READ:
+		respText = "LINES_READ"
+	case RESPONSE_FOLLOWING_LINES:
+		respText = "FOLLOWING_LINES"
+	case RESPONSE_BAD_ARGUMENTS:
+		respText = "BAD_ARGUMENTS"
+	case RESPONSE_NOT_MODIFIED:
+		respText = "NOT_MODIFIED"
+	case RESPONSE_REQUEST_TOO_LARGE:
+		respText = "REQUEST_TOO_LARGE"
+	case RESPONSE_READ_TOO_LARGE:
+		respText = "READ_TOO_LARGE"
+	case RESPONSE_WALK_TOO_LARGE:
+		respText = "WALK_TOO_MANY_ENTRIES"
+	case RESPONSE_WALK_TOO_DEEP:
+		respText = "WALK_TOO_DEEP"
+	case RESPONSE_TOO_MANY_CONNS:
+		respText = "TOO_MANY_CONNECTIONS"
+	case RESPONSE_TIMED_OUT:
+		respText = "TIME_BUDGET_EXCEEDED"
+	case RESPONSE_SNAPSHOT_TAKEN:
+		respText = "SNAPSHOT_TAKEN"
+	case RESPONSE_SNAPSHOTS_DIFFED:
+		respText = "SNAPSHOTS_DIFFED"
+	case RESPONSE_CACHE_STATS:
+		respText = "CACHE_STATS_LISTED"
+	case RESPONSE_HISTORY_LISTED:
+		respText = "HISTORY_LISTED"
+	case RESPONSE_TREE_DRAWN:
+		respText = "TREE_DRAWN"
+	case RESPONSE_SUMMARIZED:
+		respText = "SUMMARIZED"
+	case RESPONSE_NO_SNAPSHOT:
+		respText = "NO_SNAPSHOT"
+	case RESPONSE_OUT_OF_JAIL:
+		respText = "OUT_OF_JAIL"
+	case RESPONSE_DUPES_FOUND:
+		respText = "DUPES_FOUND"
+	case RESPONSE_FINDING_DUPES:
+		respText = "FINDING_DUPES"
+	}
+
+	return respText
 }
 
 func CleanUpProtoDir() {
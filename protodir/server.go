@@ -0,0 +1,37 @@
+package protodir
+
+import "net"
+
+// Server answers PTDP requests on the connections it is given. ProtoDirMain
+// runs one on its unix socket, and it can just as well be handed one end of a
+// net.Pipe to run ProtoDir in process.
+type Server struct {
+	state *protoDirState
+	slots connSlots
+}
+
+func NewServer() *Server {
+	return &Server{state: initProtoDirState(), slots: newConnSlots()}
+}
+
+func (s *Server) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn answers the one request sent on conn and closes it.
+func (s *Server) ServeConn(conn net.Conn) {
+	if !s.slots.acquire() {
+		s.state.refuseConn(conn)
+		return
+	}
+	defer s.slots.release()
+
+	s.state.handleUDMConn(conn)
+}
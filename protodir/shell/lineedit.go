@@ -0,0 +1,330 @@
+package shell
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	KEY_CTRL_A    byte = 1
+	KEY_CTRL_C    byte = 3
+	KEY_CTRL_D    byte = 4
+	KEY_CTRL_E    byte = 5
+	KEY_BACKSPACE byte = 8
+	KEY_TAB       byte = 9
+	KEY_NEWLINE   byte = 10
+	KEY_ENTER     byte = 13
+	KEY_CTRL_U    byte = 21
+	KEY_ESCAPE    byte = 27
+	KEY_DELETE    byte = 127
+)
+
+// completer gets the line up to the cursor and returns where the word being
+// completed starts, along with every word it could be completed to.
+type completer func(line string) (int, []string)
+
+type lineEditor struct {
+	in       *os.File
+	out      io.Writer
+	reader   *bufio.Reader
+	history  []string
+	histPath string
+	complete completer
+	raw      bool
+}
+
+type editBuffer struct {
+	prompt  string
+	line    []rune
+	cursor  int
+	tabbed  bool
+	histPos int
+	pending []rune
+}
+
+func newLineEditor(in *os.File, out io.Writer, histPath string, complete completer) *lineEditor {
+	editor := lineEditor{
+		in:       in,
+		out:      out,
+		reader:   bufio.NewReader(in),
+		history:  make([]string, 0),
+		histPath: histPath,
+		complete: complete,
+	}
+
+	if state, err := makeRaw(in.Fd()); err == nil {
+		restoreTerminal(in.Fd(), state)
+		editor.raw = true
+	}
+
+	editor.loadHistory()
+
+	return &editor
+}
+
+// readLine returns io.EOF once input ends or Ctrl+D is pressed on an empty
+// line. The terminal is only in raw mode while a line is being read, so
+// commands print as usual.
+func (le *lineEditor) readLine(prompt string) (string, error) {
+	if !le.raw {
+		return le.readCookedLine(prompt)
+	}
+
+	state, err := makeRaw(le.in.Fd())
+	if err != nil {
+		return le.readCookedLine(prompt)
+	}
+	defer restoreTerminal(le.in.Fd(), state)
+
+	buf := editBuffer{prompt: prompt, line: make([]rune, 0), histPos: len(le.history)}
+	le.redraw(&buf)
+
+	for {
+		r, _, err := le.reader.ReadRune()
+		if err != nil {
+			return "", err
+		}
+
+		if r != rune(KEY_TAB) {
+			buf.tabbed = false
+		}
+
+		switch r {
+		case rune(KEY_ENTER), rune(KEY_NEWLINE):
+			fmt.Fprint(le.out, "\n")
+			line := string(buf.line)
+			le.addHistory(line)
+			return line, nil
+		case rune(KEY_CTRL_C):
+			fmt.Fprint(le.out, "^C\n")
+			return "", nil
+		case rune(KEY_CTRL_D):
+			if len(buf.line) == 0 {
+				fmt.Fprint(le.out, "\n")
+				return "", io.EOF
+			}
+			buf.deleteForward()
+		case rune(KEY_DELETE), rune(KEY_BACKSPACE):
+			buf.deleteBackward()
+		case rune(KEY_CTRL_A):
+			buf.cursor = 0
+		case rune(KEY_CTRL_E):
+			buf.cursor = len(buf.line)
+		case rune(KEY_CTRL_U):
+			buf.line, buf.cursor = buf.line[buf.cursor:], 0
+		case rune(KEY_TAB):
+			le.completeLine(&buf)
+		case rune(KEY_ESCAPE):
+			le.handleEscape(&buf)
+		default:
+			if r >= 32 {
+				buf.insert(r)
+			}
+		}
+
+		le.redraw(&buf)
+	}
+}
+
+func (le *lineEditor) readCookedLine(prompt string) (string, error) {
+	fmt.Fprint(le.out, prompt)
+
+	line, err := le.reader.ReadString('\n')
+	if err != nil && len(line) == 0 {
+		return "", err
+	}
+
+	line = strings.TrimRight(line, "\r\n")
+	le.addHistory(line)
+
+	return line, nil
+}
+
+// handleEscape reads the rest of an escape sequence for the arrow, home, end
+// and delete keys. Anything else is dropped.
+func (le *lineEditor) handleEscape(buf *editBuffer) {
+	kind, err := le.reader.ReadByte()
+	if err != nil || (kind != '[' && kind != 'O') {
+		return
+	}
+
+	key, err := le.reader.ReadByte()
+	if err != nil {
+		return
+	}
+
+	switch key {
+	case 'A':
+		le.moveInHistory(buf, -1)
+	case 'B':
+		le.moveInHistory(buf, 1)
+	case 'C':
+		if buf.cursor < len(buf.line) {
+			buf.cursor++
+		}
+	case 'D':
+		if buf.cursor > 0 {
+			buf.cursor--
+		}
+	case 'H':
+		buf.cursor = 0
+	case 'F':
+		buf.cursor = len(buf.line)
+	case '3':
+		if tilde, _ := le.reader.ReadByte(); tilde == '~' {
+			buf.deleteForward()
+		}
+	}
+}
+
+// moveInHistory keeps the line being typed aside while browsing the history,
+// and gives it back when moving past the newest entry.
+func (le *lineEditor) moveInHistory(buf *editBuffer, step int) {
+	pos := buf.histPos + step
+	if pos < 0 || pos > len(le.history) {
+		return
+	}
+
+	if buf.histPos == len(le.history) {
+		buf.pending = append([]rune{}, buf.line...)
+	}
+
+	buf.histPos = pos
+	if pos == len(le.history) {
+		buf.line = append([]rune{}, buf.pending...)
+	} else {
+		buf.line = []rune(le.history[pos])
+	}
+	buf.cursor = len(buf.line)
+}
+
+// completeLine fills in as much of the word as all candidates share. If that
+// adds nothing, a second tab lists the candidates.
+func (le *lineEditor) completeLine(buf *editBuffer) {
+	if le.complete == nil {
+		return
+	}
+
+	before := string(buf.line[:buf.cursor])
+	start, candidates := le.complete(before)
+	if len(candidates) == 0 {
+		return
+	}
+
+	word := []rune(before)[start:]
+	common := commonPrefix(candidates)
+	if len(candidates) == 1 && !strings.HasSuffix(common, "/") {
+		common += " "
+	}
+
+	if len([]rune(common)) > len(word) {
+		buf.replaceWord(start, []rune(common))
+		return
+	}
+
+	if !buf.tabbed {
+		buf.tabbed = true
+		return
+	}
+
+	sort.Strings(candidates)
+	fmt.Fprintf(le.out, "\n%s\n", strings.Join(candidates, "  "))
+}
+
+func (le *lineEditor) redraw(buf *editBuffer) {
+	fmt.Fprintf(le.out, "\r%s%s\x1b[K", buf.prompt, string(buf.line))
+	if back := len(buf.line) - buf.cursor; back > 0 {
+		fmt.Fprintf(le.out, "\x1b[%dD", back)
+	}
+}
+
+func (le *lineEditor) addHistory(line string) {
+	if strings.TrimSpace(line) == "" {
+		return
+	} else if len(le.history) > 0 && le.history[len(le.history)-1] == line {
+		return
+	}
+
+	le.history = append(le.history, line)
+	if len(le.history) > SHELL_HISTORY_SIZE {
+		le.history = le.history[len(le.history)-SHELL_HISTORY_SIZE:]
+	}
+
+	le.saveHistory()
+}
+
+func (le *lineEditor) loadHistory() {
+	if le.histPath == "" {
+		return
+	}
+
+	contents, err := os.ReadFile(le.histPath)
+	if err != nil {
+		return
+	}
+
+	for _, line := range strings.Split(string(contents), "\n") {
+		if line != "" {
+			le.history = append(le.history, line)
+		}
+	}
+
+	if len(le.history) > SHELL_HISTORY_SIZE {
+		le.history = le.history[len(le.history)-SHELL_HISTORY_SIZE:]
+	}
+}
+
+func (le *lineEditor) saveHistory() {
+	if le.histPath == "" {
+		return
+	}
+
+	contents := strings.Join(le.history, "\n") + "\n"
+	os.WriteFile(le.histPath, []byte(contents), 0600)
+}
+
+func (buf *editBuffer) insert(r rune) {
+	buf.line = append(buf.line[:buf.cursor], append([]rune{r}, buf.line[buf.cursor:]...)...)
+	buf.cursor++
+}
+
+func (buf *editBuffer) deleteBackward() {
+	if buf.cursor == 0 {
+		return
+	}
+
+	buf.line = append(buf.line[:buf.cursor-1], buf.line[buf.cursor:]...)
+	buf.cursor--
+}
+
+func (buf *editBuffer) deleteForward() {
+	if buf.cursor == len(buf.line) {
+		return
+	}
+
+	buf.line = append(buf.line[:buf.cursor], buf.line[buf.cursor+1:]...)
+}
+
+func (buf *editBuffer) replaceWord(start int, word []rune) {
+	rest := append([]rune{}, buf.line[buf.cursor:]...)
+	buf.line = append(append(buf.line[:start], word...), rest...)
+	buf.cursor = start + len(word)
+}
+
+func commonPrefix(words []string) string {
+	prefix := []rune(words[0])
+	for _, word := range words[1:] {
+		runes := []rune(word)
+		i := 0
+		for i < len(prefix) && i < len(runes) && prefix[i] == runes[i] {
+			i++
+		}
+		prefix = prefix[:i]
+	}
+
+	return string(prefix)
+}
@@ -0,0 +1,568 @@
+// Package shell is an interactive shell over ProtoDir. It keeps track of the
+// state and the dir it is in, so entries are named by path instead of hash.
+package shell
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"protogen/protodir"
+	"protogen/protodir/client"
+	"sort"
+	"strings"
+)
+
+const (
+	SHELL_HISTORY_FILE string = ".protodir_history"
+	SHELL_HISTORY_SIZE int    = 500
+	SHELL_PATH_SEP     string = "/"
+)
+
+type shellCommand struct {
+	name      string
+	usage     string
+	needState bool
+	run       func(sh *dirShell, args []string) error
+}
+
+type dirShell struct {
+	client   *client.Client
+	editor   *lineEditor
+	state    string
+	cwd      []string
+	here     []string
+	hereList *client.Listing
+}
+
+var (
+	shellCommands []shellCommand
+	errNoState    = errors.New("no state, start one with `init <root>` or pick one with `use <hash>`")
+	errExit       = errors.New("exit")
+)
+
+func init() {
+	shellCommands = []shellCommand{
+		{name: "ls", usage: "ls [path]", needState: true, run: (*dirShell).runLs},
+		{name: "cd", usage: "cd [path]", needState: true, run: (*dirShell).runCd},
+		{name: "cat", usage: "cat <file>", needState: true, run: (*dirShell).runCat},
+		{name: "stat", usage: "stat <path>", needState: true, run: (*dirShell).runStat},
+		{name: "tree", usage: "tree [path]", needState: true, run: (*dirShell).runTree},
+		{name: "pwd", usage: "pwd", needState: true, run: (*dirShell).runPwd},
+		{name: "states", usage: "states", run: (*dirShell).runStates},
+		{name: "init", usage: "init <root>", run: (*dirShell).runInit},
+		{name: "use", usage: "use <state hash>", run: (*dirShell).runUse},
+		{name: "help", usage: "help", run: (*dirShell).runHelp},
+		{name: "exit", usage: "exit", run: (*dirShell).runExit},
+	}
+}
+
+func DirShellMain(sockPath, root string) {
+	sh := dirShell{client: client.NewUnix(sockPath), cwd: make([]string, 0)}
+	sh.editor = newLineEditor(os.Stdin, os.Stdout, historyPath(), sh.completeLine)
+
+	if root != "" {
+		handleError(sh.runInit([]string{root}))
+	}
+
+	for {
+		line, err := sh.editor.readLine(sh.prompt())
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			handleError(err)
+			break
+		}
+
+		if err := sh.execute(line); err == errExit {
+			break
+		} else {
+			handleError(err)
+		}
+	}
+
+	os.Exit(0)
+}
+
+func CleanUpDirShell() {
+	fmt.Println()
+	os.Exit(0)
+}
+
+func (sh *dirShell) execute(line string) error {
+	args := splitArgs(line)
+	if len(args) == 0 {
+		return nil
+	}
+
+	command := findCommand(args[0])
+	if command == nil {
+		return fmt.Errorf("unknown command %s, see help", args[0])
+	} else if command.needState && sh.state == "" {
+		return errNoState
+	}
+
+	// Other clients of the state may have changed the dir since, so every
+	// command starts from a fresh listing.
+	sh.hereList = nil
+
+	return command.run(sh, args[1:])
+}
+
+func (sh *dirShell) runLs(args []string) error {
+	listing, err := sh.visit(sh.resolve(optionalArg(args)))
+	if err != nil {
+		return err
+	}
+
+	for _, name := range listingNames(listing) {
+		fmt.Println(name)
+	}
+
+	return nil
+}
+
+func (sh *dirShell) runCd(args []string) error {
+	target := sh.resolve(optionalArg(args))
+	if len(args) == 0 {
+		target = make([]string, 0)
+	}
+	if _, err := sh.visit(target); err != nil {
+		return err
+	}
+
+	sh.cwd = target
+	return nil
+}
+
+func (sh *dirShell) runCat(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: cat <file>")
+	}
+
+	entry, err := sh.findEntry(sh.resolve(args[0]))
+	if err != nil {
+		return err
+	} else if entry.Type == client.EntryDir {
+		return fmt.Errorf("%s is a dir", args[0])
+	}
+
+	file, err := sh.client.ReadBytes(sh.state, entry.Hash)
+	if err != nil {
+		return err
+	}
+
+	os.Stdout.Write(file.Data)
+	if len(file.Data) > 0 && file.Data[len(file.Data)-1] != '\n' {
+		fmt.Println()
+	}
+
+	return nil
+}
+
+func (sh *dirShell) runStat(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: stat <path>")
+	}
+
+	entry, err := sh.findEntry(sh.resolve(args[0]))
+	if err != nil {
+		return err
+	}
+
+	stat, err := sh.client.Stat(sh.state, entry.Hash)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Path: %s\nIsDir: %t\nSize: %d\nMode: %s\nModTime: %s\nVersion: %s\n",
+		stat.Path, stat.IsDir, stat.Size, stat.Mode, stat.ModTime, stat.Version)
+
+	return nil
+}
+
+func (sh *dirShell) runTree(args []string) error {
+	target := sh.resolve(optionalArg(args))
+	listing, err := sh.visit(target)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(listing.Dir)
+	return sh.printTree(target, "")
+}
+
+func (sh *dirShell) runPwd(args []string) error {
+	listing, err := sh.visit(sh.cwd)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(listing.Dir)
+	return nil
+}
+
+func (sh *dirShell) runStates(args []string) error {
+	states, err := sh.client.ListStates()
+	if err != nil {
+		return err
+	}
+
+	for _, state := range states {
+		marker := " "
+		if state.Hash == sh.state {
+			marker = "*"
+		}
+		fmt.Printf("%s %s  %s\n", marker, state.Hash, state.Dir)
+	}
+
+	return nil
+}
+
+func (sh *dirShell) runInit(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: init <root>")
+	}
+
+	root, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+
+	state, err := sh.client.InitState(root)
+	if err != nil {
+		return err
+	}
+
+	sh.useState(state)
+	fmt.Printf("State %s\n", state)
+
+	return nil
+}
+
+func (sh *dirShell) runUse(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: use <state hash>")
+	}
+
+	if err := sh.client.Cd(args[0], args[0]); err != nil {
+		return err
+	}
+
+	sh.useState(args[0])
+	return nil
+}
+
+func (sh *dirShell) runHelp(args []string) error {
+	for _, command := range shellCommands {
+		fmt.Println(command.usage)
+	}
+
+	return nil
+}
+
+func (sh *dirShell) runExit(args []string) error {
+	return errExit
+}
+
+func (sh *dirShell) useState(state string) {
+	sh.state = state
+	sh.cwd = make([]string, 0)
+	sh.here = make([]string, 0)
+	sh.hereList = nil
+}
+
+// visit changes the state into the dir at segments and lists it. PTDP can only
+// change into a subdir or back to the root, so anything that is not below the
+// dir the state is in starts over from the root.
+func (sh *dirShell) visit(segments []string) (*client.Listing, error) {
+	if sh.hereList != nil && equalSegments(sh.here, segments) {
+		return sh.hereList, nil
+	}
+
+	if sh.hereList == nil || !hasPrefix(segments, sh.here) {
+		if err := sh.client.Cd(sh.state, sh.state); err != nil {
+			return nil, err
+		}
+		sh.here = make([]string, 0)
+		if err := sh.listHere(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range segments[len(sh.here):] {
+		dir := findByName(sh.hereList.Dirs, name)
+		if dir == nil {
+			if findByName(sh.hereList.Files, name) != nil {
+				return nil, fmt.Errorf("%s is not a dir", name)
+			}
+			return nil, fmt.Errorf("no such dir %s", name)
+		}
+
+		if err := sh.client.Cd(sh.state, dir.Hash); err != nil {
+			return nil, err
+		}
+		sh.here = append(append(make([]string, 0), sh.here...), name)
+		if err := sh.listHere(); err != nil {
+			return nil, err
+		}
+	}
+
+	return sh.hereList, nil
+}
+
+func (sh *dirShell) listHere() error {
+	listing, err := sh.client.ListDir(sh.state)
+	if err != nil {
+		sh.hereList = nil
+		return err
+	}
+
+	sh.hereList = listing
+	return nil
+}
+
+func (sh *dirShell) findEntry(segments []string) (*client.Entry, error) {
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("the root has no entry to name")
+	}
+
+	listing, err := sh.visit(segments[:len(segments)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	name := segments[len(segments)-1]
+	if entry := findByName(listing.Files, name); entry != nil {
+		return entry, nil
+	} else if entry := findByName(listing.Dirs, name); entry != nil {
+		return entry, nil
+	}
+
+	return nil, fmt.Errorf("no such entry %s", name)
+}
+
+func (sh *dirShell) printTree(segments []string, indent string) error {
+	listing, err := sh.visit(segments)
+	if err != nil {
+		return err
+	}
+
+	names := listingNames(listing)
+	for i, name := range names {
+		branch, nextIndent := protodir.TREE_BRANCH, indent+protodir.TREE_PIPE
+		if i == len(names)-1 {
+			branch, nextIndent = protodir.TREE_LAST_BRANCH, indent+protodir.TREE_SPACE
+		}
+		fmt.Printf("%s%s%s\n", indent, branch, name)
+
+		if strings.HasSuffix(name, SHELL_PATH_SEP) {
+			child := append(append(make([]string, 0), segments...), strings.TrimSuffix(name, SHELL_PATH_SEP))
+			if err := sh.printTree(child, nextIndent); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// completeLine completes command names for the first word and entry names,
+// relative to the dir typed so far, for the rest.
+func (sh *dirShell) completeLine(line string) (int, []string) {
+	start := wordStart(line)
+	word := unescapeArg(string([]rune(line)[start:]))
+	candidates := make([]string, 0)
+
+	if strings.TrimSpace(string([]rune(line)[:start])) == "" {
+		for _, command := range shellCommands {
+			if strings.HasPrefix(command.name, word) {
+				candidates = append(candidates, command.name)
+			}
+		}
+		return start, candidates
+	}
+
+	if sh.state == "" {
+		return start, candidates
+	}
+
+	dirPart, namePart := "", word
+	if at := strings.LastIndex(word, SHELL_PATH_SEP); at != -1 {
+		dirPart, namePart = word[:at+1], word[at+1:]
+	}
+
+	listing, err := sh.visit(sh.resolve(dirPart))
+	if err != nil {
+		return start, candidates
+	}
+
+	for _, name := range listingNames(listing) {
+		if strings.HasPrefix(name, namePart) {
+			candidates = append(candidates, escapeArg(dirPart+name))
+		}
+	}
+
+	return start, candidates
+}
+
+func (sh *dirShell) resolve(path string) []string {
+	segments := append(make([]string, 0), sh.cwd...)
+	if strings.HasPrefix(path, SHELL_PATH_SEP) {
+		segments = make([]string, 0)
+	}
+
+	for _, part := range strings.Split(path, SHELL_PATH_SEP) {
+		switch part {
+		case "", ".":
+		case "..":
+			if len(segments) > 0 {
+				segments = segments[:len(segments)-1]
+			}
+		default:
+			segments = append(segments, part)
+		}
+	}
+
+	return segments
+}
+
+func (sh *dirShell) prompt() string {
+	if sh.state == "" {
+		return "ptdp> "
+	}
+
+	return fmt.Sprintf("ptdp:%s/%s> ", sh.state, strings.Join(sh.cwd, SHELL_PATH_SEP))
+}
+
+func findCommand(name string) *shellCommand {
+	for i, command := range shellCommands {
+		if command.name == name {
+			return &shellCommands[i]
+		}
+	}
+
+	return nil
+}
+
+func findByName(entries []client.Entry, name string) *client.Entry {
+	for i, entry := range entries {
+		if entry.Path == name {
+			return &entries[i]
+		}
+	}
+
+	return nil
+}
+
+// listingNames gives the names of a listing sorted, with dirs marked by a
+// trailing slash.
+func listingNames(listing *client.Listing) []string {
+	names := make([]string, 0, len(listing.Dirs)+len(listing.Files))
+	for _, dir := range listing.Dirs {
+		names = append(names, dir.Path+SHELL_PATH_SEP)
+	}
+	for _, file := range listing.Files {
+		names = append(names, file.Path)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// splitArgs splits a line on spaces, keeping spaces that are escaped with a
+// backslash or inside double quotes.
+func splitArgs(line string) []string {
+	args := make([]string, 0)
+	current := make([]rune, 0)
+	inQuotes, escaped, started := false, false, false
+
+	for _, r := range line {
+		switch {
+		case escaped:
+			current, escaped = append(current, r), false
+		case r == '\\':
+			escaped, started = true, true
+		case r == '"':
+			inQuotes, started = !inQuotes, true
+		case r == ' ' && !inQuotes:
+			if started {
+				args = append(args, string(current))
+			}
+			current, started = make([]rune, 0), false
+		default:
+			current, started = append(current, r), true
+		}
+	}
+
+	if started {
+		args = append(args, string(current))
+	}
+
+	return args
+}
+
+func wordStart(line string) int {
+	runes := []rune(line)
+	start := 0
+
+	for i := 0; i < len(runes); i++ {
+		if runes[i] == '\\' {
+			i++
+		} else if runes[i] == ' ' {
+			start = i + 1
+		}
+	}
+
+	return start
+}
+
+func escapeArg(arg string) string {
+	return strings.ReplaceAll(arg, " ", "\\ ")
+}
+
+func unescapeArg(arg string) string {
+	return strings.ReplaceAll(arg, "\\ ", " ")
+}
+
+func optionalArg(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+
+	return args[0]
+}
+
+func equalSegments(a, b []string) bool {
+	return len(a) == len(b) && hasPrefix(a, b)
+}
+
+func hasPrefix(segments, prefix []string) bool {
+	if len(prefix) > len(segments) {
+		return false
+	}
+
+	for i := range prefix {
+		if segments[i] != prefix[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func historyPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, SHELL_HISTORY_FILE)
+}
+
+func handleError(err error) {
+	if err != nil {
+		fmt.Printf("\033[1;31mError occured:\033[0m %s\n", err)
+	}
+}
@@ -0,0 +1,49 @@
+//go:build linux
+
+package shell
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+type terminalState struct {
+	termios syscall.Termios
+}
+
+// makeRaw turns off echo, line buffering and signal keys on the terminal so
+// the line editor sees every key as it is pressed. Output processing is left
+// on, so a newline still returns the carriage.
+func makeRaw(fd uintptr) (*terminalState, error) {
+	var old syscall.Termios
+	if err := ioctlTermios(fd, syscall.TCGETS, &old); err != nil {
+		return nil, err
+	}
+
+	raw := old
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+
+	if err := ioctlTermios(fd, syscall.TCSETS, &raw); err != nil {
+		return nil, err
+	}
+
+	return &terminalState{termios: old}, nil
+}
+
+func restoreTerminal(fd uintptr, state *terminalState) error {
+	return ioctlTermios(fd, syscall.TCSETS, &state.termios)
+}
+
+func ioctlTermios(fd, request uintptr, termios *syscall.Termios) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(unsafe.Pointer(termios)))
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package shell
+
+import "errors"
+
+type terminalState struct{}
+
+var errNoRawMode = errors.New("raw terminal mode is only supported on Linux")
+
+// Without raw mode the shell falls back to reading whole lines, with no tab
+// completion or history keys.
+func makeRaw(fd uintptr) (*terminalState, error) {
+	return nil, errNoRawMode
+}
+
+func restoreTerminal(fd uintptr, state *terminalState) error {
+	return nil
+}
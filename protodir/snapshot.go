@@ -0,0 +1,354 @@
+package protodir
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type snapshotEntry struct {
+	ty      pathType
+	path    string
+	size    int64
+	modTime time.Time
+	hash    string
+}
+
+// dirSnapshot keeps the dirs it was taken of, which are more than one for a
+// union state, so DIFF can walk the same ones again.
+type dirSnapshot struct {
+	name    string
+	dir     string
+	dirs    []string
+	taken   time.Time
+	hashed  bool
+	entries map[string]snapshotEntry
+}
+
+type changedEntry struct {
+	from snapshotEntry
+	to   snapshotEntry
+}
+
+type snapshotDiff struct {
+	added    []snapshotEntry
+	removed  []snapshotEntry
+	modified []changedEntry
+	moved    []changedEntry
+}
+
+// SNAPSHOT <state>;<name>[;HASH=yes]
+func (pdr *protoDirState) handleRequestSnapshot(pathOrHash string) ([]byte, responseCode) {
+	fields, success := parsePathOrHashFields(pathOrHash, 2, GLOBAL_MAX_FIELDS)
+	if success != STATUS_DID_SPLIT || !isValidSnapshotName(fields[1]) {
+		return []byte(ERR_SNAPSHOT_ARGS), RESPONSE_PARSE_FAILED
+	}
+
+	options, success := parseRequestOptions(fields[2:])
+	if success != STATUS_DID_SPLIT {
+		return []byte(ERR_PARSE_OPTION), RESPONSE_BAD_ARGUMENTS
+	}
+
+	state := pdr.filterStatesAndReturn(fields[0])
+	if state == nil {
+		return nil, RESPONSE_NO_STATE
+	}
+
+	snapshot, stat := takeSnapshot(fields[1], state.path.currentDirs(), isTruthy(options[OPT_HASH]))
+	if stat != STATUS_WALK_SUCCESS {
+		return walkFailureResponse(stat)
+	}
+
+	pdr.storeSnapshot(state.getHashTrimmed(), snapshot)
+
+	return addHeader(snapshot.dir, GLOBAL_SNAPSHOT_HEADER, []byte(snapshot.toString())), RESPONSE_SNAPSHOT_TAKEN
+}
+
+// DIFF <state>;<from>[;to]
+//
+// Without a second snapshot, or with LIVE as the second one, the first
+// snapshot is compared to the dir it was taken of as it is now.
+func (pdr *protoDirState) handleRequestDiff(pathOrHash string) ([]byte, responseCode) {
+	fields, success := parsePathOrHashFields(pathOrHash, 2, 3)
+	if success != STATUS_DID_SPLIT {
+		return []byte(ERR_SNAPSHOT_ARGS), RESPONSE_PARSE_FAILED
+	}
+
+	state := pdr.filterStatesAndReturn(fields[0])
+	if state == nil {
+		return nil, RESPONSE_NO_STATE
+	}
+	stateHash := state.getHashTrimmed()
+
+	toName := GLOBAL_LIVE_SNAPSHOT
+	if len(fields) == 3 {
+		toName = fields[2]
+	}
+
+	from, ok := pdr.getSnapshot(stateHash, fields[1])
+	if !ok {
+		return []byte(fields[1]), RESPONSE_NO_SNAPSHOT
+	}
+
+	var to dirSnapshot
+	if toName == GLOBAL_LIVE_SNAPSHOT {
+		live, stat := takeSnapshot(GLOBAL_LIVE_SNAPSHOT, from.dirs, from.hashed)
+		if stat != STATUS_WALK_SUCCESS {
+			return walkFailureResponse(stat)
+		}
+		to = live
+	} else if to, ok = pdr.getSnapshot(stateHash, toName); !ok {
+		return []byte(toName), RESPONSE_NO_SNAPSHOT
+	}
+
+	diff := diffSnapshots(from, to)
+	header := fmt.Sprintf("From: %s;\nTo: %s;\n", from.name, to.name)
+
+	return addHeader(from.dir, GLOBAL_DIFF_HEADER, []byte(header+diff.toString())), RESPONSE_SNAPSHOTS_DIFFED
+}
+
+// storeSnapshot keeps the snapshots of every state apart, at most
+// GLOBAL_MAX_SNAPSHOTS of them. The oldest one is dropped to make room.
+func (pdr *protoDirState) storeSnapshot(stateHash string, snapshot dirSnapshot) {
+	pdr.Lock()
+	defer pdr.Unlock()
+
+	named, ok := pdr.snapshots[stateHash]
+	if !ok {
+		named = make(map[string]dirSnapshot)
+		pdr.snapshots[stateHash] = named
+	}
+
+	if _, replaced := named[snapshot.name]; !replaced && len(named) >= GLOBAL_MAX_SNAPSHOTS {
+		oldest := ""
+		for name, kept := range named {
+			if oldest == "" || kept.taken.Before(named[oldest].taken) {
+				oldest = name
+			}
+		}
+		delete(named, oldest)
+	}
+
+	named[snapshot.name] = snapshot
+}
+
+func (pdr *protoDirState) getSnapshot(stateHash, name string) (dirSnapshot, bool) {
+	pdr.Lock()
+	defer pdr.Unlock()
+
+	snapshot, ok := pdr.snapshots[stateHash][name]
+	return snapshot, ok
+}
+
+// takeSnapshot walks the merged tree of dirs when there is more than one.
+func takeSnapshot(name string, dirs []string, hashed bool) (dirSnapshot, successStatus) {
+	if len(dirs) == 0 {
+		return dirSnapshot{}, STATUS_NOT_EXISTS
+	}
+
+	dir := dirs[0]
+	statIsDir := checkStatIsDirAndExists(dir)
+	if statIsDir != STATUS_EXISTS {
+		return dirSnapshot{}, statIsDir
+	}
+
+	snapshot := dirSnapshot{
+		name:    name,
+		dir:     dir,
+		dirs:    dirs,
+		taken:   time.Now(),
+		hashed:  hashed,
+		entries: make(map[string]snapshotEntry),
+	}
+
+	if len(dirs) > 1 {
+		entries, stat := walkUnionEntries(dirs)
+		if stat != STATUS_WALK_SUCCESS {
+			return dirSnapshot{}, stat
+		}
+		for _, entry := range entries {
+			snapshot.entries[entry.rel] = newSnapshotEntry(entry.rel, entry.path, entry.info, hashed)
+		}
+
+		return snapshot, STATUS_WALK_SUCCESS
+	}
+
+	budget := newWalkBudget(dir)
+	err := filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if f == nil {
+			return err
+		}
+
+		if err := budget.visit(path); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return nil
+		}
+
+		snapshot.entries[rel] = newSnapshotEntry(rel, path, f, hashed)
+		return nil
+	})
+
+	if budget.stat != STATUS_WALK_SUCCESS {
+		return dirSnapshot{}, budget.stat
+	} else if err != nil {
+		return dirSnapshot{}, STATUS_WALK_FAIL
+	}
+
+	return snapshot, STATUS_WALK_SUCCESS
+}
+
+func newSnapshotEntry(rel, path string, f os.FileInfo, hashed bool) snapshotEntry {
+	entry := snapshotEntry{ty: GLOBAL_FILEPATH, path: rel, size: f.Size(), modTime: f.ModTime()}
+	if f.IsDir() {
+		entry.ty = GLOBAL_DIRPATH
+	} else if hashed && f.Mode().IsRegular() {
+		entry.hash = hashFileContents(path, 0)
+	}
+
+	return entry
+}
+
+// diffSnapshots finds what was added, removed and modified between two
+// snapshots. A removed file and an added file with the same content are
+// reported as a move instead. Without hashes, files are taken to have the
+// same content if they have the same size and modification time.
+func diffSnapshots(from, to dirSnapshot) snapshotDiff {
+	diff := snapshotDiff{}
+
+	for path, before := range from.entries {
+		after, ok := to.entries[path]
+		if !ok || after.ty != before.ty {
+			diff.removed = append(diff.removed, before)
+			if ok {
+				diff.added = append(diff.added, after)
+			}
+		} else if before.isModified(after) {
+			diff.modified = append(diff.modified, changedEntry{from: before, to: after})
+		}
+	}
+
+	for path, after := range to.entries {
+		if _, ok := from.entries[path]; !ok {
+			diff.added = append(diff.added, after)
+		}
+	}
+
+	// Sorted before pairing too, so a file copied to several places is
+	// always moved to the first of them.
+	diff.sort()
+	diff.pairMoves(from.hashed && to.hashed)
+	diff.sort()
+
+	return diff
+}
+
+func (sd *snapshotDiff) pairMoves(byHash bool) {
+	addedByContent := make(map[string][]int)
+	for i, entry := range sd.added {
+		if entry.ty == GLOBAL_FILEPATH {
+			key := entry.contentKey(byHash)
+			addedByContent[key] = append(addedByContent[key], i)
+		}
+	}
+
+	paired := make(map[int]bool)
+	removed := make([]snapshotEntry, 0)
+
+	for _, entry := range sd.removed {
+		key := entry.contentKey(byHash)
+		candidates := addedByContent[key]
+		if entry.ty != GLOBAL_FILEPATH || len(candidates) == 0 {
+			removed = append(removed, entry)
+			continue
+		}
+
+		paired[candidates[0]] = true
+		addedByContent[key] = candidates[1:]
+		sd.moved = append(sd.moved, changedEntry{from: entry, to: sd.added[candidates[0]]})
+	}
+
+	added := make([]snapshotEntry, 0)
+	for i, entry := range sd.added {
+		if !paired[i] {
+			added = append(added, entry)
+		}
+	}
+
+	sd.added, sd.removed = added, removed
+}
+
+func (sd *snapshotDiff) sort() {
+	sort.Slice(sd.added, func(i, j int) bool { return sd.added[i].path < sd.added[j].path })
+	sort.Slice(sd.removed, func(i, j int) bool { return sd.removed[i].path < sd.removed[j].path })
+	sort.Slice(sd.modified, func(i, j int) bool { return sd.modified[i].to.path < sd.modified[j].to.path })
+	sort.Slice(sd.moved, func(i, j int) bool { return sd.moved[i].to.path < sd.moved[j].to.path })
+}
+
+func (sd snapshotDiff) toString() string {
+	finStr := ""
+
+	for _, entry := range sd.added {
+		finStr += fmt.Sprintf("\n+a+path=%s+size=%d", entry.displayPath(), entry.size)
+	}
+	for _, entry := range sd.removed {
+		finStr += fmt.Sprintf("\n-r-path=%s-size=%d", entry.displayPath(), entry.size)
+	}
+	for _, change := range sd.modified {
+		finStr += fmt.Sprintf("\n~m~path=%s~size=%d~was=%d", change.to.displayPath(), change.to.size, change.from.size)
+	}
+	for _, move := range sd.moved {
+		finStr += fmt.Sprintf("\n>v>from=%s>to=%s", move.from.displayPath(), move.to.displayPath())
+	}
+
+	if len(finStr) == 0 {
+		finStr = "NO_CHANGES"
+	}
+
+	return fmt.Sprintf("%s\n===\nAdded: %d;\nRemoved: %d;\nModified: %d;\nMoved: %d;",
+		finStr, len(sd.added), len(sd.removed), len(sd.modified), len(sd.moved))
+}
+
+// Dirs are never reported as modified, their size and modification time
+// change with every entry added or removed in them.
+func (se snapshotEntry) isModified(after snapshotEntry) bool {
+	if se.ty == GLOBAL_DIRPATH {
+		return false
+	}
+
+	if se.hash != "" && after.hash != "" {
+		return se.hash != after.hash
+	}
+
+	return se.size != after.size || !se.modTime.Equal(after.modTime)
+}
+
+func (se snapshotEntry) contentKey(byHash bool) string {
+	if byHash {
+		return se.hash
+	}
+
+	return fmt.Sprintf("%d-%d", se.size, se.modTime.UnixNano())
+}
+
+func (se snapshotEntry) displayPath() string {
+	if se.ty == GLOBAL_DIRPATH {
+		return se.path + string(filepath.Separator)
+	}
+
+	return se.path
+}
+
+func (ds dirSnapshot) toString() string {
+	return fmt.Sprintf("Name: %s;\nEntries: %d;\nHashed: %t;\nTaken: %s;", ds.name, len(ds.entries), ds.hashed, ds.taken.Format(time.RFC3339))
+}
+
+func isValidSnapshotName(name string) bool {
+	return len(name) > 0 && name != GLOBAL_LIVE_SNAPSHOT && !strings.Contains(name, GLOBAL_OPTION_SEP)
+}
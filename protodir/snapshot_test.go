@@ -0,0 +1,162 @@
+package protodir
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSnapshot(hashed bool, entries ...snapshotEntry) dirSnapshot {
+	snapshot := dirSnapshot{hashed: hashed, entries: make(map[string]snapshotEntry)}
+	for _, entry := range entries {
+		snapshot.entries[entry.path] = entry
+	}
+
+	return snapshot
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	then := time.Date(2023, 2, 22, 13, 47, 11, 0, time.UTC)
+	later := then.Add(time.Minute)
+	file := func(path string, size int64, modTime time.Time, hash string) snapshotEntry {
+		return snapshotEntry{ty: GLOBAL_FILEPATH, path: path, size: size, modTime: modTime, hash: hash}
+	}
+	dir := func(path string, modTime time.Time) snapshotEntry {
+		return snapshotEntry{ty: GLOBAL_DIRPATH, path: path, size: 4096, modTime: modTime}
+	}
+
+	tests := []struct {
+		name string
+		from dirSnapshot
+		to   dirSnapshot
+		want string
+	}{
+		{
+			"unchanged",
+			testSnapshot(false, file("a", 1, then, ""), dir("d", then)),
+			testSnapshot(false, file("a", 1, then, ""), dir("d", then)),
+			"NO_CHANGES\n===\nAdded: 0;\nRemoved: 0;\nModified: 0;\nMoved: 0;",
+		},
+		{
+			"added and removed",
+			testSnapshot(false, file("a", 1, then, "")),
+			testSnapshot(false, file("b", 2, then, ""), dir("d", later)),
+			"\n+a+path=b+size=2\n+a+path=d/+size=4096\n-r-path=a-size=1\n===\nAdded: 2;\nRemoved: 1;\nModified: 0;\nMoved: 0;",
+		},
+		{
+			"modified by size or time",
+			testSnapshot(false, file("a", 1, then, ""), file("b", 1, then, "")),
+			testSnapshot(false, file("a", 2, then, ""), file("b", 1, later, "")),
+			"\n~m~path=a~size=2~was=1\n~m~path=b~size=1~was=1\n===\nAdded: 0;\nRemoved: 0;\nModified: 2;\nMoved: 0;",
+		},
+		{
+			"dirs are never modified",
+			testSnapshot(false, dir("d", then)),
+			testSnapshot(false, dir("d", later)),
+			"NO_CHANGES\n===\nAdded: 0;\nRemoved: 0;\nModified: 0;\nMoved: 0;",
+		},
+		{
+			"hashes decide over times",
+			testSnapshot(true, file("a", 1, then, "h1"), file("b", 1, then, "h2")),
+			testSnapshot(true, file("a", 1, later, "h1"), file("b", 1, then, "h3")),
+			"\n~m~path=b~size=1~was=1\n===\nAdded: 0;\nRemoved: 0;\nModified: 1;\nMoved: 0;",
+		},
+		{
+			"a file turned into a dir",
+			testSnapshot(false, file("a", 1, then, "")),
+			testSnapshot(false, dir("a", then)),
+			"\n+a+path=a/+size=4096\n-r-path=a-size=1\n===\nAdded: 1;\nRemoved: 1;\nModified: 0;\nMoved: 0;",
+		},
+		{
+			"moved by size and time",
+			testSnapshot(false, file("a", 1, then, ""), file("b", 2, then, "")),
+			testSnapshot(false, file("c", 1, then, ""), file("d", 2, later, "")),
+			"\n+a+path=d+size=2\n-r-path=b-size=2\n>v>from=a>to=c\n===\nAdded: 1;\nRemoved: 1;\nModified: 0;\nMoved: 1;",
+		},
+		{
+			"moved by hash",
+			testSnapshot(true, file("a", 1, then, "h1")),
+			testSnapshot(true, file("sub/a", 1, later, "h1")),
+			"\n>v>from=a>to=sub/a\n===\nAdded: 0;\nRemoved: 0;\nModified: 0;\nMoved: 1;",
+		},
+		{
+			"one move for two copies",
+			testSnapshot(true, file("a", 1, then, "h1")),
+			testSnapshot(true, file("b", 1, then, "h1"), file("c", 1, then, "h1")),
+			"\n+a+path=c+size=1\n>v>from=a>to=b\n===\nAdded: 1;\nRemoved: 0;\nModified: 0;\nMoved: 1;",
+		},
+		{
+			"dirs are not moved",
+			testSnapshot(false, dir("d", then)),
+			testSnapshot(false, dir("e", then)),
+			"\n+a+path=e/+size=4096\n-r-path=d/-size=4096\n===\nAdded: 1;\nRemoved: 1;\nModified: 0;\nMoved: 0;",
+		},
+	}
+
+	for _, test := range tests {
+		if got := diffSnapshots(test.from, test.to).toString(); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestStoreSnapshotKeepsNewest(t *testing.T) {
+	pdr := &protoDirState{snapshots: make(map[string]map[string]dirSnapshot)}
+	taken := time.Now()
+	store := func(state, name string) {
+		taken = taken.Add(time.Second)
+		pdr.storeSnapshot(state, dirSnapshot{name: name, taken: taken})
+	}
+
+	for i := 0; i < GLOBAL_MAX_SNAPSHOTS; i++ {
+		store("s1", fmt.Sprintf("n%d", i))
+	}
+	store("s2", "other")
+	store("s1", "n0")
+	if len(pdr.snapshots["s1"]) != GLOBAL_MAX_SNAPSHOTS {
+		t.Fatalf("after replacing one: %d snapshots, want %d", len(pdr.snapshots["s1"]), GLOBAL_MAX_SNAPSHOTS)
+	}
+
+	store("s1", "new")
+	if len(pdr.snapshots["s1"]) != GLOBAL_MAX_SNAPSHOTS {
+		t.Errorf("after one more: %d snapshots, want %d", len(pdr.snapshots["s1"]), GLOBAL_MAX_SNAPSHOTS)
+	}
+	if _, ok := pdr.getSnapshot("s1", "n1"); ok {
+		t.Errorf("the oldest snapshot n1 was kept")
+	}
+	for _, name := range []string{"n0", "n2", "new"} {
+		if _, ok := pdr.getSnapshot("s1", name); !ok {
+			t.Errorf("snapshot %s was dropped", name)
+		}
+	}
+	if _, ok := pdr.getSnapshot("s2", "other"); !ok {
+		t.Errorf("the snapshot of another state was dropped")
+	}
+}
+
+func TestSnapshotDiffAgainstLive(t *testing.T) {
+	pdr, state, root := newTestState(t, map[string]string{"a.txt": "hello\n", "b.txt": "bye\n"})
+	if body, code := askDir(pdr, "SNAPSHOT %s;before;HASH=yes", state); code != RESPONSE_SNAPSHOT_TAKEN {
+		t.Fatalf("SNAPSHOT: got %d %q", code, body)
+	}
+
+	if err := os.Rename(filepath.Join(root, "a.txt"), filepath.Join(root, "c.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "b.txt"), []byte("bye bye\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	body, code := askDir(pdr, "DIFF %s;before", state)
+	want := "\n~m~path=b.txt~size=8~was=4\n>v>from=a.txt>to=c.txt\n===\nAdded: 0;\nRemoved: 0;\nModified: 1;\nMoved: 1;"
+	if code != RESPONSE_SNAPSHOTS_DIFFED || !strings.HasSuffix(body, want) {
+		t.Errorf("DIFF: got %d %q, want it to end in %q", code, body, want)
+	}
+
+	if body, code := askDir(pdr, "DIFF %s;nothing", state); code != RESPONSE_NO_SNAPSHOT || body != "nothing" {
+		t.Errorf("DIFF of no snapshot: got %d %q", code, body)
+	}
+}
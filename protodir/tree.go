@@ -0,0 +1,385 @@
+package protodir
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	TREE_BRANCH      string = "├── "
+	TREE_LAST_BRANCH string = "└── "
+	TREE_PIPE        string = "│   "
+	TREE_SPACE       string = "    "
+	TREE_LINK_ARROW  string = " -> "
+	TREE_FORMAT_TEXT string = "text"
+	TREE_FORMAT_JSON string = "json"
+	TREE_TYPE_FILE   string = "file"
+	TREE_TYPE_DIR    string = "dir"
+	TREE_TYPE_LINK   string = "link"
+	SUMMARY_NO_EXT   string = "(none)"
+)
+
+type treeNode struct {
+	Name     string      `json:"name"`
+	Type     string      `json:"type"`
+	Size     int64       `json:"size"`
+	Target   string      `json:"target,omitempty"`
+	Children []*treeNode `json:"children,omitempty"`
+	path     string
+	info     os.FileInfo
+}
+
+type sizeBucket struct {
+	label string
+	upTo  int64
+}
+
+type histogramBar struct {
+	label string
+	count int
+	size  int64
+}
+
+type dirSummary struct {
+	files      int
+	dirs       int
+	links      int
+	totalSize  int64
+	extensions map[string]*histogramBar
+	sizes      []histogramBar
+}
+
+// The last bucket has no upper bound.
+var summarySizeBuckets = []sizeBucket{
+	{label: "0B", upTo: 0},
+	{label: "<1KiB", upTo: 1<<10 - 1},
+	{label: "<64KiB", upTo: 64<<10 - 1},
+	{label: "<1MiB", upTo: 1<<20 - 1},
+	{label: "<64MiB", upTo: 64<<20 - 1},
+	{label: "<1GiB", upTo: 1<<30 - 1},
+	{label: ">=1GiB", upTo: -1},
+}
+
+// TREE <state>[;FORMAT=text|json][;DEPTH=n]
+func (pdr *protoDirState) handleRequestTree(pathOrHash string) ([]byte, responseCode) {
+	fields, success := parsePathOrHashFields(pathOrHash, 1, GLOBAL_MAX_FIELDS)
+	if success != STATUS_DID_SPLIT {
+		return []byte(ERR_PARSE_HASH), RESPONSE_PARSE_FAILED
+	}
+
+	options, success := parseRequestOptions(fields[1:])
+	if success != STATUS_DID_SPLIT {
+		return []byte(ERR_PARSE_OPTION), RESPONSE_BAD_ARGUMENTS
+	}
+
+	format, depth, ok := options.toTreeOptions()
+	if !ok {
+		return []byte(ERR_PARSE_OPTION), RESPONSE_BAD_ARGUMENTS
+	}
+
+	state := pdr.filterStatesAndReturn(fields[0])
+	if state == nil {
+		return nil, RESPONSE_NO_STATE
+	}
+
+	root, stat := buildTree(state.path.currentDirs(), depth)
+	if stat != STATUS_WALK_SUCCESS {
+		return walkFailureResponse(stat)
+	}
+
+	var body string
+	if format == TREE_FORMAT_JSON {
+		encoded, err := json.Marshal(root)
+		if err != nil {
+			return nil, RESPONSE_WALK_FAILED
+		}
+		body = string(encoded)
+	} else {
+		body = root.toString()
+	}
+
+	return addHeader(state.path.currDir, GLOBAL_TREE_HEADER, []byte(body)), RESPONSE_TREE_DRAWN
+}
+
+// SUMMARY <state>[;RECURSIVE=yes|no]
+func (pdr *protoDirState) handleRequestSummary(pathOrHash string) ([]byte, responseCode) {
+	fields, success := parsePathOrHashFields(pathOrHash, 1, GLOBAL_MAX_FIELDS)
+	if success != STATUS_DID_SPLIT {
+		return []byte(ERR_PARSE_HASH), RESPONSE_PARSE_FAILED
+	}
+
+	options, success := parseRequestOptions(fields[1:])
+	if success != STATUS_DID_SPLIT {
+		return []byte(ERR_PARSE_OPTION), RESPONSE_BAD_ARGUMENTS
+	}
+
+	recursive := true
+	if value, ok := options[OPT_RECURSIVE]; ok {
+		recursive = isTruthy(value)
+	}
+
+	state := pdr.filterStatesAndReturn(fields[0])
+	if state == nil {
+		return nil, RESPONSE_NO_STATE
+	}
+
+	depth := 1
+	if recursive {
+		depth = 0
+	}
+
+	root, stat := buildTree(state.path.currentDirs(), depth)
+	if stat != STATUS_WALK_SUCCESS {
+		return walkFailureResponse(stat)
+	}
+
+	summary := newDirSummary()
+	for _, child := range root.Children {
+		summary.add(child)
+	}
+
+	return addHeader(state.path.currDir, GLOBAL_SUMMARY_HEADER, []byte(summary.toString())), RESPONSE_SUMMARIZED
+}
+
+func (o requestOptions) toTreeOptions() (string, int, bool) {
+	format := strings.ToLower(o[OPT_FORMAT])
+	if format == "" {
+		format = TREE_FORMAT_TEXT
+	} else if format != TREE_FORMAT_TEXT && format != TREE_FORMAT_JSON {
+		return "", 0, false
+	}
+
+	depth := 0
+	if value, ok := o[OPT_DEPTH]; ok {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return "", 0, false
+		}
+		depth = parsed
+	}
+
+	return format, depth, true
+}
+
+// buildTree goes down at most depth levels, 0 meaning no limit other than
+// the walk budget. Symlinks are shown with their target but not followed,
+// and dirs that cannot be read are shown without children. The trees of all
+// dirs are merged, an entry in an earlier dir hiding one of the same name in
+// a later dir, so a union state gets the tree of its roots overlaid.
+func buildTree(dirs []string, depth int) (*treeNode, successStatus) {
+	if len(dirs) == 0 {
+		return nil, STATUS_NOT_EXISTS
+	}
+
+	statIsDir := checkStatIsDirAndExists(dirs[0])
+	if statIsDir != STATUS_EXISTS {
+		return nil, statIsDir
+	}
+
+	info, err := os.Lstat(dirs[0])
+	if err != nil {
+		return nil, STATUS_WALK_FAIL
+	}
+
+	budget := newWalkBudget(dirs[0])
+	root := newTreeNode(dirs[0], info)
+	root.Type = TREE_TYPE_DIR
+	root.Target = ""
+
+	if err := budget.visitAtDepth(0); err != nil {
+		return nil, budget.stat
+	}
+	if err := fillTree(root, dirs, depth, 1, budget); err != nil {
+		return nil, budget.stat
+	}
+
+	return root, STATUS_WALK_SUCCESS
+}
+
+func fillTree(node *treeNode, dirs []string, depth, level int, budget *walkBudget) error {
+	childDirs := make(map[string][]string)
+
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+
+		for _, entry := range entries {
+			childPath := filepath.Join(dir, entry.Name())
+			if seen, ok := childDirs[entry.Name()]; ok {
+				if len(seen) > 0 && entry.IsDir() {
+					childDirs[entry.Name()] = append(seen, childPath)
+				}
+				continue
+			}
+
+			if err := budget.visitAtDepth(level); err != nil {
+				return err
+			}
+
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+
+			child := newTreeNode(childPath, info)
+			node.Children = append(node.Children, child)
+
+			childDirs[entry.Name()] = nil
+			if child.Type == TREE_TYPE_DIR {
+				childDirs[entry.Name()] = []string{childPath}
+			}
+		}
+	}
+
+	if len(dirs) > 1 {
+		sort.Slice(node.Children, func(i, j int) bool {
+			return node.Children[i].Name < node.Children[j].Name
+		})
+	}
+
+	if depth != 0 && level >= depth {
+		return nil
+	}
+
+	for _, child := range node.Children {
+		if child.Type == TREE_TYPE_DIR {
+			if err := fillTree(child, childDirs[child.Name], depth, level+1, budget); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func newTreeNode(path string, info os.FileInfo) *treeNode {
+	node := treeNode{Name: info.Name(), Type: TREE_TYPE_FILE, Size: info.Size(), path: path, info: info}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		node.Type = TREE_TYPE_LINK
+		node.Target, _ = os.Readlink(path)
+	} else if info.IsDir() {
+		node.Type = TREE_TYPE_DIR
+	}
+
+	return &node
+}
+
+func (tn *treeNode) toString() string {
+	var builder strings.Builder
+	var dirs, files int
+
+	builder.WriteString("\n.")
+	tn.drawChildren(&builder, "", &dirs, &files)
+
+	return fmt.Sprintf("%s\n===\nDirs: %d;\nFiles: %d;", builder.String(), dirs, files)
+}
+
+func (tn *treeNode) drawChildren(builder *strings.Builder, prefix string, dirs, files *int) {
+	for i, child := range tn.Children {
+		branch, indent := TREE_BRANCH, TREE_PIPE
+		if i == len(tn.Children)-1 {
+			branch, indent = TREE_LAST_BRANCH, TREE_SPACE
+		}
+
+		builder.WriteString("\n" + prefix + branch + child.label())
+
+		if child.Type == TREE_TYPE_DIR {
+			*dirs++
+			child.drawChildren(builder, prefix+indent, dirs, files)
+		} else {
+			*files++
+		}
+	}
+}
+
+func (tn *treeNode) label() string {
+	switch tn.Type {
+	case TREE_TYPE_DIR:
+		return tn.Name + "/"
+	case TREE_TYPE_LINK:
+		return tn.Name + TREE_LINK_ARROW + tn.Target
+	}
+
+	return tn.Name
+}
+
+func newDirSummary() *dirSummary {
+	summary := dirSummary{extensions: make(map[string]*histogramBar)}
+	for _, bucket := range summarySizeBuckets {
+		summary.sizes = append(summary.sizes, histogramBar{label: bucket.label})
+	}
+
+	return &summary
+}
+
+// add counts the node and everything below it. Links count on their own and
+// not towards the size, as their target may be counted already.
+func (ds *dirSummary) add(node *treeNode) {
+	switch node.Type {
+	case TREE_TYPE_DIR:
+		ds.dirs++
+		for _, child := range node.Children {
+			ds.add(child)
+		}
+		return
+	case TREE_TYPE_LINK:
+		ds.links++
+		return
+	}
+
+	ds.files++
+	ds.totalSize += node.Size
+
+	ext := filepath.Ext(node.Name)
+	if ext == "" || strings.EqualFold(ext, node.Name) {
+		ext = SUMMARY_NO_EXT
+	}
+	ext = strings.ToLower(ext)
+	bar, ok := ds.extensions[ext]
+	if !ok {
+		bar = &histogramBar{label: ext}
+		ds.extensions[ext] = bar
+	}
+	bar.count++
+	bar.size += node.Size
+
+	for i, bucket := range summarySizeBuckets {
+		if bucket.upTo < 0 || node.Size <= bucket.upTo {
+			ds.sizes[i].count++
+			ds.sizes[i].size += node.Size
+			break
+		}
+	}
+}
+
+func (ds *dirSummary) toString() string {
+	extensions := make([]histogramBar, 0, len(ds.extensions))
+	for _, bar := range ds.extensions {
+		extensions = append(extensions, *bar)
+	}
+	sort.Slice(extensions, func(i, j int) bool {
+		if extensions[i].count != extensions[j].count {
+			return extensions[i].count > extensions[j].count
+		}
+		return extensions[i].label < extensions[j].label
+	})
+
+	finStr := ""
+	for _, bar := range extensions {
+		finStr += fmt.Sprintf("\n#e#ext=%s#count=%d#size=%d", bar.label, bar.count, bar.size)
+	}
+	finStr += "\n==="
+	for _, bar := range ds.sizes {
+		finStr += fmt.Sprintf("\n%%b%%bucket=%s%%count=%d%%size=%d", bar.label, bar.count, bar.size)
+	}
+
+	return fmt.Sprintf("%s\n===\nFiles: %d;\nDirs: %d;\nLinks: %d;\nTotalSize: %d;", finStr, ds.files, ds.dirs, ds.links, ds.totalSize)
+}
@@ -0,0 +1,257 @@
+package protodir
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	PRECEDENCE_FIRST string = "first"
+	PRECEDENCE_LAST  string = "last"
+	UNION_MIN_ROOTS  int    = 2
+)
+
+// INIT_UNION <root>;<root>[;...][;PRECEDENCE=first|last]
+//
+// A union state overlays its roots. Listings have the entries of all roots,
+// and an entry found in several roots is taken from the one with the highest
+// precedence. Dirs of the same name are merged. By default the first root
+// given wins, with PRECEDENCE=last the last one does.
+func (pdr *protoDirState) handleRequestInitUnion(pathOrHash string) ([]byte, responseCode) {
+	fields, success := parsePathOrHashFields(pathOrHash, UNION_MIN_ROOTS, GLOBAL_MAX_FIELDS)
+	if success != STATUS_DID_SPLIT {
+		return []byte(ERR_UNION_ARGS), RESPONSE_PARSE_FAILED
+	}
+
+	roots, optionFields := splitUnionFields(fields)
+	if len(roots) < UNION_MIN_ROOTS {
+		return []byte(ERR_UNION_ARGS), RESPONSE_PARSE_FAILED
+	}
+
+	options, success := parseRequestOptions(optionFields)
+	if success != STATUS_DID_SPLIT {
+		return []byte(ERR_PARSE_OPTION), RESPONSE_BAD_ARGUMENTS
+	}
+
+	switch strings.ToLower(options[OPT_PRECEDENCE]) {
+	case "", PRECEDENCE_FIRST:
+	case PRECEDENCE_LAST:
+		for i, j := 0, len(roots)-1; i < j; i, j = i+1, j-1 {
+			roots[i], roots[j] = roots[j], roots[i]
+		}
+	default:
+		return []byte(ERR_PARSE_OPTION), RESPONSE_BAD_ARGUMENTS
+	}
+
+	hashState := pdr.addNewUnionState(roots)
+
+	return []byte(trimHash(hashState)), RESPONSE_INIT_STATE_OK
+}
+
+// splitUnionFields takes the options off the end of the fields, the rest
+// are the roots. Only known options are taken, a root may have `=` in it.
+func splitUnionFields(fields []string) ([]string, []string) {
+	end := len(fields)
+	for end > 0 {
+		key, _, found := strings.Cut(fields[end-1], GLOBAL_OPTION_SEP)
+		if !found || strings.ToUpper(key) != OPT_PRECEDENCE {
+			break
+		}
+		end--
+	}
+
+	roots := make([]string, 0, end)
+	for _, root := range fields[:end] {
+		roots = append(roots, filepath.Clean(root))
+	}
+
+	return roots, fields[end:]
+}
+
+// unionEntry is an entry of the merged tree of a union state, with its path
+// relative to the current dir and the path on disk it was taken from.
+type unionEntry struct {
+	rel  string
+	path string
+	info os.FileInfo
+}
+
+func (pdr *protoDirState) addNewUnionState(layers []string) string {
+	newState, _ := newPathState(layers[0])
+	newState.hash = hashString(strings.Join(layers, GLOBAL_TUPLE_SEP))
+	newState.path.layers = layers
+	newState.path.layerDir = "."
+
+	pdr.Lock()
+	pdr.states = append(pdr.states, &newState)
+	pdr.Unlock()
+
+	pdr.persistStates()
+
+	return newState.hash
+}
+
+func (p *pathCollective) isUnion() bool {
+	return len(p.layers) > 0
+}
+
+// currentDirs gives the current dir in every root that has it, in order of
+// precedence. A state with a single root only has its current dir.
+func (p *pathCollective) currentDirs() []string {
+	if !p.isUnion() {
+		return []string{p.currDir}
+	}
+
+	dirs := make([]string, 0, len(p.layers))
+	for _, layer := range p.layers {
+		dir := filepath.Join(layer, p.layerDir)
+		if checkStatIsDirAndExists(dir) == STATUS_EXISTS {
+			dirs = append(dirs, dir)
+		}
+	}
+
+	return dirs
+}
+
+// dirOf gives the dir the entity is in on disk, which in a union state is
+// the current dir in the root the entity was taken from.
+func (p *pathCollective) dirOf(entity *entityPath) string {
+	if entity.layer == "" {
+		return p.currDir
+	}
+
+	return filepath.Join(entity.layer, p.layerDir)
+}
+
+// cdToUnionDir changes to relDir in every root. The current dir becomes the
+// one in the root of the highest precedence that has it.
+func (p *pathCollective) cdToUnionDir(relDir string) successStatus {
+	stat := STATUS_NOT_EXISTS
+	for _, layer := range p.layers {
+		dir := filepath.Join(layer, relDir)
+		layerStat := checkStatIsDirAndExists(dir)
+		if layerStat == STATUS_EXISTS {
+			p.currDir, p.layerDir = dir, relDir
+			return STATUS_DID_CD
+		} else if layerStat == STATUS_ISNOTDIR && stat == STATUS_NOT_EXISTS {
+			stat = STATUS_ISNOTDIR
+		}
+	}
+
+	return stat
+}
+
+func (p *pathCollective) unionListing() (dirListing, successStatus) {
+	merged := dirListing{subdirs: make([]string, 0), files: make([]string, 0), layerOf: make(map[string]string)}
+
+	found := false
+	for _, layer := range p.layers {
+		listing, stat := globalDirCache.listDir(filepath.Join(layer, p.layerDir))
+		if stat != STATUS_EXISTS {
+			continue
+		}
+		found = true
+
+		for _, name := range listing.subdirs {
+			if _, seen := merged.layerOf[name]; !seen {
+				merged.subdirs = append(merged.subdirs, name)
+				merged.layerOf[name] = layer
+			}
+		}
+		for _, name := range listing.files {
+			if _, seen := merged.layerOf[name]; !seen {
+				merged.files = append(merged.files, name)
+				merged.layerOf[name] = layer
+			}
+		}
+	}
+
+	if !found {
+		return dirListing{}, STATUS_NOT_EXISTS
+	}
+
+	sort.Strings(merged.subdirs)
+	sort.Strings(merged.files)
+
+	return merged, STATUS_EXISTS
+}
+
+func (p *pathCollective) setUnionFilesAndSubDirs() successStatus {
+	listing, stat := p.unionListing()
+	if stat != STATUS_EXISTS {
+		return stat
+	}
+
+	p.subdirs = make([]entityPath, 0, len(listing.subdirs))
+	for _, name := range listing.subdirs {
+		subdir := newEntityPath(name)
+		subdir.layer = listing.layerOf[name]
+		p.subdirs = append(p.subdirs, subdir)
+	}
+
+	p.files = make([]entityPath, 0, len(listing.files))
+	for _, name := range listing.files {
+		file := newFilePath(name)
+		file.layer = listing.layerOf[name]
+		p.files = append(p.files, file)
+	}
+
+	return STATUS_IS_READ
+}
+
+// walkUnionDir walks the merged tree of dirs, in the same order as walkDir.
+func walkUnionDir(dirs []string) ([]walkedEntityPath, successStatus) {
+	root, stat := buildTree(dirs, 0)
+	if stat != STATUS_WALK_SUCCESS {
+		return nil, stat
+	}
+
+	results := make([]walkedEntityPath, 0)
+	var flatten func(node *treeNode)
+	flatten = func(node *treeNode) {
+		if node.Type == TREE_TYPE_DIR {
+			results = append(results, newWalkedEntityPath(GLOBAL_DIRPATH, node.Name, node.Size))
+		} else {
+			results = append(results, newWalkedEntityPath(GLOBAL_FILEPATH, node.Name, node.Size))
+		}
+		for _, child := range node.Children {
+			flatten(child)
+		}
+	}
+	flatten(root)
+
+	return results, STATUS_WALK_SUCCESS
+}
+
+// walkUnionEntries gives every entry of the merged tree of dirs, the dir
+// itself left out, for the commands that need more than walkUnionDir gives.
+func walkUnionEntries(dirs []string) ([]unionEntry, successStatus) {
+	root, stat := buildTree(dirs, 0)
+	if stat != STATUS_WALK_SUCCESS {
+		return nil, stat
+	}
+
+	entries := make([]unionEntry, 0)
+	var flatten func(node *treeNode, rel string)
+	flatten = func(node *treeNode, rel string) {
+		for _, child := range node.Children {
+			childRel := filepath.Join(rel, child.Name)
+			entries = append(entries, unionEntry{rel: childRel, path: child.path, info: child.info})
+			flatten(child, childRel)
+		}
+	}
+	flatten(root, "")
+
+	return entries, STATUS_WALK_SUCCESS
+}
+
+func rootLine(entity *entityPath) string {
+	if entity.layer == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("\nRoot: %s;", entity.layer)
+}
@@ -0,0 +1,117 @@
+package protodir
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestUnionRoots makes two roots that overlap: common.txt and
+// shared/x.txt are in both, and kind is a file in the first and a dir in
+// the second. common.txt of the second has the same content as a_only.txt
+// and b_only.txt.
+func newTestUnionRoots(t *testing.T) (string, string) {
+	t.Helper()
+
+	first, second := t.TempDir(), t.TempDir()
+	files := []struct {
+		root, rel, contents string
+	}{
+		{first, "common.txt", "A\n"},
+		{first, "a_only.txt", "dup\n"},
+		{first, "shared/x.txt", "Ax\n"},
+		{first, "kind", "file\n"},
+		{second, "common.txt", "dup\n"},
+		{second, "b_only.txt", "dup\n"},
+		{second, "shared/x.txt", "Bx, longer\n"},
+		{second, "shared/y.txt", "y\n"},
+		{second, "kind/inner.txt", "inner\n"},
+	}
+	for _, file := range files {
+		path := filepath.Join(file.root, file.rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(file.contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return first, second
+}
+
+func TestUnionPrecedence(t *testing.T) {
+	first, second := newTestUnionRoots(t)
+
+	tests := []struct {
+		options   string
+		winner    string
+		wantTree  string
+		wantWalk  string
+		wantDupes string
+		wantSizes map[string]int64
+	}{
+		{
+			"",
+			first,
+			".\n├── a_only.txt\n├── b_only.txt\n├── common.txt\n├── kind\n└── shared/\n    ├── x.txt\n    └── y.txt\n===\nDirs: 1;\nFiles: 6;",
+			"*f*path=a_only.txt*size=4\n*f*path=b_only.txt*size=4\n*f*path=common.txt*size=2\n*f*path=kind*size=5\n" +
+				"+d+path=shared+size=4096\n*f*path=x.txt*size=3\n*f*path=y.txt*size=2",
+			"*f*path=a_only.txt\n*f*path=b_only.txt\n===\nGroups: 1;",
+			map[string]int64{"common.txt": 2, "kind": 5, "shared/x.txt": 3, "shared/y.txt": 2, "kind/inner.txt": -1},
+		},
+		{
+			";PRECEDENCE=last",
+			second,
+			".\n├── a_only.txt\n├── b_only.txt\n├── common.txt\n├── kind/\n│   └── inner.txt\n└── shared/\n    ├── x.txt\n    └── y.txt\n===\nDirs: 2;\nFiles: 6;",
+			"*f*path=a_only.txt*size=4\n*f*path=b_only.txt*size=4\n*f*path=common.txt*size=4\n+d+path=kind+size=4096\n*f*path=inner.txt*size=6\n" +
+				"+d+path=shared+size=4096\n*f*path=x.txt*size=11\n*f*path=y.txt*size=2",
+			"*f*path=a_only.txt\n*f*path=b_only.txt\n*f*path=common.txt\n===\nGroups: 1;",
+			map[string]int64{"common.txt": 4, "kind/inner.txt": 6, "shared/x.txt": 11, "shared/y.txt": 2},
+		},
+	}
+
+	for _, test := range tests {
+		pdr := &protoDirState{
+			states:    make([]*pathState, 0),
+			snapshots: make(map[string]map[string]dirSnapshot),
+		}
+		state, code := askDir(pdr, "INIT_UNION %s;%s%s", first, second, test.options)
+		if code != RESPONSE_INIT_STATE_OK {
+			t.Fatalf("INIT_UNION%s: got %d %q", test.options, code, state)
+		}
+		if body, code := askDir(pdr, "CD_SUBDIR %s;%s", state, state); code != RESPONSE_CD_SUBDIR_OK {
+			t.Fatalf("CD_SUBDIR%s: got %d %q", test.options, code, body)
+		}
+
+		header := func(name string) string { return "$" + name + ": " + test.winner + ";\n\n" }
+		if body, _ := askDir(pdr, "TREE %s", state); body != header(GLOBAL_TREE_HEADER)+test.wantTree {
+			t.Errorf("TREE%s: got %q, want %q", test.options, body, test.wantTree)
+		}
+		if body, _ := askDir(pdr, "WALK_TREE %s", state); !strings.HasSuffix(body, test.wantWalk) {
+			t.Errorf("WALK_TREE%s: got %q, want it to end in %q", test.options, body, test.wantWalk)
+		}
+		if body, _ := askDir(pdr, "FIND_DUPES %s", state); !strings.Contains(body, test.wantDupes) {
+			t.Errorf("FIND_DUPES%s: got %q, want %q", test.options, body, test.wantDupes)
+		}
+
+		if body, code := askDir(pdr, "SNAPSHOT %s;s", state); code != RESPONSE_SNAPSHOT_TAKEN {
+			t.Fatalf("SNAPSHOT%s: got %d %q", test.options, code, body)
+		}
+		snapshot, _ := pdr.getSnapshot(state, "s")
+		for rel, want := range test.wantSizes {
+			entry, ok := snapshot.entries[rel]
+			if want == -1 && ok {
+				t.Errorf("SNAPSHOT%s: has %s, which is hidden", test.options, rel)
+			} else if want != -1 && (!ok || entry.size != want) {
+				t.Errorf("SNAPSHOT%s: %s is %+v, want size %d", test.options, rel, entry, want)
+			}
+		}
+
+		body, _ := askDir(pdr, "READ_BYTES %s;%s", state, testFileHash(t, pdr, state, "common.txt"))
+		if want := "$READ_BYTES: " + filepath.Join(test.winner, "common.txt") + ";"; !strings.HasPrefix(body, want) {
+			t.Errorf("READ_BYTES%s common.txt: got %q, want it from %s", test.options, body, test.winner)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package protodir
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	VERSION_META_PREFIX    string = "m-"
+	VERSION_CONTENT_PREFIX string = "c-"
+	VERSION_META           string = "META"
+	VERSION_CONTENT        string = "CONTENT"
+)
+
+type entityVersion struct {
+	token   string
+	modTime time.Time
+}
+
+type readCondition struct {
+	ifNoneMatch      string
+	ifModifiedSince  time.Time
+	hasModifiedSince bool
+	byContent        bool
+}
+
+// versionOfEntity returns an ETag-like token for the entity. By default it is
+// derived from size, modification time and inode, which is cheap but changes
+// on a touch. The content token hashes the whole file instead.
+func versionOfEntity(path string, info os.FileInfo, byContent bool) entityVersion {
+	version := entityVersion{modTime: info.ModTime()}
+
+	if byContent && !info.IsDir() {
+		if token, ok := contentVersionToken(path); ok {
+			version.token = token
+			return version
+		}
+	}
+
+	hasher := fnv.New64a()
+	fmt.Fprintf(hasher, "%d-%d-%d", info.Size(), info.ModTime().UnixNano(), inodeOf(info))
+	version.token = VERSION_META_PREFIX + hex.EncodeToString(hasher.Sum(nil))
+
+	return version
+}
+
+func contentVersionToken(path string) (string, bool) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", false
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", false
+	}
+
+	return contentToken(hasher.Sum(nil)), true
+}
+
+// contentVersionOf is the content token of bytes already read, so the token
+// is sure to describe them.
+func contentVersionOf(contents []byte) string {
+	sum := sha256.Sum256(contents)
+
+	return contentToken(sum[:])
+}
+
+func contentToken(sum []byte) string {
+	return VERSION_CONTENT_PREFIX + hex.EncodeToString(sum)[:32]
+}
+
+func (p pathCollective) filterAndVersionFile(hash string) (entityVersion, string, successStatus) {
+	file := p.getFileByHash(hash)
+	if file == nil {
+		return entityVersion{}, "", STATUS_NO_HASH
+	}
+
+	path := filepath.Join(p.dirOf(file), file.path)
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return entityVersion{}, "", STATUS_NOT_EXISTS
+	} else if err != nil {
+		return entityVersion{}, "", STATUS_DID_FAIL
+	}
+
+	if info.IsDir() {
+		return entityVersion{}, "", STATUS_ISNOTFILE
+	}
+
+	return versionOfEntity(path, info, false), path, STATUS_DID_STAT
+}
+
+// VERSION=META|CONTENT
+func (ro requestOptions) versionByContent() (bool, bool) {
+	version, ok := ro[OPT_VERSION]
+	if !ok {
+		return false, true
+	}
+
+	switch strings.ToUpper(version) {
+	case VERSION_META:
+		return false, true
+	case VERSION_CONTENT:
+		return true, true
+	}
+
+	return false, false
+}
+
+// IF_NONE_MATCH=<version>
+// IF_MODIFIED_SINCE=<unix seconds or RFC3339>
+func (ro requestOptions) toReadCondition() (readCondition, bool) {
+	byContent, ok := ro.versionByContent()
+	if !ok {
+		return readCondition{}, false
+	}
+
+	cond := readCondition{byContent: byContent}
+
+	if token, ok := ro[OPT_IF_NONE_MATCH]; ok {
+		if len(token) == 0 {
+			return readCondition{}, false
+		}
+		cond.ifNoneMatch = token
+		cond.byContent = cond.byContent || strings.HasPrefix(token, VERSION_CONTENT_PREFIX)
+	}
+
+	if since, ok := ro[OPT_IF_MODIFIED_SINCE]; ok {
+		parsed, ok := parseModifiedSince(since)
+		if !ok {
+			return readCondition{}, false
+		}
+		cond.ifModifiedSince, cond.hasModifiedSince = parsed, true
+	}
+
+	return cond, true
+}
+
+// isModified follows HTTP semantics: when a version is given the modification
+// time is not looked at.
+func (rc readCondition) isModified(version entityVersion) bool {
+	if rc.ifNoneMatch != "" {
+		return rc.ifNoneMatch != version.token
+	}
+
+	if rc.hasModifiedSince {
+		return version.modTime.Truncate(time.Second).After(rc.ifModifiedSince)
+	}
+
+	return true
+}
+
+func parseModifiedSince(since string) (time.Time, bool) {
+	if seconds, err := strconv.ParseInt(since, 10, 64); err == nil {
+		return time.Unix(seconds, 0), true
+	}
+
+	parsed, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return parsed, true
+}
+
+// addVersionHeader always adds the header, with no value when there is no
+// version, as when the file could not be looked at. Clients take the line
+// after the path for the version, so leaving it out would have them take
+// the first line of a file starting with `$` for it.
+func addVersionHeader(version entityVersion, contents []byte) []byte {
+	header := []byte(fmt.Sprintf("%s%s: %s;\n", GLOBAL_HEADER_PREFIX, GLOBAL_VERSION_HEADER, version.token))
+
+	return append(header, contents...)
+}
@@ -0,0 +1,59 @@
+package protodir
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadBytesConditions(t *testing.T) {
+	pdr, state, root := newTestState(t, map[string]string{"a.txt": "hello\n"})
+	file := testFileHash(t, pdr, state, "a.txt")
+	pathHeader := fmt.Sprintf("$READ_BYTES: %s;\n", filepath.Join(root, "a.txt"))
+
+	versionOf := func(options string) string {
+		body, code := askDir(pdr, "READ_BYTES %s;%s%s", state, file, options)
+		if code != RESPONSE_READ_FILE_OK {
+			t.Fatalf("READ_BYTES%s: got %d %q", options, code, body)
+		}
+		version, _, _ := strings.Cut(strings.TrimPrefix(body, pathHeader+"$VERSION: "), ";")
+		return version
+	}
+	version, contentVersion := versionOf(""), versionOf(";VERSION=content")
+	if !strings.HasPrefix(version, "m-") || !strings.HasPrefix(contentVersion, "c-") {
+		t.Fatalf("versions = %q and %q, want an m- and a c- token", version, contentVersion)
+	}
+
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	tests := []struct {
+		options  string
+		wantCode responseCode
+		want     string
+	}{
+		{"", RESPONSE_READ_FILE_OK, "$VERSION: " + version + ";\nhello\n"},
+		{";IF_NONE_MATCH=" + version, RESPONSE_NOT_MODIFIED, "$VERSION: " + version + ";\n"},
+		{";IF_NONE_MATCH=m-0", RESPONSE_READ_FILE_OK, "$VERSION: " + version + ";\nhello\n"},
+		{";IF_MODIFIED_SINCE=" + future, RESPONSE_NOT_MODIFIED, "$VERSION: " + version + ";\n"},
+		{";IF_MODIFIED_SINCE=0", RESPONSE_READ_FILE_OK, "$VERSION: " + version + ";\nhello\n"},
+		{";IF_NONE_MATCH=m-0;IF_MODIFIED_SINCE=" + future, RESPONSE_READ_FILE_OK, "$VERSION: " + version + ";\nhello\n"},
+		{";VERSION=content;IF_NONE_MATCH=" + contentVersion, RESPONSE_NOT_MODIFIED, "$VERSION: " + contentVersion + ";\n"},
+		{";VERSION=content;IF_NONE_MATCH=" + version, RESPONSE_READ_FILE_OK, "$VERSION: " + contentVersion + ";\nhello\n"},
+	}
+
+	for _, test := range tests {
+		body, code := askDir(pdr, "READ_BYTES %s;%s%s", state, file, test.options)
+		if code != test.wantCode || body != pathHeader+test.want {
+			t.Errorf("READ_BYTES%s: got %d %q, want %d %q", test.options, code, body, test.wantCode, pathHeader+test.want)
+		}
+	}
+}
+
+func TestVersionHeaderWithoutVersion(t *testing.T) {
+	got := string(addVersionHeader(entityVersion{}, []byte("$HOME: /root;\n")))
+	if want := "$VERSION: ;\n$HOME: /root;\n"; got != want {
+		t.Errorf("addVersionHeader = %q, want %q", got, want)
+	}
+}
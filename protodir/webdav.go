@@ -0,0 +1,486 @@
+package protodir
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	HTTP_DAV_PREFIX   string      = "/dav/"
+	DAV_NAMESPACE     string      = "DAV:"
+	DAV_READ_METHODS  string      = "OPTIONS, PROPFIND, GET, HEAD"
+	DAV_WRITE_METHODS string      = "PUT, MKCOL, DELETE, MOVE, COPY"
+	DAV_PUT_TEMP      string      = ".protodir_put-*.tmp"
+	DAV_PUT_MODE      fs.FileMode = 0644
+)
+
+// davHandler is a WebDAV class 1 server over the same resolution as the rest
+// of the HTTP gateway. Write methods are only allowed if it is writable.
+type davHandler struct {
+	gateway  *httpGateway
+	writable bool
+}
+
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	Namespace string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+type davResponse struct {
+	Href     string      `xml:"D:href"`
+	Propstat davPropstat `xml:"D:propstat"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+type davProp struct {
+	DisplayName   string          `xml:"D:displayname"`
+	ResourceType  davResourceType `xml:"D:resourcetype"`
+	ContentLength *int64          `xml:"D:getcontentlength,omitempty"`
+	ContentType   string          `xml:"D:getcontenttype,omitempty"`
+	LastModified  string          `xml:"D:getlastmodified"`
+	ETag          string          `xml:"D:getetag"`
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection,omitempty"`
+}
+
+type davError struct {
+	XMLName    xml.Name  `xml:"D:error"`
+	Namespace  string    `xml:"xmlns:D,attr"`
+	FiniteOnly *struct{} `xml:"D:propfind-finite-depth,omitempty"`
+}
+
+func (dh *davHandler) serve(w http.ResponseWriter, r *http.Request, session *httpSession) {
+	if !dh.allowMethod(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodOptions:
+		dh.handleOptions(w)
+	case "PROPFIND":
+		dh.handlePropfind(w, r, session)
+	case http.MethodGet, http.MethodHead:
+		dh.handleGet(w, r, session)
+	case http.MethodPut:
+		dh.handlePut(w, r, session)
+	case "MKCOL":
+		dh.handleMkcol(w, r, session)
+	case http.MethodDelete:
+		dh.handleDelete(w, r, session)
+	case "MOVE", "COPY":
+		dh.handleMoveOrCopy(w, r, session)
+	}
+}
+
+func (dh *davHandler) allowMethod(w http.ResponseWriter, r *http.Request) bool {
+	allowed := dh.allowedMethods()
+	for _, method := range strings.Split(allowed, ", ") {
+		if method == r.Method {
+			return true
+		}
+	}
+
+	w.Header().Set("Allow", allowed)
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	return false
+}
+
+func (dh *davHandler) allowedMethods() string {
+	if dh.writable {
+		return DAV_READ_METHODS + ", " + DAV_WRITE_METHODS
+	}
+
+	return DAV_READ_METHODS
+}
+
+func (dh *davHandler) handleOptions(w http.ResponseWriter) {
+	w.Header().Set("DAV", "1")
+	w.Header().Set("MS-Author-Via", "DAV")
+	w.Header().Set("Allow", dh.allowedMethods())
+	w.WriteHeader(http.StatusOK)
+}
+
+// PROPFIND answers with every property it knows, whatever the body asks for.
+// Depth infinity is refused, a walk of the whole tree is what WALK_TREE is for.
+func (dh *davHandler) handlePropfind(w http.ResponseWriter, r *http.Request, session *httpSession) {
+	io.Copy(io.Discard, r.Body)
+
+	depth := r.Header.Get("Depth")
+	if depth != "0" && depth != "1" {
+		writeDavXml(w, http.StatusForbidden, davError{Namespace: DAV_NAMESPACE, FiniteOnly: &struct{}{}})
+		return
+	}
+
+	entity, stat := session.resolve(davPathOf(r))
+	if stat != STATUS_EXISTS {
+		writeHttpStatus(w, stat)
+		return
+	}
+
+	multistatus := davMultistatus{Namespace: DAV_NAMESPACE, Responses: make([]davResponse, 0)}
+	if response, ok := davResponseOf(entity.path, entity.urlPath); ok {
+		multistatus.Responses = append(multistatus.Responses, response)
+	}
+
+	if depth == "1" && entity.ty == GLOBAL_DIRPATH {
+		entities := append(append(make([]entityPath, 0), entity.collective.subdirs...), entity.collective.files...)
+		for _, child := range entities {
+			childPath := filepath.Join(entity.collective.currDir, child.path)
+			if !isInJail(dh.gateway.realRoot, childPath) {
+				continue
+			}
+			if response, ok := davResponseOf(childPath, path.Join(entity.urlPath, child.path)); ok {
+				multistatus.Responses = append(multistatus.Responses, response)
+			}
+		}
+	}
+
+	writeDavXml(w, http.StatusMultiStatus, multistatus)
+}
+
+func (dh *davHandler) handleGet(w http.ResponseWriter, r *http.Request, session *httpSession) {
+	entity, stat := session.resolve(davPathOf(r))
+	if stat != STATUS_EXISTS {
+		writeHttpStatus(w, stat)
+		return
+	}
+
+	if entity.ty == GLOBAL_DIRPATH {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		handleError(listingTemplate.Execute(w, entity.toListing(HTTP_DAV_PREFIX, dh.gateway.realRoot)))
+		return
+	}
+
+	session.serveFile(w, r, entity)
+}
+
+// PUT writes the body next to the target first and renames it over the
+// target, so readers never see a half written file. The body is bound by the
+// read limit, a file that could not be read back is not written, and the
+// file keeps the mode of the one it replaces.
+func (dh *davHandler) handlePut(w http.ResponseWriter, r *http.Request, session *httpSession) {
+	target, stat := session.resolveTarget(davPathOf(r))
+	if stat != STATUS_EXISTS {
+		writeDavTargetStatus(w, stat)
+		return
+	}
+
+	info, err := os.Stat(target)
+	if err == nil && info.IsDir() {
+		http.Error(w, RESPONSE_IS_NOT_FILE.text(), http.StatusMethodNotAllowed)
+		return
+	}
+	existed := err == nil
+	mode := DAV_PUT_MODE
+	if existed {
+		mode = info.Mode().Perm()
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(target), DAV_PUT_TEMP)
+	if err != nil {
+		writeHttpStatus(w, STATUS_DID_FAIL)
+		return
+	}
+	defer os.Remove(temp.Name())
+
+	body := http.MaxBytesReader(w, r.Body, globalLimits.MaxReadBytes)
+	_, err = io.Copy(temp, body)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		session.code = RESPONSE_READ_TOO_LARGE
+		writeHttpStatus(w, STATUS_TOO_LARGE)
+		return
+	}
+
+	if err == nil {
+		err = os.Chmod(temp.Name(), mode)
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), target)
+	}
+	if err != nil {
+		writeHttpStatus(w, STATUS_DID_FAIL)
+		return
+	}
+
+	if existed {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func (dh *davHandler) handleMkcol(w http.ResponseWriter, r *http.Request, session *httpSession) {
+	if n, _ := io.Copy(io.Discard, r.Body); n > 0 {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	target, stat := session.resolveTarget(davPathOf(r))
+	if stat != STATUS_EXISTS {
+		writeDavTargetStatus(w, stat)
+		return
+	}
+
+	if _, err := os.Lstat(target); err == nil {
+		w.Header().Set("Allow", dh.allowedMethods())
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := os.Mkdir(target, 0755); err != nil {
+		writeHttpStatus(w, STATUS_DID_FAIL)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (dh *davHandler) handleDelete(w http.ResponseWriter, r *http.Request, session *httpSession) {
+	entity, stat := session.resolve(davPathOf(r))
+	if stat == STATUS_EXISTS && entity.urlPath == HTTP_URL_SEP {
+		stat = STATUS_OUT_OF_JAIL
+	}
+	if stat != STATUS_EXISTS {
+		writeHttpStatus(w, stat)
+		return
+	}
+
+	if err := os.RemoveAll(entity.path); err != nil {
+		writeHttpStatus(w, STATUS_DID_FAIL)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// MOVE and COPY take their target from the Destination header, which has to
+// be on this server and under the DAV prefix. An existing target is only
+// replaced if Overwrite is not F.
+func (dh *davHandler) handleMoveOrCopy(w http.ResponseWriter, r *http.Request, session *httpSession) {
+	source, stat := session.resolve(davPathOf(r))
+	if stat == STATUS_EXISTS && source.urlPath == HTTP_URL_SEP {
+		stat = STATUS_OUT_OF_JAIL
+	}
+	if stat != STATUS_EXISTS {
+		writeHttpStatus(w, stat)
+		return
+	}
+
+	destPath, status := davDestinationOf(r)
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+
+	target, stat := session.resolveTarget(destPath)
+	if stat != STATUS_EXISTS {
+		writeDavTargetStatus(w, stat)
+		return
+	}
+
+	if target == source.path || strings.HasPrefix(target, source.path+string(filepath.Separator)) {
+		http.Error(w, "destination is the source or inside it", http.StatusForbidden)
+		return
+	}
+
+	_, err := os.Lstat(target)
+	existed := err == nil
+	if existed && r.Header.Get("Overwrite") == "F" {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	} else if existed {
+		if err := os.RemoveAll(target); err != nil {
+			writeHttpStatus(w, STATUS_DID_FAIL)
+			return
+		}
+	}
+
+	if r.Method == "MOVE" {
+		err = os.Rename(source.path, target)
+	} else {
+		err = copyEntity(source.path, target, r.Header.Get("Depth") == "0")
+	}
+	if err != nil {
+		writeHttpStatus(w, STATUS_DID_FAIL)
+		return
+	}
+
+	if existed {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// resolveTarget resolves the parent of a path that may not exist yet, for
+// the methods that create entities. It returns STATUS_NO_HASH if the parent
+// is missing, which DAV reports as a conflict.
+func (hs *httpSession) resolveTarget(urlPath string) (string, successStatus) {
+	segments, ok := splitUrlPath(urlPath)
+	if !ok || len(segments) == 0 {
+		hs.code = RESPONSE_OUT_OF_JAIL
+		return "", STATUS_OUT_OF_JAIL
+	}
+
+	parent, stat := hs.resolve(strings.Join(segments[:len(segments)-1], HTTP_URL_SEP))
+	if stat == STATUS_NOT_EXISTS || (stat == STATUS_EXISTS && parent.ty != GLOBAL_DIRPATH) {
+		return "", STATUS_NO_HASH
+	} else if stat != STATUS_EXISTS {
+		return "", stat
+	}
+
+	target := filepath.Join(parent.path, segments[len(segments)-1])
+	hs.path = target
+	if !isInJail(hs.gateway.realRoot, target) {
+		hs.code = RESPONSE_OUT_OF_JAIL
+		return "", STATUS_OUT_OF_JAIL
+	}
+
+	return target, STATUS_EXISTS
+}
+
+func davResponseOf(entityPath, urlPath string) (davResponse, bool) {
+	info, err := os.Stat(entityPath)
+	if err != nil {
+		return davResponse{}, false
+	}
+
+	href := HTTP_DAV_PREFIX + strings.TrimPrefix(urlPath, HTTP_URL_SEP)
+	prop := davProp{
+		DisplayName:  info.Name(),
+		LastModified: info.ModTime().UTC().Format(http.TimeFormat),
+		ETag:         `"` + versionOfEntity(entityPath, info, false).token + `"`,
+	}
+
+	if info.IsDir() {
+		prop.ResourceType.Collection = &struct{}{}
+		if !strings.HasSuffix(href, HTTP_URL_SEP) {
+			href += HTTP_URL_SEP
+		}
+	} else {
+		size := info.Size()
+		prop.ContentLength = &size
+		prop.ContentType = mime.TypeByExtension(filepath.Ext(info.Name()))
+	}
+
+	return davResponse{
+		Href:     escapeUrlPath(href),
+		Propstat: davPropstat{Prop: prop, Status: "HTTP/1.1 200 OK"},
+	}, true
+}
+
+func davPathOf(r *http.Request) string {
+	return strings.TrimPrefix(r.URL.Path, HTTP_DAV_PREFIX)
+}
+
+func davDestinationOf(r *http.Request) (string, int) {
+	dest, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || dest.Path == "" {
+		return "", http.StatusBadRequest
+	} else if dest.Host != "" && dest.Host != r.Host {
+		return "", http.StatusBadGateway
+	} else if !strings.HasPrefix(dest.Path, HTTP_DAV_PREFIX) {
+		return "", http.StatusForbidden
+	}
+
+	return strings.TrimPrefix(dest.Path, HTTP_DAV_PREFIX), http.StatusOK
+}
+
+// copyEntity copies a file, or a dir with everything under it unless shallow
+// is set. The copy is bound by the same walk budget as WALK_TREE.
+func copyEntity(source, target string, shallow bool) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	} else if !info.IsDir() {
+		return copyFile(source, target, info.Mode())
+	} else if shallow {
+		return os.Mkdir(target, info.Mode().Perm())
+	}
+
+	budget := newWalkBudget(source)
+	return filepath.WalkDir(source, func(entryPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if err := budget.visit(entryPath); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(source, entryPath)
+		if err != nil {
+			return err
+		}
+
+		entryInfo, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return os.Mkdir(filepath.Join(target, rel), entryInfo.Mode().Perm())
+		} else if !d.Type().IsRegular() {
+			return nil
+		}
+
+		return copyFile(entryPath, filepath.Join(target, rel), entryInfo.Mode())
+	})
+}
+
+func copyFile(source, target string, mode os.FileMode) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_EXCL, mode.Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+func writeDavTargetStatus(w http.ResponseWriter, stat successStatus) {
+	if stat == STATUS_NO_HASH {
+		http.Error(w, RESPONSE_NO_DIR.text(), http.StatusConflict)
+		return
+	}
+
+	writeHttpStatus(w, stat)
+}
+
+func writeDavXml(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	handleError(xml.NewEncoder(w).Encode(value))
+}
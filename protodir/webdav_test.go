@@ -0,0 +1,65 @@
+package protodir
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDavPut(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "old.txt"), []byte("old"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	limits := globalLimits
+	globalLimits.MaxReadBytes = 8
+	t.Cleanup(func() { globalLimits = limits })
+
+	handler, err := NewHttpHandler(root, true)
+	if err != nil {
+		t.Fatalf("NewHttpHandler: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantMode   os.FileMode
+	}{
+		{"new.txt", "new", http.StatusCreated, DAV_PUT_MODE},
+		{"old.txt", "replaced", http.StatusNoContent, 0o640},
+		{"big.txt", "more than eight", http.StatusRequestEntityTooLarge, 0},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPut, HTTP_DAV_PREFIX+test.name, strings.NewReader(test.body))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != test.wantStatus {
+			t.Errorf("PUT %s: status = %d, want %d", test.name, rec.Code, test.wantStatus)
+		}
+
+		info, err := os.Stat(filepath.Join(root, test.name))
+		if test.wantMode == 0 {
+			if err == nil {
+				t.Errorf("PUT %s: file was written over the limit", test.name)
+			}
+			continue
+		}
+		if err != nil || info.Mode().Perm() != test.wantMode {
+			t.Errorf("PUT %s: stat = %v, %v, want mode %v", test.name, info, err, test.wantMode)
+		}
+	}
+
+	entries, _ := os.ReadDir(root)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".protodir_put-") {
+			t.Errorf("temporary file %s was left behind", entry.Name())
+		}
+	}
+}
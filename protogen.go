@@ -5,12 +5,14 @@ import (
 	"os"
 	"os/signal"
 	"protogen/protodir"
+	"protogen/protodir/shell"
 	"protogen/protomath"
 	"protogen/protoquote"
 	"protogen/prototype"
 	"regexp"
 	"strconv"
 	"syscall"
+	"time"
 )
 
 type programFunction int
@@ -19,6 +21,8 @@ const (
 	PROTOQUOTE programFunction = 0
 	PROTODIR   programFunction = 1
 	PROTOMATH  programFunction = 2
+	DIRSHELL   programFunction = 3
+	DIRHTTP    programFunction = 4
 	NONE       programFunction = -1
 )
 
@@ -41,15 +45,14 @@ func main() {
 	restArgs := prototype.StrSlice(os.Args[2:])
 
 	progFunc, protoName, cleanerUpper := getProgFunc(firstArg)
+	fmt.Printf("Starting ProtoGen on %s\n", protoName)
 	go progFunc.executeSuitable(restArgs)
 
-	pollForExit(protoName, cleanerUpper)
+	pollForExit(cleanerUpper)
 
 }
 
-func pollForExit(proto string, cleanerUpper func()) {
-	fmt.Printf("Starting ProtoGen on %s\n", proto)
-
+func pollForExit(cleanerUpper func()) {
 	c := make(chan os.Signal, 1)
 	finish := make(chan int)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
@@ -67,6 +70,10 @@ func getProgFunc(firstArg string) (programFunction, string, func()) {
 		return PROTOQUOTE, "ProtoQuote", protoquote.CleanUpProtoQuote
 	case "dir", "protodir":
 		return PROTODIR, "ProtoDir", protodir.CleanUpProtoDir
+	case "dir-shell":
+		return DIRSHELL, "ProtoDir Shell", shell.CleanUpDirShell
+	case "dir-http":
+		return DIRHTTP, "ProtoDir HTTP", protodir.CleanUpProtoDirHttp
 	case "math", "protomath":
 		return PROTOMATH, "ProtoMath", protomath.CleanUpProtoMath
 	default:
@@ -84,15 +91,31 @@ func (prg programFunction) executeSuitable(argsSlice prototype.StrSlice) {
 		interval := parseAndCheckInterval(getArgOut(argsSlice, "-i", "--interval", false))
 		protoquote.ProtoQuoteMain(address, interval)
 	case PROTODIR:
-		checkArgsSliceLen(argsSlice, 2, 6)
+		checkArgsSliceLen(argsSlice, 2, 26)
 		path := checkUnixPath(getArgOut(argsSlice, "-p", "--path", true))
 		ttl := parseAndCheckTtl(getArgOut(argsSlice, "-t", "--ttl", false))
 		clearInterval := parseAndCheckClearInterval(getArgOut(argsSlice, "-c", "--clear_interval", false))
-		protodir.ProtoDirMain(path, ttl, clearInterval)
+		limits := parseAndCheckDirLimits(argsSlice)
+		stateDir := checkStateDir(getArgOut(argsSlice, "-s", "--state_dir", false))
+		auditLog := getArgOut(argsSlice, "-l", "--audit-log", false)
+		protodir.ProtoDirMain(path, ttl, clearInterval, limits, stateDir, auditLog)
 	case PROTOMATH:
 		checkArgsSliceLen(argsSlice, 2, 2)
 		address := checkHostAddr(getArgOut(argsSlice, "-a", "--addr", true))
 		protomath.ProtoMathMain(address)
+	case DIRSHELL:
+		checkArgsSliceLen(argsSlice, 2, 4)
+		path := checkUnixPath(getArgOut(argsSlice, "-p", "--path", true))
+		root := getArgOut(argsSlice, "-r", "--root", false)
+		shell.DirShellMain(path, root)
+	case DIRHTTP:
+		checkArgsSliceLen(argsSlice, 4, 22)
+		address := checkHostAddr(getArgOut(argsSlice, "-a", "--addr", true))
+		root := getArgOut(argsSlice, "-r", "--root", true)
+		writable := parseAndCheckWritable(getArgOut(argsSlice, "-w", "--writable", false))
+		limits := parseAndCheckSharedDirLimits(argsSlice, protodir.DefaultProtoDirLimits())
+		auditLog := getArgOut(argsSlice, "-l", "--audit-log", false)
+		protodir.ProtoDirHttpMain(address, root, writable, limits, auditLog)
 	case NONE:
 		errorOutStr("No valid subsystem given as first argument")
 	}
@@ -140,6 +163,53 @@ func parseAndCheckTtl(arg string) int {
 	return int(integer)
 }
 
+func parseAndCheckWritable(arg string) bool {
+	switch arg {
+	case "", "no", "false":
+		return false
+	case "yes", "true":
+		return true
+	}
+
+	errorOutStr("Writable must be yes or no")
+	return false
+}
+
+func parseAndCheckDirLimits(argsSlice prototype.StrSlice) protodir.ProtoDirLimits {
+	limits := protodir.DefaultProtoDirLimits()
+	limits.MaxRequestBytes = int(parseAndCheckLimit(getArgOut(argsSlice, "-q", "--max_request", false), "max request size", uint64(limits.MaxRequestBytes)))
+
+	return parseAndCheckSharedDirLimits(argsSlice, limits)
+}
+
+// parseAndCheckSharedDirLimits parses the limits dir and dir-http share. The
+// max request size is left out, as dir-http gets HTTP requests instead.
+func parseAndCheckSharedDirLimits(argsSlice prototype.StrSlice, limits protodir.ProtoDirLimits) protodir.ProtoDirLimits {
+	limits.MaxReadBytes = int64(parseAndCheckLimit(getArgOut(argsSlice, "-b", "--max_read", false), "max read bytes", uint64(limits.MaxReadBytes)))
+	limits.MaxWalkEntries = int(parseAndCheckLimit(getArgOut(argsSlice, "-e", "--max_walk_entries", false), "max walk entries", uint64(limits.MaxWalkEntries)))
+	limits.MaxWalkDepth = int(parseAndCheckLimit(getArgOut(argsSlice, "-d", "--max_walk_depth", false), "max walk depth", uint64(limits.MaxWalkDepth)))
+	limits.MaxConnections = int(parseAndCheckLimit(getArgOut(argsSlice, "-n", "--max_conns", false), "max connections", uint64(limits.MaxConnections)))
+	budget := parseAndCheckLimit(getArgOut(argsSlice, "-B", "--time_budget", false), "time budget", uint64(limits.TimeBudget/time.Second))
+	limits.TimeBudget = time.Second * time.Duration(budget)
+	limits.CacheEntries = int(parseAndCheckLimit(getArgOut(argsSlice, "-k", "--cache_entries", false), "cache entries", uint64(limits.CacheEntries)))
+	limits.CacheBytes = int64(parseAndCheckLimit(getArgOut(argsSlice, "-m", "--cache_bytes", false), "cache bytes", uint64(limits.CacheBytes)))
+
+	return limits
+}
+
+func parseAndCheckLimit(arg, name string, defaultValue uint64) uint64 {
+	if arg == "" {
+		return defaultValue
+	}
+
+	integer, err := strconv.ParseUint(arg, 10, 63)
+	if err != nil {
+		errorOutStr(fmt.Sprintf("Wrong argument for %s, must be a positive integer or 0 for no limit", name))
+	}
+
+	return integer
+}
+
 func checkArgsSliceLen(argsSlice prototype.StrSlice, minMustBeLen, maxMustBeLen int) {
 	if !(len(argsSlice) >= minMustBeLen && len(argsSlice) <= maxMustBeLen) {
 		errorOutStr(fmt.Sprintf("Wrong number of arguments (plus flags!) given after the subcommand, must be between %d and %d", minMustBeLen, maxMustBeLen))
@@ -164,6 +234,18 @@ func checkUnixPath(path string) string {
 	return ""
 }
 
+func checkStateDir(dir string) string {
+	if dir == "" {
+		return ""
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		errorOutStr(fmt.Sprintf("Could not create state dir %s: %s", dir, err))
+	}
+
+	return dir
+}
+
 func getArgOut(argsSlice prototype.StrSlice, seekingShort, seekingLong string, required bool) string {
 	argValue := ""
 
@@ -0,0 +1,221 @@
+package protomath
+
+import "protogen/protoparser"
+
+// derivative differentiates node in name, the other names being constants.
+// User functions are differentiated through their bodies. The result is
+// left for simplify to tidy up.
+func (ec *evalContext) derivative(node protoparser.Node, name string) (protoparser.Node, *evalError) {
+	if !mentions(node, name) {
+		return numberNode(0), nil
+	}
+
+	switch n := node.(type) {
+	case *protoparser.IdentNode:
+		return numberNode(1), nil
+	case *protoparser.UnaryNode:
+		d, err := ec.derivative(n.Operand, name)
+		if err != nil || n.Op == "+" {
+			return d, err
+		}
+		return neg(d), nil
+	case *protoparser.BinaryNode:
+		return ec.binaryDerivative(n, name)
+	case *protoparser.CallNode:
+		return ec.callDerivative(n, name)
+	}
+
+	return nil, newEvalError(node, "cannot differentiate %s", protoparser.Format(node))
+}
+
+func (ec *evalContext) binaryDerivative(n *protoparser.BinaryNode, name string) (protoparser.Node, *evalError) {
+	dl, err := ec.derivative(n.Left, name)
+	if err != nil {
+		return nil, err
+	}
+	dr, err := ec.derivative(n.Right, name)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.Op {
+	case "+", "-":
+		return binary(n.Op, dl, dr), nil
+	case "*":
+		return add(mul(dl, n.Right), mul(n.Left, dr)), nil
+	case "/":
+		return div(sub(mul(dl, n.Right), mul(n.Left, dr)), pow(n.Right, numberNode(2))), nil
+	case "^":
+		return ec.powDerivative(n, name, dl, dr), nil
+	}
+
+	return nil, newEvalError(n, "cannot differentiate %s", n.Op)
+}
+
+// powDerivative is the power rule when the exponent is a constant, and
+// d(u^v) = u^v (v' ln(u) + v u' / u) otherwise.
+func (ec *evalContext) powDerivative(n *protoparser.BinaryNode, name string, dl, dr protoparser.Node) protoparser.Node {
+	if !mentions(n.Right, name) {
+		return mul(mul(n.Right, pow(n.Left, sub(n.Right, numberNode(1)))), dl)
+	}
+
+	lnBase := call("ln", n.Left)
+	if base, ok := n.Left.(*protoparser.IdentNode); ok && base.Name == "e" && name != "e" {
+		lnBase = numberNode(1)
+	}
+
+	if !mentions(n.Left, name) {
+		return mul(mul(n, lnBase), dr)
+	}
+
+	return mul(n, add(mul(dr, lnBase), div(mul(n.Right, dl), n.Left)))
+}
+
+// callDerivative is the chain rule. Trigonometric functions in degrees
+// bring in pi / 180.
+func (ec *evalContext) callDerivative(n *protoparser.CallNode, name string) (protoparser.Node, *evalError) {
+	if fn, ok := ec.sess.funcs[n.Name]; ok {
+		return ec.userFuncDerivative(n, fn, name)
+	}
+
+	if fn, ok := functions[n.Name]; !ok {
+		return nil, newEvalError(n, "cannot differentiate %s", n.Name)
+	} else if !hasArity(len(n.Args), fn.minArgs, fn.maxArgs) {
+		return nil, newEvalError(n, "%s takes %s, got %d", n.Name, arity(fn.minArgs, fn.maxArgs), len(n.Args))
+	}
+
+	ds := make([]protoparser.Node, 0, len(n.Args))
+	for _, arg := range n.Args {
+		d, err := ec.derivative(arg, name)
+		if err != nil {
+			return nil, err
+		}
+		ds = append(ds, d)
+	}
+
+	u, du := n.Args[0], ds[0]
+	toRad, fromRad := numberNode(1), numberNode(1)
+	if ec.angle == ANGLE_DEG {
+		toRad = div(&protoparser.IdentNode{Name: "pi"}, numberNode(180))
+		fromRad = div(numberNode(180), &protoparser.IdentNode{Name: "pi"})
+	}
+	one, two := numberNode(1), numberNode(2)
+
+	switch n.Name {
+	case "sqrt":
+		return div(du, mul(two, n)), nil
+	case "abs":
+		return div(mul(du, u), n), nil
+	case "exp":
+		return mul(n, du), nil
+	case "ln":
+		return div(du, u), nil
+	case "log10":
+		return div(du, mul(u, call("ln", numberNode(10)))), nil
+	case "log":
+		quotient := div(call("ln", n.Args[1]), call("ln", n.Args[0]))
+		return ec.derivative(quotient, name)
+	case "sin":
+		return mul(mul(call("cos", u), toRad), du), nil
+	case "cos":
+		return neg(mul(mul(call("sin", u), toRad), du)), nil
+	case "tan":
+		return div(mul(toRad, du), pow(call("cos", u), two)), nil
+	case "asin":
+		return div(mul(fromRad, du), call("sqrt", sub(one, pow(u, two)))), nil
+	case "acos":
+		return neg(div(mul(fromRad, du), call("sqrt", sub(one, pow(u, two))))), nil
+	case "atan":
+		return div(mul(fromRad, du), add(one, pow(u, two))), nil
+	case "atan2":
+		y, x, dy, dx := n.Args[0], n.Args[1], ds[0], ds[1]
+		return div(mul(fromRad, sub(mul(x, dy), mul(y, dx))), add(pow(x, two), pow(y, two))), nil
+	case "sinh":
+		return mul(call("cosh", u), du), nil
+	case "cosh":
+		return mul(call("sinh", u), du), nil
+	case "tanh":
+		return div(du, pow(call("cosh", u), two)), nil
+	case "asinh":
+		return div(du, call("sqrt", add(pow(u, two), one))), nil
+	case "acosh":
+		return div(du, call("sqrt", sub(pow(u, two), one))), nil
+	case "atanh":
+		return div(du, sub(one, pow(u, two))), nil
+	case "hypot":
+		a, b, da, db := n.Args[0], n.Args[1], ds[0], ds[1]
+		return div(add(mul(a, da), mul(b, db)), n), nil
+	}
+
+	return nil, newEvalError(n, "%s has no derivative everywhere", n.Name)
+}
+
+// userFuncDerivative differentiates the body of fn with the arguments put
+// in for its parameters.
+func (ec *evalContext) userFuncDerivative(n *protoparser.CallNode, fn userFunc, name string) (protoparser.Node, *evalError) {
+	if len(n.Args) != len(fn.params) {
+		return nil, newEvalError(n, "%s takes %s, got %d", n.Name, pluralArgs(len(fn.params)), len(n.Args))
+	} else if ec.depth >= MAX_CALL_DEPTH {
+		return nil, newEvalError(n, "calls are nested deeper than %d", MAX_CALL_DEPTH)
+	}
+
+	args := make(map[string]protoparser.Node, len(fn.params))
+	for i, param := range fn.params {
+		args[param] = n.Args[i]
+	}
+
+	inner := *ec
+	inner.depth++
+	d, err := inner.derivative(substitute(fn.body, args), name)
+	if err != nil {
+		return nil, callError(n, err)
+	}
+
+	return d, nil
+}
+
+// substitute puts the nodes in args for the names in node.
+func substitute(node protoparser.Node, args map[string]protoparser.Node) protoparser.Node {
+	switch n := node.(type) {
+	case *protoparser.IdentNode:
+		if arg, ok := args[n.Name]; ok {
+			return arg
+		}
+	case *protoparser.UnaryNode:
+		return &protoparser.UnaryNode{Op: n.Op, Operand: substitute(n.Operand, args), At: n.At}
+	case *protoparser.BinaryNode:
+		return &protoparser.BinaryNode{Op: n.Op, Left: substitute(n.Left, args), Right: substitute(n.Right, args), At: n.At}
+	case *protoparser.CallNode:
+		res := protoparser.CallNode{Name: n.Name, Args: make([]protoparser.Node, 0, len(n.Args)), At: n.At}
+		for _, arg := range n.Args {
+			res.Args = append(res.Args, substitute(arg, args))
+		}
+		return &res
+	case *protoparser.ListNode:
+		res := protoparser.ListNode{Elements: make([]protoparser.Node, 0, len(n.Elements)), At: n.At}
+		for _, element := range n.Elements {
+			res.Elements = append(res.Elements, substitute(element, args))
+		}
+		return &res
+	}
+
+	return node
+}
+
+func binary(op string, left, right protoparser.Node) protoparser.Node {
+	return &protoparser.BinaryNode{Op: op, Left: left, Right: right, At: right.Pos()}
+}
+
+func add(a, b protoparser.Node) protoparser.Node { return binary("+", a, b) }
+func sub(a, b protoparser.Node) protoparser.Node { return binary("-", a, b) }
+func mul(a, b protoparser.Node) protoparser.Node { return binary("*", a, b) }
+func div(a, b protoparser.Node) protoparser.Node { return binary("/", a, b) }
+func pow(a, b protoparser.Node) protoparser.Node { return binary("^", a, b) }
+
+func neg(a protoparser.Node) protoparser.Node {
+	return &protoparser.UnaryNode{Op: "-", Operand: a, At: a.Pos()}
+}
+
+func call(name string, args ...protoparser.Node) protoparser.Node {
+	return &protoparser.CallNode{Name: name, Args: args, At: args[0].Pos()}
+}
@@ -0,0 +1,169 @@
+package protomath
+
+import (
+	"fmt"
+	"math"
+	"protogen/protoparser"
+	"strconv"
+	"strings"
+)
+
+// evalError is a math error, like a division by zero, at a column of the
+// expression. Column starts at 1. An error in the body of a user function
+// is inCall, put on the outermost call of it. A domain error only holds
+// for the values at hand, like 1/x at 0, not for the expression as such.
+type evalError struct {
+	column  int
+	message string
+	inCall  bool
+	domain  bool
+}
+
+func (ee *evalError) Error() string {
+	return fmt.Sprintf("column %d: %s", ee.column, ee.message)
+}
+
+func newEvalError(node protoparser.Node, format string, args ...any) *evalError {
+	return &evalError{column: node.Pos() + 1, message: fmt.Sprintf(format, args...)}
+}
+
+func newDomainError(node protoparser.Node, format string, args ...any) *evalError {
+	err := newEvalError(node, format, args...)
+	err.domain = true
+
+	return err
+}
+
+// evalContext is what an expression is evaluated under, set per request.
+// Locals are the parameters of the user function being evaluated.
+type evalContext struct {
+	angle  angleUnit
+	sess   *session
+	locals map[string]mathValue
+	depth  int
+	// solveFor is the FOR option of SOLVE and DIFF, complexRoots the COMPLEX
+	// option of SOLVE.
+	solveFor     string
+	complexRoots bool
+}
+
+func newEvalContext(sess *session) *evalContext {
+	return &evalContext{angle: ANGLE_RAD, sess: sess}
+}
+
+// evaluate is evaluateValue where only a number will do.
+func (ec *evalContext) evaluate(node protoparser.Node) (float64, *evalError) {
+	value, err := ec.evaluateValue(node)
+	if err != nil {
+		return 0, err
+	} else if value.matrix != nil {
+		return 0, newEvalError(node, "expected a number, got %s", value.describe())
+	}
+
+	return value.num, nil
+}
+
+func (ec *evalContext) evaluateValue(node protoparser.Node) (mathValue, *evalError) {
+	switch n := node.(type) {
+	case *protoparser.NumberNode:
+		num, err := strconv.ParseFloat(n.Literal, 64)
+		if err != nil {
+			return mathValue{}, newEvalError(n, "number %s is out of range", n.Literal)
+		}
+		return number(num), nil
+	case *protoparser.UnaryNode:
+		operand, err := ec.evaluateValue(n.Operand)
+		if err != nil {
+			return mathValue{}, err
+		}
+		if n.Op == "-" {
+			return operand.negate(), nil
+		}
+		return operand, nil
+	case *protoparser.BinaryNode:
+		return ec.evaluateBinary(n)
+	case *protoparser.IdentNode:
+		return ec.evaluateIdent(n)
+	case *protoparser.CallNode:
+		return ec.evaluateCall(n)
+	case *protoparser.ListNode:
+		return ec.evaluateList(n)
+	}
+
+	return mathValue{}, newEvalError(node, "cannot evaluate %s", protoparser.Format(node))
+}
+
+func (ec *evalContext) evaluateBinary(n *protoparser.BinaryNode) (mathValue, *evalError) {
+	left, err := ec.evaluateValue(n.Left)
+	if err != nil {
+		return mathValue{}, err
+	}
+
+	right, err := ec.evaluateValue(n.Right)
+	if err != nil {
+		return mathValue{}, err
+	}
+
+	if left.matrix != nil || right.matrix != nil {
+		return ec.matrixBinary(n, left, right)
+	}
+
+	res, err := scalarBinary(n, left.num, right.num)
+	return number(res), err
+}
+
+func scalarBinary(n *protoparser.BinaryNode, left, right float64) (float64, *evalError) {
+	var res float64
+	switch n.Op {
+	case "+":
+		res = left + right
+	case "-":
+		res = left - right
+	case "*":
+		res = left * right
+	case "/", "%", "//":
+		if right == 0 {
+			return 0, newDomainError(n, "division by zero")
+		}
+		res = divide(left, right, n.Op)
+	case "^":
+		res = math.Pow(left, right)
+	}
+
+	if math.IsNaN(res) || math.IsInf(res, 0) {
+		return 0, newDomainError(n, "result of %s is not a finite number", n.Op)
+	}
+
+	return res, nil
+}
+
+func divide(left, right float64, op string) float64 {
+	switch op {
+	case "%":
+		return math.Mod(left, right)
+	case "//":
+		return math.Floor(left / right)
+	}
+
+	return left / right
+}
+
+// caretExcerpt shows the expression with a caret under column, like
+//
+//	2 + * 3
+//	    ^
+func caretExcerpt(ex string, column int) string {
+	line := strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\r' || r == '\n' {
+			return ' '
+		}
+		return r
+	}, ex)
+	line = strings.TrimRight(line, " ")
+
+	if column < 1 {
+		column = 1
+	}
+
+	return fmt.Sprintf("%s\n%s^", line, strings.Repeat(" ", column-1))
+}
@@ -0,0 +1,269 @@
+package protomath
+
+import (
+	"fmt"
+	"math/big"
+	"protogen/protoparser"
+)
+
+// exactFunctions are the built-in functions outside of FLOAT mode. The rest
+// cannot be worked out exactly.
+var exactFunctions = map[string]bool{
+	"sqrt": true, "abs": true, "floor": true, "ceil": true, "round": true, "min": true, "max": true,
+}
+
+// exactVar is a variable assigned outside of FLOAT mode, kept as it was
+// worked out.
+type exactVar struct {
+	sys   numberSystem
+	value exactValue
+}
+
+// exactContext is evalContext for the modes other than FLOAT.
+type exactContext struct {
+	sys    numberSystem
+	sess   *session
+	locals map[string]exactValue
+	depth  int
+}
+
+func newExactContext(sys numberSystem, sess *session) *exactContext {
+	return &exactContext{sys: sys, sess: sess}
+}
+
+// execute is evalContext.execute in the number system of the context.
+func (xc *exactContext) execute(node protoparser.Node) (string, *evalError) {
+	switch n := node.(type) {
+	case *protoparser.AssignNode:
+		if err := checkAssignable(n, n.Name); err != nil {
+			return "", err
+		}
+
+		value, err := xc.evaluate(n.Value)
+		if err != nil {
+			return "", err
+		}
+		xc.store(n.Name, value)
+
+		return fmt.Sprintf("%s = %s", n.Name, xc.sys.format(value)), nil
+	case *protoparser.FuncDefNode:
+		return defineFunc(xc.sess, n)
+	}
+
+	value, err := xc.evaluate(node)
+	if err != nil {
+		return "", err
+	}
+	xc.store(ANS_NAME, value)
+
+	return xc.sys.format(value), nil
+}
+
+// store keeps the exact value for this mode and the nearest float64 for
+// FLOAT mode.
+func (xc *exactContext) store(name string, value exactValue) {
+	xc.sess.vars[name] = ratToFloat(xc.sys.toRat(value))
+	xc.sess.exact[name] = exactVar{sys: xc.sys, value: value}
+	delete(xc.sess.matrices, name)
+}
+
+func (xc *exactContext) evaluate(node protoparser.Node) (exactValue, *evalError) {
+	switch n := node.(type) {
+	case *protoparser.NumberNode:
+		r, ok := parseLiteral(n.Literal)
+		if !ok {
+			return nil, newEvalError(n, "number %s is out of range", n.Literal)
+		}
+		return xc.fromRat(n, r)
+	case *protoparser.UnaryNode:
+		operand, err := xc.evaluate(n.Operand)
+		if err != nil {
+			return nil, err
+		}
+		if n.Op == "-" {
+			return xc.sys.negate(operand), nil
+		}
+		return operand, nil
+	case *protoparser.BinaryNode:
+		left, err := xc.evaluate(n.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := xc.evaluate(n.Right)
+		if err != nil {
+			return nil, err
+		}
+
+		res, msg := xc.sys.apply(n.Op, left, right)
+		if msg != "" {
+			return nil, newEvalError(n, "%s", msg)
+		}
+		return res, nil
+	case *protoparser.IdentNode:
+		return xc.evaluateIdent(n)
+	case *protoparser.CallNode:
+		return xc.evaluateCall(n)
+	case *protoparser.ListNode:
+		return nil, newEvalError(n, "matrices are only in %s mode", MODE_FLOAT)
+	}
+
+	return nil, newEvalError(node, "cannot evaluate %s", protoparser.Format(node))
+}
+
+func (xc *exactContext) fromRat(n protoparser.Node, r *big.Rat) (exactValue, *evalError) {
+	value, msg := xc.sys.fromRat(r)
+	if msg != "" {
+		return nil, newEvalError(n, "%s", msg)
+	}
+
+	return value, nil
+}
+
+// evaluateIdent looks names up like evalContext.evaluateIdent. A variable
+// from another mode is brought over as a rational.
+func (xc *exactContext) evaluateIdent(n *protoparser.IdentNode) (exactValue, *evalError) {
+	if value, ok := xc.locals[n.Name]; ok {
+		return value, nil
+	} else if _, ok := xc.sess.matrices[n.Name]; ok {
+		return nil, newEvalError(n, "matrices are only in %s mode", MODE_FLOAT)
+	} else if v, ok := xc.sess.exact[n.Name]; ok {
+		if v.sys == xc.sys {
+			return v.value, nil
+		}
+		return xc.fromRat(n, v.sys.toRat(v.value))
+	} else if value, ok := xc.sess.vars[n.Name]; ok {
+		r, _ := floatToRat(value)
+		return xc.fromRat(n, r)
+	}
+
+	if bfs, ok := xc.sys.(bigFloatSystem); ok {
+		switch n.Name {
+		case "pi":
+			return bigPi(bfs.prec()), nil
+		case "tau":
+			pi := bigPi(bfs.prec())
+			return pi.Add(pi, pi), nil
+		case "e":
+			return bigE(bfs.prec()), nil
+		}
+	} else if _, ok := constants[n.Name]; ok {
+		return nil, newEvalError(n, "%s has no exact value in %s mode", n.Name, xc.sys.mode())
+	}
+
+	return nil, unknownName(xc.sess, n)
+}
+
+func (xc *exactContext) evaluateCall(n *protoparser.CallNode) (exactValue, *evalError) {
+	if userFn, ok := xc.sess.funcs[n.Name]; ok {
+		return xc.callUserFunc(n, userFn)
+	}
+
+	minArgs, maxArgs, ok := builtinArity(n.Name)
+	if !ok {
+		return nil, newEvalError(n, "unknown function %s", n.Name)
+	} else if !exactFunctions[n.Name] {
+		return nil, newEvalError(n, "%s is only in %s mode", n.Name, MODE_FLOAT)
+	} else if !hasArity(len(n.Args), minArgs, maxArgs) {
+		return nil, newEvalError(n, "%s takes %s, got %d", n.Name, arity(minArgs, maxArgs), len(n.Args))
+	}
+
+	// min and max take list literals too, as they do in FLOAT mode, each
+	// element being one more argument.
+	argNodes := n.Args
+	if n.Name == "min" || n.Name == "max" {
+		argNodes = flattenListArgs(n.Args)
+	}
+
+	args := make([]exactValue, 0, len(argNodes))
+	for _, argNode := range argNodes {
+		arg, err := xc.evaluate(argNode)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+
+	if n.Name == "sqrt" {
+		res, msg := xc.sys.sqrt(args[0])
+		if msg != "" {
+			return nil, newEvalError(n, "%s", msg)
+		}
+		return res, nil
+	}
+
+	return xc.callRational(n, args)
+}
+
+func flattenListArgs(args []protoparser.Node) []protoparser.Node {
+	flat := make([]protoparser.Node, 0, len(args))
+	for _, arg := range args {
+		if list, ok := arg.(*protoparser.ListNode); ok {
+			flat = append(flat, list.Elements...)
+		} else {
+			flat = append(flat, arg)
+		}
+	}
+
+	return flat
+}
+
+// callRational works out the functions that only need comparing and
+// rounding on the values as rationals.
+func (xc *exactContext) callRational(n *protoparser.CallNode, args []exactValue) (exactValue, *evalError) {
+	r := xc.sys.toRat(args[0])
+
+	switch n.Name {
+	case "abs":
+		return xc.fromRat(n, new(big.Rat).Abs(r))
+	case "floor":
+		return xc.fromRat(n, new(big.Rat).SetInt(ratFloor(r)))
+	case "ceil":
+		neg := new(big.Rat).Neg(r)
+		return xc.fromRat(n, new(big.Rat).SetInt(new(big.Int).Neg(ratFloor(neg))))
+	case "round":
+		// Half away from zero, like math.Round.
+		half := new(big.Rat).Add(new(big.Rat).Abs(r), big.NewRat(1, 2))
+		rounded := new(big.Rat).SetInt(ratFloor(half))
+		if r.Sign() < 0 {
+			rounded.Neg(rounded)
+		}
+		return xc.fromRat(n, rounded)
+	}
+
+	best := 0
+	for i := 1; i < len(args); i++ {
+		cmp := xc.sys.toRat(args[i]).Cmp(xc.sys.toRat(args[best]))
+		if (n.Name == "min" && cmp < 0) || (n.Name == "max" && cmp > 0) {
+			best = i
+		}
+	}
+
+	return args[best], nil
+}
+
+func (xc *exactContext) callUserFunc(n *protoparser.CallNode, fn userFunc) (exactValue, *evalError) {
+	if len(n.Args) != len(fn.params) {
+		return nil, newEvalError(n, "%s takes %s, got %d", n.Name, pluralArgs(len(fn.params)), len(n.Args))
+	} else if xc.depth >= MAX_CALL_DEPTH {
+		return nil, newEvalError(n, "calls are nested deeper than %d", MAX_CALL_DEPTH)
+	}
+
+	locals := make(map[string]exactValue, len(fn.params))
+	for i, argNode := range n.Args {
+		arg, err := xc.evaluate(argNode)
+		if err != nil {
+			return nil, err
+		}
+		locals[fn.params[i]] = arg
+	}
+
+	inner := *xc
+	inner.locals = locals
+	inner.depth++
+	res, err := inner.evaluate(fn.body)
+	if err != nil {
+		return nil, callError(n, err)
+	}
+
+	return res, nil
+}
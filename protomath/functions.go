@@ -0,0 +1,238 @@
+package protomath
+
+import (
+	"math"
+	"protogen/protoparser"
+	"strconv"
+	"strings"
+)
+
+type angleUnit string
+
+const (
+	ANGLE_RAD angleUnit = "RAD"
+	ANGLE_DEG angleUnit = "DEG"
+)
+
+// VARIADIC as maxArgs lets a function take any number of arguments.
+const VARIADIC = -1
+
+type mathFunc struct {
+	minArgs int
+	maxArgs int
+	call    func(ec *evalContext, args []float64) float64
+}
+
+var constants = map[string]float64{
+	"pi":  math.Pi,
+	"e":   math.E,
+	"tau": 2 * math.Pi,
+}
+
+var functions = map[string]mathFunc{
+	"sqrt":  unary(math.Sqrt),
+	"abs":   unary(math.Abs),
+	"exp":   unary(math.Exp),
+	"ln":    unary(math.Log),
+	"log10": unary(math.Log10),
+	"log": {2, 2, func(_ *evalContext, args []float64) float64 {
+		return math.Log(args[1]) / math.Log(args[0])
+	}},
+
+	"sin":  angleIn(math.Sin),
+	"cos":  angleIn(math.Cos),
+	"tan":  angleIn(math.Tan),
+	"asin": angleOut(math.Asin),
+	"acos": angleOut(math.Acos),
+	"atan": angleOut(math.Atan),
+	"atan2": {2, 2, func(ec *evalContext, args []float64) float64 {
+		return ec.fromRadians(math.Atan2(args[0], args[1]))
+	}},
+
+	"sinh":  unary(math.Sinh),
+	"cosh":  unary(math.Cosh),
+	"tanh":  unary(math.Tanh),
+	"asinh": unary(math.Asinh),
+	"acosh": unary(math.Acosh),
+	"atanh": unary(math.Atanh),
+
+	"floor": unary(math.Floor),
+	"ceil":  unary(math.Ceil),
+	"round": unary(math.Round),
+
+	"hypot": {2, 2, func(_ *evalContext, args []float64) float64 {
+		return math.Hypot(args[0], args[1])
+	}},
+}
+
+func unary(fn func(float64) float64) mathFunc {
+	return mathFunc{1, 1, func(_ *evalContext, args []float64) float64 {
+		return fn(args[0])
+	}}
+}
+
+// angleIn wraps a trig function taking an angle in the unit of the request.
+func angleIn(fn func(float64) float64) mathFunc {
+	return mathFunc{1, 1, func(ec *evalContext, args []float64) float64 {
+		return fn(ec.toRadians(args[0]))
+	}}
+}
+
+// angleOut wraps an inverse trig function giving an angle in the unit of the
+// request.
+func angleOut(fn func(float64) float64) mathFunc {
+	return mathFunc{1, 1, func(ec *evalContext, args []float64) float64 {
+		return ec.fromRadians(fn(args[0]))
+	}}
+}
+
+func parseAngleUnit(str string) (angleUnit, bool) {
+	switch unit := angleUnit(strings.ToUpper(str)); unit {
+	case ANGLE_RAD, ANGLE_DEG:
+		return unit, true
+	}
+
+	return "", false
+}
+
+func (ec *evalContext) toRadians(angle float64) float64 {
+	if ec.angle == ANGLE_DEG {
+		return angle * math.Pi / 180
+	}
+
+	return angle
+}
+
+func (ec *evalContext) fromRadians(angle float64) float64 {
+	if ec.angle == ANGLE_DEG {
+		return angle * 180 / math.Pi
+	}
+
+	return angle
+}
+
+func (ec *evalContext) evaluateIdent(n *protoparser.IdentNode) (mathValue, *evalError) {
+	if value, ok := ec.locals[n.Name]; ok {
+		return value, nil
+	} else if m, ok := ec.sess.matrices[n.Name]; ok {
+		return matrixValue(m), nil
+	} else if value, ok := ec.sess.vars[n.Name]; ok {
+		return number(value), nil
+	} else if value, ok := constants[n.Name]; ok {
+		return number(value), nil
+	}
+
+	return mathValue{}, unknownName(ec.sess, n)
+}
+
+// builtinArity is how many arguments a built-in function takes, whichever
+// table it is in.
+func builtinArity(name string) (int, int, bool) {
+	if fn, ok := functions[name]; ok {
+		return fn.minArgs, fn.maxArgs, true
+	} else if fn, ok := valueFunctions[name]; ok {
+		return fn.minArgs, fn.maxArgs, true
+	}
+
+	return 0, 0, false
+}
+
+// unknownName tells why a name has no value.
+func unknownName(sess *session, n *protoparser.IdentNode) *evalError {
+	if _, _, ok := builtinArity(n.Name); ok {
+		return newEvalError(n, "function %s needs to be called, like %s(x)", n.Name, n.Name)
+	} else if _, ok := sess.funcs[n.Name]; ok {
+		return newEvalError(n, "function %s needs to be called, like %s(x)", n.Name, n.Name)
+	} else if n.Name == ANS_NAME {
+		return newEvalError(n, "there is no previous result yet")
+	}
+
+	return newEvalError(n, "unknown name %s", n.Name)
+}
+
+func (ec *evalContext) evaluateCall(n *protoparser.CallNode) (mathValue, *evalError) {
+	if userFn, ok := ec.sess.funcs[n.Name]; ok {
+		return ec.callUserFunc(n, userFn)
+	} else if fn, ok := valueFunctions[n.Name]; ok {
+		return ec.callValueFunc(n, fn)
+	}
+
+	fn, ok := functions[n.Name]
+	if !ok {
+		return mathValue{}, newEvalError(n, "unknown function %s", n.Name)
+	} else if !hasArity(len(n.Args), fn.minArgs, fn.maxArgs) {
+		return mathValue{}, newEvalError(n, "%s takes %s, got %d", n.Name, arity(fn.minArgs, fn.maxArgs), len(n.Args))
+	}
+
+	args := make([]float64, 0, len(n.Args))
+	for _, argNode := range n.Args {
+		arg, err := ec.evaluate(argNode)
+		if err != nil {
+			return mathValue{}, err
+		}
+		args = append(args, arg)
+	}
+
+	res := fn.call(ec, args)
+	if math.IsNaN(res) || math.IsInf(res, 0) {
+		return mathValue{}, newDomainError(n, "%s is not defined for %s", n.Name, formatArgs(args))
+	}
+
+	return number(res), nil
+}
+
+func (ec *evalContext) callValueFunc(n *protoparser.CallNode, fn valueFunc) (mathValue, *evalError) {
+	if !hasArity(len(n.Args), fn.minArgs, fn.maxArgs) {
+		return mathValue{}, newEvalError(n, "%s takes %s, got %d", n.Name, arity(fn.minArgs, fn.maxArgs), len(n.Args))
+	}
+
+	args := make([]mathValue, 0, len(n.Args))
+	for _, argNode := range n.Args {
+		arg, err := ec.evaluateValue(argNode)
+		if err != nil {
+			return mathValue{}, err
+		}
+		args = append(args, arg)
+	}
+
+	res, msg := fn.call(args)
+	if msg != "" {
+		return mathValue{}, newEvalError(n, "%s: %s", n.Name, msg)
+	} else if (res.matrix == nil && (math.IsNaN(res.num) || math.IsInf(res.num, 0))) || (res.matrix != nil && !res.matrix.isFinite()) {
+		return mathValue{}, newDomainError(n, "result of %s is not finite", n.Name)
+	}
+
+	return res, nil
+}
+
+func hasArity(count, minArgs, maxArgs int) bool {
+	return count >= minArgs && (maxArgs == VARIADIC || count <= maxArgs)
+}
+
+func arity(minArgs, maxArgs int) string {
+	switch {
+	case maxArgs == VARIADIC:
+		return pluralArgs(minArgs) + " or more"
+	case minArgs == maxArgs:
+		return pluralArgs(minArgs)
+	}
+
+	return strconv.Itoa(minArgs) + " to " + pluralArgs(maxArgs)
+}
+
+func pluralArgs(n int) string {
+	if n == 1 {
+		return "1 argument"
+	}
+
+	return strconv.Itoa(n) + " arguments"
+}
+
+func formatArgs(args []float64) string {
+	strs := make([]string, 0, len(args))
+	for _, arg := range args {
+		strs = append(strs, formatNumber(arg))
+	}
+
+	return strings.Join(strs, ", ")
+}
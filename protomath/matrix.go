@@ -0,0 +1,501 @@
+package protomath
+
+import (
+	"fmt"
+	"math"
+	"protogen/protoparser"
+	"strings"
+)
+
+// PIVOT_TOLERANCE is how small, relative to the largest entry, a pivot is
+// taken for zero.
+const PIVOT_TOLERANCE = 1e-12
+
+// mathValue is a number, or a matrix when matrix is set.
+type mathValue struct {
+	num    float64
+	matrix *matrix
+}
+
+// matrix keeps its entries row after row. A vector, like `[1, 2, 3]`, has
+// a single row and multiplies as a row on the left of a product and as a
+// column on the right of one.
+type matrix struct {
+	rows     int
+	cols     int
+	data     []float64
+	isVector bool
+}
+
+// valueFunc is a built-in function taking matrices or lists. Call gives an
+// error message, or "".
+type valueFunc struct {
+	minArgs int
+	maxArgs int
+	call    func(args []mathValue) (mathValue, string)
+}
+
+var valueFunctions = map[string]valueFunc{
+	"transpose": {1, 1, func(args []mathValue) (mathValue, string) {
+		m, msg := needMatrix(args[0])
+		if msg != "" {
+			return mathValue{}, msg
+		}
+		return matrixValue(m.transpose()), ""
+	}},
+	"det": {1, 1, func(args []mathValue) (mathValue, string) {
+		m, msg := needSquare(args[0])
+		if msg != "" {
+			return mathValue{}, msg
+		}
+		return number(m.det()), ""
+	}},
+	"inv": {1, 1, func(args []mathValue) (mathValue, string) {
+		m, msg := needSquare(args[0])
+		if msg != "" {
+			return mathValue{}, msg
+		}
+		inv, ok := m.inverse()
+		if !ok {
+			return mathValue{}, "the matrix is singular"
+		}
+		return matrixValue(inv), ""
+	}},
+	"rank": {1, 1, func(args []mathValue) (mathValue, string) {
+		m, msg := needMatrix(args[0])
+		if msg != "" {
+			return mathValue{}, msg
+		}
+		return number(float64(m.rank())), ""
+	}},
+}
+
+func number(num float64) mathValue {
+	return mathValue{num: num}
+}
+
+func matrixValue(m *matrix) mathValue {
+	return mathValue{matrix: m}
+}
+
+func newMatrix(rows, cols int) *matrix {
+	return &matrix{rows: rows, cols: cols, data: make([]float64, rows*cols)}
+}
+
+func newVector(entries []float64) *matrix {
+	return &matrix{rows: 1, cols: len(entries), data: entries, isVector: true}
+}
+
+func identity(n int) *matrix {
+	m := newMatrix(n, n)
+	for i := 0; i < n; i++ {
+		m.set(i, i, 1)
+	}
+
+	return m
+}
+
+func (m *matrix) at(row, col int) float64 {
+	return m.data[row*m.cols+col]
+}
+
+func (m *matrix) set(row, col int, value float64) {
+	m.data[row*m.cols+col] = value
+}
+
+func (m *matrix) clone() *matrix {
+	data := make([]float64, len(m.data))
+	copy(data, m.data)
+
+	return &matrix{rows: m.rows, cols: m.cols, data: data, isVector: m.isVector}
+}
+
+func (m *matrix) describe() string {
+	if m.isVector {
+		return fmt.Sprintf("a vector of %d", m.cols)
+	}
+
+	return fmt.Sprintf("a %dx%d matrix", m.rows, m.cols)
+}
+
+func (v mathValue) describe() string {
+	if v.matrix == nil {
+		return "a number"
+	}
+
+	return v.matrix.describe()
+}
+
+// format writes a matrix the way it is written in a request.
+func (v mathValue) format() string {
+	if v.matrix == nil {
+		return formatNumber(v.num)
+	}
+
+	rows := make([]string, 0, v.matrix.rows)
+	for i := 0; i < v.matrix.rows; i++ {
+		entries := make([]string, 0, v.matrix.cols)
+		for j := 0; j < v.matrix.cols; j++ {
+			entries = append(entries, formatNumber(v.matrix.at(i, j)))
+		}
+		rows = append(rows, "["+strings.Join(entries, ", ")+"]")
+	}
+
+	if v.matrix.isVector {
+		return rows[0]
+	}
+
+	return "[" + strings.Join(rows, ", ") + "]"
+}
+
+func (v mathValue) negate() mathValue {
+	if v.matrix == nil {
+		return number(-v.num)
+	}
+
+	return matrixValue(v.matrix.scale(-1))
+}
+
+func needMatrix(v mathValue) (*matrix, string) {
+	if v.matrix == nil {
+		return nil, "expected a matrix, got a number"
+	}
+
+	return v.matrix, ""
+}
+
+func needSquare(v mathValue) (*matrix, string) {
+	m, msg := needMatrix(v)
+	if msg != "" {
+		return nil, msg
+	} else if m.rows != m.cols {
+		return nil, fmt.Sprintf("expected a square matrix, got %s", m.describe())
+	}
+
+	return m, ""
+}
+
+// evaluateList makes a vector of a list of numbers, and a matrix of a list
+// of vectors as its rows.
+func (ec *evalContext) evaluateList(n *protoparser.ListNode) (mathValue, *evalError) {
+	values := make([]mathValue, 0, len(n.Elements))
+	for _, element := range n.Elements {
+		value, err := ec.evaluateValue(element)
+		if err != nil {
+			return mathValue{}, err
+		}
+		values = append(values, value)
+	}
+
+	if values[0].matrix == nil {
+		entries := make([]float64, 0, len(values))
+		for i, value := range values {
+			if value.matrix != nil {
+				return mathValue{}, newEvalError(n.Elements[i], "expected a number like the first entry, got %s", value.describe())
+			}
+			entries = append(entries, value.num)
+		}
+		return matrixValue(newVector(entries)), nil
+	}
+
+	cols := values[0].matrix.cols
+	m := newMatrix(len(values), cols)
+	for i, value := range values {
+		if value.matrix == nil || !value.matrix.isVector {
+			return mathValue{}, newEvalError(n.Elements[i], "expected a row like the first one, got %s", value.describe())
+		} else if value.matrix.cols != cols {
+			return mathValue{}, newEvalError(n.Elements[i], "expected a row of %d like the first one, got %d", cols, value.matrix.cols)
+		}
+		copy(m.data[i*cols:], value.matrix.data)
+	}
+
+	return matrixValue(m), nil
+}
+
+// matrixBinary is an operator with a matrix on at least one side.
+func (ec *evalContext) matrixBinary(n *protoparser.BinaryNode, left, right mathValue) (mathValue, *evalError) {
+	var res mathValue
+	msg := ""
+
+	switch {
+	case n.Op == "+" || n.Op == "-":
+		if left.matrix == nil || right.matrix == nil {
+			return mathValue{}, newEvalError(n, "cannot use %s on %s and %s", n.Op, left.describe(), right.describe())
+		}
+		sign := 1.0
+		if n.Op == "-" {
+			sign = -1
+		}
+		res, msg = left.matrix.add(right.matrix, sign)
+	case n.Op == "*" && left.matrix == nil:
+		res = matrixValue(right.matrix.scale(left.num))
+	case n.Op == "*" && right.matrix == nil:
+		res = matrixValue(left.matrix.scale(right.num))
+	case n.Op == "*":
+		res, msg = left.matrix.mul(right.matrix)
+	case n.Op == "/" && right.matrix == nil:
+		if right.num == 0 {
+			return mathValue{}, newDomainError(n, "division by zero")
+		}
+		res = matrixValue(left.matrix.scale(1 / right.num))
+	case n.Op == "^" && right.matrix == nil:
+		res, msg = left.matrix.pow(right.num)
+	default:
+		return mathValue{}, newEvalError(n, "cannot use %s on %s and %s", n.Op, left.describe(), right.describe())
+	}
+
+	if msg != "" {
+		return mathValue{}, newEvalError(n, "%s", msg)
+	} else if res.matrix != nil && !res.matrix.isFinite() {
+		return mathValue{}, newDomainError(n, "result of %s is not finite", n.Op)
+	}
+
+	return res, nil
+}
+
+func (m *matrix) isFinite() bool {
+	for _, x := range m.data {
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (m *matrix) scale(factor float64) *matrix {
+	res := m.clone()
+	for i := range res.data {
+		res.data[i] *= factor
+	}
+
+	return res
+}
+
+func (m *matrix) add(other *matrix, sign float64) (mathValue, string) {
+	if m.rows != other.rows || m.cols != other.cols {
+		return mathValue{}, fmt.Sprintf("cannot add %s and %s", m.describe(), other.describe())
+	}
+
+	res := m.clone()
+	res.isVector = m.isVector && other.isVector
+	for i := range res.data {
+		res.data[i] += sign * other.data[i]
+	}
+
+	return matrixValue(res), ""
+}
+
+// mul is the matrix product. Of two vectors it is their dot product, and
+// with a vector on either side it is a vector again.
+func (m *matrix) mul(other *matrix) (mathValue, string) {
+	right := other
+	if other.isVector {
+		right = other.transpose()
+	}
+
+	if m.cols != right.rows {
+		return mathValue{}, fmt.Sprintf("cannot multiply %s by %s", m.describe(), other.describe())
+	}
+
+	res := newMatrix(m.rows, right.cols)
+	for i := 0; i < m.rows; i++ {
+		for j := 0; j < right.cols; j++ {
+			sum := 0.0
+			for k := 0; k < m.cols; k++ {
+				sum += m.at(i, k) * right.at(k, j)
+			}
+			res.set(i, j, sum)
+		}
+	}
+
+	switch {
+	case m.isVector && other.isVector:
+		return number(res.data[0]), ""
+	case other.isVector:
+		res = res.transpose()
+		res.isVector = true
+	case m.isVector:
+		res.isVector = true
+	}
+
+	return matrixValue(res), ""
+}
+
+// pow raises a square matrix to a whole power, a negative one being a power
+// of its inverse.
+func (m *matrix) pow(exp float64) (mathValue, string) {
+	if m.rows != m.cols || m.isVector {
+		return mathValue{}, fmt.Sprintf("only square matrices have powers, got %s", m.describe())
+	} else if exp != math.Trunc(exp) {
+		return mathValue{}, "matrix powers need a whole exponent"
+	}
+
+	base := m
+	if exp < 0 {
+		inv, ok := m.inverse()
+		if !ok {
+			return mathValue{}, "the matrix is singular"
+		}
+		base, exp = inv, -exp
+	}
+
+	res := identity(m.rows)
+	for ; exp > 0; exp = math.Floor(exp / 2) {
+		if math.Mod(exp, 2) == 1 {
+			prod, _ := res.mul(base)
+			res = prod.matrix
+		}
+		square, _ := base.mul(base)
+		base = square.matrix
+	}
+
+	return matrixValue(res), ""
+}
+
+// transpose of a vector is a column.
+func (m *matrix) transpose() *matrix {
+	res := newMatrix(m.cols, m.rows)
+	for i := 0; i < m.rows; i++ {
+		for j := 0; j < m.cols; j++ {
+			res.set(j, i, m.at(i, j))
+		}
+	}
+
+	return res
+}
+
+func (m *matrix) largest() float64 {
+	largest := 0.0
+	for _, x := range m.data {
+		largest = math.Max(largest, math.Abs(x))
+	}
+
+	return largest
+}
+
+// eliminate brings m to row echelon form by Gaussian elimination with
+// partial pivoting, using the largest entry left in a column as its pivot.
+// It tells the columns of the pivots and if rows were swapped an odd number
+// of times. Only the first cols columns are pivoted on.
+func (m *matrix) eliminate(cols int) ([]int, bool) {
+	tolerance := m.pivotTolerance()
+	pivots := make([]int, 0)
+	oddSwaps := false
+
+	row := 0
+	for col := 0; col < cols && row < m.rows; col++ {
+		best := row
+		for i := row + 1; i < m.rows; i++ {
+			if math.Abs(m.at(i, col)) > math.Abs(m.at(best, col)) {
+				best = i
+			}
+		}
+		if math.Abs(m.at(best, col)) <= tolerance {
+			continue
+		}
+
+		if best != row {
+			m.swapRows(best, row)
+			oddSwaps = !oddSwaps
+		}
+
+		for i := row + 1; i < m.rows; i++ {
+			factor := m.at(i, col) / m.at(row, col)
+			m.set(i, col, 0)
+			for j := col + 1; j < m.cols; j++ {
+				m.set(i, j, m.at(i, j)-factor*m.at(row, j))
+			}
+		}
+
+		pivots = append(pivots, col)
+		row++
+	}
+
+	return pivots, oddSwaps
+}
+
+func (m *matrix) pivotTolerance() float64 {
+	return PIVOT_TOLERANCE * math.Max(1, m.largest()) * math.Max(float64(m.rows), float64(m.cols))
+}
+
+func (m *matrix) swapRows(a, b int) {
+	for j := 0; j < m.cols; j++ {
+		m.data[a*m.cols+j], m.data[b*m.cols+j] = m.data[b*m.cols+j], m.data[a*m.cols+j]
+	}
+}
+
+// backSubstitute works out the unknowns of an eliminated system, the last
+// column being the right hand side, with the free unknowns set to zero.
+func (m *matrix) backSubstitute(pivots []int) []float64 {
+	unknowns := m.cols - 1
+	res := make([]float64, unknowns)
+
+	for row := len(pivots) - 1; row >= 0; row-- {
+		col := pivots[row]
+		sum := m.at(row, unknowns)
+		for j := col + 1; j < unknowns; j++ {
+			sum -= m.at(row, j) * res[j]
+		}
+		res[col] = sum / m.at(row, col)
+	}
+
+	return res
+}
+
+func (m *matrix) det() float64 {
+	reduced := m.clone()
+	pivots, oddSwaps := reduced.eliminate(m.cols)
+	if len(pivots) < m.rows {
+		return 0
+	}
+
+	det := 1.0
+	for i := 0; i < m.rows; i++ {
+		det *= reduced.at(i, i)
+	}
+	if oddSwaps {
+		det = -det
+	}
+
+	return det
+}
+
+// inverse solves m X = I, a column of the identity at a time.
+func (m *matrix) inverse() (*matrix, bool) {
+	n := m.rows
+	augmented := newMatrix(n, 2*n)
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			augmented.set(i, j, m.at(i, j))
+		}
+		augmented.set(i, n+i, 1)
+	}
+
+	pivots, _ := augmented.eliminate(n)
+	if len(pivots) < n {
+		return nil, false
+	}
+
+	res := newMatrix(n, n)
+	for k := 0; k < n; k++ {
+		system := newMatrix(n, n+1)
+		for i := 0; i < n; i++ {
+			for j := 0; j < n; j++ {
+				system.set(i, j, augmented.at(i, j))
+			}
+			system.set(i, n, augmented.at(i, n+k))
+		}
+
+		for i, x := range system.backSubstitute(pivots) {
+			res.set(i, k, x)
+		}
+	}
+
+	return res, true
+}
+
+func (m *matrix) rank() int {
+	pivots, _ := m.clone().eliminate(m.cols)
+	return len(pivots)
+}
@@ -0,0 +1,388 @@
+package protomath
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+type numberMode string
+
+const (
+	MODE_FLOAT    numberMode = "FLOAT"
+	MODE_BIGFLOAT numberMode = "BIGFLOAT"
+	MODE_RAT      numberMode = "RAT"
+	MODE_INT      numberMode = "INT"
+)
+
+const (
+	// DEFAULT_PREC and MAX_PREC are in significant decimal digits.
+	DEFAULT_PREC = 50
+	MAX_PREC     = 10000
+	// PREC_GUARD_BITS are worked with on top of the asked precision, so the
+	// last digits shown are right.
+	PREC_GUARD_BITS = 32
+	// MAX_EXACT_EXPONENT bounds powers and the exponents of literals, which
+	// are worked out in full.
+	MAX_EXACT_EXPONENT = 1 << 16
+	// MAX_EXACT_BITS bounds the numerator and denominator of a power, as a
+	// small exponent on a big base can still need too much memory.
+	MAX_EXACT_BITS = 1 << 20
+)
+
+// exactValue is a *big.Float, *big.Rat or *big.Int, after the number system
+// it belongs to.
+type exactValue any
+
+// numberSystem is the arithmetic of a mode other than FLOAT. Values move
+// between systems as rationals. Operations give an error message, or "".
+type numberSystem interface {
+	mode() numberMode
+	fromRat(r *big.Rat) (exactValue, string)
+	toRat(v exactValue) *big.Rat
+	negate(v exactValue) exactValue
+	apply(op string, a, b exactValue) (exactValue, string)
+	sqrt(v exactValue) (exactValue, string)
+	format(v exactValue) string
+}
+
+type bigFloatSystem struct {
+	// digits is the precision asked for, in significant decimal digits.
+	digits int
+}
+
+type ratSystem struct{}
+
+type intSystem struct{}
+
+func parseNumberMode(str string) (numberMode, bool) {
+	switch mode := numberMode(strings.ToUpper(str)); mode {
+	case MODE_FLOAT, MODE_BIGFLOAT, MODE_RAT, MODE_INT:
+		return mode, true
+	}
+
+	return "", false
+}
+
+func newNumberSystem(mode numberMode, digits int) numberSystem {
+	switch mode {
+	case MODE_BIGFLOAT:
+		return bigFloatSystem{digits: digits}
+	case MODE_RAT:
+		return ratSystem{}
+	case MODE_INT:
+		return intSystem{}
+	}
+
+	return nil
+}
+
+// parseLiteral reads a number literal exactly, like `1.5` as 3/2.
+func parseLiteral(literal string) (*big.Rat, bool) {
+	if at := strings.IndexAny(literal, "eE"); at != -1 {
+		exp, err := strconv.Atoi(literal[at+1:])
+		if err != nil || exp > MAX_EXACT_EXPONENT || exp < -MAX_EXACT_EXPONENT {
+			return nil, false
+		}
+	}
+
+	return new(big.Rat).SetString(literal)
+}
+
+// floatToRat takes the shortest decimal that reads back as x, so a 0.1
+// stored in FLOAT mode is 1/10 and not the binary fraction nearest to it.
+func floatToRat(x float64) (*big.Rat, bool) {
+	if math.IsNaN(x) || math.IsInf(x, 0) {
+		return nil, false
+	}
+
+	return new(big.Rat).SetString(strconv.FormatFloat(x, 'g', -1, 64))
+}
+
+func ratToFloat(r *big.Rat) float64 {
+	x, _ := r.Float64()
+	return x
+}
+
+// ratFloor relies on the denominator being positive, for which Div rounds
+// down.
+func ratFloor(r *big.Rat) *big.Int {
+	return new(big.Int).Div(r.Num(), r.Denom())
+}
+
+func ratTrunc(r *big.Rat) *big.Int {
+	return new(big.Int).Quo(r.Num(), r.Denom())
+}
+
+// ratPow raises a to a whole exponent.
+func ratPow(a, b *big.Rat) (*big.Rat, string) {
+	if !b.IsInt() {
+		return nil, "powers need a whole exponent in this mode"
+	} else if !b.Num().IsInt64() || b.Num().Int64() > MAX_EXACT_EXPONENT || b.Num().Int64() < -MAX_EXACT_EXPONENT {
+		return nil, fmt.Sprintf("exponent is out of range, at most %d", MAX_EXACT_EXPONENT)
+	}
+
+	exp := b.Num().Int64()
+	if exp < 0 && a.Sign() == 0 {
+		return nil, "division by zero"
+	}
+
+	bits := int64(a.Num().BitLen())
+	if denBits := int64(a.Denom().BitLen()); denBits > bits {
+		bits = denBits
+	}
+	if bits > 1 && (exp > MAX_EXACT_BITS/bits || exp < -MAX_EXACT_BITS/bits) {
+		return nil, fmt.Sprintf("exponent is out of range, at most %d", MAX_EXACT_BITS/bits)
+	}
+
+	n := big.NewInt(exp)
+	n.Abs(n)
+	num := new(big.Int).Exp(a.Num(), n, nil)
+	den := new(big.Int).Exp(a.Denom(), n, nil)
+	if exp < 0 {
+		num, den = den, num
+	}
+
+	return new(big.Rat).SetFrac(num, den), ""
+}
+
+// applyRat is the arithmetic of rationals, `%` keeping the sign of a and
+// `//` rounding down like in FLOAT mode.
+func applyRat(op string, a, b *big.Rat) (*big.Rat, string) {
+	switch op {
+	case "+":
+		return new(big.Rat).Add(a, b), ""
+	case "-":
+		return new(big.Rat).Sub(a, b), ""
+	case "*":
+		return new(big.Rat).Mul(a, b), ""
+	case "^":
+		return ratPow(a, b)
+	}
+
+	if b.Sign() == 0 {
+		return nil, "division by zero"
+	}
+
+	quo := new(big.Rat).Quo(a, b)
+	switch op {
+	case "//":
+		return new(big.Rat).SetInt(ratFloor(quo)), ""
+	case "%":
+		whole := new(big.Rat).SetInt(ratTrunc(quo))
+		return new(big.Rat).Sub(a, whole.Mul(whole, b)), ""
+	}
+
+	return quo, ""
+}
+
+func (bfs bigFloatSystem) mode() numberMode { return MODE_BIGFLOAT }
+func (rs ratSystem) mode() numberMode       { return MODE_RAT }
+func (is intSystem) mode() numberMode       { return MODE_INT }
+
+func (bfs bigFloatSystem) prec() uint {
+	return uint(math.Ceil(float64(bfs.digits)*math.Log2(10))) + PREC_GUARD_BITS
+}
+
+func (bfs bigFloatSystem) newFloat() *big.Float {
+	return new(big.Float).SetPrec(bfs.prec())
+}
+
+func (bfs bigFloatSystem) fromRat(r *big.Rat) (exactValue, string) {
+	return bfs.newFloat().SetRat(r), ""
+}
+
+func (bfs bigFloatSystem) toRat(v exactValue) *big.Rat {
+	r, _ := v.(*big.Float).Rat(nil)
+	return r
+}
+
+func (bfs bigFloatSystem) negate(v exactValue) exactValue {
+	return bfs.newFloat().Neg(v.(*big.Float))
+}
+
+func (bfs bigFloatSystem) apply(op string, a, b exactValue) (exactValue, string) {
+	x, y := a.(*big.Float), b.(*big.Float)
+
+	switch op {
+	case "+":
+		return bfs.newFloat().Add(x, y), ""
+	case "-":
+		return bfs.newFloat().Sub(x, y), ""
+	case "*":
+		return bfs.newFloat().Mul(x, y), ""
+	case "/":
+		if y.Sign() == 0 {
+			return nil, "division by zero"
+		}
+		return bfs.newFloat().Quo(x, y), ""
+	}
+
+	// Powers, `%` and `//` are worked out on the exact values and rounded
+	// once at the end.
+	res, msg := applyRat(op, bfs.toRat(x), bfs.toRat(y))
+	if msg != "" {
+		return nil, msg
+	}
+
+	return bfs.fromRat(res)
+}
+
+func (bfs bigFloatSystem) sqrt(v exactValue) (exactValue, string) {
+	x := v.(*big.Float)
+	if x.Sign() < 0 {
+		return nil, "sqrt is not defined for negative numbers"
+	}
+
+	return bfs.newFloat().Sqrt(x), ""
+}
+
+func (bfs bigFloatSystem) format(v exactValue) string {
+	return v.(*big.Float).Text('g', bfs.digits)
+}
+
+func (rs ratSystem) fromRat(r *big.Rat) (exactValue, string) {
+	return new(big.Rat).Set(r), ""
+}
+
+func (rs ratSystem) toRat(v exactValue) *big.Rat {
+	return v.(*big.Rat)
+}
+
+func (rs ratSystem) negate(v exactValue) exactValue {
+	return new(big.Rat).Neg(v.(*big.Rat))
+}
+
+func (rs ratSystem) apply(op string, a, b exactValue) (exactValue, string) {
+	res, msg := applyRat(op, a.(*big.Rat), b.(*big.Rat))
+	if msg != "" {
+		return nil, msg
+	}
+
+	return res, ""
+}
+
+// sqrt is exact, so only of squares like 9/4.
+func (rs ratSystem) sqrt(v exactValue) (exactValue, string) {
+	r := v.(*big.Rat)
+	if r.Sign() < 0 {
+		return nil, "sqrt is not defined for negative numbers"
+	}
+
+	num, numOk := intSqrt(r.Num())
+	den, denOk := intSqrt(r.Denom())
+	if !numOk || !denOk {
+		return nil, fmt.Sprintf("sqrt of %s is not rational", r.RatString())
+	}
+
+	return new(big.Rat).SetFrac(num, den), ""
+}
+
+func (rs ratSystem) format(v exactValue) string {
+	return v.(*big.Rat).RatString()
+}
+
+func (is intSystem) fromRat(r *big.Rat) (exactValue, string) {
+	if !r.IsInt() {
+		return nil, fmt.Sprintf("%s is not a whole number", r.RatString())
+	}
+
+	return new(big.Int).Set(r.Num()), ""
+}
+
+func (is intSystem) toRat(v exactValue) *big.Rat {
+	return new(big.Rat).SetInt(v.(*big.Int))
+}
+
+func (is intSystem) negate(v exactValue) exactValue {
+	return new(big.Int).Neg(v.(*big.Int))
+}
+
+// apply keeps to whole numbers: `/` has to come out even, and powers cannot
+// be negative.
+func (is intSystem) apply(op string, a, b exactValue) (exactValue, string) {
+	x, y := a.(*big.Int), b.(*big.Int)
+
+	if op == "^" && y.Sign() < 0 {
+		return nil, "negative powers are not whole numbers"
+	} else if op == "/" && y.Sign() != 0 {
+		if rem := new(big.Int).Rem(x, y); rem.Sign() != 0 {
+			return nil, fmt.Sprintf("%s / %s is not a whole number, use //", x, y)
+		}
+	}
+
+	res, msg := applyRat(op, is.toRat(x), is.toRat(y))
+	if msg != "" {
+		return nil, msg
+	}
+
+	return is.fromRat(res)
+}
+
+func (is intSystem) sqrt(v exactValue) (exactValue, string) {
+	x := v.(*big.Int)
+	if x.Sign() < 0 {
+		return nil, "sqrt is not defined for negative numbers"
+	}
+
+	root, ok := intSqrt(x)
+	if !ok {
+		return nil, fmt.Sprintf("sqrt of %s is not a whole number", x)
+	}
+
+	return root, ""
+}
+
+func (is intSystem) format(v exactValue) string {
+	return v.(*big.Int).String()
+}
+
+// intSqrt tells the square root of x and if x is a square.
+func intSqrt(x *big.Int) (*big.Int, bool) {
+	root := new(big.Int).Sqrt(x)
+	return root, new(big.Int).Mul(root, root).Cmp(x) == 0
+}
+
+// bigPi is Machin's formula, pi = 16 atan(1/5) - 4 atan(1/239).
+func bigPi(prec uint) *big.Float {
+	pi := new(big.Float).SetPrec(prec).Mul(big.NewFloat(16), atanInverse(5, prec))
+	return pi.Sub(pi, new(big.Float).SetPrec(prec).Mul(big.NewFloat(4), atanInverse(239, prec)))
+}
+
+// atanInverse is atan(1/x) = 1/x - 1/(3x^3) + 1/(5x^5) - ...
+func atanInverse(x int64, prec uint) *big.Float {
+	xSquared := new(big.Float).SetPrec(prec).SetInt64(x * x)
+	power := new(big.Float).SetPrec(prec).Quo(big.NewFloat(1), new(big.Float).SetInt64(x))
+	sum := new(big.Float).SetPrec(prec).Set(power)
+	limit := new(big.Float).SetMantExp(big.NewFloat(1), -int(prec))
+
+	for k := int64(1); ; k++ {
+		power.Quo(power, xSquared)
+		term := new(big.Float).SetPrec(prec).Quo(power, new(big.Float).SetInt64(2*k+1))
+		if term.Cmp(limit) < 0 {
+			return sum
+		}
+
+		if k%2 == 1 {
+			sum.Sub(sum, term)
+		} else {
+			sum.Add(sum, term)
+		}
+	}
+}
+
+// bigE is e = 1 + 1/1! + 1/2! + ...
+func bigE(prec uint) *big.Float {
+	sum := new(big.Float).SetPrec(prec).SetInt64(1)
+	term := new(big.Float).SetPrec(prec).SetInt64(1)
+	limit := new(big.Float).SetMantExp(big.NewFloat(1), -int(prec))
+
+	for k := int64(1); term.Cmp(limit) >= 0; k++ {
+		term.Quo(term, new(big.Float).SetInt64(k))
+		sum.Add(sum, term)
+	}
+
+	return sum
+}
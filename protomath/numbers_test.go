@@ -0,0 +1,62 @@
+package protomath
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExactModes(t *testing.T) {
+	tests := []struct {
+		req      string
+		wantCode responseType
+		want     string
+	}{
+		{"MODE=RAT 1/3", RESPONSE_PARSE_OK, "MODE=RAT\n1/3"},
+		{"MODE=RAT 1/3 + 1/6", RESPONSE_PARSE_OK, "MODE=RAT\n1/2"},
+		{"MODE=RAT 0.1 + 0.2", RESPONSE_PARSE_OK, "MODE=RAT\n3/10"},
+		{"MODE=RAT 1.5e3", RESPONSE_PARSE_OK, "MODE=RAT\n1500"},
+		{"MODE=RAT 2^-2", RESPONSE_PARSE_OK, "MODE=RAT\n1/4"},
+		{"MODE=RAT 1/0", RESPONSE_MATH_ERROR, "column 2: division by zero\n1/0\n ^"},
+		{"MODE=INT 7/2", RESPONSE_MATH_ERROR, "column 2: 7 / 2 is not a whole number, use //\n7/2\n ^"},
+		{"MODE=INT 10 / 5", RESPONSE_PARSE_OK, "MODE=INT\n2"},
+		{"MODE=INT 7 // 2", RESPONSE_PARSE_OK, "MODE=INT\n3"},
+		{"MODE=INT -7//2", RESPONSE_PARSE_OK, "MODE=INT\n-4"},
+		{"MODE=INT -7 % 3", RESPONSE_PARSE_OK, "MODE=INT\n-1"},
+		{"MODE=INT 2^100", RESPONSE_PARSE_OK, "MODE=INT\n1267650600228229401496703205376"},
+		{"MODE=INT 2^-1", RESPONSE_MATH_ERROR, "column 2: negative powers are not whole numbers\n2^-1\n ^"},
+		{"MODE=INT sin(1)", RESPONSE_MATH_ERROR, "column 1: sin is only in FLOAT mode\nsin(1)\n^"},
+		{"MODE=BIGFLOAT 2/3", RESPONSE_PARSE_OK, "MODE=BIGFLOAT PREC=50\n0.66666666666666666666666666666666666666666666666667"},
+		{"MODE=BIGFLOAT PREC=30 1/3", RESPONSE_PARSE_OK, "MODE=BIGFLOAT PREC=30\n0.333333333333333333333333333333"},
+		{"MODE=BIGFLOAT PREC=20 sqrt(2)", RESPONSE_PARSE_OK, "MODE=BIGFLOAT PREC=20\n1.4142135623730950488"},
+		{"MODE=BIGFLOAT PREC=1 2/3", RESPONSE_PARSE_OK, "MODE=BIGFLOAT PREC=1\n0.7"},
+		{"MODE=BIGFLOAT PREC=0 1", RESPONSE_BAD_OPTION, "PREC must be 1 to 10000 digits, got 0"},
+		{"MODE=BIGFLOAT PREC=10001 1", RESPONSE_BAD_OPTION, "PREC must be 1 to 10000 digits, got 10001"},
+		{"PREC=5 1/3", RESPONSE_BAD_OPTION, "PREC is only for MODE=BIGFLOAT"},
+		{"MODE=FOO 1", RESPONSE_BAD_OPTION, "MODE must be FLOAT, BIGFLOAT, RAT or INT, got FOO"},
+		{"MODE=INT 2^65537", RESPONSE_MATH_ERROR, "column 2: exponent is out of range, at most 65536\n2^65537\n ^"},
+		{"MODE=RAT 1e65537", RESPONSE_MATH_ERROR, "column 1: number 1e65537 is out of range\n1e65537\n^"},
+		{"MODE=RAT 1e-65537", RESPONSE_MATH_ERROR, "column 1: number 1e-65537 is out of range\n1e-65537\n^"},
+	}
+
+	for _, test := range tests {
+		body, code := askMath(test.req)
+		if code != test.wantCode || body != test.want {
+			t.Errorf("%s: got %d %q, want %d %q", test.req, code, body, test.wantCode, test.want)
+		}
+	}
+}
+
+// The largest precision and exponent are still answered, in full.
+func TestExactModeBounds(t *testing.T) {
+	body, code := askMath("MODE=BIGFLOAT PREC=10000 1/7")
+	digits := strings.TrimPrefix(body, "MODE=BIGFLOAT PREC=10000\n0.")
+	if code != RESPONSE_PARSE_OK || len(digits) != MAX_PREC || !strings.HasPrefix(digits, "142857142857") {
+		t.Errorf("1/7 to %d digits: got %d, %d digits", MAX_PREC, code, len(digits))
+	}
+
+	body, code = askMath("MODE=INT 2^65536")
+	digits = strings.TrimPrefix(body, "MODE=INT\n")
+	if code != RESPONSE_PARSE_OK || len(digits) != 19729 || !strings.HasPrefix(digits, "2003529930") {
+		t.Errorf("2^65536: got %d, %d digits", code, len(digits))
+	}
+}
@@ -0,0 +1,345 @@
+package protomath
+
+import (
+	"fmt"
+	"math"
+	"protogen/protoparser"
+	"strconv"
+)
+
+const (
+	// DEFAULT_TOLERANCE is the error aimed for, absolute or relative to the
+	// answer, whichever is larger.
+	DEFAULT_TOLERANCE = 1e-10
+	// Subdivisions of INTEGRATE and iterations of ROOT, unless MAXITER says
+	// otherwise.
+	INTEGRATE_MAX_ITERATIONS = 1000
+	ROOT_MAX_ITERATIONS      = 100
+	MAX_ITERATIONS_LIMIT     = 100000
+	// MACHINE_EPSILON is the gap between 1 and the next float64.
+	MACHINE_EPSILON = 2.220446049250313e-16
+)
+
+// Nodes and weights of the 15 point Kronrod rule and the 7 point Gauss rule
+// inside it, the Gauss nodes being every other Kronrod node.
+var (
+	kronrodNodes = [8]float64{
+		0.991455371120812639206854697526329, 0.949107912342758524526189684047851,
+		0.864864423359769072789712788640926, 0.741531185599394439863864773280788,
+		0.586087235467691130294144845693013, 0.405845151377397166906606412076961,
+		0.207784955007898467600689403773245, 0,
+	}
+	kronrodWeights = [8]float64{
+		0.022935322010529224963732008058970, 0.063092092629978553290700663189204,
+		0.104790010322250183839876322541518, 0.140653259715525918745189590510238,
+		0.169004726639267902826583426598550, 0.190350578064785409913256402421014,
+		0.204432940075298892414161999234649, 0.209482141084727828012999174891714,
+	}
+	gaussWeights = [4]float64{
+		0.129484966168869693270611432679082, 0.279705391489276667901467771423780,
+		0.381830050505118944950369775488975, 0.417959183673469387755102040816327,
+	}
+)
+
+// sampledFunc is an expression as a function of one name, counting its
+// evaluations and keeping the first error.
+type sampledFunc struct {
+	ec          *evalContext
+	node        protoparser.Node
+	name        string
+	evaluations int
+	err         *evalError
+}
+
+// numericResult is what INTEGRATE and ROOT answer. The estimate is the
+// error estimate of an integral or the residual of a root.
+type numericResult struct {
+	method      solveMethod
+	name        string
+	value       float64
+	iterations  int
+	evaluations int
+	estimate    float64
+	converged   bool
+}
+
+type interval struct {
+	a, b   float64
+	result float64
+	err    float64
+}
+
+func (ec *evalContext) sample(node protoparser.Node, name string) *sampledFunc {
+	return &sampledFunc{ec: ec, node: node, name: name}
+}
+
+func (sf *sampledFunc) at(x float64) float64 {
+	if sf.err != nil {
+		return math.NaN()
+	}
+	sf.evaluations++
+
+	inner := *sf.ec
+	inner.locals = map[string]mathValue{sf.name: number(x)}
+	value, err := inner.evaluate(sf.node)
+	if err == nil && (math.IsNaN(value) || math.IsInf(value, 0)) {
+		err = newEvalError(sf.node, "result is not finite")
+	}
+	if err != nil && sf.name == "" {
+		sf.err = err
+		return math.NaN()
+	} else if err != nil {
+		sf.err = &evalError{column: err.column, message: fmt.Sprintf("%s at %s = %s", err.message, sf.name, formatNumber(x))}
+		return math.NaN()
+	}
+
+	return value
+}
+
+// integrate is adaptive Gauss-Kronrod: the interval with the largest error
+// estimate is halved until the estimates add up to within tol.
+func (sf *sampledFunc) integrate(a, b, tol float64, maxIter int) (numericResult, *evalError) {
+	res := numericResult{method: METHOD_GAUSS_KRONROD}
+	intervals := []interval{sf.gaussKronrod(a, b)}
+
+	for {
+		total, totalErr, worst := 0.0, 0.0, 0
+		for i, iv := range intervals {
+			total += iv.result
+			totalErr += iv.err
+			if iv.err > intervals[worst].err {
+				worst = i
+			}
+		}
+		res.value, res.estimate = total, totalErr
+
+		if sf.err != nil {
+			return res, sf.err
+		} else if totalErr <= math.Max(tol, tol*math.Abs(total)) {
+			res.converged = true
+			break
+		}
+
+		iv := intervals[worst]
+		mid := (iv.a + iv.b) / 2
+		if res.iterations >= maxIter || mid == iv.a || mid == iv.b {
+			break
+		}
+
+		res.iterations++
+		intervals[worst] = sf.gaussKronrod(iv.a, mid)
+		intervals = append(intervals, sf.gaussKronrod(mid, iv.b))
+	}
+
+	res.evaluations = sf.evaluations
+	return res, nil
+}
+
+// gaussKronrod takes the difference of the Kronrod and the Gauss rule for
+// the error.
+func (sf *sampledFunc) gaussKronrod(a, b float64) interval {
+	center, half := (a+b)/2, (b-a)/2
+	fc := sf.at(center)
+	kronrod := fc * kronrodWeights[7]
+	gauss := fc * gaussWeights[3]
+
+	for j := 0; j < 7; j++ {
+		dx := half * kronrodNodes[j]
+		pair := sf.at(center-dx) + sf.at(center+dx)
+		kronrod += kronrodWeights[j] * pair
+		if j%2 == 1 {
+			gauss += gaussWeights[j/2] * pair
+		}
+	}
+
+	return interval{a: a, b: b, result: kronrod * half, err: math.Abs((kronrod - gauss) * half)}
+}
+
+// integrateSimpson is adaptive Simpson's rule, halving where the two halves
+// disagree with the whole by more than their share of tol.
+func (sf *sampledFunc) integrateSimpson(a, b, tol float64, maxIter int) (numericResult, *evalError) {
+	res := numericResult{method: METHOD_SIMPSON, converged: true}
+
+	fa, fm, fb := sf.at(a), sf.at((a+b)/2), sf.at(b)
+	whole := (b - a) / 6 * (fa + 4*fm + fb)
+	tol = math.Max(tol, tol*math.Abs(whole))
+	res.value, res.estimate = sf.simpson(&res, maxIter, a, b, fa, fm, fb, whole, tol)
+	res.evaluations = sf.evaluations
+
+	return res, sf.err
+}
+
+func (sf *sampledFunc) simpson(res *numericResult, maxIter int, a, b, fa, fm, fb, whole, tol float64) (float64, float64) {
+	m := (a + b) / 2
+	lm, rm := (a+m)/2, (m+b)/2
+	flm, frm := sf.at(lm), sf.at(rm)
+	left := (m - a) / 6 * (fa + 4*flm + fm)
+	right := (b - m) / 6 * (fm + 4*frm + fb)
+	delta := left + right - whole
+
+	if math.Abs(delta) <= 15*tol || sf.err != nil {
+		return left + right + delta/15, math.Abs(delta) / 15
+	} else if res.iterations >= maxIter || lm == a || rm == b {
+		res.converged = false
+		return left + right + delta/15, math.Abs(delta) / 15
+	}
+
+	res.iterations++
+	leftValue, leftErr := sf.simpson(res, maxIter, a, m, fa, flm, fm, left, tol/2)
+	rightValue, rightErr := sf.simpson(res, maxIter, m, b, fm, frm, fb, right, tol/2)
+
+	return leftValue + rightValue, leftErr + rightErr
+}
+
+// newton is Newton's method from x, with the derivative worked out by DIFF
+// when it can be and by a difference quotient otherwise.
+func (sf *sampledFunc) newton(x, tol float64, maxIter int) (numericResult, *evalError) {
+	res := numericResult{method: METHOD_NEWTON, name: sf.name}
+
+	deriv := func(x float64) float64 { return derivativeAt(sf.at, x) }
+	if d, err := sf.ec.derivative(sf.node, sf.name); err == nil {
+		symbolic := sf.ec.sample(sf.ec.simplify(d), sf.name)
+		deriv = func(x float64) float64 {
+			sf.evaluations++
+			return symbolic.at(x)
+		}
+	}
+
+	for res.iterations < maxIter {
+		fx := sf.at(x)
+		if sf.err != nil && res.iterations == 0 {
+			return res, sf.err
+		} else if sf.err != nil {
+			break
+		} else if fx == 0 {
+			res.converged = true
+			break
+		}
+
+		slope := deriv(x)
+		if slope == 0 || math.IsNaN(slope) {
+			break
+		}
+
+		step := fx / slope
+		next := x - step
+		if math.IsInf(next, 0) || math.IsNaN(next) {
+			break
+		}
+		x = next
+		res.iterations++
+
+		if math.Abs(step) <= tol*math.Max(1, math.Abs(x)) {
+			res.converged = true
+			break
+		}
+	}
+
+	res.value, res.estimate = x, math.Abs(sf.at(x))
+	res.evaluations = sf.evaluations
+	if sf.err != nil {
+		// The last step can land where the function is not defined.
+		sf.err = nil
+		res.converged = false
+		res.estimate = math.NaN()
+	}
+
+	return res, nil
+}
+
+// brent is Brent's method on a bracket [a, b] where the function changes
+// sign, taking inverse quadratic interpolation or secant steps while they
+// shrink the bracket fast enough and bisecting otherwise.
+func (sf *sampledFunc) brent(a, b, tol float64, maxIter int) (numericResult, string, *evalError) {
+	res := numericResult{method: METHOD_BRENT, name: sf.name}
+
+	fa, fb := sf.at(a), sf.at(b)
+	if sf.err != nil {
+		return res, "", sf.err
+	} else if (fa > 0 && fb > 0) || (fa < 0 && fb < 0) {
+		return res, fmt.Sprintf("the function has the same sign at %s and %s", formatNumber(a), formatNumber(b)), nil
+	}
+
+	c, fc := b, fb
+	d, e := b-a, b-a
+	for ; res.iterations < maxIter; res.iterations++ {
+		if (fb > 0 && fc > 0) || (fb < 0 && fc < 0) {
+			c, fc = a, fa
+			d = b - a
+			e = d
+		}
+		if math.Abs(fc) < math.Abs(fb) {
+			a, b, c = b, c, b
+			fa, fb, fc = fb, fc, fb
+		}
+
+		tol1 := 2*MACHINE_EPSILON*math.Abs(b) + 0.5*tol*math.Max(1, math.Abs(b))
+		xm := (c - b) / 2
+		if math.Abs(xm) <= tol1 || fb == 0 {
+			res.converged = true
+			break
+		}
+
+		if math.Abs(e) >= tol1 && math.Abs(fa) > math.Abs(fb) {
+			var p, q float64
+			s := fb / fa
+			if a == c {
+				p, q = 2*xm*s, 1-s
+			} else {
+				q, r := fa/fc, fb/fc
+				p = s * (2*xm*q*(q-r) - (b-a)*(r-1))
+				q = (q - 1) * (r - 1) * (s - 1)
+			}
+			if p > 0 {
+				q = -q
+			}
+			p = math.Abs(p)
+
+			if 2*p < math.Min(3*xm*q-math.Abs(tol1*q), math.Abs(e*q)) {
+				e, d = d, p/q
+			} else {
+				d, e = xm, xm
+			}
+		} else {
+			d, e = xm, xm
+		}
+
+		a, fa = b, fb
+		if math.Abs(d) > tol1 {
+			b += d
+		} else {
+			b += math.Copysign(tol1, xm)
+		}
+		fb = sf.at(b)
+		if sf.err != nil {
+			return res, "", sf.err
+		}
+	}
+
+	res.value, res.estimate = b, math.Abs(fb)
+	res.evaluations = sf.evaluations
+
+	return res, "", nil
+}
+
+// toString is a line of how the answer was found and then the answer, the
+// value of the integral or the root.
+func (nr numericResult) toString() string {
+	converged := "YES"
+	if !nr.converged {
+		converged = "NO"
+	}
+
+	estimate := "ERROR"
+	if nr.name != "" {
+		estimate = "RESIDUAL"
+	}
+
+	header := fmt.Sprintf("METHOD=%s CONVERGED=%s ITERATIONS=%d EVALUATIONS=%d %s=%s",
+		nr.method, converged, nr.iterations, nr.evaluations, estimate, strconv.FormatFloat(nr.estimate, 'e', 2, 64))
+	if nr.name == "" {
+		return header + "\n" + formatNumber(nr.value)
+	}
+
+	return fmt.Sprintf("%s\n%s = %s", header, nr.name, formatNumber(nr.value))
+}
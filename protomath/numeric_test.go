@@ -0,0 +1,54 @@
+package protomath
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIntegrateAndRoot(t *testing.T) {
+	tests := []struct {
+		req      string
+		wantCode responseType
+		want     string
+	}{
+		{"INTEGRATE x FROM 0 TO 1", RESPONSE_INTEGRATED, "0.5000"},
+		{"INTEGRATE exp(-x^2) FROM -10 TO 10", RESPONSE_INTEGRATED, "1.7725"},
+		{"INTEGRATE 1/x FROM 0 TO 1", RESPONSE_NOT_CONVERGED, ""},
+		{"INTEGRATE 1 FROM 0 TO 1", RESPONSE_INTEGRATED, "1.0000"},
+		{"INTEGRATE pi FROM 0 TO 2", RESPONSE_INTEGRATED, "6.2832"},
+		{"FOR=t INTEGRATE 3 FROM 1 TO 2", RESPONSE_INTEGRATED, "3.0000"},
+		{"ROOT x^2 - 2 NEAR 1", RESPONSE_ROOT_FOUND, "x = 1.4142"},
+		{"ROOT x^2 - 2 IN [1, 2]", RESPONSE_ROOT_FOUND, "x = 1.4142"},
+		{"ROOT cos(x) - x NEAR 0", RESPONSE_ROOT_FOUND, "x = 0.7391"},
+		{"ROOT x^2 + 1 NEAR 1", RESPONSE_NOT_CONVERGED, ""},
+	}
+
+	for _, test := range tests {
+		body, code := askMath(test.req)
+		lines := strings.Split(body, "\n")
+		if code != test.wantCode || (test.want != "" && lines[len(lines)-1] != test.want) {
+			t.Errorf("%s: got %d %q, want %d %q", test.req, code, body, test.wantCode, test.want)
+		}
+	}
+}
+
+func TestNumericMathErrors(t *testing.T) {
+	tests := []struct {
+		req  string
+		want string
+	}{
+		{"FOR=x INTEGRATE 1e308 FROM 0 TO 1e10", "result of INTEGRATE is not a finite number"},
+		{"INTEGRATE 10^x FROM 0 TO 400", "result of ^ is not a finite number"},
+		{"INTEGRATE exp(x) FROM 0 TO 1000", "exp is not defined"},
+		{"INTEGRATE 1/0 FROM 0 TO 1", "column 2: division by zero"},
+		{"ROOT 2 NEAR 1", "column 1: a constant has no root"},
+		{"ROOT pi - 3 IN [0, 1]", "a constant has no root"},
+	}
+
+	for _, test := range tests {
+		body, code := askMath(test.req)
+		if code != RESPONSE_MATH_ERROR || !strings.Contains(body, test.want) {
+			t.Errorf("%s: got %d %q, want %d with %q", test.req, code, body, RESPONSE_MATH_ERROR, test.want)
+		}
+	}
+}
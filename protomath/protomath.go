@@ -3,9 +3,11 @@ package protomath
 import (
 	"fmt"
 	"log"
+	"math"
 	"net"
 	"os"
 	"protogen/protoparser"
+	"strconv"
 	"strings"
 )
 
@@ -16,9 +18,83 @@ const (
 	RESPONSE_REQPARSE_FAILED responseType = 52
 	RESPONSE_NON_ASCII       responseType = 53
 	RESPONSE_UNSUPPORTED_OP  responseType = 54
+	RESPONSE_SYNTAX_ERROR    responseType = 55
+	RESPONSE_MATH_ERROR      responseType = 56
+	RESPONSE_BAD_OPTION      responseType = 57
+	RESPONSE_UNKNOWN_SESSION responseType = 58
+	RESPONSE_SINGULAR_SYSTEM responseType = 59
+	RESPONSE_NOT_CONVERGED   responseType = 60
 	RESPONSE_PARSE_OK        responseType = 100
+	RESPONSE_SESSION_OPENED  responseType = 101
+	RESPONSE_VARS_LISTED     responseType = 102
+	RESPONSE_SESSION_CLEARED responseType = 103
+	RESPONSE_SOLVED          responseType = 104
+	RESPONSE_SIMPLIFIED      responseType = 105
+	RESPONSE_DIFFERENTIATED  responseType = 106
+	RESPONSE_INTEGRATED      responseType = 107
+	RESPONSE_ROOT_FOUND      responseType = 108
 )
 
+// Letters and underscores are allowed too, for names and options.
+const ALLOWED_EQ_BYTES = "0123456789.,;=+-*/%^()[] \t\r\n"
+
+const (
+	OPT_ANGLE   = "ANGLE"
+	OPT_SESSION = "SESSION"
+	OPT_MODE    = "MODE"
+	OPT_PREC    = "PREC"
+	OPT_FOR     = "FOR"
+	OPT_COMPLEX = "COMPLEX"
+	OPT_METHOD  = "METHOD"
+	OPT_TOL     = "TOL"
+	OPT_MAXITER = "MAXITER"
+)
+
+const (
+	COMM_SESSION = "SESSION"
+	COMM_VARS    = "VARS"
+	COMM_CLEAR   = "CLEAR"
+	COMM_SOLVE   = "SOLVE"
+	// COMM_SOLVE_SYSTEM takes linear equations separated by semicolons.
+	COMM_SOLVE_SYSTEM = "SOLVE_SYSTEM"
+	COMM_SIMPLIFY     = "SIMPLIFY"
+	COMM_DIFF         = "DIFF"
+	COMM_INTEGRATE    = "INTEGRATE"
+	COMM_ROOT         = "ROOT"
+)
+
+// Clauses after the expression of INTEGRATE and ROOT.
+const (
+	CLAUSE_FROM = "FROM"
+	CLAUSE_TO   = "TO"
+	CLAUSE_NEAR = "NEAR"
+	CLAUSE_IN   = "IN"
+)
+
+var (
+	knownOptions = map[string]bool{
+		OPT_ANGLE: true, OPT_SESSION: true, OPT_MODE: true, OPT_PREC: true, OPT_FOR: true, OPT_COMPLEX: true,
+		OPT_METHOD: true, OPT_TOL: true, OPT_MAXITER: true,
+	}
+	knownCommands = map[string]bool{
+		COMM_SESSION: true, COMM_VARS: true, COMM_CLEAR: true, COMM_SOLVE: true, COMM_SOLVE_SYSTEM: true,
+		COMM_SIMPLIFY: true, COMM_DIFF: true, COMM_INTEGRATE: true, COMM_ROOT: true,
+	}
+	// symbolicCommands answer an expression instead of a number.
+	symbolicCommands = map[string]bool{COMM_SIMPLIFY: true, COMM_DIFF: true}
+	// sessionCommands only make sense in a session.
+	sessionCommands = map[string]bool{COMM_VARS: true, COMM_CLEAR: true}
+)
+
+// mathRequest is a request split into the command and `KEY=VALUE` options
+// in front and the expression after them. Without a command the expression
+// is evaluated.
+type mathRequest struct {
+	command string
+	options map[string]string
+	expr    string
+}
+
 func ProtoMathMain(addr string) {
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -69,21 +145,46 @@ func (rp responseType) toString() string {
 		respText = "UNALLOWED BYTE DETECTED"
 	case RESPONSE_UNSUPPORTED_OP:
 		respText = "DETECTED UNSUPPORTED OPERATION"
+	case RESPONSE_SYNTAX_ERROR:
+		respText = "SYNTAX ERROR"
+	case RESPONSE_MATH_ERROR:
+		respText = "MATH ERROR"
+	case RESPONSE_BAD_OPTION:
+		respText = "BAD OPTION"
+	case RESPONSE_UNKNOWN_SESSION:
+		respText = "UNKNOWN SESSION"
+	case RESPONSE_SINGULAR_SYSTEM:
+		respText = "SINGULAR SYSTEM"
+	case RESPONSE_NOT_CONVERGED:
+		respText = "NOT CONVERGED"
+	case RESPONSE_SESSION_OPENED:
+		respText = "SESSION OPENED"
+	case RESPONSE_VARS_LISTED:
+		respText = "VARS LISTED"
+	case RESPONSE_SESSION_CLEARED:
+		respText = "SESSION CLEARED"
+	case RESPONSE_SOLVED:
+		respText = "EQUATION SOLVED"
+	case RESPONSE_SIMPLIFIED:
+		respText = "EXPRESSION SIMPLIFIED"
+	case RESPONSE_DIFFERENTIATED:
+		respText = "EXPRESSION DIFFERENTIATED"
+	case RESPONSE_INTEGRATED:
+		respText = "INTEGRAL COMPUTED"
+	case RESPONSE_ROOT_FOUND:
+		respText = "ROOT FOUND"
 	}
 
 	return fmt.Sprintf("%d %s", rp, respText)
 }
 
+// makeSureAllowed lets through digits, letters, the decimal point, commas,
+// semicolons, operators, parens, brackets and whitespace.
 func makeSureAllowed(by []byte) bool {
 	for _, b := range by {
-		if b > 57 && b < 32 {
+		isLetter := (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || b == '_'
+		if !isLetter && !strings.ContainsRune(ALLOWED_EQ_BYTES, rune(b)) {
 			return false
-		} else {
-			if b > 32 && b < 42 {
-				return false
-			} else if b == 46 || b == 44 {
-				return false
-			}
 		}
 	}
 
@@ -95,25 +196,412 @@ func solveEquation(eq []byte) ([]byte, responseType) {
 	if !strings.Contains(str, "PTMPv1 ") {
 		return nil, RESPONSE_REQPARSE_FAILED
 	}
-	if strings.Contains(str, "**") {
-		return nil, RESPONSE_UNSUPPORTED_OP
-	}
 
 	str = strings.Replace(str, "PTMPv1 ", "", -1)
+	str = strings.TrimRight(str, " \t\r\n")
 
 	isAlowed := makeSureAllowed([]byte(str))
 	if !isAlowed {
 		return nil, RESPONSE_NON_ASCII
 	}
 
-	solution, success := protoparser.ShuntingYard(str)
-	if !success {
-		return nil, RESPONSE_EQPARSE_FAILED
+	req := parseRequest(str)
+
+	if req.command == COMM_SESSION {
+		sess, err := globalSessions.open()
+		if err != nil {
+			return nil, RESPONSE_REQPARSE_FAILED
+		}
+		return []byte(sess.id + "\n\n"), RESPONSE_SESSION_OPENED
+	}
+
+	sess := newSession("")
+	if id, ok := req.options[OPT_SESSION]; ok {
+		if sess, ok = globalSessions.get(id); !ok {
+			return []byte(fmt.Sprintf("no session %s, it may have expired\n\n", id)), RESPONSE_UNKNOWN_SESSION
+		}
+	} else if sessionCommands[req.command] {
+		return []byte(fmt.Sprintf("%s needs a %s\n\n", req.command, OPT_SESSION)), RESPONSE_UNKNOWN_SESSION
+	}
+
+	sess.Lock()
+	defer sess.Unlock()
+
+	switch req.command {
+	case COMM_VARS:
+		return []byte(sess.toString() + "\n"), RESPONSE_VARS_LISTED
+	case COMM_CLEAR:
+		sess.clear()
+		return nil, RESPONSE_SESSION_CLEARED
+	}
+
+	ec := newEvalContext(sess)
+	if angle, ok := req.options[OPT_ANGLE]; ok {
+		if ec.angle, ok = parseAngleUnit(angle); !ok {
+			return []byte(fmt.Sprintf("%s must be DEG or RAD, got %s\n\n", OPT_ANGLE, angle)), RESPONSE_BAD_OPTION
+		}
+	}
+
+	sys, echo, badOption := req.numberSystem()
+	if badOption != "" {
+		return []byte(badOption + "\n\n"), RESPONSE_BAD_OPTION
+	}
+
+	if req.command == COMM_SOLVE_SYSTEM {
+		return handleSolveSystem(req, ec, sys)
+	} else if symbolicCommands[req.command] {
+		return handleSymbolic(req, ec, sys)
+	} else if req.command == COMM_INTEGRATE || req.command == COMM_ROOT {
+		return handleNumeric(req, ec, sys)
+	}
+
+	var tree protoparser.Node
+	var parseErr *protoparser.ParseError
+	if req.command == COMM_SOLVE {
+		tree, parseErr = protoparser.ParseEquation(req.expr)
+	} else {
+		tree, parseErr = protoparser.ParseStatement(req.expr)
+	}
+	if parseErr != nil {
+		return positionalError(req.expr, parseErr.Column, parseErr.Error()), RESPONSE_SYNTAX_ERROR
+	}
+
+	if eq, ok := asEquation(tree); ok {
+		return handleSolve(req, ec, sys, eq)
+	}
+
+	var solution string
+	var evalErr *evalError
+	if sys == nil {
+		solution, evalErr = ec.execute(tree)
+	} else {
+		solution, evalErr = newExactContext(sys, sess).execute(tree)
+	}
+	if evalErr != nil {
+		return positionalError(req.expr, evalErr.column, evalErr.Error()), RESPONSE_MATH_ERROR
+	}
+
+	return []byte(echo + solution + "\n\n"), RESPONSE_PARSE_OK
+}
+
+// SOLVE, or any equation that is not an assignment
+func handleSolve(req mathRequest, ec *evalContext, sys numberSystem, eq *protoparser.EquationNode) ([]byte, responseType) {
+	if sys != nil {
+		return []byte(fmt.Sprintf("equations are only solved in %s mode\n\n", MODE_FLOAT)), RESPONSE_BAD_OPTION
+	}
+
+	ec.solveFor = req.options[OPT_FOR]
+	if complexRoots, ok := req.options[OPT_COMPLEX]; ok {
+		switch strings.ToUpper(complexRoots) {
+		case "YES":
+			ec.complexRoots = true
+		case "NO":
+		default:
+			return []byte(fmt.Sprintf("%s must be YES or NO, got %s\n\n", OPT_COMPLEX, complexRoots)), RESPONSE_BAD_OPTION
+		}
+	}
+
+	solution, evalErr := ec.solve(eq)
+	if evalErr != nil {
+		return positionalError(req.expr, evalErr.column, evalErr.Error()), RESPONSE_MATH_ERROR
+	}
+
+	return []byte(solution + "\n\n"), RESPONSE_SOLVED
+}
+
+func handleSolveSystem(req mathRequest, ec *evalContext, sys numberSystem) ([]byte, responseType) {
+	if sys != nil {
+		return []byte(fmt.Sprintf("equations are only solved in %s mode\n\n", MODE_FLOAT)), RESPONSE_BAD_OPTION
+	}
+
+	eqs, parseErr := protoparser.ParseSystem(req.expr)
+	if parseErr != nil {
+		return positionalError(req.expr, parseErr.Column, parseErr.Error()), RESPONSE_SYNTAX_ERROR
+	}
+
+	ec.solveFor = req.options[OPT_FOR]
+	sol, evalErr := ec.solveSystem(eqs)
+	if evalErr != nil {
+		return positionalError(req.expr, evalErr.column, evalErr.Error()), RESPONSE_MATH_ERROR
+	} else if sol.singular() {
+		return []byte(sol.toString() + "\n\n"), RESPONSE_SINGULAR_SYSTEM
+	}
+
+	return []byte(sol.toString() + "\n\n"), RESPONSE_SOLVED
+}
+
+// SIMPLIFY or DIFF, answering the expression simplified or its derivative
+// with the name it is in.
+func handleSymbolic(req mathRequest, ec *evalContext, sys numberSystem) ([]byte, responseType) {
+	if sys != nil {
+		return []byte(fmt.Sprintf("%s is only in %s mode\n\n", req.command, MODE_FLOAT)), RESPONSE_BAD_OPTION
+	}
+
+	tree, parseErr := protoparser.Parse(req.expr)
+	if parseErr != nil {
+		return positionalError(req.expr, parseErr.Column, parseErr.Error()), RESPONSE_SYNTAX_ERROR
+	} else if found := ec.findMatrix(tree); found != nil {
+		evalErr := newEvalError(found, "%s only takes numbers, %s is a matrix", req.command, protoparser.Format(found))
+		return positionalError(req.expr, evalErr.column, evalErr.Error()), RESPONSE_MATH_ERROR
+	}
+
+	if req.command == COMM_SIMPLIFY {
+		return []byte(protoparser.Format(ec.simplify(tree)) + "\n\n"), RESPONSE_SIMPLIFIED
+	}
+
+	// An expression without an unknown is a number, its derivative is 0.
+	ec.solveFor = req.options[OPT_FOR]
+	if ec.solveFor == "" && len(ec.freeNames(tree)) == 0 {
+		if _, evalErr := ec.evaluate(tree); evalErr != nil {
+			return positionalError(req.expr, evalErr.column, evalErr.Error()), RESPONSE_MATH_ERROR
+		}
+		return []byte("0\n\n"), RESPONSE_DIFFERENTIATED
+	}
+
+	name, evalErr := ec.findUnknown(tree, tree)
+	if evalErr != nil {
+		return positionalError(req.expr, evalErr.column, evalErr.Error()), RESPONSE_MATH_ERROR
+	}
+
+	d, evalErr := ec.derivative(tree, name)
+	if evalErr != nil {
+		return positionalError(req.expr, evalErr.column, evalErr.Error()), RESPONSE_MATH_ERROR
+	}
+
+	return []byte(fmt.Sprintf("%s=%s\n%s\n\n", OPT_FOR, name, protoparser.Format(ec.simplify(d)))), RESPONSE_DIFFERENTIATED
+}
+
+// INTEGRATE f FROM a TO b, ROOT f NEAR x0 or ROOT f IN [a, b]
+func handleNumeric(req mathRequest, ec *evalContext, sys numberSystem) ([]byte, responseType) {
+	if sys != nil {
+		return []byte(fmt.Sprintf("%s is only in %s mode\n\n", req.command, MODE_FLOAT)), RESPONSE_BAD_OPTION
+	}
+
+	maxIter := ROOT_MAX_ITERATIONS
+	clauses := []string{CLAUSE_NEAR, CLAUSE_IN}
+	if req.command == COMM_INTEGRATE {
+		maxIter = INTEGRATE_MAX_ITERATIONS
+		clauses = []string{CLAUSE_FROM, CLAUSE_TO}
+	}
+
+	tol, maxIter, badOption := req.iterationLimits(maxIter)
+	if badOption != "" {
+		return []byte(badOption + "\n\n"), RESPONSE_BAD_OPTION
+	}
+
+	tree, given, parseErr := protoparser.ParseClauses(req.expr, clauses...)
+	if parseErr != nil {
+		return positionalError(req.expr, parseErr.Column, parseErr.Error()), RESPONSE_SYNTAX_ERROR
+	}
+
+	// A constant is integrated over a name it does not have, which leaves the
+	// name empty.
+	ec.solveFor = req.options[OPT_FOR]
+	var name string
+	var evalErr *evalError
+	if ec.solveFor == "" && len(ec.freeNames(tree)) == 0 {
+		if req.command != COMM_INTEGRATE {
+			evalErr = newEvalError(tree, "a constant has no root")
+			return positionalError(req.expr, evalErr.column, evalErr.Error()), RESPONSE_MATH_ERROR
+		}
+	} else if name, evalErr = ec.findUnknown(tree, tree); evalErr != nil {
+		return positionalError(req.expr, evalErr.column, evalErr.Error()), RESPONSE_MATH_ERROR
+	}
+
+	var res numericResult
+	resp := RESPONSE_ROOT_FOUND
+	if req.command == COMM_INTEGRATE {
+		res, evalErr, badOption = integrate(req, ec.sample(tree, name), given, tol, maxIter)
+		resp = RESPONSE_INTEGRATED
+	} else {
+		res, evalErr, badOption = findRoot(req, ec.sample(tree, name), given, tol, maxIter)
+	}
+
+	if badOption != "" {
+		return []byte(badOption + "\n\n"), RESPONSE_BAD_OPTION
+	} else if evalErr != nil {
+		return positionalError(req.expr, evalErr.column, evalErr.Error()), RESPONSE_MATH_ERROR
+	} else if math.IsNaN(res.value) || math.IsInf(res.value, 0) || math.IsNaN(res.estimate) || math.IsInf(res.estimate, 0) {
+		evalErr = newEvalError(tree, "result of %s is not a finite number", req.command)
+		return positionalError(req.expr, evalErr.column, evalErr.Error()), RESPONSE_MATH_ERROR
+	} else if !res.converged {
+		resp = RESPONSE_NOT_CONVERGED
+	}
+
+	return []byte(res.toString() + "\n\n"), resp
+}
+
+func integrate(req mathRequest, sf *sampledFunc, given map[string]protoparser.Node, tol float64, maxIter int) (numericResult, *evalError, string) {
+	from, hasFrom := given[CLAUSE_FROM]
+	to, hasTo := given[CLAUSE_TO]
+	if !hasFrom || !hasTo {
+		return numericResult{}, &evalError{column: len(req.expr) + 1, message: fmt.Sprintf("%s needs %s and %s", COMM_INTEGRATE, CLAUSE_FROM, CLAUSE_TO)}, ""
 	}
 
-	solution += "\n\n"
+	a, err := sf.ec.evaluate(from)
+	if err != nil {
+		return numericResult{}, err, ""
+	}
+	b, err := sf.ec.evaluate(to)
+	if err != nil {
+		return numericResult{}, err, ""
+	}
+
+	switch method := strings.ToUpper(req.options[OPT_METHOD]); method {
+	case "", string(METHOD_GAUSS_KRONROD):
+		res, err := sf.integrate(a, b, tol, maxIter)
+		return res, err, ""
+	case string(METHOD_SIMPSON):
+		res, err := sf.integrateSimpson(a, b, tol, maxIter)
+		return res, err, ""
+	}
+
+	return numericResult{}, nil, fmt.Sprintf("%s must be %s or %s, got %s", OPT_METHOD, METHOD_GAUSS_KRONROD, METHOD_SIMPSON, req.options[OPT_METHOD])
+}
+
+func findRoot(req mathRequest, sf *sampledFunc, given map[string]protoparser.Node, tol float64, maxIter int) (numericResult, *evalError, string) {
+	near, hasNear := given[CLAUSE_NEAR]
+	bracket, hasIn := given[CLAUSE_IN]
+	if hasNear == hasIn {
+		return numericResult{}, &evalError{column: len(req.expr) + 1, message: fmt.Sprintf("%s needs one of %s and %s", COMM_ROOT, CLAUSE_NEAR, CLAUSE_IN)}, ""
+	}
+
+	if hasNear {
+		x0, err := sf.ec.evaluate(near)
+		if err != nil {
+			return numericResult{}, err, ""
+		}
+		res, err := sf.newton(x0, tol, maxIter)
+		return res, err, ""
+	}
+
+	value, err := sf.ec.evaluateValue(bracket)
+	if err != nil {
+		return numericResult{}, err, ""
+	} else if value.matrix == nil || !value.matrix.isVector || value.matrix.cols != 2 {
+		return numericResult{}, newEvalError(bracket, "%s takes a bracket like [a, b], got %s", CLAUSE_IN, value.describe()), ""
+	}
+
+	res, msg, err := sf.brent(value.matrix.data[0], value.matrix.data[1], tol, maxIter)
+	if msg != "" {
+		return numericResult{}, newEvalError(bracket, "%s", msg), ""
+	}
+
+	return res, err, ""
+}
+
+// iterationLimits tells the TOL and MAXITER options, maxIter unless
+// MAXITER is given.
+func (req mathRequest) iterationLimits(maxIter int) (float64, int, string) {
+	tol := DEFAULT_TOLERANCE
+	if tolStr, ok := req.options[OPT_TOL]; ok {
+		var err error
+		if tol, err = strconv.ParseFloat(tolStr, 64); err != nil || !(tol > 0 && tol < 1) {
+			return 0, 0, fmt.Sprintf("%s must be a number between 0 and 1, got %s", OPT_TOL, tolStr)
+		}
+	}
+
+	if maxIterStr, ok := req.options[OPT_MAXITER]; ok {
+		var err error
+		if maxIter, err = strconv.Atoi(maxIterStr); err != nil || maxIter < 1 || maxIter > MAX_ITERATIONS_LIMIT {
+			return 0, 0, fmt.Sprintf("%s must be 1 to %d, got %s", OPT_MAXITER, MAX_ITERATIONS_LIMIT, maxIterStr)
+		}
+	}
+
+	return tol, maxIter, ""
+}
+
+// asEquation tells if tree is an equation. A definition of a built-in
+// function, like `sqrt(x) = 3`, is one too.
+func asEquation(tree protoparser.Node) (*protoparser.EquationNode, bool) {
+	switch n := tree.(type) {
+	case *protoparser.EquationNode:
+		return n, true
+	case *protoparser.FuncDefNode:
+		if _, _, ok := builtinArity(n.Name); !ok {
+			return nil, false
+		}
+
+		call := protoparser.CallNode{Name: n.Name, Args: make([]protoparser.Node, 0, len(n.Params)), At: n.At}
+		for _, param := range n.Params {
+			call.Args = append(call.Args, &protoparser.IdentNode{Name: param, At: n.At})
+		}
+		return &protoparser.EquationNode{Left: &call, Right: n.Body, At: n.At}, true
+	}
+
+	return nil, false
+}
+
+// numberSystem tells the system of the MODE and PREC options, nil for
+// FLOAT, and the line echoing them back. Without a MODE nothing is echoed.
+func (req mathRequest) numberSystem() (numberSystem, string, string) {
+	modeStr, hasMode := req.options[OPT_MODE]
+	precStr, hasPrec := req.options[OPT_PREC]
+
+	mode := MODE_FLOAT
+	if hasMode {
+		var ok bool
+		if mode, ok = parseNumberMode(modeStr); !ok {
+			return nil, "", fmt.Sprintf("%s must be FLOAT, BIGFLOAT, RAT or INT, got %s", OPT_MODE, modeStr)
+		}
+	}
+
+	digits := DEFAULT_PREC
+	if hasPrec && mode != MODE_BIGFLOAT {
+		return nil, "", fmt.Sprintf("%s is only for %s=%s", OPT_PREC, OPT_MODE, MODE_BIGFLOAT)
+	} else if hasPrec {
+		var err error
+		if digits, err = strconv.Atoi(precStr); err != nil || digits < 1 || digits > MAX_PREC {
+			return nil, "", fmt.Sprintf("%s must be 1 to %d digits, got %s", OPT_PREC, MAX_PREC, precStr)
+		}
+	}
+
+	echo := ""
+	if mode == MODE_BIGFLOAT {
+		echo = fmt.Sprintf("%s=%s %s=%d\n", OPT_MODE, mode, OPT_PREC, digits)
+	} else if hasMode {
+		echo = fmt.Sprintf("%s=%s\n", OPT_MODE, mode)
+	}
+
+	return newNumberSystem(mode, digits), echo, ""
+}
+
+// parseRequest takes the command and the options off the front of str. An
+// option is a word like `ANGLE=DEG`. Only known commands and options are
+// taken, so `X=3` is still an assignment.
+func parseRequest(str string) mathRequest {
+	req := mathRequest{options: make(map[string]string)}
+
+	rest := strings.TrimLeft(str, " \t\r\n")
+	for {
+		word, after, _ := strings.Cut(rest, " ")
+		if key, value, isOption := strings.Cut(word, "="); isOption && knownOptions[key] {
+			req.options[key] = value
+		} else if knownCommands[word] && req.command == "" {
+			req.command = word
+		} else {
+			break
+		}
+
+		rest = strings.TrimLeft(after, " \t\r\n")
+	}
+	req.expr = rest
+
+	return req
+}
+
+// formatNumber gives a number with four decimals, never as `-0.0000`.
+func formatNumber(num float64) string {
+	str := strconv.FormatFloat(num, 'f', 4, 64)
+	if str == "-0.0000" {
+		return "0.0000"
+	}
+
+	return str
+}
 
-	return []byte(solution), RESPONSE_PARSE_OK
+func positionalError(ex string, column int, message string) []byte {
+	return []byte(message + "\n" + caretExcerpt(ex, column) + "\n\n")
 }
 
 func CleanUpProtoMath() {
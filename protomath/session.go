@@ -0,0 +1,261 @@
+package protomath
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"protogen/protoparser"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SESSION_ID_BYTES    = 8
+	SESSION_IDLE_EXPIRY = 30 * time.Minute
+	MAX_SESSIONS        = 1024
+	// MAX_CALL_DEPTH stops functions calling themselves forever.
+	MAX_CALL_DEPTH = 64
+	ANS_NAME       = "ans"
+)
+
+type userFunc struct {
+	params []string
+	body   protoparser.Node
+}
+
+// session is the environment requests are evaluated in: variables, the
+// user's functions and `ans`. A request without a session gets a fresh one
+// that is dropped after it.
+type session struct {
+	sync.Mutex
+	id       string
+	vars     map[string]float64
+	exact    map[string]exactVar
+	matrices map[string]*matrix
+	funcs    map[string]userFunc
+	lastUsed time.Time
+}
+
+type sessionStore struct {
+	sync.Mutex
+	sessions map[string]*session
+}
+
+var globalSessions = sessionStore{sessions: make(map[string]*session)}
+
+func newSession(id string) *session {
+	return &session{
+		id:       id,
+		vars:     make(map[string]float64),
+		exact:    make(map[string]exactVar),
+		matrices: make(map[string]*matrix),
+		funcs:    make(map[string]userFunc),
+		lastUsed: time.Now(),
+	}
+}
+
+// open starts a session, making room by dropping idle sessions and then the
+// least recently used one.
+func (ss *sessionStore) open() (*session, error) {
+	idBytes := make([]byte, SESSION_ID_BYTES)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, err
+	}
+
+	ss.Lock()
+	defer ss.Unlock()
+
+	ss.expire()
+	for len(ss.sessions) >= MAX_SESSIONS {
+		ss.dropLeastRecentlyUsed()
+	}
+
+	sess := newSession(hex.EncodeToString(idBytes))
+	ss.sessions[sess.id] = sess
+
+	return sess, nil
+}
+
+func (ss *sessionStore) get(id string) (*session, bool) {
+	ss.Lock()
+	defer ss.Unlock()
+
+	ss.expire()
+	sess, ok := ss.sessions[id]
+	if ok {
+		sess.lastUsed = time.Now()
+	}
+
+	return sess, ok
+}
+
+func (ss *sessionStore) expire() {
+	for id, sess := range ss.sessions {
+		if time.Since(sess.lastUsed) > SESSION_IDLE_EXPIRY {
+			delete(ss.sessions, id)
+		}
+	}
+}
+
+func (ss *sessionStore) dropLeastRecentlyUsed() {
+	oldest := ""
+	for id, sess := range ss.sessions {
+		if oldest == "" || sess.lastUsed.Before(ss.sessions[oldest].lastUsed) {
+			oldest = id
+		}
+	}
+
+	delete(ss.sessions, oldest)
+}
+
+func (sess *session) clear() {
+	sess.vars = make(map[string]float64)
+	sess.exact = make(map[string]exactVar)
+	sess.matrices = make(map[string]*matrix)
+	sess.funcs = make(map[string]userFunc)
+}
+
+// toString lists the variables and then the functions, each sorted by name.
+// A variable assigned outside of FLOAT mode is shown as it is kept, with its
+// mode.
+func (sess *session) toString() string {
+	var sb strings.Builder
+
+	names := append(sortedKeys(sess.vars), sortedKeys(sess.matrices)...)
+	sort.Strings(names)
+	for _, name := range names {
+		if m, ok := sess.matrices[name]; ok {
+			sb.WriteString(fmt.Sprintf("%s = %s\n", name, matrixValue(m).format()))
+		} else if v, ok := sess.exact[name]; ok {
+			sb.WriteString(fmt.Sprintf("%s = %s %s\n", name, v.sys.format(v.value), v.sys.mode()))
+		} else {
+			sb.WriteString(fmt.Sprintf("%s = %s\n", name, formatNumber(sess.vars[name])))
+		}
+	}
+	for _, name := range sortedKeys(sess.funcs) {
+		fn := sess.funcs[name]
+		def := protoparser.FuncDefNode{Name: name, Params: fn.params, Body: fn.body}
+		sb.WriteString(protoparser.Format(&def) + "\n")
+	}
+
+	return sb.String()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// execute evaluates a statement in the session: an assignment stores the
+// value, a definition the function, and anything else is an expression whose
+// value becomes `ans`.
+func (ec *evalContext) execute(node protoparser.Node) (string, *evalError) {
+	switch n := node.(type) {
+	case *protoparser.AssignNode:
+		if err := checkAssignable(n, n.Name); err != nil {
+			return "", err
+		}
+
+		value, err := ec.evaluateValue(n.Value)
+		if err != nil {
+			return "", err
+		}
+		ec.store(n.Name, value)
+
+		return fmt.Sprintf("%s = %s", n.Name, value.format()), nil
+	case *protoparser.FuncDefNode:
+		return defineFunc(ec.sess, n)
+	}
+
+	value, err := ec.evaluateValue(node)
+	if err != nil {
+		return "", err
+	}
+	ec.store(ANS_NAME, value)
+
+	return value.format(), nil
+}
+
+// store keeps a name as a number or as a matrix, never both.
+func (ec *evalContext) store(name string, value mathValue) {
+	delete(ec.sess.exact, name)
+	if value.matrix != nil {
+		ec.sess.matrices[name] = value.matrix
+		delete(ec.sess.vars, name)
+	} else {
+		ec.sess.vars[name] = value.num
+		delete(ec.sess.matrices, name)
+	}
+}
+
+func defineFunc(sess *session, n *protoparser.FuncDefNode) (string, *evalError) {
+	if _, _, ok := builtinArity(n.Name); ok {
+		return "", newEvalError(n, "%s is a built-in function", n.Name)
+	}
+
+	seen := make(map[string]bool, len(n.Params))
+	for _, param := range n.Params {
+		if seen[param] {
+			return "", newEvalError(n, "parameter %s is given twice", param)
+		}
+		seen[param] = true
+	}
+	sess.funcs[n.Name] = userFunc{params: n.Params, body: n.Body}
+
+	return protoparser.Format(n), nil
+}
+
+func checkAssignable(n protoparser.Node, name string) *evalError {
+	if _, ok := constants[name]; ok {
+		return newEvalError(n, "%s is a constant", name)
+	} else if name == ANS_NAME {
+		return newEvalError(n, "%s is set by the session", name)
+	}
+
+	return nil
+}
+
+func (ec *evalContext) callUserFunc(n *protoparser.CallNode, fn userFunc) (mathValue, *evalError) {
+	if len(n.Args) != len(fn.params) {
+		return mathValue{}, newEvalError(n, "%s takes %s, got %d", n.Name, pluralArgs(len(fn.params)), len(n.Args))
+	} else if ec.depth >= MAX_CALL_DEPTH {
+		return mathValue{}, newEvalError(n, "calls are nested deeper than %d", MAX_CALL_DEPTH)
+	}
+
+	locals := make(map[string]mathValue, len(fn.params))
+	for i, argNode := range n.Args {
+		arg, err := ec.evaluateValue(argNode)
+		if err != nil {
+			return mathValue{}, err
+		}
+		locals[fn.params[i]] = arg
+	}
+
+	// The body was written in another request, so its columns mean nothing
+	// here and its errors are put on the call.
+	inner := *ec
+	inner.locals = locals
+	inner.depth++
+	res, err := inner.evaluateValue(fn.body)
+	if err != nil {
+		return mathValue{}, callError(n, err)
+	}
+
+	return res, nil
+}
+
+// callError puts an error from the body of a user function on the call.
+func callError(n *protoparser.CallNode, err *evalError) *evalError {
+	if err.inCall {
+		return &evalError{column: n.Pos() + 1, message: err.message, inCall: true, domain: err.domain}
+	}
+
+	return &evalError{column: n.Pos() + 1, message: fmt.Sprintf("in %s: %s", n.Name, err.message), inCall: true, domain: err.domain}
+}
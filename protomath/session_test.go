@@ -0,0 +1,27 @@
+package protomath
+
+import "testing"
+
+func TestSessionEchoesAndListsDefinitions(t *testing.T) {
+	id, code := askMath("SESSION")
+	if code != RESPONSE_SESSION_OPENED {
+		t.Fatalf("SESSION: got %d %q", code, id)
+	}
+
+	tests := []struct {
+		req  string
+		want string
+	}{
+		{"f(x, y) = -(x + 1)^2 + 2y", "f(x, y) = -(x + 1)^2 + 2 * y"},
+		{"g(t) = (t - 1) / (t + 1)", "g(t) = (t - 1) / (t + 1)"},
+		{"a = 2^3^2", "a = 512.0000"},
+		{"VARS", "a = 512.0000\nf(x, y) = -(x + 1)^2 + 2 * y\ng(t) = (t - 1) / (t + 1)"},
+	}
+
+	for _, test := range tests {
+		body, _ := askMath("SESSION=" + id + " " + test.req)
+		if body != test.want {
+			t.Errorf("%s: got %q, want %q", test.req, body, test.want)
+		}
+	}
+}
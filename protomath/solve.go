@@ -0,0 +1,824 @@
+package protomath
+
+import (
+	"fmt"
+	"math"
+	"math/cmplx"
+	"protogen/protoparser"
+	"sort"
+	"strings"
+)
+
+type solveMethod string
+
+const (
+	METHOD_IDENTITY   solveMethod = "IDENTITY"
+	METHOD_LINEAR     solveMethod = "LINEAR"
+	METHOD_QUADRATIC  solveMethod = "QUADRATIC"
+	METHOD_CUBIC      solveMethod = "CUBIC"
+	METHOD_QUARTIC    solveMethod = "QUARTIC"
+	METHOD_POLYNOMIAL solveMethod = "POLYNOMIAL"
+	METHOD_NUMERIC    solveMethod = "NUMERIC"
+	METHOD_GAUSSIAN   solveMethod = "GAUSSIAN"
+	// The methods of INTEGRATE and ROOT.
+	METHOD_GAUSS_KRONROD solveMethod = "GAUSS_KRONROD"
+	METHOD_SIMPSON       solveMethod = "SIMPSON"
+	METHOD_NEWTON        solveMethod = "NEWTON"
+	METHOD_BRENT         solveMethod = "BRENT"
+)
+
+const (
+	// MAX_POLY_DEGREE is the highest degree expanded into a polynomial, the
+	// rest is solved numerically.
+	MAX_POLY_DEGREE = 64
+	// Equations that are not polynomials are scanned for sign changes in
+	// SCAN_STEPS steps over -SCAN_RANGE to SCAN_RANGE.
+	SCAN_RANGE = 1000.0
+	SCAN_STEPS = 20000
+	// MAX_ROOTS are answered, the ones nearest to zero.
+	MAX_ROOTS = 20
+
+	NEWTON_ITERATIONS        = 100
+	BISECT_ITERATIONS        = 200
+	DURAND_KERNER_ITERATIONS = 1000
+	POLISH_ITERATIONS        = 8
+
+	// ROOT_TOLERANCE is how close to zero, relative to the size of its terms,
+	// a polynomial has to get for a root where it does not change sign.
+	ROOT_TOLERANCE = 1e-9
+	// SAME_ROOT_TOLERANCE is how close, relative to their size, roots are
+	// taken for the same one.
+	SAME_ROOT_TOLERANCE = 1e-7
+	// NUMERIC_TOLERANCE is how close to zero an equation that is not a
+	// polynomial has to get at a root.
+	NUMERIC_TOLERANCE = 1e-6
+	// CANCEL_TOLERANCE is how small, next to the terms it was summed from, a
+	// coefficient is taken for zero, like x in `0.1x + 0.2x - 0.3x`.
+	CANCEL_TOLERANCE = 1e-12
+)
+
+// polynomial has the coefficient of x^i at i.
+type polynomial []float64
+
+// solution is what SOLVE answers: the roots and how they were found.
+type solution struct {
+	unknown string
+	method  solveMethod
+	real    []float64
+	complex []complex128
+	// everything is set when every value of the unknown is a root.
+	everything bool
+	// more is set when there were more than MAX_ROOTS roots.
+	more bool
+}
+
+// solve finds the roots of eq, polynomials in closed form up to quartic and
+// the rest numerically.
+func (ec *evalContext) solve(eq *protoparser.EquationNode) (string, *evalError) {
+	unknown, err := ec.findUnknown(eq, eq.Left, eq.Right)
+	if err != nil {
+		return "", err
+	}
+
+	diff := &protoparser.BinaryNode{Op: "-", Left: eq.Left, Right: eq.Right, At: eq.At}
+	sol := solution{unknown: unknown}
+
+	poly, isPoly, err := ec.toPolynomial(diff, unknown)
+	if err != nil {
+		return "", err
+	}
+
+	if isPoly {
+		sol.solvePolynomial(poly.trim(), ec.complexRoots)
+	} else {
+		sol.method = METHOD_NUMERIC
+		if sol.real, sol.more, err = ec.scanRoots(diff, unknown); err != nil {
+			return "", err
+		}
+	}
+
+	return sol.toString(), nil
+}
+
+// findUnknown is the name FOR= names or else the one name in nodes that has
+// no value. Errors are put at at.
+func (ec *evalContext) findUnknown(at protoparser.Node, nodes ...protoparser.Node) (string, *evalError) {
+	if ec.solveFor != "" {
+		return ec.solveFor, nil
+	}
+
+	names := ec.freeNames(nodes...)
+	switch len(names) {
+	case 0:
+		return "", newEvalError(at, "there is no unknown, name one with %s=", OPT_FOR)
+	case 1:
+		return names[0], nil
+	}
+
+	return "", newEvalError(at, "there is more than one unknown, %s, name one with %s=", strings.Join(names, ", "), OPT_FOR)
+}
+
+// freeNames are the names in nodes that have no value, in order.
+func (ec *evalContext) freeNames(nodes ...protoparser.Node) []string {
+	free := make(map[string]bool)
+	for _, node := range nodes {
+		collectFreeNames(node, ec.sess, free)
+	}
+
+	return sortedKeys(free)
+}
+
+func collectFreeNames(node protoparser.Node, sess *session, free map[string]bool) {
+	switch n := node.(type) {
+	case *protoparser.IdentNode:
+		_, isVar := sess.vars[n.Name]
+		_, isMatrix := sess.matrices[n.Name]
+		_, isConst := constants[n.Name]
+		if !isVar && !isMatrix && !isConst && n.Name != ANS_NAME {
+			free[n.Name] = true
+		}
+	case *protoparser.UnaryNode:
+		collectFreeNames(n.Operand, sess, free)
+	case *protoparser.BinaryNode:
+		collectFreeNames(n.Left, sess, free)
+		collectFreeNames(n.Right, sess, free)
+	case *protoparser.CallNode:
+		for _, arg := range n.Args {
+			collectFreeNames(arg, sess, free)
+		}
+	case *protoparser.ListNode:
+		for _, element := range n.Elements {
+			collectFreeNames(element, sess, free)
+		}
+	}
+}
+
+func mentions(node protoparser.Node, name string) bool {
+	switch n := node.(type) {
+	case *protoparser.IdentNode:
+		return n.Name == name
+	case *protoparser.UnaryNode:
+		return mentions(n.Operand, name)
+	case *protoparser.BinaryNode:
+		return mentions(n.Left, name) || mentions(n.Right, name)
+	case *protoparser.CallNode:
+		for _, arg := range n.Args {
+			if mentions(arg, name) {
+				return true
+			}
+		}
+	case *protoparser.ListNode:
+		for _, element := range n.Elements {
+			if mentions(element, name) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// toPolynomial expands node into a polynomial in unknown, telling if it is
+// one. Parts without the unknown are evaluated as they are, but for sums,
+// which are added up like polynomials so what cancels out is zero.
+func (ec *evalContext) toPolynomial(node protoparser.Node, unknown string) (polynomial, bool, *evalError) {
+	if !mentions(node, unknown) && !isSum(node) {
+		value, err := ec.evaluate(node)
+		return polynomial{value}, err == nil, err
+	}
+
+	switch n := node.(type) {
+	case *protoparser.IdentNode:
+		return polynomial{0, 1}, true, nil
+	case *protoparser.UnaryNode:
+		operand, ok, err := ec.toPolynomial(n.Operand, unknown)
+		if !ok || n.Op == "+" {
+			return operand, ok, err
+		}
+		return operand.scale(-1), true, nil
+	case *protoparser.BinaryNode:
+		return ec.binaryPolynomial(n, unknown)
+	}
+
+	return nil, false, nil
+}
+
+func isSum(node protoparser.Node) bool {
+	n, ok := node.(*protoparser.BinaryNode)
+	return ok && (n.Op == "+" || n.Op == "-")
+}
+
+func (ec *evalContext) binaryPolynomial(n *protoparser.BinaryNode, unknown string) (polynomial, bool, *evalError) {
+	left, ok, err := ec.toPolynomial(n.Left, unknown)
+	if !ok {
+		return nil, false, err
+	}
+
+	// Only dividing by and raising to numbers keeps a polynomial.
+	if n.Op == "/" || n.Op == "^" {
+		if mentions(n.Right, unknown) {
+			return nil, false, nil
+		}
+
+		right, err := ec.evaluate(n.Right)
+		if err != nil {
+			return nil, false, err
+		} else if n.Op == "/" && right == 0 {
+			return nil, false, newEvalError(n, "division by zero")
+		} else if n.Op == "/" {
+			return left.scale(1 / right), true, nil
+		}
+
+		if right < 0 || right != math.Trunc(right) || float64(left.trim().degree())*right > MAX_POLY_DEGREE {
+			return nil, false, nil
+		}
+		return left.pow(int(right)), true, nil
+	}
+
+	right, ok, err := ec.toPolynomial(n.Right, unknown)
+	if !ok {
+		return nil, false, err
+	}
+
+	switch n.Op {
+	case "+":
+		return left.add(right), true, nil
+	case "-":
+		return left.add(right.scale(-1)), true, nil
+	case "*":
+		if left.trim().degree()+right.trim().degree() > MAX_POLY_DEGREE {
+			return nil, false, nil
+		}
+		return left.mul(right), true, nil
+	}
+
+	return nil, false, nil
+}
+
+func (p polynomial) degree() int {
+	return len(p) - 1
+}
+
+// trim drops leading coefficients that are zero. Ones left over from
+// rounding are zero already, add and mul see to it, so a leading coefficient
+// that is only small next to the others is kept.
+func (p polynomial) trim() polynomial {
+	end := len(p)
+	for end > 1 && p[end-1] == 0 {
+		end--
+	}
+
+	return p[:end]
+}
+
+// cancel zeroes the coefficients that are only rounding left over from
+// terms that cancelled out, size having the sum of the sizes of those terms.
+func (p polynomial) cancel(size []float64) polynomial {
+	for i, c := range p {
+		if math.Abs(c) <= CANCEL_TOLERANCE*size[i] {
+			p[i] = 0
+		}
+	}
+
+	return p
+}
+
+func (p polynomial) scale(factor float64) polynomial {
+	res := make(polynomial, len(p))
+	for i, c := range p {
+		res[i] = c * factor
+	}
+
+	return res
+}
+
+func (p polynomial) add(q polynomial) polynomial {
+	res := make(polynomial, int(math.Max(float64(len(p)), float64(len(q)))))
+	size := make([]float64, len(res))
+	for i, c := range p {
+		res[i] += c
+		size[i] += math.Abs(c)
+	}
+	for i, c := range q {
+		res[i] += c
+		size[i] += math.Abs(c)
+	}
+
+	return res.cancel(size)
+}
+
+func (p polynomial) mul(q polynomial) polynomial {
+	res := make(polynomial, len(p)+len(q)-1)
+	size := make([]float64, len(res))
+	for i, a := range p {
+		for j, b := range q {
+			res[i+j] += a * b
+			size[i+j] += math.Abs(a * b)
+		}
+	}
+
+	return res.cancel(size)
+}
+
+func (p polynomial) pow(n int) polynomial {
+	res := polynomial{1}
+	for i := 0; i < n; i++ {
+		res = res.mul(p)
+	}
+
+	return res
+}
+
+func (p polynomial) derivative() polynomial {
+	if len(p) == 1 {
+		return polynomial{0}
+	}
+
+	res := make(polynomial, len(p)-1)
+	for i := 1; i < len(p); i++ {
+		res[i-1] = float64(i) * p[i]
+	}
+
+	return res
+}
+
+// at is Horner's rule, also giving the sum of the sizes of the terms to
+// judge how close to zero the value is.
+func (p polynomial) at(x float64) (float64, float64) {
+	value, size := 0.0, 0.0
+	for i := len(p) - 1; i >= 0; i-- {
+		value = value*x + p[i]
+		size = size*math.Abs(x) + math.Abs(p[i])
+	}
+
+	return value, size
+}
+
+func (p polynomial) atComplex(z complex128) complex128 {
+	value := complex(0, 0)
+	for i := len(p) - 1; i >= 0; i-- {
+		value = value*z + complex(p[i], 0)
+	}
+
+	return value
+}
+
+// cauchyBound is a bound on the size of every root.
+func (p polynomial) cauchyBound() float64 {
+	lead := p[len(p)-1]
+	bound := 0.0
+	for _, c := range p[:len(p)-1] {
+		bound = math.Max(bound, math.Abs(c/lead))
+	}
+
+	return 1 + bound
+}
+
+func (sol *solution) solvePolynomial(p polynomial, complexRoots bool) {
+	var roots []complex128
+
+	switch p.degree() {
+	case 0:
+		sol.method = METHOD_IDENTITY
+		sol.everything = p[0] == 0
+		return
+	case 1:
+		sol.method = METHOD_LINEAR
+		sol.real = []float64{-p[0] / p[1]}
+		return
+	case 2:
+		sol.method = METHOD_QUADRATIC
+		roots = solveQuadratic(complex(p[2], 0), complex(p[1], 0), complex(p[0], 0))
+	case 3:
+		sol.method = METHOD_CUBIC
+		roots = solveCubic(p)
+	case 4:
+		sol.method = METHOD_QUARTIC
+		roots = solveQuartic(p)
+	default:
+		sol.method = METHOD_POLYNOMIAL
+		sol.real = dedupeReal(p.realRoots())
+		if complexRoots {
+			sol.complex = dedupeComplex(nonReal(p.durandKerner()))
+		}
+		return
+	}
+
+	for i := range roots {
+		roots[i] = p.polish(roots[i])
+	}
+
+	for _, z := range roots {
+		if isReal(z) {
+			sol.real = append(sol.real, real(z))
+		} else if complexRoots {
+			sol.complex = append(sol.complex, z)
+		}
+	}
+	sol.real = dedupeReal(sol.real)
+	sol.complex = dedupeComplex(sol.complex)
+}
+
+// solveQuadratic scales the coefficients by the largest of them first, so
+// the discriminant neither overflows nor underflows.
+func solveQuadratic(a, b, c complex128) []complex128 {
+	scale := math.Max(cmplx.Abs(a), math.Max(cmplx.Abs(b), cmplx.Abs(c)))
+	if scale > 0 {
+		a, b, c = a/complex(scale, 0), b/complex(scale, 0), c/complex(scale, 0)
+	}
+
+	disc := cmplx.Sqrt(b*b - 4*a*c)
+
+	// Adding numbers of the same sign keeps the precision of the smaller
+	// root, which is then taken from the product of the roots.
+	q := -(b + disc) / 2
+	if real(b)*real(disc)+imag(b)*imag(disc) < 0 {
+		q = -(b - disc) / 2
+	}
+	if q == 0 {
+		return []complex128{0, 0}
+	}
+
+	return []complex128{q / a, c / q}
+}
+
+// solveCubic is Cardano's formula on x^3 + bx^2 + cx + d made depressed,
+// t^3 + pt + q with x = t - b/3.
+func solveCubic(poly polynomial) []complex128 {
+	b, c, d := poly[2]/poly[3], poly[1]/poly[3], poly[0]/poly[3]
+	p := c - b*b/3
+	q := 2*b*b*b/27 - b*c/3 + d
+	shift := complex(-b/3, 0)
+
+	if p == 0 && q == 0 {
+		return []complex128{shift, shift, shift}
+	}
+
+	disc := cmplx.Sqrt(complex(q*q/4+p*p*p/27, 0))
+	u := cmplx.Pow(complex(-q/2, 0)+disc, 1.0/3)
+	if cmplx.Abs(u) == 0 {
+		u = cmplx.Pow(complex(-q/2, 0)-disc, 1.0/3)
+	}
+
+	omega := cmplx.Rect(1, 2*math.Pi/3)
+	roots := make([]complex128, 0, 3)
+	for k := 0; k < 3; k++ {
+		uk := u * cmplx.Pow(omega, complex(float64(k), 0))
+		roots = append(roots, uk-complex(p, 0)/(3*uk)+shift)
+	}
+
+	return roots
+}
+
+// solveQuartic is Ferrari's method on x^4 + bx^3 + cx^2 + dx + e made
+// depressed, y^4 + py^2 + qy + r with x = y - b/4. It adds a m to complete
+// the square, (y^2 + p/2 + m)^2 = 2m y^2 - qy + m^2 + mp + p^2/4 - r, the
+// right side being a square when m is a root of the resolvent cubic.
+func solveQuartic(poly polynomial) []complex128 {
+	b, c, d, e := poly[3]/poly[4], poly[2]/poly[4], poly[1]/poly[4], poly[0]/poly[4]
+	p := c - 3*b*b/8
+	q := b*b*b/8 - b*c/2 + d
+	r := -3*b*b*b*b/256 + b*b*c/16 - b*d/4 + e
+	shift := complex(-b/4, 0)
+
+	var ys []complex128
+	if math.Abs(q) <= 1e-14*(1+math.Abs(p)+math.Abs(r)) {
+		// y^4 + py^2 + r is a quadratic in y^2.
+		for _, z := range solveQuadratic(1, complex(p, 0), complex(r, 0)) {
+			ys = append(ys, cmplx.Sqrt(z), -cmplx.Sqrt(z))
+		}
+	} else {
+		resolvent := polynomial{-q * q, 2*p*p - 8*r, 8 * p, 8}
+		m := solveCubic(resolvent)[0]
+		for _, root := range solveCubic(resolvent) {
+			if cmplx.Abs(root) > cmplx.Abs(m) {
+				m = root
+			}
+		}
+
+		s := cmplx.Sqrt(2 * m)
+		half := complex(p/2, 0) + m
+		ys = append(ys, solveQuadratic(1, -s, half+complex(q, 0)/(2*s))...)
+		ys = append(ys, solveQuadratic(1, s, half-complex(q, 0)/(2*s))...)
+	}
+
+	roots := make([]complex128, 0, 4)
+	for _, y := range ys {
+		roots = append(roots, y+shift)
+	}
+
+	return roots
+}
+
+// polish takes a few Newton steps from z, as long as they get closer to a
+// root, making up for the rounding of the closed forms.
+func (p polynomial) polish(z complex128) complex128 {
+	deriv := p.derivative()
+	for i := 0; i < POLISH_ITERATIONS; i++ {
+		dz := deriv.atComplex(z)
+		if dz == 0 {
+			break
+		}
+
+		next := z - p.atComplex(z)/dz
+		if cmplx.Abs(p.atComplex(next)) >= cmplx.Abs(p.atComplex(z)) {
+			break
+		}
+		z = next
+	}
+
+	return z
+}
+
+// realRoots brackets the real roots between the critical points, the real
+// roots of the derivative, where the polynomial is monotonic. A critical
+// point where it touches zero is a multiple root.
+func (p polynomial) realRoots() []float64 {
+	if p.degree() == 0 {
+		return nil
+	} else if p.degree() == 1 {
+		return []float64{-p[0] / p[1]}
+	}
+
+	bound := p.cauchyBound()
+	points := append([]float64{-bound}, dedupeReal(p.derivative().trim().realRoots())...)
+	points = append(points, bound)
+
+	roots := make([]float64, 0)
+	for i := 0; i+1 < len(points); i++ {
+		a, b := points[i], points[i+1]
+		fa, _ := p.at(a)
+		fb, _ := p.at(b)
+		if fa == 0 {
+			roots = append(roots, a)
+		} else if fa*fb < 0 {
+			roots = append(roots, bracketRoot(func(x float64) float64 {
+				value, _ := p.at(x)
+				return value
+			}, a, b))
+		}
+	}
+
+	for _, c := range points[1 : len(points)-1] {
+		if value, size := p.at(c); math.Abs(value) <= ROOT_TOLERANCE*size {
+			roots = append(roots, c)
+		}
+	}
+
+	return roots
+}
+
+// durandKerner finds every root of p at once, improving a guess for each
+// from the others.
+func (p polynomial) durandKerner() []complex128 {
+	monic := p.scale(1 / p[len(p)-1])
+	n := p.degree()
+
+	roots := make([]complex128, n)
+	for i := range roots {
+		roots[i] = cmplx.Pow(complex(0.4, 0.9), complex(float64(i), 0))
+	}
+
+	for iter := 0; iter < DURAND_KERNER_ITERATIONS; iter++ {
+		change := 0.0
+		for i := range roots {
+			denom := complex(1, 0)
+			for j := range roots {
+				if i != j {
+					denom *= roots[i] - roots[j]
+				}
+			}
+			if denom == 0 {
+				continue
+			}
+
+			step := monic.atComplex(roots[i]) / denom
+			roots[i] -= step
+			change = math.Max(change, cmplx.Abs(step))
+		}
+
+		if change < 1e-15 {
+			break
+		}
+	}
+
+	for i := range roots {
+		roots[i] = p.polish(roots[i])
+	}
+
+	return roots
+}
+
+// scanRoots looks for roots of node in the unknown where it changes sign or
+// comes close to zero, between -SCAN_RANGE and SCAN_RANGE. It tells if there
+// were more than MAX_ROOTS. Domain errors are gaps in the scan, any other
+// error is one of the expression and is given back.
+func (ec *evalContext) scanRoots(node protoparser.Node, unknown string) ([]float64, bool, *evalError) {
+	var failed *evalError
+	f := func(x float64) float64 {
+		inner := *ec
+		inner.locals = map[string]mathValue{unknown: number(x)}
+		value, err := inner.evaluate(node)
+		if err != nil {
+			if !err.domain && failed == nil {
+				failed = err
+			}
+			return math.NaN()
+		}
+		return value
+	}
+
+	if f(-SCAN_RANGE); failed != nil {
+		return nil, false, failed
+	}
+
+	step := 2 * SCAN_RANGE / SCAN_STEPS
+	xs := make([]float64, SCAN_STEPS+1)
+	ys := make([]float64, SCAN_STEPS+1)
+	for i := range xs {
+		xs[i] = -SCAN_RANGE + float64(i)*step
+		ys[i] = f(xs[i])
+	}
+
+	roots := make([]float64, 0)
+	for i := 0; i+1 < len(xs); i++ {
+		var root float64
+		switch {
+		case ys[i] == 0:
+			root = xs[i]
+		case ys[i]*ys[i+1] < 0:
+			root = bracketRoot(f, xs[i], xs[i+1])
+		case i > 0 && math.Abs(ys[i]) < math.Abs(ys[i-1]) && math.Abs(ys[i]) < math.Abs(ys[i+1]):
+			// Touching zero without crossing it, like (x - 1)^2.
+			var ok bool
+			if root, ok = newtonRoot(f, xs[i]); !ok || root < xs[i-1] || root > xs[i+1] {
+				continue
+			}
+		default:
+			continue
+		}
+
+		if math.Abs(f(root)) <= NUMERIC_TOLERANCE {
+			roots = append(roots, root)
+		}
+	}
+
+	if failed != nil {
+		return nil, false, failed
+	}
+
+	roots = dedupeReal(roots)
+	if len(roots) <= MAX_ROOTS {
+		return roots, false, nil
+	}
+
+	sort.Slice(roots, func(i, j int) bool {
+		return math.Abs(roots[i]) < math.Abs(roots[j])
+	})
+	roots = roots[:MAX_ROOTS]
+	sort.Float64s(roots)
+
+	return roots, true, nil
+}
+
+// bracketRoot is Newton's method kept inside [a, b], where f changes sign,
+// falling back to bisecting whenever a step would leave the bracket.
+func bracketRoot(f func(float64) float64, a, b float64) float64 {
+	fa := f(a)
+	x := (a + b) / 2
+
+	for i := 0; i < BISECT_ITERATIONS; i++ {
+		fx := f(x)
+		if fx == 0 || b-a <= 1e-15*math.Max(1, math.Abs(x)) {
+			return x
+		}
+
+		if (fa < 0) == (fx < 0) {
+			a, fa = x, fx
+		} else {
+			b = x
+		}
+
+		next := x - fx/derivativeAt(f, x)
+		if math.IsNaN(next) || next <= a || next >= b {
+			next = (a + b) / 2
+		}
+		x = next
+	}
+
+	return x
+}
+
+func newtonRoot(f func(float64) float64, x float64) (float64, bool) {
+	for i := 0; i < NEWTON_ITERATIONS; i++ {
+		fx := f(x)
+		if fx == 0 {
+			return x, true
+		}
+
+		next := x - fx/derivativeAt(f, x)
+		if math.IsNaN(next) || math.IsInf(next, 0) {
+			return x, false
+		} else if math.Abs(next-x) <= 1e-15*math.Max(1, math.Abs(x)) {
+			return next, true
+		}
+		x = next
+	}
+
+	return x, true
+}
+
+func derivativeAt(f func(float64) float64, x float64) float64 {
+	h := 1e-7 * math.Max(1, math.Abs(x))
+	return (f(x+h) - f(x-h)) / (2 * h)
+}
+
+func isReal(z complex128) bool {
+	return math.Abs(imag(z)) <= SAME_ROOT_TOLERANCE*math.Max(1, cmplx.Abs(z))
+}
+
+func nonReal(roots []complex128) []complex128 {
+	res := make([]complex128, 0)
+	for _, z := range roots {
+		if !isReal(z) {
+			res = append(res, z)
+		}
+	}
+
+	return res
+}
+
+func dedupeReal(roots []float64) []float64 {
+	sort.Float64s(roots)
+
+	res := make([]float64, 0, len(roots))
+	for _, x := range roots {
+		if len(res) > 0 && math.Abs(x-res[len(res)-1]) <= SAME_ROOT_TOLERANCE*math.Max(1, math.Abs(x)) {
+			continue
+		}
+		res = append(res, x)
+	}
+
+	return res
+}
+
+func dedupeComplex(roots []complex128) []complex128 {
+	sort.Slice(roots, func(i, j int) bool {
+		if real(roots[i]) != real(roots[j]) {
+			return real(roots[i]) < real(roots[j])
+		}
+		return imag(roots[i]) < imag(roots[j])
+	})
+
+	res := make([]complex128, 0, len(roots))
+	for _, z := range roots {
+		isDupe := false
+		for _, seen := range res {
+			if cmplx.Abs(z-seen) <= SAME_ROOT_TOLERANCE*math.Max(1, cmplx.Abs(z)) {
+				isDupe = true
+				break
+			}
+		}
+		if !isDupe {
+			res = append(res, z)
+		}
+	}
+
+	return res
+}
+
+// toString is a line telling the method and the number of roots, then a
+// line per root, the real ones first.
+func (sol *solution) toString() string {
+	var sb strings.Builder
+
+	count := fmt.Sprint(len(sol.real) + len(sol.complex))
+	if sol.everything {
+		count = "ALL"
+	} else if sol.more {
+		count += "+"
+	}
+
+	sb.WriteString(fmt.Sprintf("METHOD=%s ROOTS=%s", sol.method, count))
+	if sol.method == METHOD_NUMERIC {
+		sb.WriteString(fmt.Sprintf(" RANGE=%g..%g", -SCAN_RANGE, SCAN_RANGE))
+	}
+	sb.WriteString("\n")
+
+	for _, x := range sol.real {
+		sb.WriteString(fmt.Sprintf("%s = %s\n", sol.unknown, formatNumber(x)))
+	}
+	for _, z := range sol.complex {
+		sb.WriteString(fmt.Sprintf("%s = %s\n", sol.unknown, formatComplex(z)))
+	}
+
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+func formatComplex(z complex128) string {
+	if imag(z) < 0 {
+		return fmt.Sprintf("%s - %si", formatNumber(real(z)), formatNumber(-imag(z)))
+	}
+
+	return fmt.Sprintf("%s + %si", formatNumber(real(z)), formatNumber(imag(z)))
+}
@@ -0,0 +1,61 @@
+package protomath
+
+import (
+	"strings"
+	"testing"
+)
+
+// askMath sends one request the way a connection would, trimming the blank
+// line that ends the body.
+func askMath(req string) (string, responseType) {
+	body, code := solveEquation([]byte("PTMPv1 " + req))
+	return strings.TrimSuffix(string(body), "\n\n"), code
+}
+
+func TestSolveFindsRoots(t *testing.T) {
+	tests := []struct {
+		req  string
+		want string
+	}{
+		{"SOLVE 2x + 1 = 0", "METHOD=LINEAR ROOTS=1\nx = -0.5000"},
+		{"SOLVE x^2 - 5x + 6 = 0", "METHOD=QUADRATIC ROOTS=2\nx = 2.0000\nx = 3.0000"},
+		{"SOLVE x^2 + 1 = 0", "METHOD=QUADRATIC ROOTS=0"},
+		{"COMPLEX=yes SOLVE x^2 + 1 = 0", "METHOD=QUADRATIC ROOTS=2\nx = 0.0000 - 1.0000i\nx = 0.0000 + 1.0000i"},
+		{"SOLVE x^3 - 6x^2 + 11x - 6 = 0", "METHOD=CUBIC ROOTS=3\nx = 1.0000\nx = 2.0000\nx = 3.0000"},
+		{"SOLVE x^4 - 5x^2 + 4 = 0", "METHOD=QUARTIC ROOTS=4\nx = -2.0000\nx = -1.0000\nx = 1.0000\nx = 2.0000"},
+		{"SOLVE 1e-20x^2 + x - 1 = 0", "METHOD=QUADRATIC ROOTS=2\nx = -100000000000000000000.0000\nx = 1.0000"},
+		{"SOLVE 1e200x^2 - 1e200 = 0", "METHOD=QUADRATIC ROOTS=2\nx = -1.0000\nx = 1.0000"},
+		{"SOLVE 1e160x^2 + 3e160x + 2e160 = 0", "METHOD=QUADRATIC ROOTS=2\nx = -2.0000\nx = -1.0000"},
+		{"SOLVE 1e-200x^2 - 1e-200 = 0", "METHOD=QUADRATIC ROOTS=2\nx = -1.0000\nx = 1.0000"},
+		{"SOLVE 0x = 5", "METHOD=IDENTITY ROOTS=0"},
+		{"SOLVE cos(x) = x", "METHOD=NUMERIC ROOTS=1 RANGE=-1000..1000\nx = 0.7391"},
+		{"SOLVE ln(x) = 1", "METHOD=NUMERIC ROOTS=1 RANGE=-1000..1000\nx = 2.7183"},
+		{"SOLVE 1/x = 2 + sin(x)", "METHOD=NUMERIC ROOTS=1 RANGE=-1000..1000\nx = 0.4160"},
+	}
+
+	for _, test := range tests {
+		body, code := askMath(test.req)
+		if code != RESPONSE_SOLVED || body != test.want {
+			t.Errorf("%s: got %d %q, want %d %q", test.req, code, body, RESPONSE_SOLVED, test.want)
+		}
+	}
+}
+
+func TestSolveErrors(t *testing.T) {
+	tests := []struct {
+		req  string
+		want string
+	}{
+		{"SOLVE foo(x) = 1", "column 1: unknown function foo\nfoo(x) = 1\n^"},
+		{"SOLVE x(x+1) = 0", "column 1: unknown function x\nx(x+1) = 0\n^"},
+		{"SOLVE sin(x, 2) = 1", "column 1: sin takes 1 argument, got 2\nsin(x, 2) = 1\n^"},
+		{"SOLVE cos(x) = y", "column 8: there is more than one unknown, x, y, name one with FOR=\ncos(x) = y\n       ^"},
+	}
+
+	for _, test := range tests {
+		body, code := askMath(test.req)
+		if code != RESPONSE_MATH_ERROR || body != test.want {
+			t.Errorf("%s: got %d %q, want %d %q", test.req, code, body, RESPONSE_MATH_ERROR, test.want)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package protomath
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// The statistics functions take lists, which are vectors like `[1, 2, 3]`.
+// Variance, stdev and cov are of a sample, pvariance and pstdev of a whole
+// population.
+
+// statFunctions are registered with valueFunctions, min and max taking
+// numbers as well as lists.
+var statFunctions = map[string]valueFunc{
+	"sum":        {1, 1, statSum},
+	"mean":       {1, 1, statMean},
+	"median":     {1, 1, statMedian},
+	"mode":       {1, 1, statMode},
+	"variance":   {1, 1, statVariance(true)},
+	"stdev":      {1, 1, statStdev(true)},
+	"pvariance":  {1, 1, statVariance(false)},
+	"pstdev":     {1, 1, statStdev(false)},
+	"percentile": {2, 2, statPercentile},
+	"cov":        {2, 2, statCov},
+	"corr":       {2, 2, statCorr},
+	"linreg":     {2, 2, statLinreg},
+	"min":        {1, VARIADIC, statExtreme(math.Min)},
+	"max":        {1, VARIADIC, statExtreme(math.Max)},
+}
+
+func init() {
+	for name, fn := range statFunctions {
+		valueFunctions[name] = fn
+	}
+}
+
+func statSum(args []mathValue) (mathValue, string) {
+	xs, msg := needList(args[0])
+	if msg != "" {
+		return mathValue{}, msg
+	}
+
+	return number(sumOf(xs)), ""
+}
+
+func statMean(args []mathValue) (mathValue, string) {
+	xs, msg := needList(args[0])
+	if msg != "" {
+		return mathValue{}, msg
+	}
+
+	return number(meanOf(xs)), ""
+}
+
+func statMedian(args []mathValue) (mathValue, string) {
+	xs, msg := needList(args[0])
+	if msg != "" {
+		return mathValue{}, msg
+	}
+
+	return number(percentileOf(sorted(xs), 50)), ""
+}
+
+// statMode is the most common value, the smallest of them on a tie.
+func statMode(args []mathValue) (mathValue, string) {
+	xs, msg := needList(args[0])
+	if msg != "" {
+		return mathValue{}, msg
+	}
+
+	xs = sorted(xs)
+	best, bestCount := xs[0], 0
+	for i := 0; i < len(xs); {
+		j := i
+		for j < len(xs) && xs[j] == xs[i] {
+			j++
+		}
+		if j-i > bestCount {
+			best, bestCount = xs[i], j-i
+		}
+		i = j
+	}
+
+	return number(best), ""
+}
+
+func statVariance(sample bool) func(args []mathValue) (mathValue, string) {
+	return func(args []mathValue) (mathValue, string) {
+		xs, msg := needList(args[0])
+		if msg != "" {
+			return mathValue{}, msg
+		}
+
+		variance, msg := varianceOf(xs, sample)
+		return number(variance), msg
+	}
+}
+
+func statStdev(sample bool) func(args []mathValue) (mathValue, string) {
+	return func(args []mathValue) (mathValue, string) {
+		xs, msg := needList(args[0])
+		if msg != "" {
+			return mathValue{}, msg
+		}
+
+		variance, msg := varianceOf(xs, sample)
+		return number(math.Sqrt(variance)), msg
+	}
+}
+
+// statPercentile interpolates between the two values nearest to the p-th
+// percentile, so the 50th is the median.
+func statPercentile(args []mathValue) (mathValue, string) {
+	xs, msg := needList(args[0])
+	if msg != "" {
+		return mathValue{}, msg
+	} else if args[1].matrix != nil || args[1].num < 0 || args[1].num > 100 {
+		return mathValue{}, fmt.Sprintf("expected a percentile from 0 to 100, got %s", describeNumber(args[1]))
+	}
+
+	return number(percentileOf(sorted(xs), args[1].num)), ""
+}
+
+// statExtreme is min or max of numbers and lists together.
+func statExtreme(pick func(a, b float64) float64) func(args []mathValue) (mathValue, string) {
+	return func(args []mathValue) (mathValue, string) {
+		values := make([]float64, 0, len(args))
+		for _, arg := range args {
+			if arg.matrix == nil {
+				values = append(values, arg.num)
+				continue
+			}
+
+			xs, msg := needList(arg)
+			if msg != "" {
+				return mathValue{}, msg
+			}
+			values = append(values, xs...)
+		}
+
+		res := values[0]
+		for _, x := range values[1:] {
+			res = pick(res, x)
+		}
+
+		return number(res), ""
+	}
+}
+
+func statCov(args []mathValue) (mathValue, string) {
+	xs, ys, msg := needPairs(args)
+	if msg != "" {
+		return mathValue{}, msg
+	} else if len(xs) < 2 {
+		return mathValue{}, "needs at least 2 pairs"
+	}
+
+	return number(sumOfProducts(xs, ys) / float64(len(xs)-1)), ""
+}
+
+// statCorr is Pearson's correlation coefficient.
+func statCorr(args []mathValue) (mathValue, string) {
+	xs, ys, msg := needPairs(args)
+	if msg != "" {
+		return mathValue{}, msg
+	}
+
+	sxx, syy := sumOfProducts(xs, xs), sumOfProducts(ys, ys)
+	if sxx == 0 || syy == 0 {
+		return mathValue{}, "not defined when all values of a list are the same"
+	}
+
+	return number(sumOfProducts(xs, ys) / math.Sqrt(sxx*syy)), ""
+}
+
+// statLinreg fits y = slope * x + intercept by least squares, answering
+// [slope, intercept].
+func statLinreg(args []mathValue) (mathValue, string) {
+	xs, ys, msg := needPairs(args)
+	if msg != "" {
+		return mathValue{}, msg
+	}
+
+	sxx := sumOfProducts(xs, xs)
+	if sxx == 0 {
+		return mathValue{}, "not defined when all x values are the same"
+	}
+
+	slope := sumOfProducts(xs, ys) / sxx
+	intercept := meanOf(ys) - slope*meanOf(xs)
+
+	return matrixValue(newVector([]float64{slope, intercept})), ""
+}
+
+func needList(v mathValue) ([]float64, string) {
+	if v.matrix == nil || !v.matrix.isVector {
+		return nil, fmt.Sprintf("expected a list, got %s", v.describe())
+	}
+
+	return v.matrix.data, ""
+}
+
+func needPairs(args []mathValue) ([]float64, []float64, string) {
+	xs, msg := needList(args[0])
+	if msg != "" {
+		return nil, nil, msg
+	}
+	ys, msg := needList(args[1])
+	if msg != "" {
+		return nil, nil, msg
+	} else if len(xs) != len(ys) {
+		return nil, nil, fmt.Sprintf("expected lists of the same length, got %d and %d", len(xs), len(ys))
+	}
+
+	return xs, ys, ""
+}
+
+func describeNumber(v mathValue) string {
+	if v.matrix != nil {
+		return v.describe()
+	}
+
+	return formatNumber(v.num)
+}
+
+func sorted(xs []float64) []float64 {
+	res := make([]float64, len(xs))
+	copy(res, xs)
+	sort.Float64s(res)
+
+	return res
+}
+
+func sumOf(xs []float64) float64 {
+	sum := 0.0
+	for _, x := range xs {
+		sum += x
+	}
+
+	return sum
+}
+
+func meanOf(xs []float64) float64 {
+	return sumOf(xs) / float64(len(xs))
+}
+
+// varianceOf takes the squares of the differences from the mean, which
+// loses less than the mean of the squares minus the square of the mean.
+func varianceOf(xs []float64, sample bool) (float64, string) {
+	n := float64(len(xs))
+	if sample {
+		if len(xs) < 2 {
+			return 0, "needs at least 2 values"
+		}
+		n--
+	}
+
+	return sumOfProducts(xs, xs) / n, ""
+}
+
+// sumOfProducts is the sum of (x - mean x)(y - mean y).
+func sumOfProducts(xs, ys []float64) float64 {
+	mx, my := meanOf(xs), meanOf(ys)
+	sum := 0.0
+	for i := range xs {
+		sum += (xs[i] - mx) * (ys[i] - my)
+	}
+
+	return sum
+}
+
+func percentileOf(sortedXs []float64, p float64) float64 {
+	rank := p / 100 * float64(len(sortedXs)-1)
+	lo := int(math.Floor(rank))
+	if lo+1 >= len(sortedXs) {
+		return sortedXs[len(sortedXs)-1]
+	}
+
+	frac := rank - float64(lo)
+	return sortedXs[lo] + frac*(sortedXs[lo+1]-sortedXs[lo])
+}
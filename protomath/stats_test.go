@@ -0,0 +1,49 @@
+package protomath
+
+import "testing"
+
+func TestStatistics(t *testing.T) {
+	tests := []struct {
+		req      string
+		wantCode responseType
+		want     string
+	}{
+		{"sum([1, 2, 3.5])", RESPONSE_PARSE_OK, "6.5000"},
+		{"mean([1, 2, 3, 4])", RESPONSE_PARSE_OK, "2.5000"},
+		{"median([3, 1, 2])", RESPONSE_PARSE_OK, "2.0000"},
+		{"median([4, 1, 3, 2])", RESPONSE_PARSE_OK, "2.5000"},
+		{"mode([5, 1, 1])", RESPONSE_PARSE_OK, "1.0000"},
+		{"mode([3, 3, 1, 2, 2])", RESPONSE_PARSE_OK, "2.0000"},
+		{"percentile([1, 2, 3, 4], 0)", RESPONSE_PARSE_OK, "1.0000"},
+		{"percentile([1, 2, 3, 4], 50)", RESPONSE_PARSE_OK, "2.5000"},
+		{"percentile([1, 2, 3, 4], 100)", RESPONSE_PARSE_OK, "4.0000"},
+		{"percentile([1, 2, 3, 4], 101)", RESPONSE_MATH_ERROR, "column 1: percentile: expected a percentile from 0 to 100, got 101.0000\npercentile([1, 2, 3, 4], 101)\n^"},
+		{"percentile([1, 2, 3, 4], -1)", RESPONSE_MATH_ERROR, "column 1: percentile: expected a percentile from 0 to 100, got -1.0000\npercentile([1, 2, 3, 4], -1)\n^"},
+		{"variance([1, 2, 3, 4])", RESPONSE_PARSE_OK, "1.6667"},
+		{"pvariance([1, 2, 3, 4])", RESPONSE_PARSE_OK, "1.2500"},
+		{"stdev([1, 2, 3, 4])", RESPONSE_PARSE_OK, "1.2910"},
+		{"pstdev([1, 2, 3, 4])", RESPONSE_PARSE_OK, "1.1180"},
+		{"cov([1, 2, 3], [2, 4, 6])", RESPONSE_PARSE_OK, "2.0000"},
+		{"corr([1, 2, 3], [2, 4, 6])", RESPONSE_PARSE_OK, "1.0000"},
+		{"corr([1, 2, 3], [3, 2, 1])", RESPONSE_PARSE_OK, "-1.0000"},
+		{"corr([1, 1, 1], [1, 2, 3])", RESPONSE_MATH_ERROR, "column 1: corr: not defined when all values of a list are the same\ncorr([1, 1, 1], [1, 2, 3])\n^"},
+		{"corr([1, 2], [1, 2, 3])", RESPONSE_MATH_ERROR, "column 1: corr: expected lists of the same length, got 2 and 3\ncorr([1, 2], [1, 2, 3])\n^"},
+		{"linreg([1, 2, 3], [3, 5, 7])", RESPONSE_PARSE_OK, "[2.0000, 1.0000]"},
+		{"linreg([2, 2, 2], [1, 2, 3])", RESPONSE_MATH_ERROR, "column 1: linreg: not defined when all x values are the same\nlinreg([2, 2, 2], [1, 2, 3])\n^"},
+		{"min(3, [1, 5], 2)", RESPONSE_PARSE_OK, "1.0000"},
+		{"max([1, 5], 7, [2])", RESPONSE_PARSE_OK, "7.0000"},
+		{"max([[1, 2], [3, 9]], 4)", RESPONSE_MATH_ERROR, "column 1: max: expected a list, got a 2x2 matrix\nmax([[1, 2], [3, 9]], 4)\n^"},
+		{"MODE=RAT min(1/3, [1/2, 1/4])", RESPONSE_PARSE_OK, "MODE=RAT\n1/4"},
+		{"MODE=RAT max([1/3], 1/2)", RESPONSE_PARSE_OK, "MODE=RAT\n1/2"},
+		{"MODE=INT max([1, 5], 7 // 2, [2])", RESPONSE_PARSE_OK, "MODE=INT\n5"},
+		{"MODE=RAT min([[1, 2]])", RESPONSE_MATH_ERROR, "column 6: matrices are only in FLOAT mode\nmin([[1, 2]])\n     ^"},
+		{"MODE=RAT median([1/3, 1/2])", RESPONSE_MATH_ERROR, "column 1: median is only in FLOAT mode\nmedian([1/3, 1/2])\n^"},
+	}
+
+	for _, test := range tests {
+		body, code := askMath(test.req)
+		if code != test.wantCode || body != test.want {
+			t.Errorf("%s: got %d %q, want %d %q", test.req, code, body, test.wantCode, test.want)
+		}
+	}
+}
@@ -0,0 +1,438 @@
+package protomath
+
+import (
+	"math"
+	"protogen/protoparser"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SIMPLIFY_DIGITS are the significant digits numbers are written with after
+// folding, so 0.1 + 0.2 is 0.3.
+const SIMPLIFY_DIGITS = 12
+
+// transcendental calls are only folded when they come out whole, like
+// ln(1), so `DIFF 2^x` is ln(2) * 2^x and not 0.69314718056 * 2^x.
+var transcendental = map[string]bool{
+	"exp": true, "ln": true, "log10": true, "log": true,
+	"sin": true, "cos": true, "tan": true, "asin": true, "acos": true, "atan": true, "atan2": true,
+	"sinh": true, "cosh": true, "tanh": true, "asinh": true, "acosh": true, "atanh": true,
+}
+
+// term is coeff times the factors, each a base raised to a number. Bases
+// are names, calls and whatever else could not be taken apart, like sums
+// that are multiplied.
+type term struct {
+	coeff   float64
+	factors []factor
+}
+
+type factor struct {
+	base protoparser.Node
+	exp  float64
+}
+
+// sum is an expression written as terms added together, zero having none.
+type sum []term
+
+// simplify folds constants, drops identities like `x * 1` and `x^0`, and
+// collects like terms, so `2x + 3x - x*x/x` is 4 * x.
+func (ec *evalContext) simplify(node protoparser.Node) protoparser.Node {
+	return ec.toSum(node).node()
+}
+
+func (ec *evalContext) toSum(node protoparser.Node) sum {
+	switch n := node.(type) {
+	case *protoparser.NumberNode:
+		num, err := strconv.ParseFloat(n.Literal, 64)
+		if err != nil {
+			return atom(n)
+		}
+		return constant(num)
+	case *protoparser.IdentNode:
+		return atom(n)
+	case *protoparser.UnaryNode:
+		operand := ec.toSum(n.Operand)
+		if n.Op == "-" {
+			return operand.scale(-1)
+		}
+		return operand
+	case *protoparser.BinaryNode:
+		return ec.binarySum(n)
+	case *protoparser.CallNode:
+		return ec.callSum(n)
+	}
+
+	return atom(node)
+}
+
+func (ec *evalContext) binarySum(n *protoparser.BinaryNode) sum {
+	left := ec.toSum(n.Left)
+	right := ec.toSum(n.Right)
+
+	switch n.Op {
+	case "+":
+		return append(append(sum{}, left...), right...).collect()
+	case "-":
+		return append(append(sum{}, left...), right.scale(-1)...).collect()
+	case "*":
+		return left.mul(right)
+	case "/":
+		return left.div(right)
+	case "^":
+		return left.pow(right)
+	}
+
+	// `%` and `//` are only worked out on numbers.
+	if a, ok := left.constantValue(); ok {
+		if b, ok := right.constantValue(); ok {
+			if res, err := scalarBinary(n, a, b); err == nil {
+				return constant(res)
+			}
+		}
+	}
+
+	return atom(&protoparser.BinaryNode{Op: n.Op, Left: left.node(), Right: right.node(), At: n.At})
+}
+
+// callSum works out a call when its arguments are numbers, and for
+// transcendental calls the result is whole.
+func (ec *evalContext) callSum(n *protoparser.CallNode) sum {
+	call := protoparser.CallNode{Name: n.Name, Args: make([]protoparser.Node, 0, len(n.Args)), At: n.At}
+	folds := true
+	for _, arg := range n.Args {
+		simplified := ec.toSum(arg)
+		_, isConstant := simplified.constantValue()
+		folds = folds && isConstant
+		call.Args = append(call.Args, simplified.node())
+	}
+
+	if folds {
+		value, err := ec.evaluateValue(&call)
+		isExact := !transcendental[call.Name] || value.num == math.Trunc(value.num)
+		if err == nil && value.matrix == nil && isExact {
+			return constant(value.num)
+		}
+	}
+
+	return atom(&call)
+}
+
+func constant(num float64) sum {
+	if num == 0 {
+		return sum{}
+	}
+
+	return sum{{coeff: num}}
+}
+
+func atom(base protoparser.Node) sum {
+	return sum{{coeff: 1, factors: []factor{{base: base, exp: 1}}}}
+}
+
+// constantValue tells the number s is, if it is one.
+func (s sum) constantValue() (float64, bool) {
+	switch {
+	case len(s) == 0:
+		return 0, true
+	case len(s) == 1 && len(s[0].factors) == 0:
+		return s[0].coeff, true
+	}
+
+	return 0, false
+}
+
+func (s sum) scale(factor float64) sum {
+	res := make(sum, 0, len(s))
+	for _, t := range s {
+		if coeff := t.coeff * factor; coeff != 0 {
+			res = append(res, term{coeff: coeff, factors: t.factors})
+		}
+	}
+
+	return res
+}
+
+// collect adds up like terms, the ones with the same factors, and puts the
+// terms in order: highest degree first and numbers last.
+func (s sum) collect() sum {
+	res := make(sum, 0, len(s))
+	at := make(map[string]int)
+	for _, t := range s {
+		key := t.key()
+		if i, ok := at[key]; ok {
+			res[i].coeff += t.coeff
+			continue
+		}
+		at[key] = len(res)
+		res = append(res, t)
+	}
+
+	res = res.scale(1)
+	sort.SliceStable(res, func(i, j int) bool {
+		if di, dj := res[i].degree(), res[j].degree(); di != dj {
+			return di > dj
+		}
+		return res[i].key() < res[j].key()
+	})
+
+	return res
+}
+
+// mul multiplies single terms out and scales sums by numbers. Sums are not
+// expanded, so `(x + 1)(x + 1)` is (x + 1)^2.
+func (s sum) mul(other sum) sum {
+	if len(s) == 0 || len(other) == 0 {
+		return sum{}
+	} else if num, ok := s.constantValue(); ok {
+		return other.scale(num)
+	} else if num, ok := other.constantValue(); ok {
+		return s.scale(num)
+	}
+
+	return sum{s.asTerm().mul(other.asTerm())}.collect()
+}
+
+func (s sum) div(other sum) sum {
+	if len(other) == 0 {
+		return atom(&protoparser.BinaryNode{Op: "/", Left: s.node(), Right: numberNode(0)})
+	}
+
+	inverse := other.asTerm()
+	inverse.coeff = 1 / inverse.coeff
+	factors := make([]factor, 0, len(inverse.factors))
+	for _, f := range inverse.factors {
+		factors = append(factors, factor{base: f.base, exp: -f.exp})
+	}
+	inverse.factors = factors
+
+	return s.mul(sum{inverse})
+}
+
+// pow raises to a number by raising the coefficient and the exponents of a
+// single term. Exponents only multiply for whole powers, since (x^2)^0.5 is
+// not x for a negative x.
+func (s sum) pow(exp sum) sum {
+	e, ok := exp.constantValue()
+	switch {
+	case !ok:
+		if base, ok := s.constantValue(); ok && base == 1 {
+			return constant(1)
+		}
+		return atom(&protoparser.BinaryNode{Op: "^", Left: s.node(), Right: exp.node()})
+	case e == 0:
+		return constant(1)
+	case e == 1:
+		return s
+	case len(s) == 0 && e > 0:
+		return sum{}
+	case len(s) != 1:
+		return sum{{coeff: 1, factors: []factor{{base: s.node(), exp: e}}}}
+	}
+
+	t := s[0]
+	whole := e == math.Trunc(e)
+	if !whole && t.coeff < 0 {
+		return sum{{coeff: 1, factors: []factor{{base: s.node(), exp: e}}}}
+	}
+
+	coeff := math.Pow(t.coeff, e)
+	if math.IsInf(coeff, 0) || math.IsNaN(coeff) {
+		return atom(&protoparser.BinaryNode{Op: "^", Left: s.node(), Right: exp.node()})
+	}
+
+	res := term{coeff: coeff, factors: make([]factor, 0, len(t.factors))}
+	for _, f := range t.factors {
+		if whole || f.exp == 1 {
+			res.factors = append(res.factors, factor{base: f.base, exp: f.exp * e})
+		} else {
+			res.factors = append(res.factors, factor{base: factor{base: f.base, exp: f.exp}.node(), exp: e})
+		}
+	}
+
+	return sum{res.normalize()}
+}
+
+// asTerm is s as a single term, a sum of several being a factor of its own.
+func (s sum) asTerm() term {
+	if len(s) == 1 {
+		return s[0]
+	}
+
+	return term{coeff: 1, factors: []factor{{base: s.node(), exp: 1}}}
+}
+
+func (t term) mul(other term) term {
+	factors := append(append([]factor{}, t.factors...), other.factors...)
+	return term{coeff: t.coeff * other.coeff, factors: factors}.normalize()
+}
+
+// normalize puts the powers of the same base together, drops the ones
+// raised to zero, and sorts the factors with names first.
+func (t term) normalize() term {
+	res := term{coeff: t.coeff, factors: make([]factor, 0, len(t.factors))}
+	at := make(map[string]int)
+	for _, f := range t.factors {
+		key := protoparser.Format(f.base)
+		if i, ok := at[key]; ok {
+			res.factors[i].exp += f.exp
+			continue
+		}
+		at[key] = len(res.factors)
+		res.factors = append(res.factors, f)
+	}
+
+	kept := res.factors[:0]
+	for _, f := range res.factors {
+		if f.exp != 0 {
+			kept = append(kept, f)
+		}
+	}
+	res.factors = kept
+
+	sort.SliceStable(res.factors, func(i, j int) bool {
+		_, iName := res.factors[i].base.(*protoparser.IdentNode)
+		_, jName := res.factors[j].base.(*protoparser.IdentNode)
+		if iName != jName {
+			return iName
+		}
+		return protoparser.Format(res.factors[i].base) < protoparser.Format(res.factors[j].base)
+	})
+
+	return res
+}
+
+func (t term) key() string {
+	parts := make([]string, 0, len(t.factors))
+	for _, f := range t.factors {
+		parts = append(parts, protoparser.Format(f.node()))
+	}
+
+	return strings.Join(parts, " * ")
+}
+
+func (t term) degree() float64 {
+	degree := 0.0
+	for _, f := range t.factors {
+		degree += f.exp
+	}
+
+	return degree
+}
+
+// node writes s as an expression, subtracting the terms after the first
+// that are negative.
+func (s sum) node() protoparser.Node {
+	if len(s) == 0 {
+		return numberNode(0)
+	}
+
+	res := s[0].node()
+	for _, t := range s[1:] {
+		op := "+"
+		if t.coeff < 0 {
+			op = "-"
+			t.coeff = -t.coeff
+		}
+		res = &protoparser.BinaryNode{Op: op, Left: res, Right: t.node()}
+	}
+
+	return res
+}
+
+// node writes t as the coefficient and the factors with positive exponents
+// over the rest. A coefficient like 0.5 of a factor is written as a division
+// by 2.
+func (t term) node() protoparser.Node {
+	numer := make([]protoparser.Node, 0, len(t.factors)+1)
+	denom := make([]protoparser.Node, 0, len(t.factors)+1)
+
+	coeff := t.coeff
+	if inverse := 1 / math.Abs(coeff); len(t.factors) > 0 && math.Abs(coeff) < 1 && isWhole(inverse) {
+		denom = append(denom, numberNode(math.Round(inverse)))
+		coeff = math.Copysign(1, coeff)
+	}
+
+	for _, f := range t.factors {
+		if f.exp > 0 {
+			numer = append(numer, f.node())
+		} else {
+			denom = append(denom, factor{base: f.base, exp: -f.exp}.node())
+		}
+	}
+
+	switch {
+	case len(numer) == 0:
+		numer = append(numer, numberNode(coeff))
+	case coeff == -1:
+		numer[0] = &protoparser.UnaryNode{Op: "-", Operand: numer[0]}
+	case coeff != 1:
+		numer = append([]protoparser.Node{numberNode(coeff)}, numer...)
+	}
+
+	if len(denom) == 0 {
+		return product(numer)
+	}
+
+	return &protoparser.BinaryNode{Op: "/", Left: product(numer), Right: product(denom)}
+}
+
+func (f factor) node() protoparser.Node {
+	if f.exp == 1 {
+		return f.base
+	}
+
+	return &protoparser.BinaryNode{Op: "^", Left: f.base, Right: numberNode(f.exp)}
+}
+
+func product(nodes []protoparser.Node) protoparser.Node {
+	res := nodes[0]
+	for _, node := range nodes[1:] {
+		res = &protoparser.BinaryNode{Op: "*", Left: res, Right: node}
+	}
+
+	return res
+}
+
+// numberNode is a number literal, under a minus sign when negative.
+func numberNode(num float64) protoparser.Node {
+	literal := strconv.FormatFloat(math.Abs(num), 'g', SIMPLIFY_DIGITS, 64)
+	if num < 0 {
+		return &protoparser.UnaryNode{Op: "-", Operand: &protoparser.NumberNode{Literal: literal}}
+	}
+
+	return &protoparser.NumberNode{Literal: literal}
+}
+
+func isWhole(num float64) bool {
+	return math.Abs(num-math.Round(num)) <= 1e-9*math.Abs(num)
+}
+
+// findMatrix tells a matrix in node. SIMPLIFY and DIFF only take numbers,
+// since products of matrices cannot be reordered.
+func (ec *evalContext) findMatrix(node protoparser.Node) protoparser.Node {
+	switch n := node.(type) {
+	case *protoparser.ListNode:
+		return n
+	case *protoparser.IdentNode:
+		if _, ok := ec.sess.matrices[n.Name]; ok {
+			return n
+		}
+	case *protoparser.UnaryNode:
+		return ec.findMatrix(n.Operand)
+	case *protoparser.BinaryNode:
+		if found := ec.findMatrix(n.Left); found != nil {
+			return found
+		}
+		return ec.findMatrix(n.Right)
+	case *protoparser.CallNode:
+		for _, arg := range n.Args {
+			if found := ec.findMatrix(arg); found != nil {
+				return found
+			}
+		}
+	}
+
+	return nil
+}
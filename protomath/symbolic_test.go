@@ -0,0 +1,41 @@
+package protomath
+
+import "testing"
+
+func TestDiffAndSimplify(t *testing.T) {
+	tests := []struct {
+		req      string
+		wantCode responseType
+		want     string
+	}{
+		{"DIFF x^2 * sin(x)", RESPONSE_DIFFERENTIATED, "FOR=x\nx^2 * cos(x) + 2 * x * sin(x)"},
+		{"DIFF sin(x^2)", RESPONSE_DIFFERENTIATED, "FOR=x\n2 * x * cos(x^2)"},
+		{"DIFF exp(2x)", RESPONSE_DIFFERENTIATED, "FOR=x\n2 * exp(2 * x)"},
+		{"DIFF ln(x)", RESPONSE_DIFFERENTIATED, "FOR=x\n1 / x"},
+		{"DIFF 1/x", RESPONSE_DIFFERENTIATED, "FOR=x\n-1 / x^2"},
+		{"DIFF x^x", RESPONSE_DIFFERENTIATED, "FOR=x\n(ln(x) + 1) * x^x"},
+		{"DIFF abs(x)", RESPONSE_DIFFERENTIATED, "FOR=x\nx / abs(x)"},
+		{"DIFF floor(x)", RESPONSE_MATH_ERROR, "column 1: floor has no derivative everywhere\nfloor(x)\n^"},
+		{"DIFF foo(x)", RESPONSE_MATH_ERROR, "column 1: cannot differentiate foo\nfoo(x)\n^"},
+		{"DIFF 5", RESPONSE_DIFFERENTIATED, "0"},
+		{"DIFF pi^2", RESPONSE_DIFFERENTIATED, "0"},
+		{"DIFF x*y", RESPONSE_MATH_ERROR, "column 2: there is more than one unknown, x, y, name one with FOR=\nx*y\n ^"},
+		{"FOR=x DIFF x*y + y^2", RESPONSE_DIFFERENTIATED, "FOR=x\ny"},
+		{"FOR=y DIFF x*y + y^2", RESPONSE_DIFFERENTIATED, "FOR=y\nx + 2 * y"},
+		{"MODE=RAT DIFF x", RESPONSE_BAD_OPTION, "DIFF is only in FLOAT mode"},
+		{"SIMPLIFY x + x", RESPONSE_SIMPLIFIED, "2 * x"},
+		{"SIMPLIFY 2x + 3x - x", RESPONSE_SIMPLIFIED, "4 * x"},
+		{"SIMPLIFY x - x", RESPONSE_SIMPLIFIED, "0"},
+		{"SIMPLIFY x*x", RESPONSE_SIMPLIFIED, "x^2"},
+		{"SIMPLIFY x*1 + 0", RESPONSE_SIMPLIFIED, "x"},
+		{"SIMPLIFY x^0", RESPONSE_SIMPLIFIED, "1"},
+		{"SIMPLIFY 2 + 3*4", RESPONSE_SIMPLIFIED, "14"},
+	}
+
+	for _, test := range tests {
+		body, code := askMath(test.req)
+		if code != test.wantCode || body != test.want {
+			t.Errorf("%s: got %d %q, want %d %q", test.req, code, body, test.wantCode, test.want)
+		}
+	}
+}
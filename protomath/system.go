@@ -0,0 +1,207 @@
+package protomath
+
+import (
+	"fmt"
+	"math"
+	"protogen/protoparser"
+	"strings"
+)
+
+// systemSolution is what SOLVE_SYSTEM answers. A system with fewer pivots
+// than unknowns has no single solution, and is inconsistent when one of the
+// equations left over after elimination says 0 = c.
+type systemSolution struct {
+	unknowns     []string
+	values       []float64
+	rank         int
+	inconsistent bool
+}
+
+// linearForm is coeffs·unknowns + constant.
+type linearForm struct {
+	coeffs   []float64
+	constant float64
+}
+
+// solveSystem solves linear equations in the unknowns FOR= names, or else in
+// every name that has no value.
+func (ec *evalContext) solveSystem(eqs []*protoparser.EquationNode) (systemSolution, *evalError) {
+	unknowns, err := ec.findUnknowns(eqs)
+	if err != nil {
+		return systemSolution{}, err
+	}
+
+	n := len(unknowns)
+	augmented := newMatrix(len(eqs), n+1)
+	for i, eq := range eqs {
+		diff := &protoparser.BinaryNode{Op: "-", Left: eq.Left, Right: eq.Right, At: eq.At}
+		form, err := ec.toLinearForm(diff, unknowns)
+		if err != nil {
+			return systemSolution{}, err
+		}
+
+		for j, coeff := range form.coeffs {
+			augmented.set(i, j, coeff)
+		}
+		augmented.set(i, n, -form.constant)
+	}
+
+	tolerance := augmented.pivotTolerance()
+	pivots, _ := augmented.eliminate(n)
+	sol := systemSolution{unknowns: unknowns, rank: len(pivots)}
+
+	for i := len(pivots); i < augmented.rows; i++ {
+		if math.Abs(augmented.at(i, n)) > tolerance {
+			sol.inconsistent = true
+			return sol, nil
+		}
+	}
+	if len(pivots) == n {
+		sol.values = augmented.backSubstitute(pivots)
+	}
+
+	return sol, nil
+}
+
+func (ec *evalContext) findUnknowns(eqs []*protoparser.EquationNode) ([]string, *evalError) {
+	if ec.solveFor != "" {
+		unknowns := strings.Split(ec.solveFor, ",")
+		seen := make(map[string]bool, len(unknowns))
+		for _, name := range unknowns {
+			if name == "" {
+				return nil, newEvalError(eqs[0], "%s must name unknowns like x,y, got %s", OPT_FOR, ec.solveFor)
+			} else if seen[name] {
+				return nil, newEvalError(eqs[0], "unknown %s is named twice", name)
+			}
+			seen[name] = true
+		}
+		return unknowns, nil
+	}
+
+	free := make(map[string]bool)
+	for _, eq := range eqs {
+		collectFreeNames(eq.Left, ec.sess, free)
+		collectFreeNames(eq.Right, ec.sess, free)
+	}
+	if len(free) == 0 {
+		return nil, newEvalError(eqs[0], "there is no unknown to solve for, name them with %s=", OPT_FOR)
+	}
+
+	return sortedKeys(free), nil
+}
+
+// toLinearForm takes node apart into a multiple of each unknown and a
+// constant. Parts without unknowns are evaluated as they are.
+func (ec *evalContext) toLinearForm(node protoparser.Node, unknowns []string) (linearForm, *evalError) {
+	form := linearForm{coeffs: make([]float64, len(unknowns))}
+
+	hasUnknown := false
+	for _, name := range unknowns {
+		hasUnknown = hasUnknown || mentions(node, name)
+	}
+	if !hasUnknown {
+		value, err := ec.evaluate(node)
+		form.constant = value
+		return form, err
+	}
+
+	switch n := node.(type) {
+	case *protoparser.IdentNode:
+		for i, name := range unknowns {
+			if name == n.Name {
+				form.coeffs[i] = 1
+			}
+		}
+		return form, nil
+	case *protoparser.UnaryNode:
+		operand, err := ec.toLinearForm(n.Operand, unknowns)
+		if n.Op == "-" {
+			operand = operand.scale(-1)
+		}
+		return operand, err
+	case *protoparser.BinaryNode:
+		return ec.binaryLinearForm(n, unknowns)
+	}
+
+	return form, newEvalError(node, "%s is not linear in %s", protoparser.Format(node), strings.Join(unknowns, ", "))
+}
+
+func (ec *evalContext) binaryLinearForm(n *protoparser.BinaryNode, unknowns []string) (linearForm, *evalError) {
+	left, err := ec.toLinearForm(n.Left, unknowns)
+	if err != nil {
+		return linearForm{}, err
+	}
+	right, err := ec.toLinearForm(n.Right, unknowns)
+	if err != nil {
+		return linearForm{}, err
+	}
+
+	switch {
+	case n.Op == "+":
+		return left.add(right, 1), nil
+	case n.Op == "-":
+		return left.add(right, -1), nil
+	case n.Op == "*" && left.isConstant():
+		return right.scale(left.constant), nil
+	case n.Op == "*" && right.isConstant():
+		return left.scale(right.constant), nil
+	case n.Op == "/" && right.isConstant():
+		if right.constant == 0 {
+			return linearForm{}, newEvalError(n, "division by zero")
+		}
+		return left.scale(1 / right.constant), nil
+	}
+
+	return linearForm{}, newEvalError(n, "%s is not linear in %s", protoparser.Format(n), strings.Join(unknowns, ", "))
+}
+
+func (lf linearForm) isConstant() bool {
+	for _, coeff := range lf.coeffs {
+		if coeff != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (lf linearForm) scale(factor float64) linearForm {
+	res := linearForm{coeffs: make([]float64, len(lf.coeffs)), constant: lf.constant * factor}
+	for i, coeff := range lf.coeffs {
+		res.coeffs[i] = coeff * factor
+	}
+
+	return res
+}
+
+func (lf linearForm) add(other linearForm, sign float64) linearForm {
+	res := linearForm{coeffs: make([]float64, len(lf.coeffs)), constant: lf.constant + sign*other.constant}
+	for i, coeff := range lf.coeffs {
+		res.coeffs[i] = coeff + sign*other.coeffs[i]
+	}
+
+	return res
+}
+
+// singular tells if the system has no single solution.
+func (sol systemSolution) singular() bool {
+	return sol.inconsistent || sol.values == nil
+}
+
+// toString is like the answer of SOLVE, or else tells why there is no
+// single solution.
+func (sol systemSolution) toString() string {
+	if sol.inconsistent {
+		return "INCONSISTENT"
+	} else if sol.values == nil {
+		return fmt.Sprintf("UNDERDETERMINED RANK=%d UNKNOWNS=%d", sol.rank, len(sol.unknowns))
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("METHOD=%s UNKNOWNS=%d", METHOD_GAUSSIAN, len(sol.unknowns)))
+	for i, name := range sol.unknowns {
+		sb.WriteString(fmt.Sprintf("\n%s = %s", name, formatNumber(sol.values[i])))
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,44 @@
+package protomath
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSolveSystem(t *testing.T) {
+	tests := []struct {
+		req      string
+		wantCode responseType
+		want     string
+	}{
+		{"SOLVE_SYSTEM x + y = 3; x - y = 1", RESPONSE_SOLVED, "METHOD=GAUSSIAN UNKNOWNS=2\nx = 2.0000\ny = 1.0000"},
+		{"SOLVE_SYSTEM x + y = 3; 2x + 2y = 6", RESPONSE_SINGULAR_SYSTEM, "UNDERDETERMINED RANK=1 UNKNOWNS=2"},
+		{"SOLVE_SYSTEM x + y = 3; x + y = 4", RESPONSE_SINGULAR_SYSTEM, "INCONSISTENT"},
+	}
+
+	for _, test := range tests {
+		body, code := askMath(test.req)
+		if code != test.wantCode || body != test.want {
+			t.Errorf("%s: got %d %q, want %d %q", test.req, code, body, test.wantCode, test.want)
+		}
+	}
+}
+
+func TestSolveSystemNotLinear(t *testing.T) {
+	tests := []struct {
+		req  string
+		want string
+	}{
+		{"SOLVE_SYSTEM x*y = 3; x - y = 1", "column 2: x * y is not linear in x, y"},
+		{"SOLVE_SYSTEM x^2 + y = 3; x - y = 1", "column 2: x^2 is not linear in x, y"},
+		{"SOLVE_SYSTEM -(x + 1)^2 = y; x = 1", "column 9: (x + 1)^2 is not linear in x, y"},
+		{"SOLVE_SYSTEM sin(x) + y = 3; x - y = 1", "column 1: sin(x) is not linear in x, y"},
+	}
+
+	for _, test := range tests {
+		body, code := askMath(test.req)
+		if code != RESPONSE_MATH_ERROR || !strings.HasPrefix(body, test.want+"\n") {
+			t.Errorf("%s: got %d %q, want %d %q", test.req, code, body, RESPONSE_MATH_ERROR, test.want)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package protoparser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Node is a node of a parsed expression. Pos is the byte offset in the
+// expression the node starts at, or for operators where the operator is.
+type Node interface {
+	Pos() int
+	String() string
+}
+
+type NumberNode struct {
+	Literal string
+	At      int
+}
+
+type UnaryNode struct {
+	Op      string
+	Operand Node
+	At      int
+}
+
+type BinaryNode struct {
+	Op    string
+	Left  Node
+	Right Node
+	At    int
+}
+
+// IdentNode is a name standing on its own, like the constant `pi`.
+type IdentNode struct {
+	Name string
+	At   int
+}
+
+type CallNode struct {
+	Name string
+	Args []Node
+	At   int
+}
+
+// ListNode is a list like `[1, 2, 3]`, or with lists in it a matrix like
+// `[[1, 2], [3, 4]]`.
+type ListNode struct {
+	Elements []Node
+	At       int
+}
+
+// AssignNode is a statement like `x = 3`.
+type AssignNode struct {
+	Name  string
+	Value Node
+	At    int
+}
+
+// FuncDefNode is a statement like `f(x, y) = x^2 + y`.
+type FuncDefNode struct {
+	Name   string
+	Params []string
+	Body   Node
+	At     int
+}
+
+// EquationNode is an equation like `2x + 3 = 7`, At being where the equals
+// sign is.
+type EquationNode struct {
+	Left  Node
+	Right Node
+	At    int
+}
+
+func (n *NumberNode) Pos() int   { return n.At }
+func (n *UnaryNode) Pos() int    { return n.At }
+func (n *BinaryNode) Pos() int   { return n.At }
+func (n *IdentNode) Pos() int    { return n.At }
+func (n *CallNode) Pos() int     { return n.At }
+func (n *ListNode) Pos() int     { return n.At }
+func (n *AssignNode) Pos() int   { return n.At }
+func (n *FuncDefNode) Pos() int  { return n.At }
+func (n *EquationNode) Pos() int { return n.At }
+
+func (n *NumberNode) String() string {
+	return n.Literal
+}
+
+func (n *UnaryNode) String() string {
+	return fmt.Sprintf("(%s%s)", n.Op, n.Operand)
+}
+
+func (n *BinaryNode) String() string {
+	return fmt.Sprintf("(%s %s %s)", n.Left, n.Op, n.Right)
+}
+
+func (n *IdentNode) String() string {
+	return n.Name
+}
+
+func (n *CallNode) String() string {
+	args := make([]string, 0, len(n.Args))
+	for _, arg := range n.Args {
+		args = append(args, arg.String())
+	}
+
+	return fmt.Sprintf("%s(%s)", n.Name, strings.Join(args, ", "))
+}
+
+func (n *AssignNode) String() string {
+	return fmt.Sprintf("%s = %s", n.Name, n.Value)
+}
+
+func (n *FuncDefNode) String() string {
+	return fmt.Sprintf("%s(%s) = %s", n.Name, strings.Join(n.Params, ", "), n.Body)
+}
+
+func (n *EquationNode) String() string {
+	return fmt.Sprintf("%s = %s", n.Left, n.Right)
+}
+
+func (n *ListNode) String() string {
+	elements := make([]string, 0, len(n.Elements))
+	for _, element := range n.Elements {
+		elements = append(elements, element.String())
+	}
+
+	return fmt.Sprintf("[%s]", strings.Join(elements, ", "))
+}
+
+// Format writes n back as an expression or statement, with only the parens
+// the parser needs to read it the same way.
+func Format(n Node) string {
+	switch t := n.(type) {
+	case *UnaryNode:
+		if operand, ok := t.Operand.(*BinaryNode); ok && operand.Op == "^" {
+			return t.Op + Format(operand)
+		} else if _, ok := t.Operand.(*BinaryNode); ok {
+			return t.Op + "(" + Format(t.Operand) + ")"
+		} else if _, ok := t.Operand.(*UnaryNode); ok {
+			return t.Op + "(" + Format(t.Operand) + ")"
+		}
+		return t.Op + Format(t.Operand)
+	case *BinaryNode:
+		return formatBinary(t)
+	case *CallNode:
+		args := make([]string, 0, len(t.Args))
+		for _, arg := range t.Args {
+			args = append(args, Format(arg))
+		}
+		return fmt.Sprintf("%s(%s)", t.Name, strings.Join(args, ", "))
+	case *ListNode:
+		elements := make([]string, 0, len(t.Elements))
+		for _, element := range t.Elements {
+			elements = append(elements, Format(element))
+		}
+		return fmt.Sprintf("[%s]", strings.Join(elements, ", "))
+	case *AssignNode:
+		return t.Name + " = " + Format(t.Value)
+	case *FuncDefNode:
+		return fmt.Sprintf("%s(%s) = %s", t.Name, strings.Join(t.Params, ", "), Format(t.Body))
+	case *EquationNode:
+		return Format(t.Left) + " = " + Format(t.Right)
+	}
+
+	return n.String()
+}
+
+func formatBinary(n *BinaryNode) string {
+	prec := precedences[n.Op]
+
+	left := Format(n.Left)
+	switch l := n.Left.(type) {
+	case *BinaryNode:
+		if lp := precedences[l.Op]; lp < prec || (lp == prec && rightAssociative[n.Op]) {
+			left = "(" + left + ")"
+		}
+	case *UnaryNode:
+		if prec == PowPrec {
+			left = "(" + left + ")"
+		}
+	}
+
+	right := Format(n.Right)
+	switch r := n.Right.(type) {
+	case *BinaryNode:
+		if rp := precedences[r.Op]; rp < prec || (rp == prec && !rightAssociative[n.Op]) {
+			right = "(" + right + ")"
+		}
+	case *UnaryNode:
+		if prec != PowPrec {
+			right = "(" + right + ")"
+		}
+	}
+
+	if n.Op == "^" {
+		return left + "^" + right
+	}
+
+	return left + " " + n.Op + " " + right
+}
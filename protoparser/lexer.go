@@ -0,0 +1,116 @@
+package protoparser
+
+import (
+	"fmt"
+	"regexp"
+)
+
+type TokenKind int
+
+const (
+	TokenNumber TokenKind = iota
+	TokenOperator
+	TokenLParen
+	TokenRParen
+	TokenIdent
+	TokenComma
+	TokenAssign
+	TokenLBracket
+	TokenRBracket
+	TokenSemicolon
+)
+
+type Token struct {
+	Kind TokenKind
+	Text string
+	// Pos is the byte offset of the token in the expression.
+	Pos int
+}
+
+var (
+	numberLiteralPatt = regexp.MustCompile(`^(\d+\.?\d*|\.\d+)([eE][+-]?\d+)?`)
+	operatorPatt      = regexp.MustCompile(`^(\*\*|//|[-+*/%^])`)
+	identPatt         = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*`)
+
+	// `**` is another way to write `^`.
+	operatorAliases = map[string]string{
+		"**": "^",
+	}
+)
+
+// Lex splits ex into tokens. Numbers may have a fraction and an exponent,
+// like `1.5`, `.5` or `6.02e23`.
+func Lex(ex string) ([]Token, *ParseError) {
+	tokens := make([]Token, 0)
+
+	for pos := 0; pos < len(ex); {
+		rest := ex[pos:]
+
+		switch c := ex[pos]; {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			pos++
+		case c == '(':
+			tokens = append(tokens, Token{Kind: TokenLParen, Text: "(", Pos: pos})
+			pos++
+		case c == ')':
+			tokens = append(tokens, Token{Kind: TokenRParen, Text: ")", Pos: pos})
+			pos++
+		case c == ',':
+			tokens = append(tokens, Token{Kind: TokenComma, Text: ",", Pos: pos})
+			pos++
+		case c == '[':
+			tokens = append(tokens, Token{Kind: TokenLBracket, Text: "[", Pos: pos})
+			pos++
+		case c == ']':
+			tokens = append(tokens, Token{Kind: TokenRBracket, Text: "]", Pos: pos})
+			pos++
+		case c == ';':
+			tokens = append(tokens, Token{Kind: TokenSemicolon, Text: ";", Pos: pos})
+			pos++
+		case c == '=':
+			tokens = append(tokens, Token{Kind: TokenAssign, Text: "=", Pos: pos})
+			pos++
+		case numberLiteralPatt.MatchString(rest):
+			literal := numberLiteralPatt.FindString(rest)
+			tokens = append(tokens, Token{Kind: TokenNumber, Text: literal, Pos: pos})
+			pos += len(literal)
+		case identPatt.MatchString(rest):
+			ident := identPatt.FindString(rest)
+			tokens = append(tokens, Token{Kind: TokenIdent, Text: ident, Pos: pos})
+			pos += len(ident)
+		case operatorPatt.MatchString(rest):
+			op := operatorPatt.FindString(rest)
+			text := op
+			if alias, ok := operatorAliases[op]; ok {
+				text = alias
+			}
+			tokens = append(tokens, Token{Kind: TokenOperator, Text: text, Pos: pos})
+			pos += len(op)
+		default:
+			return nil, newParseError(pos, "unexpected character %q", c)
+		}
+	}
+
+	return tokens, nil
+}
+
+func (t Token) describe() string {
+	switch t.Kind {
+	case TokenNumber:
+		return fmt.Sprintf("number %s", t.Text)
+	case TokenOperator:
+		return fmt.Sprintf("operator %s", t.Text)
+	case TokenIdent:
+		return fmt.Sprintf("name %s", t.Text)
+	case TokenComma:
+		return "comma"
+	case TokenAssign:
+		return "equals sign"
+	case TokenSemicolon:
+		return "semicolon"
+	case TokenLBracket, TokenRBracket:
+		return fmt.Sprintf("bracket %s", t.Text)
+	}
+
+	return fmt.Sprintf("paren %s", t.Text)
+}
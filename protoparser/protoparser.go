@@ -1,93 +1,486 @@
 package protoparser
 
 import (
-	dtype "protogen/prototype"
-	"regexp"
-	"strings"
+	"fmt"
+	"math"
+	"strconv"
 )
 
 type precedence int
 
 const (
-	HighHighPrec precedence = 4
-	LowHighPrec  precedence = 3
-	HighLowPrec  precedence = 2
-	LowLowPrec   precedence = 1
-	ParanPrec    precedence = 0
-	None         precedence = -1
+	PowPrec precedence = 3
+	MulPrec precedence = 2
+	AddPrec precedence = 1
 )
 
 var (
 	precedences = map[string]precedence{
-		"*": HighHighPrec,
-		"/": LowHighPrec,
-		"+": HighLowPrec,
-		"-": LowLowPrec,
-		"(": ParanPrec,
-		")": ParanPrec,
-		"":  None,
+		"^":  PowPrec,
+		"*":  MulPrec,
+		"/":  MulPrec,
+		"%":  MulPrec,
+		"//": MulPrec,
+		"+":  AddPrec,
+		"-":  AddPrec,
+	}
+	rightAssociative = map[string]bool{
+		"^": true,
+	}
+	unaryOperators = map[string]bool{
+		"-": true,
+		"+": true,
 	}
 )
 
+// ParseError tells where in the expression parsing stopped and why. Column
+// starts at 1.
+type ParseError struct {
+	Column  int
+	Message string
+}
+
+type parser struct {
+	tokens []Token
+	pos    int
+	end    int
+}
+
+func (pe *ParseError) Error() string {
+	return fmt.Sprintf("column %d: %s", pe.Column, pe.Message)
+}
+
+func newParseError(pos int, format string, args ...any) *ParseError {
+	return &ParseError{Column: pos + 1, Message: fmt.Sprintf(format, args...)}
+}
+
+// Parse builds the tree of ex. A `+` or `-` where an operand is expected is
+// a sign, binding looser than `^`, so `-2^2` is -(2^2) and `2^-1` is 2^(-1).
+func Parse(ex string) (Node, *ParseError) {
+	tokens, err := Lex(ex)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseTokens(tokens, len(ex))
+}
+
+// ShuntingYard evaluates ex, made of numbers and operators only, giving the
+// result to 4 places. Names, calls and lists are not taken.
+//
+// Deprecated: use Parse and evaluate the tree, as protomath does.
 func ShuntingYard(ex string) (string, bool) {
-	tokenPatt := regexp.MustCompile(`\b\d+\b|\(|\)|\/|\-|\*|\+`)
+	tree, err := Parse(ex)
+	if err != nil {
+		return "", false
+	}
 
-	numberPatt := regexp.MustCompile(`\d+(\.\d+)?`)
-	lParaPatt := regexp.MustCompile(`\(`)
-	rParaPatt := regexp.MustCompile(`\)`)
-	opPatt := regexp.MustCompile(`\/|\-|\*|\+`)
+	res, ok := evaluateArithmetic(tree)
+	if !ok {
+		return "", false
+	}
 
-	tokens := tokenPatt.FindAllString(ex, -1)
+	return strconv.FormatFloat(res, 'f', 4, 64), true
+}
 
-	queueOut := dtype.NewQueue()
-	stackOp := dtype.NewStack()
+func evaluateArithmetic(n Node) (float64, bool) {
+	switch t := n.(type) {
+	case *NumberNode:
+		num, err := strconv.ParseFloat(t.Literal, 64)
+		return num, err == nil
+	case *UnaryNode:
+		operand, ok := evaluateArithmetic(t.Operand)
+		if t.Op == "-" {
+			operand = -operand
+		}
+		return operand, ok
+	case *BinaryNode:
+		left, leftOk := evaluateArithmetic(t.Left)
+		right, rightOk := evaluateArithmetic(t.Right)
+		if !leftOk || !rightOk {
+			return 0, false
+		}
+
+		var res float64
+		switch t.Op {
+		case "+":
+			res = left + right
+		case "-":
+			res = left - right
+		case "*":
+			res = left * right
+		case "/":
+			res = left / right
+		case "%":
+			res = math.Mod(left, right)
+		case "//":
+			res = math.Floor(left / right)
+		case "^":
+			res = math.Pow(left, right)
+		}
+		return res, !math.IsNaN(res) && !math.IsInf(res, 0)
+	}
+
+	return 0, false
+}
+
+// ParseStatement is Parse, also taking an assignment like `x = 3`, a
+// function definition like `f(x, y) = x^2 + y`, or else an equation like
+// `2x + 3 = 7`.
+func ParseStatement(ex string) (Node, *ParseError) {
+	tokens, err := Lex(ex)
+	if err != nil {
+		return nil, err
+	}
+
+	assign := findAssign(tokens)
+	if assign == -1 {
+		return parseTokens(tokens, len(ex))
+	}
+
+	eq, err := parseSides(tokens, assign, len(ex))
+	if err != nil {
+		return nil, err
+	}
 
-	for _, token := range tokens {
-		token = strings.Trim(token, " ")
-		if numberPatt.MatchString(token) {
-			queueOut.Push(token, false)
-		} else if opPatt.MatchString(token) {
-			for precedences[stackOp.ReturnLast()] > precedences[token] {
-				queueOut.Push(stackOp.Pop(), false)
+	switch t := eq.Left.(type) {
+	case *IdentNode:
+		return &AssignNode{Name: t.Name, Value: eq.Right, At: t.At}, nil
+	case *CallNode:
+		// A call with anything but names in it, like `abs(x - 3) = 1`, is
+		// an equation.
+		params := make([]string, 0, len(t.Args))
+		for _, arg := range t.Args {
+			param, ok := arg.(*IdentNode)
+			if !ok {
+				return eq, nil
 			}
+			params = append(params, param.Name)
+		}
+		return &FuncDefNode{Name: t.Name, Params: params, Body: eq.Right, At: t.At}, nil
+	}
 
-			stackOp.Push(token)
-		} else if rParaPatt.MatchString(token) {
+	return eq, nil
+}
 
-			for !lParaPatt.MatchString(stackOp.ReturnLast()) {
-				tok_ := stackOp.Pop()
-				queueOut.Push(tok_, false)
+// ParseEquation parses ex as an equation, even one like `x = 3` that
+// ParseStatement takes for an assignment.
+func ParseEquation(ex string) (*EquationNode, *ParseError) {
+	tokens, err := Lex(ex)
+	if err != nil {
+		return nil, err
+	}
+
+	assign := findAssign(tokens)
+	if assign == -1 {
+		return nil, newParseError(len(ex), "an equation needs an equals sign")
+	}
+
+	return parseSides(tokens, assign, len(ex))
+}
+
+// ParseSystem parses ex as equations separated by semicolons, like
+// `x + y = 3; x - y = 1`.
+func ParseSystem(ex string) ([]*EquationNode, *ParseError) {
+	tokens, err := Lex(ex)
+	if err != nil {
+		return nil, err
+	}
+
+	eqs := make([]*EquationNode, 0)
+	start := 0
+	for i := 0; i <= len(tokens); i++ {
+		end := len(ex)
+		if i < len(tokens) {
+			if tokens[i].Kind != TokenSemicolon {
+				continue
 			}
+			end = tokens[i].Pos
+		}
 
-			stackOp.Pop()
+		part := tokens[start:i]
+		assign := findAssign(part)
+		if assign == -1 {
+			return nil, newParseError(end, "an equation needs an equals sign")
+		}
 
-		} else {
-			stackOp.Push(token)
+		eq, err := parseSides(part, assign, end)
+		if err != nil {
+			return nil, err
 		}
+		eqs = append(eqs, eq)
+		start = i + 1
+	}
+
+	return eqs, nil
+}
+
+// ParseClauses parses ex as an expression followed by clauses that each
+// start with one of keywords, like `x^2 FROM 0 TO 1`. Keywords are names,
+// in any order and each at most once.
+func ParseClauses(ex string, keywords ...string) (Node, map[string]Node, *ParseError) {
+	tokens, err := Lex(ex)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	isKeyword := make(map[string]bool, len(keywords))
+	for _, keyword := range keywords {
+		isKeyword[keyword] = true
 	}
 
-	for !stackOp.IsEmpty() {
-		queueOut.Push(stackOp.Pop(), false)
+	starts := make([]int, 0)
+	seen := make(map[string]bool)
+	for i, tok := range tokens {
+		if tok.Kind == TokenIdent && isKeyword[tok.Text] {
+			if seen[tok.Text] {
+				return nil, nil, newParseError(tok.Pos, "%s is given twice", tok.Text)
+			}
+			seen[tok.Text] = true
+			starts = append(starts, i)
+		}
 	}
 
-	rpnStack := dtype.NewStack()
+	first, end := len(tokens), len(ex)
+	if len(starts) > 0 {
+		first, end = starts[0], tokens[starts[0]].Pos
+	}
+	expr, err := parseTokens(tokens[:first], end)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	var success bool
+	clauses := make(map[string]Node, len(starts))
+	for i, start := range starts {
+		next, end := len(tokens), len(ex)
+		if i+1 < len(starts) {
+			next, end = starts[i+1], tokens[starts[i+1]].Pos
+		}
 
-	for !queueOut.IsEmpty() {
-		token := queueOut.Pop(false)
+		clause, err := parseTokens(tokens[start+1:next], end)
+		if err != nil {
+			return nil, nil, err
+		}
+		clauses[tokens[start].Text] = clause
+	}
 
-		if numberPatt.MatchString(token) {
-			rpnStack.Push(token)
-		} else {
-			opOne := rpnStack.Pop()
-			opTwo := rpnStack.Pop()
+	return expr, clauses, nil
+}
 
-			success = rpnStack.DoOp(opOne, opTwo, token)
+func findAssign(tokens []Token) int {
+	for i, tok := range tokens {
+		if tok.Kind == TokenAssign {
+			return i
 		}
+	}
+
+	return -1
+}
+
+// parseSides parses what is left and right of the equals sign at assign.
+func parseSides(tokens []Token, assign int, end int) (*EquationNode, *ParseError) {
+	eq := tokens[assign]
+	if assign == 0 {
+		return nil, newParseError(eq.Pos, "nothing left of the equals sign")
+	}
+
+	left, err := parseTokens(tokens[:assign], eq.Pos)
+	if err != nil {
+		return nil, err
+	}
 
+	right, err := parseTokens(tokens[assign+1:], end)
+	if err != nil {
+		return nil, err
 	}
 
-	return rpnStack.Pop(), success
+	return &EquationNode{Left: left, Right: right, At: eq.Pos}, nil
+}
+
+// parseTokens parses tokens as a whole expression. End is the offset to
+// report when the expression ends too early.
+func parseTokens(tokens []Token, end int) (Node, *ParseError) {
+	p := parser{tokens: tokens, end: end}
+	node, err := p.parseExpression(AddPrec)
+	if err != nil {
+		return nil, err
+	}
+
+	if tok, ok := p.peek(); ok {
+		if tok.Kind == TokenRParen {
+			return nil, newParseError(tok.Pos, "unmatched closing paren")
+		} else if tok.Kind == TokenRBracket {
+			return nil, newParseError(tok.Pos, "unmatched closing bracket")
+		}
+		return nil, newParseError(tok.Pos, "unexpected %s", tok.describe())
+	}
+
+	return node, nil
+}
+
+// parseExpression is precedence climbing: it parses operands and every
+// operator binding at least as tight as minPrec.
+func (p *parser) parseExpression(minPrec precedence) (Node, *ParseError) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		tok, ok := p.peek()
+		if !ok {
+			return left, nil
+		}
+
+		// A name or a paren right after an operand multiplies it, like `2x`
+		// or `(x + 1)(x - 1)`.
+		implicit := tok.Kind == TokenIdent || tok.Kind == TokenLParen
+		if implicit {
+			tok = Token{Kind: TokenOperator, Text: "*", Pos: tok.Pos}
+		} else if tok.Kind != TokenOperator {
+			return left, nil
+		}
+
+		if precedences[tok.Text] < minPrec {
+			return left, nil
+		} else if !implicit {
+			p.pos++
+		}
+
+		nextPrec := precedences[tok.Text] + 1
+		if rightAssociative[tok.Text] {
+			nextPrec = precedences[tok.Text]
+		}
+
+		right, err := p.parseExpression(nextPrec)
+		if err != nil {
+			return nil, err
+		}
+
+		left = &BinaryNode{Op: tok.Text, Left: left, Right: right, At: tok.Pos}
+	}
+}
+
+func (p *parser) parseUnary() (Node, *ParseError) {
+	tok, ok := p.peek()
+	if ok && tok.Kind == TokenOperator && unaryOperators[tok.Text] {
+		p.pos++
+
+		operand, err := p.parseExpression(PowPrec)
+		if err != nil {
+			return nil, err
+		}
+
+		return &UnaryNode{Op: tok.Text, Operand: operand, At: tok.Pos}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Node, *ParseError) {
+	tok, ok := p.next()
+	if !ok {
+		return nil, newParseError(p.end, "unexpected end of expression")
+	}
+
+	switch tok.Kind {
+	case TokenNumber:
+		return &NumberNode{Literal: tok.Text, At: tok.Pos}, nil
+	case TokenIdent:
+		if next, ok := p.peek(); ok && next.Kind == TokenLParen {
+			p.pos++
+			return p.parseCall(tok, next)
+		}
+		return &IdentNode{Name: tok.Text, At: tok.Pos}, nil
+	case TokenLBracket:
+		return p.parseList(tok)
+	case TokenLParen:
+		inner, err := p.parseExpression(AddPrec)
+		if err != nil {
+			return nil, err
+		}
+
+		closing, ok := p.next()
+		if !ok {
+			return nil, newParseError(tok.Pos, "unclosed paren")
+		} else if closing.Kind != TokenRParen {
+			return nil, newParseError(closing.Pos, "unexpected %s, expected closing paren", closing.describe())
+		}
+
+		return inner, nil
+	}
+
+	return nil, newParseError(tok.Pos, "unexpected %s", tok.describe())
+}
+
+// parseCall parses the arguments of a call, the name and the opening paren
+// already taken.
+func (p *parser) parseCall(name, open Token) (Node, *ParseError) {
+	call := CallNode{Name: name.Text, Args: make([]Node, 0), At: name.Pos}
+
+	if next, ok := p.peek(); ok && next.Kind == TokenRParen {
+		p.pos++
+		return &call, nil
+	}
+
+	for {
+		arg, err := p.parseExpression(AddPrec)
+		if err != nil {
+			return nil, err
+		}
+		call.Args = append(call.Args, arg)
+
+		sep, ok := p.next()
+		if !ok {
+			return nil, newParseError(open.Pos, "unclosed paren")
+		} else if sep.Kind == TokenRParen {
+			return &call, nil
+		} else if sep.Kind != TokenComma {
+			return nil, newParseError(sep.Pos, "unexpected %s, expected comma or closing paren", sep.describe())
+		}
+	}
+}
+
+// parseList parses the elements of a list, the opening bracket already
+// taken.
+func (p *parser) parseList(open Token) (Node, *ParseError) {
+	list := ListNode{Elements: make([]Node, 0), At: open.Pos}
+
+	if next, ok := p.peek(); ok && next.Kind == TokenRBracket {
+		return nil, newParseError(next.Pos, "empty list")
+	}
+
+	for {
+		element, err := p.parseExpression(AddPrec)
+		if err != nil {
+			return nil, err
+		}
+		list.Elements = append(list.Elements, element)
+
+		sep, ok := p.next()
+		if !ok {
+			return nil, newParseError(open.Pos, "unclosed bracket")
+		} else if sep.Kind == TokenRBracket {
+			return &list, nil
+		} else if sep.Kind != TokenComma {
+			return nil, newParseError(sep.Pos, "unexpected %s, expected comma or closing bracket", sep.describe())
+		}
+	}
+}
+
+func (p *parser) peek() (Token, bool) {
+	if p.pos >= len(p.tokens) {
+		return Token{}, false
+	}
+
+	return p.tokens[p.pos], true
+}
+
+func (p *parser) next() (Token, bool) {
+	tok, ok := p.peek()
+	if ok {
+		p.pos++
+	}
 
+	return tok, ok
 }
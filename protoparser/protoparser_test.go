@@ -0,0 +1,204 @@
+package protoparser
+
+import "testing"
+
+// The trees are compared by String, which puts every operation in parens.
+func TestParseGrammar(t *testing.T) {
+	tests := []struct {
+		ex   string
+		want string
+	}{
+		{"1 + 2 * 3", "(1 + (2 * 3))"},
+		{"1 - 2 - 3", "((1 - 2) - 3)"},
+		{"8 / 4 * 2", "((8 / 4) * 2)"},
+		{"1 + 2 - 3 + 4", "(((1 + 2) - 3) + 4)"},
+		{"2 ^ 3 ^ 2", "(2 ^ (3 ^ 2))"},
+		{"(2 ^ 3) ^ 2", "((2 ^ 3) ^ 2)"},
+		{"-2^2", "(-(2 ^ 2))"},
+		{"2^-1", "(2 ^ (-1))"},
+		{"--3", "(-(-3))"},
+		{"+4 - -1", "((+4) - (-1))"},
+		{"2**3", "(2 ^ 3)"},
+		{"2 ** 3 ** 2", "(2 ^ (3 ^ 2))"},
+		{"7 // 2 * 3", "((7 // 2) * 3)"},
+		{"7 % 3 + 1", "((7 % 3) + 1)"},
+		{"1.5e3 + .5", "(1.5e3 + .5)"},
+		{"2x", "(2 * x)"},
+		{"2x^2", "(2 * (x ^ 2))"},
+		{"2(x + 1)", "(2 * (x + 1))"},
+		{"(x + 1)(x - 1)", "((x + 1) * (x - 1))"},
+		{"x(x + 1)", "x((x + 1))"},
+		{"x (x + 1)", "x((x + 1))"},
+		{"2 sin(x)", "(2 * sin(x))"},
+		{"atan2(1, 2)", "atan2(1, 2)"},
+		{"f()", "f()"},
+	}
+
+	for _, test := range tests {
+		tree, err := Parse(test.ex)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", test.ex, err)
+			continue
+		}
+		if got := tree.String(); got != test.want {
+			t.Errorf("Parse(%q) = %s, want %s", test.ex, got, test.want)
+		}
+	}
+}
+
+func TestParseErrorColumns(t *testing.T) {
+	tests := []struct {
+		ex   string
+		want string
+	}{
+		{"", "column 1: unexpected end of expression"},
+		{"2 +", "column 4: unexpected end of expression"},
+		{"2 + * 3", "column 5: unexpected operator *"},
+		{"(1 + 2", "column 1: unclosed paren"},
+		{"1 + 2)", "column 6: unmatched closing paren"},
+		{"(1 + 2]", "column 7: unexpected bracket ], expected closing paren"},
+		{"1 $ 2", "column 3: unexpected character '$'"},
+		{"2 3", "column 3: unexpected number 3"},
+		{"sin(1, )", "column 8: unexpected paren )"},
+		{"sin(1 2)", "column 7: unexpected number 2, expected comma or closing paren"},
+	}
+
+	for _, test := range tests {
+		_, err := Parse(test.ex)
+		if err == nil {
+			t.Errorf("Parse(%q): no error, want %s", test.ex, test.want)
+		} else if got := err.Error(); got != test.want {
+			t.Errorf("Parse(%q): %s, want %s", test.ex, got, test.want)
+		}
+	}
+}
+
+func TestShuntingYard(t *testing.T) {
+	tests := []struct {
+		ex     string
+		want   string
+		wantOk bool
+	}{
+		{"1 + 2 * 3", "7.0000", true},
+		{"-2^2", "-4.0000", true},
+		{"2^-1", "0.5000", true},
+		{"7 // 2", "3.0000", true},
+		{"-7 // 2", "-4.0000", true},
+		{"7 % 3", "1.0000", true},
+		{"1 / 0", "", false},
+		{"x + 1", "", false},
+		{"2 + * 3", "", false},
+	}
+
+	for _, test := range tests {
+		got, ok := ShuntingYard(test.ex)
+		if got != test.want || ok != test.wantOk {
+			t.Errorf("ShuntingYard(%q) = %q, %v, want %q, %v", test.ex, got, ok, test.want, test.wantOk)
+		}
+	}
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	tests := []string{
+		"1 + 2 * 3",
+		"(1 + 2) * 3",
+		"1 - (2 - 3)",
+		"2^3^2",
+		"(2^3)^2",
+		"-2^2",
+		"(-2)^2",
+		"2^-1",
+		"-(x + 1)",
+		"7 // 2 % 3",
+		"sin(x) * cos(2 * x)",
+		"[1, 2 + x, [3]]",
+	}
+
+	for _, ex := range tests {
+		tree, err := Parse(ex)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", ex, err)
+		} else if got := Format(tree); got != ex {
+			t.Errorf("Format(Parse(%q)) = %q", ex, got)
+		}
+	}
+
+	statements := []string{
+		"x = 3",
+		"f(x, y) = x^2 + y",
+		"g() = 1",
+		"2 * x + 3 = 7",
+		"x^2 = -(x - 1)",
+	}
+
+	for _, ex := range statements {
+		tree, err := ParseStatement(ex)
+		if err != nil {
+			t.Errorf("ParseStatement(%q): %v", ex, err)
+		} else if got := Format(tree); got != ex {
+			t.Errorf("Format(ParseStatement(%q)) = %q", ex, got)
+		}
+	}
+
+	eq, err := ParseEquation("x = 3")
+	if err != nil {
+		t.Errorf("ParseEquation: %v", err)
+	} else if got := Format(eq); got != "x = 3" {
+		t.Errorf("Format(ParseEquation) = %q", got)
+	}
+
+	eqs, err := ParseSystem("x + y = 3; x - y = 1")
+	if err != nil {
+		t.Errorf("ParseSystem: %v", err)
+	} else if len(eqs) != 2 || Format(eqs[0]) != "x + y = 3" || Format(eqs[1]) != "x - y = 1" {
+		t.Errorf("ParseSystem: got %v", eqs)
+	}
+
+	expr, clauses, err := ParseClauses("x^2 FROM 0 TO 2 * pi", "FROM", "TO")
+	if err != nil {
+		t.Errorf("ParseClauses: %v", err)
+	} else if Format(expr) != "x^2" || Format(clauses["FROM"]) != "0" || Format(clauses["TO"]) != "2 * pi" {
+		t.Errorf("ParseClauses: got %s, %v", Format(expr), clauses)
+	}
+}
+
+func TestStatementErrorColumns(t *testing.T) {
+	tests := []struct {
+		entry string
+		ex    string
+		want  string
+	}{
+		{"statement", "[]", "column 2: empty list"},
+		{"statement", "[1, 2", "column 1: unclosed bracket"},
+		{"statement", "x = ", "column 5: unexpected end of expression"},
+		{"statement", "= 3", "column 1: nothing left of the equals sign"},
+		{"equation", "x + 1", "column 6: an equation needs an equals sign"},
+		{"equation", "x = [1, 2", "column 5: unclosed bracket"},
+		{"system", "x + y = 3;", "column 11: an equation needs an equals sign"},
+		{"system", "x = 1; ; y = 2", "column 8: an equation needs an equals sign"},
+		{"system", "x = 1; y = (2", "column 12: unclosed paren"},
+		{"clauses", "x FROM 0 FROM 1", "column 10: FROM is given twice"},
+		{"clauses", "x FROM", "column 7: unexpected end of expression"},
+		{"clauses", "x + FROM 1", "column 5: unexpected end of expression"},
+	}
+
+	for _, test := range tests {
+		var err *ParseError
+		switch test.entry {
+		case "statement":
+			_, err = ParseStatement(test.ex)
+		case "equation":
+			_, err = ParseEquation(test.ex)
+		case "system":
+			_, err = ParseSystem(test.ex)
+		case "clauses":
+			_, _, err = ParseClauses(test.ex, "FROM", "TO")
+		}
+
+		if err == nil {
+			t.Errorf("%s %q: no error, want %s", test.entry, test.ex, test.want)
+		} else if got := err.Error(); got != test.want {
+			t.Errorf("%s %q: %s, want %s", test.entry, test.ex, got, test.want)
+		}
+	}
+}
@@ -1,10 +1,5 @@
 package prototype
 
-import (
-	"strconv"
-	"strings"
-)
-
 const NULLSTR = "\x00\x12\x01\x02"
 
 type UsualType interface {
@@ -91,34 +86,6 @@ func (s *Stack) Push(str string) {
 	*s = append(*s, str) // Simply append the new value to the end of the stack
 }
 
-func (s *Stack) DoOp(opOne, opTwo, operator string) bool {
-	var res float64
-
-	firstParsed, successFirst := parseToFloat(opTwo)
-	secondParsed, successSecond := parseToFloat(opOne)
-
-	if !successFirst || !successSecond {
-		return false
-	}
-	
-
-	switch operator {
-	case "+":
-		res = firstParsed + secondParsed
-	case "-":
-		res = firstParsed - secondParsed
-	case "*":
-		res = firstParsed * secondParsed
-	case "/":
-		res = firstParsed / secondParsed
-
-	}
-
-	*s = append(*s, strconv.FormatFloat(res, 'f', 4, 64)) // Simply append the new value to the end of the stack
-
-	return true
-}
-
 // Remove and return top element of stack. Return false if stack is empty.
 func (s *Stack) Pop() string {
 	if s.IsEmpty() {
@@ -174,12 +141,3 @@ func (q *Queue) Pop(op bool) string {
 func NewQueue() *Queue {
 	return &Queue{}
 }
-
-func parseToFloat(num string) (float64, bool) {
-	numParsed, err := strconv.ParseFloat(strings.Trim(num, ""), 32)
-	if err != nil {
-		return 0.0, false
-	}
-
-	return numParsed, true
-}